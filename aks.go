@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// aksManagedRefuse refuses to scale a set backing an AKS node pool,
+	// whose control plane sets its capacity back to the node pool count.
+	aksManagedRefuse = "refuse"
+
+	// aksManagedAgentPool scales the set through the count of its node
+	// pool, so the AKS control plane agrees with the capacity.
+	aksManagedAgentPool = "agent_pool"
+
+	aksManagedIgnore = "ignore"
+
+	resourceGroupAPIVersion = "2021-04-01"
+	agentPoolAPIVersion     = "2022-04-01"
+)
+
+func parseAKSManagedAction(config map[string]string) (string, error) {
+	value, ok := config[configKeyAKSManagedAction]
+	if !ok || value == "" {
+		return aksManagedRefuse, nil
+	}
+	switch value {
+	case aksManagedRefuse, aksManagedAgentPool, aksManagedIgnore:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be one of %s, %s or %s", configKeyAKSManagedAction,
+		value, aksManagedRefuse, aksManagedAgentPool, aksManagedIgnore)
+}
+
+// aksNodePool returns the name of the AKS node pool the scale set backs, or
+// an empty string for a set AKS does not own. AKS tags the sets it creates
+// with the pool name, as aks-managed-poolName on current clusters and
+// poolName on older ones.
+func aksNodePool(vmss compute.VirtualMachineScaleSet) string {
+	var managed bool
+	var pool string
+	for key, value := range vmss.Tags {
+		if value == nil {
+			continue
+		}
+		switch {
+		case strings.EqualFold(key, "aks-managed-poolName"):
+			return *value
+		case strings.EqualFold(key, "poolName"):
+			pool = *value
+		case strings.HasPrefix(strings.ToLower(key), "aks-managed-"),
+			strings.EqualFold(key, "orchestrator") && strings.HasPrefix(*value, "Kubernetes"):
+			managed = true
+		}
+	}
+	if !managed {
+		return ""
+	}
+	return pool
+}
+
+// aksAgentPool is the node pool a scale set is scaled through.
+type aksAgentPool struct {
+	clusterID string
+	name      string
+}
+
+// aksAgentPools records the member sets scaled through their node pool, keyed
+// by vmssKey. Every capacity change of a recorded set, by a scale or a
+// background task, goes through the node pool.
+type aksAgentPools struct {
+	lock  sync.RWMutex
+	pools map[string]aksAgentPool
+}
+
+func newAKSAgentPools() *aksAgentPools {
+	return &aksAgentPools{pools: make(map[string]aksAgentPool)}
+}
+
+func (p *aksAgentPools) get(resourceGroup, vmScaleSet string) (aksAgentPool, bool) {
+	if p == nil {
+		return aksAgentPool{}, false
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	pool, ok := p.pools[vmssKey(resourceGroup, vmScaleSet)]
+	return pool, ok
+}
+
+// useAgentPool records that the capacity of a set is changed through its
+// node pool, resolving the cluster owning the node resource group of the set.
+func (ac *AzureController) useAgentPool(ctx context.Context, resourceGroup, vmScaleSet, pool string) error {
+	if existing, ok := ac.aksPools.get(resourceGroup, vmScaleSet); ok && existing.name == pool {
+		return nil
+	}
+	ctx, done := ac.timeCall(ctx, "get_aks_cluster", resourceGroup, vmScaleSet)
+	defer done()
+
+	var group struct {
+		ManagedBy string `json:"managedBy"`
+	}
+	path := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", ac.subscriptionID, resourceGroup)
+	if err := ac.armRequest(ctx, http.MethodGet, path, map[string]interface{}{"api-version": resourceGroupAPIVersion}, &group); err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToLower(group.ManagedBy), "/providers/microsoft.containerservice/managedclusters/") {
+		return fmt.Errorf("%s/%s is tagged as AKS node pool %q but resource group %s is not managed by an AKS cluster",
+			resourceGroup, vmScaleSet, pool, resourceGroup)
+	}
+
+	ac.aksPools.lock.Lock()
+	defer ac.aksPools.lock.Unlock()
+	ac.aksPools.pools[vmssKey(resourceGroup, vmScaleSet)] = aksAgentPool{clusterID: group.ManagedBy, name: pool}
+	return nil
+}
+
+// setAgentPoolCount sets the node count of the node pool of a set, which AKS
+// applies to the set. The rest of the node pool is written back as read.
+// Pools the AKS cluster autoscaler scales are refused, as it would undo the
+// count.
+func (ac *AzureController) setAgentPoolCount(ctx context.Context, resourceGroup, vmScaleSet string, pool aksAgentPool, count int64) error {
+	ctx, done := ac.timeCall(ctx, "set_agent_pool_count", resourceGroup, vmScaleSet)
+	defer done()
+
+	path := pool.clusterID + "/agentPools/" + pool.name
+	query := map[string]interface{}{"api-version": agentPoolAPIVersion}
+	var agentPool map[string]interface{}
+	if err := ac.armRequest(ctx, http.MethodGet, path, query, &agentPool); err != nil {
+		submissionFrom(ctx).accept()
+		return err
+	}
+	properties, _ := agentPool["properties"].(map[string]interface{})
+	if properties == nil {
+		submissionFrom(ctx).accept()
+		return fmt.Errorf("node pool %s of %s/%s has no properties", pool.name, resourceGroup, vmScaleSet)
+	}
+	if autoscaling, _ := properties["enableAutoScaling"].(bool); autoscaling {
+		submissionFrom(ctx).accept()
+		return fmt.Errorf("refusing to scale, the AKS cluster autoscaler scales node pool %s of %s/%s", pool.name, resourceGroup, vmScaleSet)
+	}
+	properties["count"] = count
+
+	req, err := autorest.CreatePreparer(
+		autorest.AsContentType("application/json; charset=utf-8"),
+		autorest.AsPut(),
+		autorest.WithBaseURL(ac.baseURI),
+		autorest.WithPath(path),
+		autorest.WithQueryParameters(query),
+		autorest.WithJSON(map[string]interface{}{"properties": properties}),
+	).Prepare((&http.Request{}).WithContext(ctx))
+	if err != nil {
+		submissionFrom(ctx).accept()
+		return wrapAzureError(ctx, "failed to prepare the agent pool update request", err)
+	}
+	if err := scaleWrites.wait(ctx, "set_agent_pool_count"); err != nil {
+		submissionFrom(ctx).accept()
+		return wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	resp, err := ac.authz.Send(req, azure.DoRetryWithRegistration(ac.authz))
+	submissionFrom(ctx).accept()
+	if err != nil {
+		return wrapAzureError(ctx, "failed to send the agent pool update request",
+			autorest.NewErrorWithError(err, "containerservice", "AgentPools", resp, "Failure sending request"))
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		err = autorest.Respond(resp, azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated), autorest.ByClosing())
+		return wrapAzureError(ctx, "failed to update the agent pool",
+			autorest.NewErrorWithError(err, "containerservice", "AgentPools", resp, "Failure responding to request"))
+	}
+	future, err := azure.NewFutureFromResponse(resp)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the agent pool update response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, &future, ac.authz, "cannot get the agent pool update future response")
+}
+
+// syncAgentPoolCount sets the node count of the node pool of a set to the
+// capacity left once instances of the set were deleted, so AKS takes the
+// deletions as the scale in rather than picking nodes of its own.
+func (ac *AzureController) syncAgentPoolCount(ctx context.Context, resourceGroup, vmScaleSet string, pool aksAgentPool) error {
+	// The deletion is the operation an asynchronous scale submitted.
+	ctx = context.WithValue(ctx, submissionKey{}, (*submission)(nil))
+	capacity, err := ac.getCapacity(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return err
+	}
+	return ac.setAgentPoolCount(ctx, resourceGroup, vmScaleSet, pool, capacity)
+}
+
+// checkAKSManaged applies the AKS managed action to a member set of a scale
+// or Status, returning the node pool the set backs, if any.
+func (t *TargetPlugin) checkAKSManaged(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet, action string) (string, error) {
+	pool := aksNodePool(vmss)
+	if pool == "" || action == aksManagedIgnore {
+		return pool, nil
+	}
+	if action == aksManagedRefuse {
+		return pool, fmt.Errorf("refusing to scale, %s/%s backs AKS node pool %q, whose capacity the AKS control plane owns",
+			resourceGroup, vmScaleSet, pool)
+	}
+	return pool, t.azureFor(resourceGroup, vmScaleSet).useAgentPool(ctx, resourceGroup, vmScaleSet, pool)
+}
+
+// annotateAKSManaged reports in the Status meta the node pool a member set
+// backs and what the plugin does with it: refuse to scale it, scale it
+// through the node pool, or ignore the ownership. Sets scaled through their
+// node pool are recorded here too, so background tasks changing their
+// capacity go through the node pool before the first scale does.
+func (t *TargetPlugin) annotateAKSManaged(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet, action string, meta map[string]string) {
+	pool, err := t.checkAKSManaged(ctx, resourceGroup, vmScaleSet, vmss, action)
+	if pool == "" {
+		return
+	}
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "aks_node_pool")] = pool
+	switch {
+	case action == aksManagedRefuse:
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "aks_managed")] = "refused"
+	case err != nil:
+		t.logger.Warn("failed to resolve the AKS node pool of the scale set", "vmss_name", vmScaleSet, "node_pool", pool, "error", err)
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "aks_managed")] = "unresolved"
+	default:
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "aks_managed")] = action
+	}
+}
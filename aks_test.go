@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+const testAKSClusterID = "/subscriptions/s/resourceGroups/rg-aks/providers/Microsoft.ContainerService/managedClusters/cluster"
+
+func TestAKSNodePool(t *testing.T) {
+	tag := func(tags map[string]string) compute.VirtualMachineScaleSet {
+		vmss := compute.VirtualMachineScaleSet{Tags: make(map[string]*string)}
+		for key, value := range tags {
+			value := value
+			vmss.Tags[key] = &value
+		}
+		return vmss
+	}
+	cases := []struct {
+		name string
+		vmss compute.VirtualMachineScaleSet
+		want string
+	}{
+		{"plain", tag(map[string]string{"env": "prod"}), ""},
+		{"current", tag(map[string]string{"aks-managed-poolName": "nomad", "aks-managed-orchestrator": "Kubernetes:1.27.3"}), "nomad"},
+		{"older", tag(map[string]string{"poolName": "nomad", "orchestrator": "Kubernetes:1.19.7"}), "nomad"},
+		{"pool name alone", tag(map[string]string{"poolName": "nomad"}), ""},
+	}
+	for _, tc := range cases {
+		if got := aksNodePool(tc.vmss); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSetCapacityThroughAgentPool(t *testing.T) {
+	var put map[string]interface{}
+	client := autorest.NewClientWithUserAgent(pluginName)
+	client.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, `{}`
+		switch path := strings.ToLower(r.URL.Path); {
+		case strings.HasSuffix(path, "/resourcegroups/mc_rg-aks_cluster"):
+			body = `{"managedBy":"` + testAKSClusterID + `"}`
+		case strings.HasSuffix(path, "/agentpools/nomad") && r.Method == http.MethodGet:
+			body = `{"properties":{"count":2,"vmSize":"Standard_D4s_v5","enableAutoScaling":false}}`
+		case strings.HasSuffix(path, "/agentpools/nomad") && r.Method == http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &put); err != nil {
+				t.Error(err)
+			}
+			body = `{"properties":{"count":5,"provisioningState":"Succeeded"}}`
+		default:
+			status, body = http.StatusNotFound, `{"error":{"code":"NotFound"}}`
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{authz: client, baseURI: "http://fake", subscriptionID: "s",
+		aksPools: newAKSAgentPools(), logger: hclog.NewNullLogger()}
+
+	aksSet := compute.VirtualMachineScaleSet{Tags: map[string]*string{
+		"aks-managed-poolName": &[]string{"nomad"}[0],
+	}}
+	if _, err := plugin.checkAKSManaged(context.Background(), "MC_rg-aks_cluster", "aks-nomad-vmss", aksSet, aksManagedRefuse); err == nil {
+		t.Error("got no error refusing an AKS managed set")
+	}
+	meta := make(map[string]string)
+	plugin.annotateAKSManaged(context.Background(), "MC_rg-aks_cluster", "aks-nomad-vmss", aksSet, aksManagedAgentPool, meta)
+	if meta[vmssMetaKey("MC_rg-aks_cluster", "aks-nomad-vmss", "aks_node_pool")] != "nomad" || meta[vmssMetaKey("MC_rg-aks_cluster", "aks-nomad-vmss", "aks_managed")] != aksManagedAgentPool {
+		t.Fatalf("got meta %v", meta)
+	}
+
+	if err := plugin.AzureController.setCapacity(context.Background(), "MC_rg-aks_cluster", "aks-nomad-vmss", 5); err != nil {
+		t.Fatal(err)
+	}
+	properties, _ := put["properties"].(map[string]interface{})
+	if properties["count"] != float64(5) || properties["vmSize"] != "Standard_D4s_v5" {
+		t.Errorf("got agent pool update %v", put)
+	}
+}
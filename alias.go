@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// aliasPattern is what a scale set alias may look like. Dots are left out
+// as they separate the parts of Status meta keys.
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// setAliases holds the short aliases target entries give their scale sets,
+// which stand in for the name in log lines, metric labels and Status meta
+// keys. Aliases are recorded per target, so a target listing a set without
+// an alias keeps the one another target gives it. A set given different
+// aliases by two targets is shown by its name.
+var setAliases = newAliasRegistry()
+
+type aliasRegistry struct {
+	lock sync.RWMutex
+
+	// targets holds the aliases of each target, by target key and then
+	// vmssKey. sets and names index them by vmssKey and by lowercase
+	// scale set name, the latter only for names a single set carries an
+	// alias under.
+	targets map[string]map[string]string
+	sets    map[string]string
+	names   map[string]string
+}
+
+func newAliasRegistry() *aliasRegistry {
+	return &aliasRegistry{
+		targets: make(map[string]map[string]string),
+		sets:    make(map[string]string),
+		names:   make(map[string]string),
+	}
+}
+
+// register replaces the aliases of the target by those of its members.
+func (a *aliasRegistry) register(target string, members []scaleSetTarget) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	aliases := make(map[string]string, len(members))
+	for _, member := range members {
+		if member.alias != "" {
+			aliases[vmssKey(member.resourceGroup, member.vmScaleSet)] = member.alias
+		}
+	}
+	a.targets[target] = aliases
+
+	a.sets = make(map[string]string, len(a.sets))
+	conflicts := make(map[string]bool)
+	for _, aliases := range a.targets {
+		for key, alias := range aliases {
+			if existing, ok := a.sets[key]; ok && existing != alias {
+				conflicts[key] = true
+			}
+			a.sets[key] = alias
+		}
+	}
+	a.names = make(map[string]string, len(a.sets))
+	for key := range conflicts {
+		delete(a.sets, key)
+	}
+	ambiguous := make(map[string]bool)
+	for key, alias := range a.sets {
+		name := key[strings.LastIndex(key, "/")+1:]
+		if _, ok := a.names[name]; ok {
+			ambiguous[name] = true
+		}
+		a.names[name] = alias
+	}
+	for name := range ambiguous {
+		delete(a.names, name)
+	}
+}
+
+// display returns the alias of the scale set, or its name when it has none.
+func (a *aliasRegistry) display(resourceGroup, vmScaleSet string) string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if alias, ok := a.sets[vmssKey(resourceGroup, vmScaleSet)]; ok {
+		return alias
+	}
+	return vmScaleSet
+}
+
+// displayName is display for log lines, which only carry the scale set name.
+// Names aliased in more than one resource group are left as they are.
+func (a *aliasRegistry) displayName(vmScaleSet string) string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if alias, ok := a.names[strings.ToLower(vmScaleSet)]; ok {
+		return alias
+	}
+	return vmScaleSet
+}
+
+// validateAliases checks the aliases of the entries of a target are well
+// formed and tell the entries apart, from each other and from the names of
+// the other sets.
+func validateAliases(targets []scaleSetTarget) error {
+	names := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		names[strings.ToLower(target.vmScaleSet)] = true
+	}
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if target.alias == "" {
+			continue
+		}
+		name := target.resourceGroup + "/" + target.vmScaleSet
+		key := strings.ToLower(target.alias)
+		switch {
+		case !aliasPattern.MatchString(target.alias):
+			return fmt.Errorf("%s entry %s has invalid alias %q, must only hold letters, digits, '-' and '_'", configKeyTargets, name, target.alias)
+		case seen[key]:
+			return fmt.Errorf("%s entry %s reuses alias %q", configKeyTargets, name, target.alias)
+		case names[key] && !strings.EqualFold(target.alias, target.vmScaleSet):
+			return fmt.Errorf("%s entry %s alias %q is the name of another entry", configKeyTargets, name, target.alias)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// aliasLogger logs the alias of a scale set in place of its name in the
+// vmss_name field, so all log lines of the plugin use the short alias.
+type aliasLogger struct {
+	hclog.Logger
+}
+
+func newAliasLogger(log hclog.Logger) hclog.Logger {
+	if _, ok := log.(aliasLogger); ok {
+		return log
+	}
+	return aliasLogger{Logger: log}
+}
+
+func aliasArgs(args []interface{}) []interface{} {
+	for idx := 0; idx+1 < len(args); idx += 2 {
+		if key, ok := args[idx].(string); !ok || key != "vmss_name" {
+			continue
+		}
+		if vmScaleSet, ok := args[idx+1].(string); ok {
+			if alias := setAliases.displayName(vmScaleSet); alias != vmScaleSet {
+				replaced := make([]interface{}, len(args))
+				copy(replaced, args)
+				replaced[idx+1] = alias
+				args = replaced
+			}
+		}
+	}
+	return args
+}
+
+func (l aliasLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	l.Logger.Log(level, msg, aliasArgs(args)...)
+}
+
+func (l aliasLogger) Trace(msg string, args ...interface{}) { l.Logger.Trace(msg, aliasArgs(args)...) }
+func (l aliasLogger) Debug(msg string, args ...interface{}) { l.Logger.Debug(msg, aliasArgs(args)...) }
+func (l aliasLogger) Info(msg string, args ...interface{})  { l.Logger.Info(msg, aliasArgs(args)...) }
+func (l aliasLogger) Warn(msg string, args ...interface{})  { l.Logger.Warn(msg, aliasArgs(args)...) }
+func (l aliasLogger) Error(msg string, args ...interface{}) { l.Logger.Error(msg, aliasArgs(args)...) }
+
+func (l aliasLogger) With(args ...interface{}) hclog.Logger {
+	return aliasLogger{Logger: l.Logger.With(aliasArgs(args)...)}
+}
+
+func (l aliasLogger) Named(name string) hclog.Logger {
+	return aliasLogger{Logger: l.Logger.Named(name)}
+}
+
+func (l aliasLogger) ResetNamed(name string) hclog.Logger {
+	return aliasLogger{Logger: l.Logger.ResetNamed(name)}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestAliasRegistry(t *testing.T) {
+	aliases := newAliasRegistry()
+	aliases.register("primary", []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "a", alias: "batch"},
+		{resourceGroup: "rg", vmScaleSet: "b"},
+	})
+	// A target listing the set without an alias keeps the alias.
+	aliases.register("secondary", []scaleSetTarget{{resourceGroup: "RG", vmScaleSet: "A"}})
+	if got := aliases.display("rg", "a"); got != "batch" {
+		t.Errorf("rg/a displays as %q, want batch", got)
+	}
+	if got := aliases.displayName("a"); got != "batch" {
+		t.Errorf("a displays as %q in logs, want batch", got)
+	}
+	if got := aliases.display("rg", "b"); got != "b" {
+		t.Errorf("rg/b displays as %q, want its name", got)
+	}
+
+	// The same name in another resource group has an alias of its own;
+	// log lines, which only carry the name, keep it.
+	aliases.register("other", []scaleSetTarget{{resourceGroup: "other", vmScaleSet: "a", alias: "web"}})
+	if got := aliases.display("other", "a"); got != "web" {
+		t.Errorf("other/a displays as %q, want web", got)
+	}
+	if got := aliases.display("rg", "a"); got != "batch" {
+		t.Errorf("rg/a displays as %q, want batch", got)
+	}
+	if got := aliases.displayName("a"); got != "a" {
+		t.Errorf("a displays as %q in logs, want its name", got)
+	}
+
+	// Targets disagreeing on the alias of a set show its name.
+	aliases.register("secondary", []scaleSetTarget{{resourceGroup: "rg", vmScaleSet: "a", alias: "jobs"}})
+	if got := aliases.display("rg", "a"); got != "a" {
+		t.Errorf("rg/a displays as %q, want its name", got)
+	}
+}
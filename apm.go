@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/plugins/base"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// apmPluginName is the name the companion APM plugin is served under,
+	// when the binary is started with the apm argument, as in args = ["apm"]
+	// of the autoscaler apm block.
+	apmPluginName = pluginName + "-apm"
+	apmCommand    = "apm"
+
+	apmQueryTimeout = time.Minute
+)
+
+// apmMetricAliases are the short names of the VMSS host metrics Azure
+// Monitor collects without an agent.
+var apmMetricAliases = map[string]string{
+	"cpu":         "Percentage CPU",
+	"memory":      "Available Memory Bytes",
+	"network_in":  "Network In Total",
+	"network_out": "Network Out Total",
+	"disk_read":   "Disk Read Bytes",
+	"disk_write":  "Disk Write Bytes",
+}
+
+// APMPlugin is an APM plugin serving Azure Monitor metrics of scale sets, so
+// a policy can scale a target of the plugin on metrics of the same sets.
+type APMPlugin struct {
+	logger         hclog.Logger
+	metrics        insights.MetricsClient
+	subscriptionID string
+	authorizers    *authorizerCache
+
+	// scopes holds the member sets of the targets listed in the APM config,
+	// keyed by their lower cased alias and name, so queries can name them
+	// the way the target does.
+	scopes map[string]scaleSetTarget
+	sets   []scaleSetTarget
+}
+
+func apmFactory(log hclog.Logger) interface{} {
+	return &APMPlugin{logger: log, authorizers: newAuthorizerCache()}
+}
+
+func (a *APMPlugin) PluginInfo() (*base.PluginInfo, error) {
+	return &base.PluginInfo{
+		Name:       apmPluginName,
+		PluginType: sdk.PluginTypeAPM,
+	}, nil
+}
+
+func (a *APMPlugin) SetConfig(config map[string]string) error {
+	subscriptionID := argsOrEnv(config, configKeySubscriptionID, "ARM_SUBSCRIPTION_ID")
+	if subscriptionID == "" {
+		return fmt.Errorf("cannot set config, %s is required", configKeySubscriptionID)
+	}
+	baseURI, resource := resourceManager(config)
+	authorizer, err := a.authorizers.get(config, resource)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	limits, err := parseAzureRateLimits(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	sender, err := newAzureSender(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	sets, err := parseAPMScopes(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	client := insights.NewMetricsClientWithBaseURI(baseURI, subscriptionID)
+	client.Sender = rateLimitSender(instrumentSender(sender), limits)
+	client.Authorizer = authorizer
+	a.metrics = client
+	a.subscriptionID = subscriptionID
+	a.sets = sets
+	a.scopes = apmScopeIndex(sets)
+	a.authorizers.evictUnused()
+	return nil
+}
+
+func apmScopeIndex(sets []scaleSetTarget) map[string]scaleSetTarget {
+	scopes := make(map[string]scaleSetTarget, 2*len(sets))
+	for _, set := range sets {
+		scopes[strings.ToLower(set.vmScaleSet)] = set
+		if set.alias != "" {
+			scopes[strings.ToLower(set.alias)] = set
+		}
+	}
+	return scopes
+}
+
+// parseAPMScopes reads the member sets of a target from the same keys the
+// target plugin reads them, so the configuration of a target can be given to
+// the APM plugin as it is. It returns nil when the config lists no sets.
+// Pattern entries are refused, as the APM plugin does not discover sets.
+func parseAPMScopes(config map[string]string) ([]scaleSetTarget, error) {
+	var listed bool
+	for _, key := range []string{configKeyTargets, configKeyTargetsFile, configKeyVMSSList} {
+		if _, ok := config[key]; ok {
+			listed = true
+		}
+	}
+	if !listed {
+		return nil, nil
+	}
+	sets, err := parseScaleSetTargets(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if match, _ := scaleSetPattern(set.vmScaleSet); match != nil {
+			return nil, fmt.Errorf("%s/%s is a pattern, the APM plugin only scopes queries to named scale sets", set.resourceGroup, set.vmScaleSet)
+		}
+	}
+	return sets, nil
+}
+
+// apmQuery is a parsed query, given as semicolon separated key=value pairs:
+//
+//	metric=cpu;aggregation=average;vmss=rg-a/set-a,rg-b/set-b
+//	metric=memory;target=web,batch
+//
+// The metric is an alias or an Azure Monitor metric name, the aggregation
+// defaults to average. The target key names sets of the targets listed in
+// the APM config by alias or name, or all of them with "*".
+type apmQuery struct {
+	metric      string
+	aggregation string
+	sets        []scaleSetTarget
+}
+
+func parseAPMQuery(query string, scopes map[string]scaleSetTarget, all []scaleSetTarget) (*apmQuery, error) {
+	q := &apmQuery{aggregation: string(insights.TimeAggregationTypeAverage)}
+	for _, part := range strings.Split(query, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("query entry %q must be in the key=value form", part)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "metric":
+			q.metric = value
+			if alias, ok := apmMetricAliases[strings.ToLower(value)]; ok {
+				q.metric = alias
+			}
+		case "aggregation":
+			q.aggregation = ""
+			for _, aggregation := range insights.PossibleTimeAggregationTypeValues() {
+				if strings.EqualFold(value, string(aggregation)) {
+					q.aggregation = string(aggregation)
+				}
+			}
+			if q.aggregation == "" {
+				return nil, fmt.Errorf("unsupported aggregation %q", value)
+			}
+		case "vmss":
+			for _, set := range strings.Split(value, ",") {
+				resourceGroup, vmScaleSet, ok := strings.Cut(strings.TrimSpace(set), "/")
+				if !ok || resourceGroup == "" || vmScaleSet == "" {
+					return nil, fmt.Errorf("scale set %q must be in the resource_group/name form", set)
+				}
+				q.sets = append(q.sets, scaleSetTarget{resourceGroup: resourceGroup, vmScaleSet: vmScaleSet})
+			}
+		case "target":
+			if len(all) == 0 {
+				return nil, fmt.Errorf("query names target %q but the APM config lists no targets", value)
+			}
+			if value == "*" {
+				q.sets = append(q.sets, all...)
+				continue
+			}
+			for _, name := range strings.Split(value, ",") {
+				set, ok := scopes[strings.ToLower(strings.TrimSpace(name))]
+				if !ok {
+					return nil, fmt.Errorf("unknown target %q, not listed in the APM config", name)
+				}
+				q.sets = append(q.sets, set)
+			}
+		default:
+			return nil, fmt.Errorf("unknown query key %q", key)
+		}
+	}
+	if q.metric == "" || len(q.sets) == 0 {
+		return nil, fmt.Errorf("query %q needs a metric and at least one vmss or target", query)
+	}
+	return q, nil
+}
+
+// Query returns the metric of the scale sets over the time range, in one
+// minute points. The points of several sets are combined with the
+// aggregation: totals and counts add up, minimums and maximums keep the
+// extreme and averages are averaged.
+func (a *APMPlugin) Query(query string, timeRange sdk.TimeRange) (sdk.TimestampedMetrics, error) {
+	series, q, err := a.query(query, timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	combined := make(map[time.Time][]float64)
+	for _, metrics := range series {
+		for _, metric := range metrics {
+			combined[metric.Timestamp] = append(combined[metric.Timestamp], metric.Value)
+		}
+	}
+	result := make(sdk.TimestampedMetrics, 0, len(combined))
+	for timestamp, values := range combined {
+		result = append(result, sdk.TimestampedMetric{Timestamp: timestamp, Value: combineValues(q.aggregation, values)})
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// QueryMultiple returns the metric of every scale set of the query
+// separately, in the order they are listed.
+func (a *APMPlugin) QueryMultiple(query string, timeRange sdk.TimeRange) ([]sdk.TimestampedMetrics, error) {
+	series, _, err := a.query(query, timeRange)
+	return series, err
+}
+
+func (a *APMPlugin) query(query string, timeRange sdk.TimeRange) ([]sdk.TimestampedMetrics, *apmQuery, error) {
+	q, err := parseAPMQuery(query, a.scopes, a.sets)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apmQueryTimeout)
+	defer cancel()
+
+	timespan := timeRange.From.UTC().Format(time.RFC3339) + "/" + timeRange.To.UTC().Format(time.RFC3339)
+	interval := "PT1M"
+	series := make([]sdk.TimestampedMetrics, 0, len(q.sets))
+	for _, set := range q.sets {
+		subscription := set.subscription
+		if subscription == "" {
+			subscription = a.subscriptionID
+		}
+		resourceURI := fmt.Sprintf("subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s",
+			subscription, set.resourceGroup, set.vmScaleSet)
+		resp, err := a.metrics.List(ctx, resourceURI, timespan, &interval, q.metric, q.aggregation, nil, "", "", insights.Data, "")
+		if err != nil {
+			return nil, nil, wrapAzureError(ctx, fmt.Sprintf("failed to query %s of %s/%s", q.metric, set.resourceGroup, set.vmScaleSet), err)
+		}
+		series = append(series, metricPoints(resp, q.aggregation))
+	}
+	a.logger.Debug("queried Azure Monitor", "metric", q.metric, "aggregation", q.aggregation, "sets", len(q.sets))
+	return series, q, nil
+}
+
+// metricPoints returns the points of the aggregation in a metrics response.
+// Points without a value, minutes Azure Monitor has no data for, are left
+// out.
+func metricPoints(resp insights.Response, aggregation string) sdk.TimestampedMetrics {
+	var points sdk.TimestampedMetrics
+	if resp.Value == nil {
+		return points
+	}
+	for _, metric := range *resp.Value {
+		if metric.Timeseries == nil {
+			continue
+		}
+		for _, element := range *metric.Timeseries {
+			if element.Data == nil {
+				continue
+			}
+			for _, data := range *element.Data {
+				if data.TimeStamp == nil {
+					continue
+				}
+				if value := aggregationValue(data, aggregation); value != nil {
+					points = append(points, sdk.TimestampedMetric{Timestamp: data.TimeStamp.Time, Value: *value})
+				}
+			}
+		}
+	}
+	sort.Sort(points)
+	return points
+}
+
+func aggregationValue(data insights.MetricValue, aggregation string) *float64 {
+	switch insights.TimeAggregationType(aggregation) {
+	case insights.TimeAggregationTypeMinimum:
+		return data.Minimum
+	case insights.TimeAggregationTypeMaximum:
+		return data.Maximum
+	case insights.TimeAggregationTypeTotal:
+		return data.Total
+	case insights.TimeAggregationTypeCount:
+		return data.Count
+	default:
+		return data.Average
+	}
+}
+
+func combineValues(aggregation string, values []float64) float64 {
+	var result float64
+	switch insights.TimeAggregationType(aggregation) {
+	case insights.TimeAggregationTypeMinimum:
+		result = math.Inf(1)
+		for _, value := range values {
+			result = math.Min(result, value)
+		}
+	case insights.TimeAggregationTypeMaximum:
+		result = math.Inf(-1)
+		for _, value := range values {
+			result = math.Max(result, value)
+		}
+	case insights.TimeAggregationTypeTotal, insights.TimeAggregationTypeCount:
+		for _, value := range values {
+			result += value
+		}
+	default:
+		for _, value := range values {
+			result += value
+		}
+		result /= float64(len(values))
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseAPMQueryTargets(t *testing.T) {
+	sets, err := parseAPMScopes(map[string]string{configKeyTargets: "web=rg-a/nomad-web,rg-b/nomad-batch"})
+	if err != nil || len(sets) != 2 {
+		t.Fatalf("got %v, %v", sets, err)
+	}
+	scopes := apmScopeIndex(sets)
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"metric=cpu;target=web", []string{"nomad-web"}},
+		{"metric=cpu;target=WEB,nomad-batch", []string{"nomad-web", "nomad-batch"}},
+		{"metric=memory;target=*", []string{"nomad-web", "nomad-batch"}},
+		{"metric=cpu;vmss=rg-c/other;target=web", []string{"other", "nomad-web"}},
+	}
+	for _, tc := range cases {
+		q, err := parseAPMQuery(tc.query, scopes, sets)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		var got []string
+		for _, set := range q.sets {
+			got = append(got, set.vmScaleSet)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for idx := range got {
+			if got[idx] != tc.want[idx] {
+				t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+			}
+		}
+	}
+	if _, err := parseAPMQuery("metric=cpu;target=unknown", scopes, sets); err == nil {
+		t.Error("got no error for an unknown target")
+	}
+	if _, err := parseAPMQuery("metric=cpu;target=web", nil, nil); err == nil {
+		t.Error("got no error for a target without scopes")
+	}
+	if _, err := parseAPMScopes(map[string]string{configKeyTargets: "rg-a/nomad-*"}); err == nil {
+		t.Error("got no error for a pattern entry")
+	}
+	if sets, err := parseAPMScopes(map[string]string{}); sets != nil || err != nil {
+		t.Errorf("got %v, %v without targets", sets, err)
+	}
+}
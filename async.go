@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+func parseScaleAsync(config map[string]string) (bool, error) {
+	value, ok := config[configKeyScaleAsync]
+	if !ok {
+		return false, nil
+	}
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", configKeyScaleAsync, value, err)
+	}
+	return async, nil
+}
+
+// submission tracks whether Azure has accepted every long running operation
+// of an asynchronous scale. Scale returns once done is closed and leaves the
+// completion to the background.
+type submission struct {
+	lock      sync.Mutex
+	remaining int
+	done      chan struct{}
+}
+
+type submissionKey struct{}
+
+func newSubmission() *submission {
+	return &submission{done: make(chan struct{})}
+}
+
+func withSubmission(ctx context.Context, s *submission) context.Context {
+	return context.WithValue(ctx, submissionKey{}, s)
+}
+
+// submissionFrom returns the submission of an asynchronous scale, or nil.
+func submissionFrom(ctx context.Context) *submission {
+	s, _ := ctx.Value(submissionKey{}).(*submission)
+	return s
+}
+
+// expect sets the number of operations the scale is about to start. It must
+// be called before any of them is started.
+func (s *submission) expect(n int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remaining = n
+	if n == 0 {
+		s.closeLocked()
+	}
+}
+
+// accept records that Azure accepted, or rejected, one operation.
+func (s *submission) accept() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.remaining > 0 {
+		s.remaining--
+		if s.remaining == 0 {
+			s.closeLocked()
+		}
+	}
+}
+
+func (s *submission) closeLocked() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
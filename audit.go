@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultAuditLogMaxBytes = 100 * 1024 * 1024
+	defaultAuditLogMaxFiles = 5
+)
+
+type auditLogConfig struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+}
+
+func parseAuditLogConfig(config map[string]string) (*auditLogConfig, error) {
+	path, ok := config[configKeyAuditLogPath]
+	if !ok || path == "" {
+		return nil, nil
+	}
+
+	cfg := &auditLogConfig{path: path, maxBytes: defaultAuditLogMaxBytes, maxFiles: defaultAuditLogMaxFiles}
+	if value, ok := config[configKeyAuditLogMaxBytes]; ok {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyAuditLogMaxBytes, value)
+		}
+		cfg.maxBytes = maxBytes
+	}
+	if value, ok := config[configKeyAuditLogMaxFiles]; ok {
+		maxFiles, err := strconv.Atoi(value)
+		if err != nil || maxFiles < 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyAuditLogMaxFiles, value)
+		}
+		cfg.maxFiles = maxFiles
+	}
+	return cfg, nil
+}
+
+// auditLog appends every scale event as a JSON line to a local file. Once the
+// file exceeds the size limit it is rotated to path.1, shifting older files up
+// and dropping the ones beyond maxFiles.
+type auditLog struct {
+	lock sync.Mutex
+	cfg  *auditLogConfig
+	file *os.File
+	size int64
+}
+
+func newAuditLog(cfg *auditLogConfig) (*auditLog, error) {
+	a := &auditLog{cfg: cfg}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.cfg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", a.cfg.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat audit log %s: %v", a.cfg.path, err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.cfg.maxFiles == 0 {
+		if err := os.Remove(a.cfg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", a.cfg.path, a.cfg.maxFiles))
+	for i := a.cfg.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", a.cfg.path, i), fmt.Sprintf("%s.%d", a.cfg.path, i+1))
+	}
+	if err := os.Rename(a.cfg.path, a.cfg.path+".1"); err != nil {
+		_ = a.open()
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) record(event *scaleEvent, log hclog.Logger) {
+	encoded, err := event.encode()
+	if err != nil {
+		log.Warn("failed to encode scale event", "error", err)
+		return
+	}
+	encoded = append(encoded, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.size > 0 && a.size+int64(len(encoded)) > a.cfg.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.Warn("failed to rotate audit log", "path", a.cfg.path, "error", err)
+			return
+		}
+	}
+	n, err := a.file.Write(encoded)
+	a.size += int64(n)
+	if err != nil {
+		log.Warn("failed to write audit log", "path", a.cfg.path, "error", err)
+	}
+}
+
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_ = a.file.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	autoscaleConflictWarn   = "warn"
+	autoscaleConflictRefuse = "refuse"
+	autoscaleConflictIgnore = "ignore"
+
+	// autoscaleSettingsTTL bounds how often the autoscale settings of a
+	// resource group are listed; they change rarely and are not part of the
+	// scale set read.
+	autoscaleSettingsTTL = 5 * time.Minute
+)
+
+func parseAutoscaleConflictAction(config map[string]string) (string, error) {
+	value, ok := config[configKeyAzureAutoscaleConflict]
+	if !ok || value == "" {
+		return autoscaleConflictWarn, nil
+	}
+	switch value {
+	case autoscaleConflictWarn, autoscaleConflictRefuse, autoscaleConflictIgnore:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be one of %s, %s or %s", configKeyAzureAutoscaleConflict,
+		value, autoscaleConflictWarn, autoscaleConflictRefuse, autoscaleConflictIgnore)
+}
+
+// autoscaleSettings lists the enabled Azure Monitor autoscale settings of a
+// resource group, keyed by the lower cased ID of the resource they target.
+func (ac *AzureController) autoscaleSettings(ctx context.Context, resourceGroup string) (map[string]string, error) {
+	ctx, done := ac.timeCall(ctx, "list_autoscale_settings", resourceGroup, "")
+	defer done()
+
+	pager, err := ac.autoscale.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to list Azure autoscale settings", err)
+	}
+
+	settings := make(map[string]string)
+	for pager.NotDone() {
+		for _, setting := range pager.Values() {
+			if setting.AutoscaleSetting == nil || setting.TargetResourceURI == nil || setting.Name == nil {
+				continue
+			}
+			if setting.Enabled != nil && !*setting.Enabled {
+				continue
+			}
+			settings[strings.ToLower(*setting.TargetResourceURI)] = *setting.Name
+		}
+		if err := pager.NextWithContext(ctx); err != nil {
+			return nil, wrapAzureError(ctx, "failed to list Azure autoscale settings", err)
+		}
+	}
+	return settings, nil
+}
+
+// autoscaleConflictTracker caches the autoscale settings per resource group
+// and remembers which scale sets were already reported, so the warning is
+// logged once when a conflict appears rather than on every Status call.
+type autoscaleConflictTracker struct {
+	lock     sync.Mutex
+	settings map[string]cachedAutoscaleSettings
+	reported map[string]string
+}
+
+type cachedAutoscaleSettings struct {
+	settings  map[string]string
+	fetchedAt time.Time
+}
+
+func newAutoscaleConflictTracker() *autoscaleConflictTracker {
+	return &autoscaleConflictTracker{
+		settings: make(map[string]cachedAutoscaleSettings),
+		reported: make(map[string]string),
+	}
+}
+
+// autoscaleConflict returns the name of the enabled Azure autoscale setting
+// attached to a scale set, or an empty string if there is none.
+func (t *TargetPlugin) autoscaleConflict(ctx context.Context, resourceGroup, vmScaleSet, vmssID string, log hclog.Logger) (string, error) {
+	c := t.autoscaleConflicts
+	key := strings.ToLower(t.targets.subscription(resourceGroup, vmScaleSet) + "/" + resourceGroup)
+
+	c.lock.Lock()
+	entry, ok := c.settings[key]
+	c.lock.Unlock()
+	if !ok || time.Since(entry.fetchedAt) > autoscaleSettingsTTL {
+		settings, err := t.azureFor(resourceGroup, vmScaleSet).autoscaleSettings(ctx, resourceGroup)
+		if err != nil {
+			return "", err
+		}
+		entry = cachedAutoscaleSettings{settings: settings, fetchedAt: time.Now()}
+		c.lock.Lock()
+		c.settings[key] = entry
+		c.lock.Unlock()
+	}
+	name := entry.settings[strings.ToLower(vmssID)]
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	setKey := vmssKey(resourceGroup, vmScaleSet)
+	switch previous := c.reported[setKey]; {
+	case name != "" && name != previous:
+		log.Warn("scale set has an enabled Azure autoscale setting which will fight the Nomad autoscaler, "+
+			"disable or delete it", "vmss_name", vmScaleSet, "autoscale_setting", name)
+		c.reported[setKey] = name
+	case name == "" && previous != "":
+		log.Info("Azure autoscale setting no longer applies to scale set", "vmss_name", vmScaleSet, "autoscale_setting", previous)
+		delete(c.reported, setKey)
+	}
+	return name, nil
+}
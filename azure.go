@@ -2,108 +2,841 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// scaleSetClient is the part of the Azure API the capacity logic works
+// with. AzureController implements it against ARM; code written against it
+// can run with any other implementation.
+type scaleSetClient interface {
+	getCapacity(ctx context.Context, resourceGroup string, vmScaleSet string) (int64, error)
+	listRunningInstances(ctx context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error)
+	setCapacity(ctx context.Context, resourceGroup string, vmScaleSet string, capacity int64) error
+	deleteInstances(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string) error
+}
+
+var _ scaleSetClient = (*AzureController)(nil)
+
 type AzureController struct {
-	vmss    compute.VirtualMachineScaleSetsClient
-	vmssVMs compute.VirtualMachineScaleSetVMsClient
+	vmss     compute.VirtualMachineScaleSetsClient
+	vmssVMs  compute.VirtualMachineScaleSetVMsClient
+	upgrades compute.VirtualMachineScaleSetRollingUpgradesClient
+
+	autoscale insights.AutoscaleSettingsClient
+
+	// metrics reads the utilization of scale sets from Azure Monitor for
+	// load aware distribution.
+	metrics insights.MetricsClient
+
+	// sizes lists the VM sizes of a location, whose vCPUs weight the
+	// capacity of targets counting vCPUs, cached in vcpus.
+	sizes compute.VirtualMachineSizesClient
+	vcpus *vmSizeVCPUs
+
+	// standby talks to the standby pool resource provider, which the
+	// SDK has no client for.
+	standby autorest.Client
+	baseURI string
+
+	// graph runs Resource Graph queries, which list the scale sets of many
+	// resource groups and the instances of many sets in one call when
+	// resourceGraph is set.
+	graph         autorest.Client
+	resourceGraph bool
+
+	// authz reads the resource locks and policy states of scale sets
+	// before they are scaled, and updates the AKS node pools of the sets
+	// in aksPools.
+	authz    autorest.Client
+	aksPools *aksAgentPools
+
+	// ifMatch makes capacity updates conditional on the ETag read when
+	// planning the scale operation.
+	ifMatch bool
+
+	// removals records the instances deleted through the controller,
+	// which the spot eviction statistics leave out.
+	removals *removalLog
+
+	// operationDeadline bounds the wait on a long running operation, and
+	// pollingBudget the status polls it takes; zero waits for as long as
+	// Azure takes. orphanedOps records the operations given up on.
+	operationDeadline time.Duration
+	pollingBudget     int
+	orphanedOps       *orphanedOperations
+
+	// slowCallThreshold is the duration above which a call is logged to
+	// logger as slow; zero logs none.
+	slowCallThreshold time.Duration
+	logger            hclog.Logger
+
+	subscriptionID string
+	lock           sync.Mutex
+	subscriptions  map[string]*AzureController
 }
 
-func (ac *AzureController) init(config map[string]string) error {
+func (ac *AzureController) init(config map[string]string, authorizers *authorizerCache) error {
+	sim, err := parseSimulation(config)
+	if err != nil {
+		return err
+	}
+	subscriptionID := argsOrEnv(config, configKeySubscriptionID, "ARM_SUBSCRIPTION_ID")
+	if sim != nil && subscriptionID == "" {
+		subscriptionID = simulatedSubscriptionID
+	}
+	ac.subscriptionID = subscriptionID
+
+	baseURI, resource := resourceManager(config)
+	// Simulated and replayed requests never reach Azure, so they need no
+	// token either.
+	var authorizer autorest.Authorizer = autorest.NullAuthorizer{}
+	if sim == nil && config[configKeyAzureReplayDir] == "" {
+		if authorizer, err = authorizers.get(config, resource); err != nil {
+			return err
+		}
+	}
+	limits, err := parseAzureRateLimits(config)
+	if err != nil {
+		return err
+	}
+	sender := newSimulateSender(sim)
+	if sim == nil {
+		if sender, err = newAzureSender(config); err != nil {
+			return err
+		}
+	}
+	if sender, err = wrapRecording(config, sender, subscriptionID); err != nil {
+		return err
+	}
+	faults, err := parseFaultInjection(config)
+	if err != nil {
+		return err
+	}
+	sender = faultSender(sender, faults)
+
+	vmss := compute.NewVirtualMachineScaleSetsClientWithBaseURI(baseURI, subscriptionID)
+	vmss.Sender = rateLimitSender(instrumentSender(sender), limits)
+	vmss.Authorizer = authorizer
+	ac.vmss = vmss
+
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(baseURI, subscriptionID)
+	vmssVMs.Sender = rateLimitSender(instrumentSender(sender), limits)
+	vmssVMs.Authorizer = authorizer
+	ac.vmssVMs = vmssVMs
+
+	upgrades := compute.NewVirtualMachineScaleSetRollingUpgradesClientWithBaseURI(baseURI, subscriptionID)
+	upgrades.Sender = rateLimitSender(instrumentSender(sender), limits)
+	upgrades.Authorizer = authorizer
+	ac.upgrades = upgrades
+
+	autoscale := insights.NewAutoscaleSettingsClientWithBaseURI(baseURI, subscriptionID)
+	autoscale.Sender = rateLimitSender(instrumentSender(sender), limits)
+	autoscale.Authorizer = authorizer
+	ac.autoscale = autoscale
+
+	metrics := insights.NewMetricsClientWithBaseURI(baseURI, subscriptionID)
+	metrics.Sender = rateLimitSender(instrumentSender(sender), limits)
+	metrics.Authorizer = authorizer
+	ac.metrics = metrics
+
+	sizes := compute.NewVirtualMachineSizesClientWithBaseURI(baseURI, subscriptionID)
+	sizes.Sender = rateLimitSender(instrumentSender(sender), limits)
+	sizes.Authorizer = authorizer
+	ac.sizes = sizes
+	if ac.vcpus == nil {
+		ac.vcpus = newVMSizeVCPUs()
+	}
+
+	standby := autorest.NewClientWithUserAgent(pluginName)
+	standby.Sender = rateLimitSender(instrumentSender(sender), limits)
+	standby.Authorizer = authorizer
+	ac.standby = standby
+	ac.baseURI = baseURI
+
+	graph := autorest.NewClientWithUserAgent(pluginName)
+	graph.Sender = rateLimitSender(instrumentSender(sender), limits)
+	graph.Authorizer = authorizer
+	ac.graph = graph
+
+	authz := autorest.NewClientWithUserAgent(pluginName)
+	authz.Sender = rateLimitSender(instrumentSender(sender), limits)
+	authz.Authorizer = authorizer
+	ac.authz = authz
+	if ac.aksPools == nil {
+		ac.aksPools = newAKSAgentPools()
+	}
+	if ac.removals == nil {
+		ac.removals = newRemovalLog()
+	}
+	if ac.orphanedOps == nil {
+		ac.orphanedOps = newOrphanedOperations()
+	}
+	if ac.operationDeadline, err = parseOperationDeadline(config); err != nil {
+		return err
+	}
+	if ac.pollingBudget, err = parsePollingBudget(config); err != nil {
+		return err
+	}
+	if ac.slowCallThreshold, err = parseSlowCallThreshold(config); err != nil {
+		return err
+	}
+	if err := scaleWrites.configure(config); err != nil {
+		return err
+	}
+
+	if value, ok := config[configKeyVMSSIfMatch]; ok {
+		if ac.ifMatch, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", configKeyVMSSIfMatch, value, err)
+		}
+	}
+	if value, ok := config[configKeyResourceGraph]; ok {
+		if ac.resourceGraph, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", configKeyResourceGraph, value, err)
+		}
+	}
+
+	return nil
+}
+
+// forSubscription returns a controller for scale sets in another
+// subscription. It shares the credentials and senders of ac, so the plugin
+// identity needs access to every subscription it is pointed at.
+func (ac *AzureController) forSubscription(subscriptionID string) *AzureController {
+	if subscriptionID == "" || strings.EqualFold(subscriptionID, ac.subscriptionID) {
+		return ac
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if controller, ok := ac.subscriptions[key]; ok {
+		return controller
+	}
+
+	controller := &AzureController{
+		vmss:              ac.vmss,
+		vmssVMs:           ac.vmssVMs,
+		upgrades:          ac.upgrades,
+		autoscale:         ac.autoscale,
+		metrics:           ac.metrics,
+		sizes:             ac.sizes,
+		vcpus:             ac.vcpus,
+		standby:           ac.standby,
+		baseURI:           ac.baseURI,
+		graph:             ac.graph,
+		resourceGraph:     ac.resourceGraph,
+		authz:             ac.authz,
+		aksPools:          ac.aksPools,
+		ifMatch:           ac.ifMatch,
+		removals:          ac.removals,
+		operationDeadline: ac.operationDeadline,
+		pollingBudget:     ac.pollingBudget,
+		orphanedOps:       ac.orphanedOps,
+		slowCallThreshold: ac.slowCallThreshold,
+		logger:            ac.logger,
+		subscriptionID:    subscriptionID,
+	}
+	controller.vmss.SubscriptionID = subscriptionID
+	controller.vmssVMs.SubscriptionID = subscriptionID
+	controller.upgrades.SubscriptionID = subscriptionID
+	controller.autoscale.SubscriptionID = subscriptionID
+	controller.metrics.SubscriptionID = subscriptionID
+	controller.sizes.SubscriptionID = subscriptionID
+	if ac.subscriptions == nil {
+		ac.subscriptions = make(map[string]*AzureController)
+	}
+	ac.subscriptions[key] = controller
+	return controller
+}
+
+// resourceManager returns the base URI of the Resource Manager the clients
+// talk to and the Azure AD resource their tokens are issued for. The endpoint
+// can be overridden for sovereign clouds, Azure Stack or a fake Resource
+// Manager serving canned responses, whose tokens are issued for the endpoint
+// itself; the resource is empty for the public cloud default.
+func resourceManager(config map[string]string) (string, string) {
+	value := config[configKeyResourceManagerEndpoint]
+	if value == "" {
+		return compute.DefaultBaseURI, ""
+	}
+	return strings.TrimSuffix(value, "/"), strings.TrimSuffix(value, "/") + "/"
+}
+
+// authorizerCache holds the authorizers a plugin built so far, keyed by
+// credentials, subscription and resource. Every client, the Azure Monitor
+// exporter and the controllers built on later SetConfig calls share one token
+// per identity and resource, which the authorizer refreshes ahead of expiry,
+// rather than each going to Azure AD. Entries the last config did not ask
+// for are evicted once it is set, so rotated credentials and removed
+// subscriptions do not keep an authorizer for the life of the process.
+type authorizerCache struct {
+	lock    sync.Mutex
+	entries map[string]*reloadableAuthorizer
+	used    map[string]struct{}
+}
+
+func newAuthorizerCache() *authorizerCache {
+	return &authorizerCache{
+		entries: make(map[string]*reloadableAuthorizer),
+		used:    make(map[string]struct{}),
+	}
+}
+
+// get returns an Azure AD authorizer for the plugin credentials, falling
+// back to the environment. An empty resource selects the Resource Manager
+// endpoint.
+func (c *authorizerCache) get(config map[string]string, resource string) (autorest.Authorizer, error) {
 	tenantID := argsOrEnv(config, configKeyTenantID, "ARM_TENANT_ID")
 	clientID := argsOrEnv(config, configKeyClientID, "ARM_CLIENT_ID")
+	secret := newSecretSource(config)
+
+	// A secret file is keyed by its path, so its authorizer is reused
+	// across rotations.
+	secretKey := "file:" + secret.file
+	if secret.file == "" {
+		secretHash := sha256.Sum256([]byte(secret.value))
+		secretKey = hex.EncodeToString(secretHash[:])
+	}
 	subscriptionID := argsOrEnv(config, configKeySubscriptionID, "ARM_SUBSCRIPTION_ID")
-	secretKey := argsOrEnv(config, configKeySecretKey, "ARM_CLIENT_SECRET")
+	key := strings.Join([]string{tenantID, clientID, secretKey, strings.ToLower(subscriptionID), resource}, "|")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.used[key] = struct{}{}
+	if authorizer, ok := c.entries[key]; ok {
+		return authorizer, nil
+	}
+	authorizer, err := newReloadableAuthorizer(tenantID, clientID, secret, resource)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = authorizer
+	return authorizer, nil
+}
 
-	var authorizer autorest.Authorizer
+// evictUnused drops the authorizers not asked for since the last eviction,
+// which is when the config they were built for was replaced.
+func (c *authorizerCache) evictUnused() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.entries {
+		if _, ok := c.used[key]; !ok {
+			delete(c.entries, key)
+		}
+	}
+	c.used = make(map[string]struct{})
+}
+
+// clear drops every authorizer, once the plugin shuts down.
+func (c *authorizerCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*reloadableAuthorizer)
+	c.used = make(map[string]struct{})
+}
+
+func buildAuthorizer(tenantID, clientID, secretKey, resource string) (autorest.Authorizer, error) {
 	if tenantID != "" && clientID != "" && secretKey != "" {
-		var err error
-		authorizer, err = auth.NewClientCredentialsConfig(clientID, secretKey, tenantID).Authorizer()
+		credentials := auth.NewClientCredentialsConfig(clientID, secretKey, tenantID)
+		if resource != "" {
+			credentials.Resource = resource
+		}
+		authorizer, err := credentials.Authorizer()
 		if err != nil {
-			return fmt.Errorf("azure-vmss (ClientCredentials): %s", err)
+			return nil, fmt.Errorf("azure-vmss (ClientCredentials): %s", err)
 		}
+		return authorizer, nil
+	}
+
+	var authorizer autorest.Authorizer
+	var err error
+	if resource != "" {
+		authorizer, err = auth.NewAuthorizerFromEnvironmentWithResource(resource)
 	} else {
-		var err error
 		authorizer, err = auth.NewAuthorizerFromEnvironment()
-		if err != nil {
-			return fmt.Errorf("azure-vmss (EnvironmentCredentials): %s", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("azure-vmss (EnvironmentCredentials): %s", err)
+	}
+	return authorizer, nil
+}
+
+// listScaleSets returns the names of the scale sets in a resource group.
+func (ac *AzureController) listScaleSets(ctx context.Context, resourceGroup string) ([]string, error) {
+	ctx, done := ac.timeCall(ctx, "list_scale_sets", resourceGroup, "")
+	defer done()
+
+	pager, err := ac.vmss.List(ctx, resourceGroup)
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to list Azure vmss", err)
+	}
+
+	var names []string
+	for pager.NotDone() {
+		for _, vmss := range pager.Values() {
+			if vmss.Name != nil {
+				names = append(names, *vmss.Name)
+			}
+		}
+		if err := pager.NextWithContext(ctx); err != nil {
+			return nil, wrapAzureError(ctx, "failed to list Azure vmss", err)
 		}
 	}
+	return names, nil
+}
 
-	vmss := compute.NewVirtualMachineScaleSetsClient(subscriptionID)
-	vmss.Sender = autorest.CreateSender()
-	vmss.Authorizer = authorizer
-	ac.vmss = vmss
+// upgradeInProgress reports whether a rolling upgrade, including one started
+// by automatic OS image upgrades, is currently rolling forward. Scale sets that
+// never ran an upgrade return NotFound, which is treated as no upgrade.
+func (ac *AzureController) upgradeInProgress(ctx context.Context, resourceGroup string, vmScaleSet string) bool {
+	ctx, done := ac.timeCall(ctx, "get_rolling_upgrade", resourceGroup, vmScaleSet)
+	defer done()
 
-	vmssVMs := compute.NewVirtualMachineScaleSetVMsClient(subscriptionID)
-	vmssVMs.Sender = autorest.CreateSender()
-	vmssVMs.Authorizer = authorizer
-	ac.vmssVMs = vmssVMs
+	status, err := ac.upgrades.GetLatest(ctx, resourceGroup, vmScaleSet)
+	if err != nil || status.RollingUpgradeStatusInfoProperties == nil || status.RunningStatus == nil {
+		return false
+	}
+	return status.RunningStatus.Code == compute.RollingUpgradeStatusCodeRollingForward
+}
 
-	return nil
+// etag returns the ETag of a scale set read, if ARM returned one.
+func etag(vmss compute.VirtualMachineScaleSet) string {
+	if vmss.Response.Response == nil {
+		return ""
+	}
+	return vmss.Header.Get("ETag")
+}
+
+type vmssInstance struct {
+	remoteID          string
+	instanceID        string
+	powerState        string
+	provisioningState string
+	provisionedAt     time.Time
+	errors            []instanceError
+
+	// health is the Application Health extension state, such as
+	// HealthState/healthy. It is only listed for sets running the
+	// extension.
+	health string
+
+	// maintenancePending is set when Azure has platform maintenance
+	// scheduled for the instance. It is only listed along with the health.
+	maintenancePending bool
 }
 
-func (ac *AzureController) getRemoteIds(ctx context.Context, resourceGroup string, vmScaleSet string, remoteIDs []string) ([]string, error) {
-	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet,
-		"startswith(instanceView/statuses/code, 'PowerState') eq true",
-		"instanceView/statuses", "instanceView")
+// instanceError is an error level status reported by an instance or one of
+// its extensions, such as a provisioning timeout or a failed custom script.
+type instanceError struct {
+	code    string
+	message string
+}
+
+func (i vmssInstance) running() bool {
+	return i.powerState == "PowerState/running"
+}
+
+// powerStateFilter has ARM return only the instances which report a power
+// state, leaving out those still being created.
+const powerStateFilter = "startswith(instanceView/statuses/code, 'PowerState') eq true"
+
+// listInstances returns every instance of the scale set. No power state
+// filter is applied, so instances which are still being created and have not
+// reported a power state yet are included.
+func (ac *AzureController) listInstances(ctx context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error) {
+	return ac.queryInstances(ctx, resourceGroup, vmScaleSet, "", instanceStatusesSelect)
+}
+
+// instanceStatusesSelect selects only the instance view statuses, which is
+// all vmssInstance is built from unless the health is needed too.
+const instanceStatusesSelect = "instanceView/statuses"
+
+// queryInstances lists the instances matching filter, selecting selection of
+// each. The list API has no page size parameter, ARM decides how many
+// instances a page holds.
+func (ac *AzureController) queryInstances(ctx context.Context, resourceGroup string, vmScaleSet string, filter string, selection string) ([]vmssInstance, error) {
+	ctx, done := ac.timeCall(ctx, "list_instances", resourceGroup, vmScaleSet)
+	defer done()
+
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, filter, selection, "instanceView")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query VMSS instances: %v", err)
+		return nil, wrapAzureError(ctx, "failed to query VMSS instances", err)
 	}
 
+	var instances []vmssInstance
 	for pager.NotDone() {
 		for _, vm := range pager.Values() {
-			for _, s := range *vm.VirtualMachineScaleSetVMProperties.InstanceView.Statuses {
-				if strings.HasPrefix(*s.Code, "PowerState/") {
-					if *s.Code == "PowerState/running" {
-						remoteIDs = append(remoteIDs, fmt.Sprintf("%s_%s", vmScaleSet, *vm.InstanceID))
+			instance := vmssInstance{
+				remoteID:   fmt.Sprintf("%s_%s", vmScaleSet, *vm.InstanceID),
+				instanceID: *vm.InstanceID,
+			}
+			if vm.VirtualMachineScaleSetVMProperties != nil && vm.InstanceView != nil && vm.InstanceView.Statuses != nil {
+				for _, s := range *vm.InstanceView.Statuses {
+					switch {
+					case strings.HasPrefix(*s.Code, "ProvisioningState/"):
+						instance.provisioningState = *s.Code
+						if s.Time != nil {
+							instance.provisionedAt = s.Time.Time
+						}
+					case strings.HasPrefix(*s.Code, "PowerState/"):
+						instance.powerState = *s.Code
 					}
-					break
+				}
+				instance.errors = instanceErrors(vm.InstanceView)
+				if health := vm.InstanceView.VMHealth; health != nil && health.Status != nil && health.Status.Code != nil {
+					instance.health = *health.Status.Code
+				}
+				instance.maintenancePending = maintenancePending(vm.InstanceView.MaintenanceRedeployStatus)
+			}
+			instances = append(instances, instance)
+		}
+
+		err := pager.NextWithContext(ctx)
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to list instances in VMSS", err)
+		}
+	}
+
+	return instances, nil
+}
+
+func instanceErrors(view *compute.VirtualMachineScaleSetVMInstanceView) []instanceError {
+	var errors []instanceError
+	collect := func(prefix string, statuses *[]compute.InstanceViewStatus) {
+		if statuses == nil {
+			return
+		}
+		for _, s := range *statuses {
+			if s.Level != compute.Error || s.Code == nil {
+				continue
+			}
+			e := instanceError{code: prefix + *s.Code}
+			if s.Message != nil {
+				e.message = *s.Message
+			}
+			errors = append(errors, e)
+		}
+	}
+
+	collect("", view.Statuses)
+	if view.Extensions != nil {
+		for _, ext := range *view.Extensions {
+			if ext.Name != nil {
+				collect(*ext.Name+"/", ext.Statuses)
+			}
+		}
+	}
+	return errors
+}
+
+func (ac *AzureController) listRunningInstances(ctx context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error) {
+	return ac.queryRunningInstances(ctx, resourceGroup, vmScaleSet, instanceStatusesSelect)
+}
+
+func (ac *AzureController) queryRunningInstances(ctx context.Context, resourceGroup string, vmScaleSet string, selection string) ([]vmssInstance, error) {
+	instances, err := ac.queryInstances(ctx, resourceGroup, vmScaleSet, powerStateFilter, selection)
+	if err != nil {
+		return nil, err
+	}
+
+	running := instances[:0]
+	for _, instance := range instances {
+		if instance.running() {
+			running = append(running, instance)
+		}
+	}
+	return running, nil
+}
+
+func (ac *AzureController) listInstanceNames(ctx context.Context, resourceGroup string, vmScaleSet string) (map[string]struct{}, error) {
+	ctx, done := ac.timeCall(ctx, "list_instance_names", resourceGroup, vmScaleSet)
+	defer done()
+
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, "", "", "")
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to query VMSS instances", err)
+	}
+
+	names := make(map[string]struct{})
+	for pager.NotDone() {
+		for _, vm := range pager.Values() {
+			names[strings.ToLower(fmt.Sprintf("%s_%s", vmScaleSet, *vm.InstanceID))] = struct{}{}
+		}
+
+		err := pager.NextWithContext(ctx)
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to list instances in VMSS", err)
+		}
+	}
+
+	return names, nil
+}
+
+func (ac *AzureController) listInstanceTags(ctx context.Context, resourceGroup string, vmScaleSet string) (map[string]map[string]string, error) {
+	ctx, done := ac.timeCall(ctx, "list_instance_tags", resourceGroup, vmScaleSet)
+	defer done()
+
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, "", "", "")
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to query VMSS instances", err)
+	}
+
+	tags := make(map[string]map[string]string)
+	for pager.NotDone() {
+		for _, vm := range pager.Values() {
+			instanceTags := make(map[string]string, len(vm.Tags))
+			for key, value := range vm.Tags {
+				if value != nil {
+					instanceTags[key] = *value
 				}
 			}
+			tags[*vm.InstanceID] = instanceTags
 		}
 
 		err := pager.NextWithContext(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list instances in VMSS: %v", err)
+			return nil, wrapAzureError(ctx, "failed to list instances in VMSS", err)
 		}
 	}
 
-	return remoteIDs, nil
+	return tags, nil
 }
 
-func (ac *AzureController) scaleOut(ctx context.Context, resourceGroup string, vmScaleSet string, count int64, wg *sync.WaitGroup, logger hclog.Logger) {
-	defer wg.Done()
-	if future, err := ac.vmss.Update(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetUpdate{
+// listOutdatedInstances returns the IDs of the instances which do not run the
+// latest scale set model, such as after an image or extension update that was
+// not rolled out to them.
+func (ac *AzureController) listOutdatedInstances(ctx context.Context, resourceGroup string, vmScaleSet string) (map[string]bool, error) {
+	ctx, done := ac.timeCall(ctx, "list_outdated_instances", resourceGroup, vmScaleSet)
+	defer done()
+
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, "", "", "")
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to query VMSS instances", err)
+	}
+
+	outdated := make(map[string]bool)
+	for pager.NotDone() {
+		for _, vm := range pager.Values() {
+			if vm.VirtualMachineScaleSetVMProperties != nil && vm.LatestModelApplied != nil && !*vm.LatestModelApplied {
+				outdated[*vm.InstanceID] = true
+			}
+		}
+
+		err := pager.NextWithContext(ctx)
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to list instances in VMSS", err)
+		}
+	}
+
+	return outdated, nil
+}
+
+// tagInstance merges tags into the existing tags of a single scale set
+// instance.
+func (ac *AzureController) tagInstance(ctx context.Context, resourceGroup string, vmScaleSet string, instanceID string, tags map[string]string) error {
+	ctx, done := ac.timeCall(ctx, "tag_instance", resourceGroup, vmScaleSet)
+	defer done()
+
+	vm, err := ac.vmssVMs.Get(ctx, resourceGroup, vmScaleSet, instanceID, "")
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get VMSS instance "+instanceID, err)
+	}
+	if vm.Tags == nil {
+		vm.Tags = make(map[string]*string, len(tags))
+	}
+	for key, value := range tags {
+		vm.Tags[key] = ptr.StringToPtr(value)
+	}
+
+	future, err := ac.vmssVMs.Update(ctx, resourceGroup, vmScaleSet, instanceID, vm)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss instance update response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmssVMs.Client, "cannot get the vmss instance update future response")
+}
+
+// setScaleInProtection protects a single scale set instance from scale in, or
+// lifts the protection, merging tags into its tags. A tag with an empty value
+// is removed.
+func (ac *AzureController) setScaleInProtection(ctx context.Context, resourceGroup string, vmScaleSet string, instanceID string, protect bool, tags map[string]string) error {
+	ctx, done := ac.timeCall(ctx, "set_scale_in_protection", resourceGroup, vmScaleSet)
+	defer done()
+
+	vm, err := ac.vmssVMs.Get(ctx, resourceGroup, vmScaleSet, instanceID, "")
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get VMSS instance "+instanceID, err)
+	}
+	if vm.VirtualMachineScaleSetVMProperties == nil {
+		vm.VirtualMachineScaleSetVMProperties = &compute.VirtualMachineScaleSetVMProperties{}
+	}
+	if vm.ProtectionPolicy == nil {
+		vm.ProtectionPolicy = &compute.VirtualMachineScaleSetVMProtectionPolicy{}
+	}
+	vm.ProtectionPolicy.ProtectFromScaleIn = ptr.BoolToPtr(protect)
+	if vm.Tags == nil {
+		vm.Tags = make(map[string]*string, len(tags))
+	}
+	for key, value := range tags {
+		if value == "" {
+			delete(vm.Tags, key)
+			continue
+		}
+		vm.Tags[key] = ptr.StringToPtr(value)
+	}
+
+	future, err := ac.vmssVMs.Update(ctx, resourceGroup, vmScaleSet, instanceID, vm)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss instance update response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmssVMs.Client, "cannot get the vmss instance update future response")
+}
+
+// tagScaleSet merges tags into the existing tags of a scale set. The update is
+// a PATCH which replaces the whole tag map, hence the read beforehand.
+func (ac *AzureController) tagScaleSet(ctx context.Context, resourceGroup string, vmScaleSet string, tags map[string]string) error {
+	ctx, done := ac.timeCall(ctx, "tag_scale_set", resourceGroup, vmScaleSet)
+	defer done()
+
+	vmss, err := ac.vmss.Get(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get Azure vmss", err)
+	}
+	merged := make(map[string]*string, len(vmss.Tags)+len(tags))
+	for key, value := range vmss.Tags {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = ptr.StringToPtr(value)
+	}
+
+	future, err := ac.vmss.Update(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetUpdate{Tags: merged})
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss update response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss update future response")
+}
+
+// getCapacity returns the SKU capacity of a scale set.
+func (ac *AzureController) getCapacity(ctx context.Context, resourceGroup string, vmScaleSet string) (int64, error) {
+	ctx, done := ac.timeCall(ctx, "get_capacity", resourceGroup, vmScaleSet)
+	defer done()
+
+	vmss, err := ac.vmss.Get(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return 0, wrapAzureError(ctx, "failed to get Azure vmss", err)
+	}
+	return ptr.PtrToInt64(vmss.Sku.Capacity), nil
+}
+
+func (ac *AzureController) setCapacity(ctx context.Context, resourceGroup string, vmScaleSet string, capacity int64) error {
+	return ac.setCapacityIfMatch(ctx, resourceGroup, vmScaleSet, capacity, "", -1)
+}
+
+// setCapacityIfMatch updates the capacity of a scale set. When optimistic
+// concurrency is enabled and an ETag is given, the update is conditional on
+// the scale set not having changed since it was read, failing with 412
+// Precondition Failed otherwise. Without one, a non-negative expected
+// capacity is checked against a fresh read just before the update, which
+// narrows rather than closes the window for a concurrent change.
+func (ac *AzureController) setCapacityIfMatch(ctx context.Context, resourceGroup string, vmScaleSet string, capacity int64, etag string, expected int64) error {
+	if pool, ok := ac.aksPools.get(resourceGroup, vmScaleSet); ok {
+		// AKS applies the count of the node pool to the set, so the
+		// update is not conditional.
+		return ac.setAgentPoolCount(ctx, resourceGroup, vmScaleSet, pool, capacity)
+	}
+	ctx, done := ac.timeCall(ctx, "set_capacity", resourceGroup, vmScaleSet)
+	defer done()
+
+	future, err := ac.startCapacityUpdate(ctx, resourceGroup, vmScaleSet, capacity, etag, expected)
+	submissionFrom(ctx).accept()
+	if err != nil {
+		return err
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss update future response")
+}
+
+func (ac *AzureController) startCapacityUpdate(ctx context.Context, resourceGroup string, vmScaleSet string, capacity int64, etag string, expected int64) (compute.VirtualMachineScaleSetsUpdateFuture, error) {
+	var future compute.VirtualMachineScaleSetsUpdateFuture
+	if !(ac.ifMatch && etag != "") && expected >= 0 {
+		current, err := ac.getCapacity(ctx, resourceGroup, vmScaleSet)
+		if err != nil {
+			return future, err
+		}
+		if current != expected {
+			return future, capacityChangedError(ctx, resourceGroup, vmScaleSet, expected, current)
+		}
+	}
+	req, err := ac.vmss.UpdatePreparer(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetUpdate{
 		Sku: &compute.Sku{
-			Capacity: ptr.Int64ToPtr(count),
+			Capacity: ptr.Int64ToPtr(capacity),
 		},
-	}); err != nil {
-		logger.Error("failed to get the vmss update response: %v", err)
-	} else {
-		if err = future.WaitForCompletionRef(ctx, ac.vmss.Client); err != nil {
-			logger.Error("cannot get the vmss update future response: %v", err)
+	})
+	if err != nil {
+		return future, wrapAzureError(ctx, "failed to prepare the vmss update request", err)
+	}
+	if ac.ifMatch && etag != "" {
+		if req, err = autorest.Prepare(req, autorest.WithHeader("If-Match", etag)); err != nil {
+			return future, wrapAzureError(ctx, "failed to prepare the vmss update request", err)
 		}
 	}
+	if err := scaleWrites.wait(ctx, "set_capacity"); err != nil {
+		return future, wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	if future, err = ac.vmss.UpdateSender(req); err != nil {
+		return future, wrapAzureError(ctx, "failed to get the vmss update response", err)
+	}
+	return future, nil
 }
 
-func (ac *AzureController) scaleIn(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string, wg *sync.WaitGroup, logger hclog.Logger) {
-	defer wg.Done()
-	if future, err := ac.vmss.DeleteInstances(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+func (ac *AzureController) deleteInstances(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string) error {
+	ctx, done := ac.timeCall(ctx, "delete_instances", resourceGroup, vmScaleSet)
+	defer done()
+
+	ac.removals.begin(resourceGroup, vmScaleSet, instanceIDs)
+	defer ac.removals.end(resourceGroup, vmScaleSet, instanceIDs)
+	if err := scaleWrites.wait(ctx, "delete_instances"); err != nil {
+		submissionFrom(ctx).accept()
+		return wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	future, err := ac.vmss.DeleteInstances(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
 		InstanceIds: ptr.StringArrToPtr(instanceIDs),
-	}); err != nil {
-		logger.Error("failed to scale in Azure ScaleSet: %v", err)
-	} else {
-		if err = future.WaitForCompletionRef(ctx, ac.vmss.Client); err != nil {
-			logger.Error("failed to scale in Azure ScaleSet: %v", err)
-		}
+	})
+	submissionFrom(ctx).accept()
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss delete instances response", err)
+	}
+	if err := ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss delete instances future response"); err != nil {
+		return err
+	}
+	ac.removals.record(resourceGroup, vmScaleSet, instanceIDs)
+	if pool, ok := ac.aksPools.get(resourceGroup, vmScaleSet); ok {
+		return ac.syncAgentPoolCount(ctx, resourceGroup, vmScaleSet, pool)
+	}
+	return nil
+}
+
+func (ac *AzureController) scaleOut(ctx context.Context, resourceGroup string, vmScaleSet string, count int64, etag string, expected int64, logger hclog.Logger) error {
+	if err := ac.setCapacityIfMatch(ctx, resourceGroup, vmScaleSet, count, etag, expected); err != nil {
+		logger.Error("failed to scale out Azure ScaleSet", "vmss_name", vmScaleSet, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (ac *AzureController) scaleIn(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string, logger hclog.Logger) error {
+	if err := ac.deleteInstances(ctx, resourceGroup, vmScaleSet, instanceIDs); err != nil {
+		logger.Error("failed to scale in Azure ScaleSet", "vmss_name", vmScaleSet, "error", err)
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+func TestResourceManager(t *testing.T) {
+	cases := []struct {
+		endpoint     string
+		wantBaseURI  string
+		wantResource string
+	}{
+		{endpoint: "", wantBaseURI: "https://management.azure.com", wantResource: ""},
+		{endpoint: "https://management.usgovcloudapi.net/", wantBaseURI: "https://management.usgovcloudapi.net", wantResource: "https://management.usgovcloudapi.net/"},
+		{endpoint: "https://management.local.azurestack.external", wantBaseURI: "https://management.local.azurestack.external", wantResource: "https://management.local.azurestack.external/"},
+	}
+	for _, c := range cases {
+		config := map[string]string{}
+		if c.endpoint != "" {
+			config[configKeyResourceManagerEndpoint] = c.endpoint
+		}
+		baseURI, resource := resourceManager(config)
+		if baseURI != c.wantBaseURI || resource != c.wantResource {
+			t.Errorf("%q: got %q, %q, want %q, %q", c.endpoint, baseURI, resource, c.wantBaseURI, c.wantResource)
+		}
+	}
+}
+
+// seedAuthorizer makes the authorizer of the credentials in config for the
+// resource one that sends a fixed token, so no request reaches Azure AD.
+func seedAuthorizer(authorizers *authorizerCache, config map[string]string, resource string) {
+	hash := sha256.Sum256([]byte(config[configKeySecretKey]))
+	key := strings.Join([]string{config[configKeyTenantID], config[configKeyClientID], hex.EncodeToString(hash[:]),
+		strings.ToLower(config[configKeySubscriptionID]), resource}, "|")
+	authorizers.lock.Lock()
+	authorizers.entries[key] = &reloadableAuthorizer{
+		current: autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"Authorization": "Bearer fake"}),
+	}
+	authorizers.lock.Unlock()
+}
+
+func TestFakeResourceManager(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 1)
+	fake.add("rg", "b", 1)
+	arm := newFakeARM(t, fake)
+	nomad := httptest.NewServer(newFakeNomad(t, "fake", fake.remoteIDs("rg", "a", "b")))
+	t.Cleanup(nomad.Close)
+
+	config := map[string]string{
+		configKeySubscriptionID:          simulatedSubscriptionID,
+		configKeyTenantID:                "tenant",
+		configKeyClientID:                "client",
+		configKeySecretKey:               "secret",
+		configKeyResourceManagerEndpoint: arm.server.URL,
+		"nomad_address":                  nomad.URL,
+	}
+	// The token is only seeded for the resource the endpoint derives, so
+	// another resource would send the plugin to Azure AD and fail.
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	seedAuthorizer(plugin.authorizers, config, arm.server.URL+"/")
+	if err := plugin.SetConfig(config); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	t.Cleanup(plugin.shutdown)
+
+	target := map[string]string{
+		configKeyTargets:         "rg/a,rg/b",
+		"node_class":             "fake",
+		"node_selector_strategy": "newest_create_index",
+	}
+	status, err := plugin.Status(target)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.Count != 2 || !status.Ready {
+		t.Fatalf("got count %d, ready %t, want 2 ready instances", status.Count, status.Ready)
+	}
+
+	if err := plugin.Scale(sdk.ScalingAction{Count: 4, Direction: sdk.ScaleDirectionUp}, target); err != nil {
+		t.Fatalf("scale out failed: %v", err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2, "b": 2})
+
+	if err := plugin.Scale(sdk.ScalingAction{Count: 3, Direction: sdk.ScaleDirectionDown}, target); err != nil {
+		t.Fatalf("scale in failed: %v", err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2, "b": 1})
+
+	// Two updates and a deletion went through the long running operation
+	// each, with the first status poll throttled.
+	if got := arm.throttledPolls(); got != 3 {
+		t.Errorf("got %d throttled polls, want 3", got)
+	}
+}
+
+func TestAuthorizerCacheIsScopedToThePlugin(t *testing.T) {
+	config := map[string]string{
+		configKeySubscriptionID: "sub",
+		configKeyTenantID:       "tenant",
+		configKeyClientID:       "client",
+		configKeySecretKey:      "secret",
+	}
+	authorizers := newAuthorizerCache()
+	first, err := authorizers.get(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := authorizers.get(config, ""); again != first {
+		t.Error("the authorizer of unchanged credentials was rebuilt")
+	}
+	if other, _ := newAuthorizerCache().get(config, ""); other == first {
+		t.Error("another plugin shares the authorizer")
+	}
+
+	authorizers.clear()
+	if len(authorizers.entries) != 0 {
+		t.Errorf("got %d cached authorizers after shutdown, want none", len(authorizers.entries))
+	}
+}
+
+func TestAuthorizerCacheEvictsReplacedCredentials(t *testing.T) {
+	authorizers := newAuthorizerCache()
+	config := map[string]string{
+		configKeySubscriptionID: "sub",
+		configKeyTenantID:       "tenant",
+		configKeyClientID:       "client",
+		configKeySecretKey:      "old",
+	}
+	first, err := authorizers.get(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizers.evictUnused()
+	if again, _ := authorizers.get(config, ""); again != first {
+		t.Error("the authorizer of unchanged credentials was rebuilt")
+	}
+	authorizers.evictUnused()
+
+	// A rotated secret replaces the entry of the previous one.
+	config[configKeySecretKey] = "new"
+	if _, err := authorizers.get(config, ""); err != nil {
+		t.Fatal(err)
+	}
+	authorizers.evictUnused()
+	if len(authorizers.entries) != 1 {
+		t.Errorf("got %d cached authorizers, want only the rotated one", len(authorizers.entries))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// capacityBudget is a hard limit on the capacity of a target which holds
+// whatever the strategy asks for. It only ever holds back a scale out: a
+// target already over budget is left as it is, not scaled in.
+type capacityBudget struct {
+	maxInstances     int64
+	maxInstanceHours float64
+}
+
+func parseCapacityBudget(config map[string]string) (*capacityBudget, error) {
+	var budget capacityBudget
+	if value, ok := config[configKeyMaxTotalInstances]; ok {
+		max, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyMaxTotalInstances, value)
+		}
+		budget.maxInstances = max
+	}
+	if value, ok := config[configKeyMaxInstanceHoursPerDay]; ok {
+		hours, err := strconv.ParseFloat(value, 64)
+		if err != nil || hours <= 0 || math.IsInf(hours, 0) {
+			return nil, fmt.Errorf("invalid %s %q", configKeyMaxInstanceHoursPerDay, value)
+		}
+		budget.maxInstanceHours = hours
+	}
+	if budget.maxInstances == 0 && budget.maxInstanceHours == 0 {
+		return nil, nil
+	}
+	return &budget, nil
+}
+
+// budgetExceededError is returned when the budget clamps a scale out. The
+// scale to the clamped count has been carried out by then.
+type budgetExceededError struct {
+	requested int64
+	allowed   int64
+	limit     string
+}
+
+func (e *budgetExceededError) Error() string {
+	return fmt.Sprintf("requested %d instances exceeds %s, capped at %d", e.requested, e.limit, e.allowed)
+}
+
+// allowed returns the largest total capacity the budget allows now, and the
+// limit that sets it. The instance hours budget allows the capacity which,
+// kept until the end of the UTC day, uses up what is left of it.
+func (b *capacityBudget) allowed(usedHours float64, now time.Time) (int64, string) {
+	allowed, limit := int64(math.MaxInt64), ""
+	if b.maxInstances > 0 {
+		allowed, limit = b.maxInstances, configKeyMaxTotalInstances
+	}
+	if b.maxInstanceHours > 0 {
+		left := nextUTCDay(now).Sub(now).Hours()
+		hours := int64(0)
+		if remaining := b.maxInstanceHours - usedHours; remaining > 0 {
+			hours = int64(remaining / left)
+		}
+		if hours < allowed {
+			allowed, limit = hours, configKeyMaxInstanceHoursPerDay
+		}
+	}
+	return allowed, limit
+}
+
+// clamp limits a scale out to the budget, never below the current capacity.
+func (b *capacityBudget) clamp(current, requested int64, usedHours float64, now time.Time) (int64, error) {
+	if b == nil || requested <= current {
+		return requested, nil
+	}
+	allowed, limit := b.allowed(usedHours, now)
+	allowed = max(allowed, current)
+	if requested <= allowed {
+		return requested, nil
+	}
+	return allowed, &budgetExceededError{requested: requested, allowed: allowed, limit: limit}
+}
+
+func nextUTCDay(now time.Time) time.Time {
+	year, month, day := now.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+// budgetUsage is the capacity use of a target over the current UTC day.
+type budgetUsage struct {
+	day      time.Time
+	hours    float64
+	capacity int64
+	at       time.Time
+	clamped  string
+}
+
+// budgetTracker integrates the capacity each target reports over time into
+// instance hours per UTC day and remembers the last clamp of each target for
+// Status. Usage is held in memory, so a restarted plugin counts the day from
+// its start. A nil tracker records nothing.
+type budgetTracker struct {
+	lock    sync.Mutex
+	targets map[string]*budgetUsage
+}
+
+func newBudgetTracker() *budgetTracker {
+	return &budgetTracker{targets: make(map[string]*budgetUsage)}
+}
+
+// observe records the current capacity of the target and returns the
+// instance hours it has used so far today.
+func (b *budgetTracker) observe(target string, capacity int64, now time.Time) float64 {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	day := nextUTCDay(now).AddDate(0, 0, -1)
+	usage, ok := b.targets[target]
+	if !ok {
+		usage = &budgetUsage{day: day, at: now}
+		b.targets[target] = usage
+	}
+	since := usage.at
+	if usage.day.Before(day) {
+		usage.day, usage.hours = day, 0
+		if since.Before(day) {
+			since = day
+		}
+	}
+	if now.After(since) {
+		usage.hours += float64(usage.capacity) * now.Sub(since).Hours()
+	}
+	usage.capacity, usage.at = capacity, now
+	return usage.hours
+}
+
+// setClamped records the clamp of the last scale of the target, an empty
+// message clearing it.
+func (b *budgetTracker) setClamped(target, message string) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if usage, ok := b.targets[target]; ok {
+		usage.clamped = message
+	}
+}
+
+func (b *budgetTracker) annotate(target string, budget *capacityBudget, meta map[string]string) {
+	if b == nil || budget == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	usage, ok := b.targets[target]
+	if !ok {
+		return
+	}
+	if budget.maxInstanceHours > 0 {
+		meta[metaKeyBudgetInstanceHours] = strconv.FormatFloat(usage.hours, 'f', 1, 64)
+	}
+	if usage.clamped != "" {
+		meta[metaKeyBudgetClamped] = usage.clamped
+	}
+}
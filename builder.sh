@@ -2,4 +2,7 @@
 
 CGO_ENABLED=0
 
-go build -tags netgo -o azure-vmss-list .
\ No newline at end of file
+VERSION=${VERSION:-$(git describe --tags --always 2>/dev/null || echo dev)}
+GIT_COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+
+go build -tags netgo -ldflags "-X main.version=${VERSION} -X main.gitCommit=${GIT_COMMIT}" -o azure-vmss-list .
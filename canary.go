@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultScaleInCanaryDelay = 10 * time.Minute
+
+// scaleInCanary limits a scale in to percent of the requested removal. The
+// rest is removed after delay, once the pool is verified to have absorbed the
+// first step.
+type scaleInCanary struct {
+	percent int64
+	delay   time.Duration
+}
+
+func parseScaleInCanary(config map[string]string) (*scaleInCanary, error) {
+	value, ok := config[configKeyScaleInCanaryPercent]
+	if !ok {
+		return nil, nil
+	}
+	percent, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid %s %q, must be between 1 and 100", configKeyScaleInCanaryPercent, value)
+	}
+	canary := &scaleInCanary{percent: percent, delay: defaultScaleInCanaryDelay}
+	if value, ok := config[configKeyScaleInCanaryDelay]; ok {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyScaleInCanaryDelay, value)
+		}
+		canary.delay = delay
+	}
+	if percent == 100 {
+		return nil, nil
+	}
+	return canary, nil
+}
+
+// immediate returns how many of num instances are removed right away, at
+// least one.
+func (c *scaleInCanary) immediate(num int64) int64 {
+	return max((num*c.percent+99)/100, 1)
+}
+
+type canaryFollowUpKey struct{}
+
+// isCanaryFollowUp reports whether ctx belongs to the deferred part of a
+// canary scale in, which is not split again.
+func isCanaryFollowUp(ctx context.Context) bool {
+	_, ok := ctx.Value(canaryFollowUpKey{}).(bool)
+	return ok
+}
+
+// pendingCanary is the deferred part of a canary scale in, down to the count
+// of the latest action for the target.
+type pendingCanary struct {
+	action sdk.ScalingAction
+	config map[string]string
+	count  int64
+	due    time.Time
+	cancel context.CancelFunc
+}
+
+// canaryScaleIns tracks the deferred part of the canary scale in of each
+// target. A nil tracker schedules nothing.
+type canaryScaleIns struct {
+	lock    sync.Mutex
+	pending map[string]*pendingCanary
+}
+
+func newCanaryScaleIns() *canaryScaleIns {
+	return &canaryScaleIns{pending: make(map[string]*pendingCanary)}
+}
+
+// schedule runs fn with the pending action after delay, unless it is
+// cancelled before.
+func (c *canaryScaleIns) schedule(target string, action sdk.ScalingAction, config map[string]string, count int64, delay time.Duration, fn func(ctx context.Context, action sdk.ScalingAction, config map[string]string)) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), canaryFollowUpKey{}, true))
+	pending := &pendingCanary{action: action, config: config, count: count, due: time.Now().Add(delay), cancel: cancel}
+
+	c.lock.Lock()
+	if previous, ok := c.pending[target]; ok {
+		previous.cancel()
+	}
+	c.pending[target] = pending
+	c.lock.Unlock()
+
+	go func() {
+		defer c.done(target, pending)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		c.lock.Lock()
+		action, config := pending.action, pending.config
+		c.lock.Unlock()
+		fn(ctx, action, config)
+	}()
+}
+
+func (c *canaryScaleIns) done(target string, pending *pendingCanary) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending[target] == pending {
+		delete(c.pending, target)
+	}
+	pending.cancel()
+}
+
+// update points the pending scale in of the target at a newer scale in
+// action, which then waits for the same verification rather than starting a
+// canary of its own. It reports whether one was pending.
+func (c *canaryScaleIns) update(target string, action sdk.ScalingAction, config map[string]string, count int64) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending, ok := c.pending[target]
+	if ok {
+		pending.action, pending.config, pending.count = action, config, count
+	}
+	return ok
+}
+
+// cancel drops the pending scale in of the target, a newer action other than
+// a scale in superseding it. It reports whether one was pending.
+func (c *canaryScaleIns) cancel(target string) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending, ok := c.pending[target]
+	if ok {
+		pending.cancel()
+		delete(c.pending, target)
+	}
+	return ok
+}
+
+func (c *canaryScaleIns) cancelAll() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for target, pending := range c.pending {
+		pending.cancel()
+		delete(c.pending, target)
+	}
+}
+
+func (c *canaryScaleIns) annotate(target string, meta map[string]string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pending, ok := c.pending[target]; ok {
+		meta[metaKeyCanaryPending] = fmt.Sprintf("%d at %s", pending.count, pending.due.UTC().Format(time.RFC3339))
+	}
+}
+
+// scheduleCanaryRemainder schedules the scale in of the target down to the
+// count of the action, after the canary delay.
+func (t *TargetPlugin) scheduleCanaryRemainder(action sdk.ScalingAction, config map[string]string, canary *scaleInCanary, remaining int64, log hclog.Logger) {
+	log.Info("canary scale in, deferring the rest", "remaining", remaining, "delay", canary.delay)
+	t.canaries.schedule(targetKey(config), action, config, remaining, canary.delay, func(ctx context.Context, action sdk.ScalingAction, config map[string]string) {
+		t.runCanaryRemainder(ctx, action, config, t.logger.With("task", "canary_scale_in", "target", targetKey(config)))
+	})
+}
+
+// runCanaryRemainder completes a canary scale in when the pool is still ready
+// and no allocations are waiting for capacity. Otherwise the rest is dropped,
+// the strategy sizes the target again on its next evaluation.
+func (t *TargetPlugin) runCanaryRemainder(ctx context.Context, action sdk.ScalingAction, config map[string]string, log hclog.Logger) {
+	if t.shutdownState.stopping.Load() {
+		return
+	}
+	if err := t.verifyCanary(config); err != nil {
+		log.Warn("canary scale in not verified, dropping the rest", "error", err)
+		return
+	}
+
+	event := newScaleEvent(action, config)
+	keys, err := t.targetVMSSKeys(config)
+	if err != nil {
+		log.Warn("failed to complete canary scale in", "error", err)
+		return
+	}
+	release, err := t.scaleLocks.tryAcquire(keys, event.OperationID)
+	if err != nil {
+		log.Warn("skipping rest of canary scale in", "error", err)
+		return
+	}
+	defer release()
+	log.Info("canary scale in verified, removing the rest", "operation_id", event.OperationID, "desired_count", action.Count)
+	_ = t.runScale(ctx, action, config, event)
+}
+
+// verifyCanary returns why the pool did not absorb the first step of a canary
+// scale in: it is not ready, or evaluations are blocked on capacity.
+func (t *TargetPlugin) verifyCanary(config map[string]string) error {
+	status, err := t.Status(config)
+	if err != nil {
+		return fmt.Errorf("failed to read target status: %v", err)
+	}
+	if !status.Ready {
+		return fmt.Errorf("target is not ready")
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+	evals, _, err := cluster.client.Evaluations().List(&api.QueryOptions{Filter: `Status == "blocked"`})
+	if err != nil {
+		return fmt.Errorf("failed to list blocked evaluations: %v", err)
+	}
+	if len(evals) > 0 {
+		return fmt.Errorf("%d evaluations are blocked on capacity", len(evals))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chatWebhooks are the incoming webhook URLs of one chat service. Failures
+// go to the failure webhook when set, otherwise to the regular one.
+type chatWebhooks struct {
+	success string
+	failure string
+}
+
+func (w chatWebhooks) target(failed bool) string {
+	if failed && w.failure != "" {
+		return w.failure
+	}
+	return w.success
+}
+
+type chatConfig struct {
+	slack chatWebhooks
+	teams chatWebhooks
+}
+
+func parseChatConfig(config map[string]string) (*chatConfig, error) {
+	cfg := &chatConfig{}
+	for key, dest := range map[string]*string{
+		configKeySlackWebhook:        &cfg.slack.success,
+		configKeySlackFailureWebhook: &cfg.slack.failure,
+		configKeyTeamsWebhook:        &cfg.teams.success,
+		configKeyTeamsFailureWebhook: &cfg.teams.failure,
+	} {
+		if value, ok := config[key]; ok && value != "" {
+			if _, err := url.ParseRequestURI(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			*dest = value
+		}
+	}
+	if cfg.slack == (chatWebhooks{}) && cfg.teams == (chatWebhooks{}) {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// chatNotifier posts a one line summary of every scale event that changed, or
+// failed to change, capacity to Slack and/or Microsoft Teams. Both accept the
+// same minimal {"text": ...} payload on their incoming webhooks.
+type chatNotifier struct {
+	cfg    *chatConfig
+	client *http.Client
+}
+
+func newChatNotifier(cfg *chatConfig) *chatNotifier {
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = defaultWebhookTimeout
+	return &chatNotifier{cfg: cfg, client: client}
+}
+
+func (c *chatNotifier) notify(event *scaleEvent, log hclog.Logger) {
+	message, failed, ok := chatMessage(event)
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		log.Warn("failed to encode chat notification", "error", err)
+		return
+	}
+
+	for service, webhooks := range map[string]chatWebhooks{"slack": c.cfg.slack, "teams": c.cfg.teams} {
+		target := webhooks.target(failed)
+		if target == "" {
+			continue
+		}
+		go func(service, target string) {
+			if err := postWebhook(c.client, target, payload, nil); err != nil {
+				log.Warn("failed to deliver chat notification", "service", service, "error", err)
+			}
+		}(service, target)
+	}
+}
+
+// chatMessage renders an event as, for example, "scaled pool web from 12→18
+// across vmss-a/vmss-b in 94s". Events which did not attempt a change are not
+// reported.
+func chatMessage(event *scaleEvent) (string, bool, bool) {
+	event.lock.Lock()
+	defer event.lock.Unlock()
+
+	if event.Result == "noop" {
+		return "", false, false
+	}
+
+	pool := event.Pool
+	if pool == "" {
+		pool = event.Target
+	}
+	sets := make([]string, 0, len(event.Deltas))
+	for vmScaleSet := range event.Deltas {
+		sets = append(sets, vmScaleSet)
+	}
+	sort.Strings(sets)
+
+	summary := fmt.Sprintf("pool %s from %d→%d across %s in %s",
+		pool, event.Current, event.Desired, strings.Join(sets, "/"),
+		(time.Duration(event.DurationMs) * time.Millisecond).Round(time.Second))
+	if event.Error != "" {
+		return fmt.Sprintf("failed to scale %s: %s", summary, event.Error), true, true
+	}
+	return "scaled " + summary, false, true
+}
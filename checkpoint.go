@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpointDirectionCleanup is the direction of the checkpoint a scale in
+// leaves behind when deleting some of its instances or its post scale in
+// tasks failed. Its sets hold the instances still to delete with their
+// nodes, and the nodes of deleted instances still to clean up.
+const checkpointDirectionCleanup = "cleanup"
+
+// operationCheckpoint is the persisted state of a scale operation. A scale in
+// is checkpointed once its nodes are drained, since from then on an
+// interruption leaves drained nodes on instances which are still running.
+type operationCheckpoint struct {
+	OperationID string               `json:"operation_id"`
+	Target      string               `json:"target"`
+	Direction   string               `json:"direction"`
+	Started     time.Time            `json:"started"`
+	Config      map[string]string    `json:"config"`
+	Sets        []checkpointScaleSet `json:"sets,omitempty"`
+}
+
+type checkpointScaleSet struct {
+	ResourceGroup string                      `json:"resource_group"`
+	VMScaleSet    string                      `json:"vm_scale_set"`
+	InstanceIDs   []string                    `json:"instance_ids"`
+	Nodes         []scaleutils.NodeResourceID `json:"nodes"`
+}
+
+// operationStore keeps the checkpoints of the running scale operations in a
+// local file, rewritten atomically on every change. A store without a path
+// keeps them in memory only, and a nil store keeps nothing.
+type operationStore struct {
+	lock        sync.Mutex
+	path        string
+	checkpoints map[string]*operationCheckpoint
+	resuming    map[string]bool
+}
+
+func newMemoryOperationStore() *operationStore {
+	return &operationStore{checkpoints: make(map[string]*operationCheckpoint), resuming: make(map[string]bool)}
+}
+
+// persistent reports whether the checkpoints outlive the plugin process.
+func (s *operationStore) persistent() bool {
+	return s != nil && s.path != ""
+}
+
+func newOperationStore(path string) (*operationStore, error) {
+	s := newMemoryOperationStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operation state %s: %v", path, err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.checkpoints); err != nil {
+			return nil, fmt.Errorf("failed to decode operation state %s: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *operationStore) save(checkpoint *operationCheckpoint) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checkpoints[checkpoint.OperationID] = checkpoint
+	return s.writeLocked()
+}
+
+func (s *operationStore) remove(operationID string) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.checkpoints[operationID]; !ok {
+		return nil
+	}
+	delete(s.checkpoints, operationID)
+	return s.writeLocked()
+}
+
+func (s *operationStore) list() []*operationCheckpoint {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	checkpoints := make([]*operationCheckpoint, 0, len(s.checkpoints))
+	for _, checkpoint := range s.checkpoints {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints
+}
+
+// claim marks a checkpoint as being resumed, reporting false when it already
+// is, so an operation is not finished twice at once.
+func (s *operationStore) claim(operationID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.resuming[operationID] {
+		return false
+	}
+	s.resuming[operationID] = true
+	return true
+}
+
+func (s *operationStore) release(operationID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.resuming, operationID)
+}
+
+// pendingCleanups returns the cleanup checkpoints of a target.
+func (s *operationStore) pendingCleanups(target string) []*operationCheckpoint {
+	var pending []*operationCheckpoint
+	for _, checkpoint := range s.list() {
+		if checkpoint.Direction == checkpointDirectionCleanup && checkpoint.Target == target {
+			pending = append(pending, checkpoint)
+		}
+	}
+	return pending
+}
+
+func (s *operationStore) writeLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write operation state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write operation state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write operation state: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write operation state: %v", err)
+	}
+	return nil
+}
+
+// checkpoint persists the state of an operation, logging rather than failing
+// the scale when the store cannot be written.
+func (t *TargetPlugin) checkpoint(checkpoint *operationCheckpoint, log hclog.Logger) {
+	if err := t.operations.save(checkpoint); err != nil {
+		log.Warn("failed to checkpoint scale operation", "error", err)
+	}
+}
+
+func (t *TargetPlugin) completeCheckpoint(operationID string, log hclog.Logger) {
+	if err := t.operations.remove(operationID); err != nil {
+		log.Warn("failed to remove scale operation checkpoint", "error", err)
+	}
+}
+
+// deferCleanup turns the checkpoint of a scale in which did not complete into
+// a cleanup checkpoint holding what is left to do, for the next evaluation of
+// the target to finish. A set without instance IDs holds the nodes of deleted
+// instances whose post scale in tasks failed.
+func (t *TargetPlugin) deferCleanup(checkpoint *operationCheckpoint, pending []checkpointScaleSet, log hclog.Logger) {
+	cleanup := *checkpoint
+	cleanup.Direction = checkpointDirectionCleanup
+	cleanup.Sets = pending
+	t.checkpoint(&cleanup, log)
+	log.Warn("scale in did not complete, recorded pending cleanup for the next evaluation", "sets", len(pending))
+}
+
+// cleanupNodes returns the checkpoint set of the nodes of deleted instances,
+// or none when there are none.
+func cleanupNodes(deleted []scaleutils.NodeResourceID) []checkpointScaleSet {
+	if len(deleted) == 0 {
+		return nil
+	}
+	return []checkpointScaleSet{{Nodes: deleted}}
+}
+
+// resumeCleanups finishes, in the background, the pending cleanups of a
+// target which are not being finished already. A standby leaves them to the
+// leader.
+func (t *TargetPlugin) resumeCleanups(target string) {
+	if !t.leader.isLeader() {
+		return
+	}
+	store := t.operations
+	for _, checkpoint := range store.pendingCleanups(target) {
+		if !store.claim(checkpoint.OperationID) {
+			continue
+		}
+		go func(checkpoint *operationCheckpoint) {
+			defer store.release(checkpoint.OperationID)
+			log := t.logger.With("operation_id", checkpoint.OperationID, "target", checkpoint.Target)
+			if err := t.resumeScaleIn(withOperationID(context.Background(), checkpoint.OperationID), checkpoint, log); err != nil {
+				log.Warn("failed to complete pending post scale in cleanup, retrying on the next evaluation", "error", err)
+				return
+			}
+			if err := store.remove(checkpoint.OperationID); err != nil {
+				log.Warn("failed to remove scale operation checkpoint", "error", err)
+			}
+			log.Info("completed pending post scale in cleanup")
+		}(checkpoint)
+	}
+}
+
+// resumeOperations finishes the scale operations an earlier run of the plugin
+// was interrupted in. Drained instances which still exist are deleted and
+// their nodes handed to the post scale in tasks, as the interrupted operation
+// would have done. A standby resumes them once it holds the leader lease.
+func (t *TargetPlugin) resumeOperations(ctx context.Context, store *operationStore) {
+	if !t.leader.wait(ctx) {
+		return
+	}
+	running := t.inFlight.list()
+	for _, checkpoint := range store.list() {
+		if _, ok := running[checkpoint.OperationID]; ok {
+			continue
+		}
+		log := t.logger.With("operation_id", checkpoint.OperationID, "target", checkpoint.Target)
+		if checkpoint.Direction == checkpointDirectionCleanup {
+			// Left for the next evaluation of the target.
+			continue
+		}
+		if checkpoint.Direction != "in" {
+			log.Info("discarding checkpoint of interrupted scale operation", "direction", checkpoint.Direction)
+			t.completeCheckpoint(checkpoint.OperationID, log)
+			continue
+		}
+
+		log.Warn("resuming interrupted scale in", "started", checkpoint.Started)
+		if err := t.resumeScaleIn(withOperationID(ctx, checkpoint.OperationID), checkpoint, log); err != nil {
+			log.Error("failed to resume interrupted scale in, retrying on the next evaluation", "error", err)
+			continue
+		}
+		t.completeCheckpoint(checkpoint.OperationID, log)
+		log.Info("resumed interrupted scale in")
+	}
+}
+
+func (t *TargetPlugin) resumeScaleIn(ctx context.Context, checkpoint *operationCheckpoint, log hclog.Logger) error {
+	_, vmScaleSetList, err := t.parseVMSSList(checkpoint.Config)
+	if err != nil {
+		return err
+	}
+	filters, err := parseNodeFilters(checkpoint.Config, vmScaleSetList)
+	if err != nil {
+		return err
+	}
+	t.targets.observe(checkpoint.Config)
+	cluster, err := t.clusterFor(checkpoint.Config)
+	if err != nil {
+		return err
+	}
+	utils, err := cluster.operationUtils(checkpoint.OperationID, log)
+	if err != nil {
+		return err
+	}
+	scaleInConfig, err := t.scaleInConfig(poolConfig(checkpoint.Config, filters))
+	if err != nil {
+		return fmt.Errorf("failed to build node drain config: %v", err)
+	}
+
+	// Sets whose instances could not be deleted are kept with their nodes,
+	// and re-recorded with whatever else is left, so drained nodes are never
+	// forgotten while their instances still run.
+	var result *multierror.Error
+	var failed []checkpointScaleSet
+	var deletedIDs []scaleutils.NodeResourceID
+	for _, set := range checkpoint.Sets {
+		if len(set.InstanceIDs) == 0 {
+			// A cleanup checkpoint, the instances are gone already.
+			deletedIDs = append(deletedIDs, set.Nodes...)
+			continue
+		}
+		if err := t.resumeSetScaleIn(ctx, set, log); err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s/%s: %w", set.ResourceGroup, set.VMScaleSet, err))
+			failed = append(failed, set)
+			continue
+		}
+		deletedIDs = append(deletedIDs, set.Nodes...)
+	}
+
+	pending := failed
+	if err := utils.RunPostScaleInTasks(ctx, scaleInConfig, deletedIDs); err != nil {
+		result = multierror.Append(result, fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err))
+		pending = append(pending, cleanupNodes(deletedIDs)...)
+	}
+	if result.ErrorOrNil() != nil && len(pending) > 0 {
+		t.deferCleanup(checkpoint, pending, log)
+	}
+	return result.ErrorOrNil()
+}
+
+// resumeSetScaleIn deletes the drained instances of the set which still
+// exist. It holds the scale lock of the set as a scale operation does, and a
+// set busy with another operation is left for the next attempt. The desired
+// capacity is lowered as the interrupted operation would have, so the self
+// heal does not grow the set back.
+func (t *TargetPlugin) resumeSetScaleIn(ctx context.Context, set checkpointScaleSet, log hclog.Logger) error {
+	release, err := t.scaleLocks.tryAcquire([]string{vmssKey(set.ResourceGroup, set.VMScaleSet)}, operationID(ctx))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	azure := t.azureFor(set.ResourceGroup, set.VMScaleSet)
+	instances, err := azure.listInstances(ctx, set.ResourceGroup, set.VMScaleSet)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		existing[instance.instanceID] = true
+	}
+	var remaining []string
+	for _, instanceID := range set.InstanceIDs {
+		if existing[instanceID] {
+			remaining = append(remaining, instanceID)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	capacity, err := azure.getCapacity(ctx, set.ResourceGroup, set.VMScaleSet)
+	if err != nil {
+		return err
+	}
+
+	log.Info("deleting drained Azure ScaleSet instances", "vmss_name", set.VMScaleSet, "instances", remaining)
+	if err := azure.scaleIn(ctx, set.ResourceGroup, set.VMScaleSet, remaining, log); err != nil {
+		return err
+	}
+	t.desired.set(set.ResourceGroup, set.VMScaleSet, capacity-int64(len(remaining)))
+	t.statusCache.invalidate(set.ResourceGroup, set.VMScaleSet)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"io"
+	"os"
+	"strings"
+)
+
+// configFlags collects repeated -config key=value flags.
+type configFlags map[string]string
+
+func (c configFlags) String() string {
+	pairs := make([]string, 0, len(c))
+	for key, value := range c {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (c configFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("%q must be key=value", value)
+	}
+	c[key] = val
+	return nil
+}
+
+// runCommand handles the command line modes of the plugin binary and returns
+// the exit code. Without arguments the binary serves the plugin instead, and
+// with apm the companion APM plugin.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "plan" {
+		return runPlan(args[1:], stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet(pluginName, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	showVersion := flags.Bool("version", false, "print the plugin version and supported config keys and exit")
+	validate := flags.Bool("validate-config", false, "validate a plugin and target config and exit")
+	checkAzure := flags.Bool("check-azure", false, "with -validate-config, also check read-only that Azure authentication works and every scale set exists")
+	configFile, config := addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *showVersion {
+		printVersion(stdout)
+		return 0
+	}
+	if !*validate {
+		fmt.Fprintln(stderr, "no command given, run with -version, -validate-config, plan or apm")
+		flags.Usage()
+		return 2
+	}
+	merged, err := loadCommandConfig(*configFile, config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := validateCommandConfig(context.Background(), merged, *checkAzure, stdout); err != nil {
+		fmt.Fprintf(stderr, "config is invalid: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "config is valid")
+	return 0
+}
+
+func addConfigFlags(flags *flag.FlagSet) (*string, configFlags) {
+	configFile := flags.String("config-file", "", "JSON file holding the config map")
+	config := make(configFlags)
+	flags.Var(config, "config", "config `key=value`, may be repeated and overrides -config-file")
+	return configFile, config
+}
+
+// newCommandPlugin builds a plugin for the command line modes. Unlike
+// SetConfig it starts no background work and takes no HA lock.
+func newCommandPlugin(config map[string]string) (*TargetPlugin, error) {
+	t := &TargetPlugin{
+		logger:      hclog.NewNullLogger(),
+		authorizers: newAuthorizerCache(),
+		targets:     newTargetRegistry(),
+		nodeTags:    newNodeTagIndex(),
+		clusters:    newClusterCache(),
+		discovery:   newScaleSetDiscovery(),
+	}
+	t.AzureController = &AzureController{logger: t.logger}
+	if err := t.AzureController.init(config, t.authorizers); err != nil {
+		return nil, err
+	}
+	scaleInDefaults, err := parseScaleInDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+	t.scaleInDefaults = scaleInDefaults
+	if t.targetGroups, err = parseTargetGroups(config); err != nil {
+		return nil, err
+	}
+	if t.nomadRetry, err = parseNomadRetry(config); err != nil {
+		return nil, err
+	}
+	t.nomadConfig = nomadConfigKeys(config)
+	if t.cluster, err = t.newNomadCluster(t.nomadConfig); err != nil {
+		return nil, err
+	}
+	resolved, err := t.resolveTargetGroup(config)
+	if err != nil {
+		return nil, err
+	}
+	t.targets.observe(resolved)
+	return t, nil
+}
+
+// loadCommandConfig reads the config file, if any, and applies the -config
+// flags on top.
+func loadCommandConfig(path string, overrides map[string]string) (map[string]string, error) {
+	config := make(map[string]string)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to decode config file %s, it must be a JSON object of strings: %v", path, err)
+		}
+	}
+	for key, value := range overrides {
+		config[key] = value
+	}
+	return config, nil
+}
+
+// validateCommandConfig runs the SetConfig validation and, when asked, reads
+// every member scale set to prove the credentials and names are right.
+func validateCommandConfig(ctx context.Context, config map[string]string, checkAzure bool, out io.Writer) error {
+	if err := validatePluginConfig(config); err != nil {
+		return err
+	}
+	if !checkAzure {
+		return nil
+	}
+
+	t, err := newCommandPlugin(config)
+	if err != nil {
+		return err
+	}
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	for _, member := range members {
+		capacity, err := t.azureFor(member.resourceGroup, member.vmScaleSet).getCapacity(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s/%s: %w", member.resourceGroup, member.vmScaleSet, err))
+			continue
+		}
+		fmt.Fprintf(out, "%s/%s: found, capacity %d\n", member.resourceGroup, member.vmScaleSet, capacity)
+	}
+	return result.ErrorOrNil()
+}
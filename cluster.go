@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// nomadConfigKeyPrefix is the prefix shared by every Nomad connection option
+// understood by nomad.ConfigFromNamespacedMap.
+const nomadConfigKeyPrefix = "nomad_"
+
+// nomadCluster bundles the Nomad API client and the cluster scale utils used
+// to talk to a single Nomad cluster.
+type nomadCluster struct {
+	client   *api.Client
+	utils    *scaleutils.ClusterScaleUtils
+	config   map[string]string
+	lookup   scaleutils.ClusterNodeIDLookupFunc
+	retry    nomadRetry
+	identity nodeIdentity
+}
+
+func (t *TargetPlugin) newNomadCluster(config map[string]string) (*nomadCluster, error) {
+	utils, err := scaleutils.NewClusterScaleUtils(nomad.ConfigFromNamespacedMap(config), t.logger)
+	if err != nil {
+		return nil, err
+	}
+	utils.ClusterNodeIDLookupFunc = t.nodeIDMap
+
+	client, err := api.NewClient(nomad.ConfigFromNamespacedMap(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate Nomad client: %v", err)
+	}
+	return &nomadCluster{client: client, utils: utils, config: config, lookup: t.nodeIDMap, retry: t.nomadRetry, identity: t.nodeIdentity}, nil
+}
+
+// operationUtils returns cluster scale utils whose Nomad requests carry the
+// given operation ID header, so drains can be tied back to the scale operation
+// that issued them. The pre and post scale in tasks are retried when the Nomad
+// API fails transiently.
+func (c *nomadCluster) operationUtils(operationID string, logger hclog.Logger) (*retryingScaleUtils, error) {
+	cfg := nomad.ConfigFromNamespacedMap(c.config)
+	cfg.Headers = http.Header{headerOperationID: []string{operationID}}
+	utils, err := scaleutils.NewClusterScaleUtils(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	utils.ClusterNodeIDLookupFunc = c.lookup
+	return &retryingScaleUtils{ClusterScaleUtils: utils, retry: c.retry, identity: c.identity, log: logger}, nil
+}
+
+// clusterCache holds the Nomad clusters built from per-target connection
+// overrides, keyed by the overrides themselves.
+type clusterCache struct {
+	lock     sync.Mutex
+	clusters map[string]*nomadCluster
+}
+
+func newClusterCache() *clusterCache {
+	return &clusterCache{clusters: make(map[string]*nomadCluster)}
+}
+
+// clusterFor returns the Nomad cluster a target talks to. Targets without
+// nomad_* options use the plugin-level connection; otherwise the target
+// options are layered over the plugin-level ones so only the differing
+// settings, such as the address or ACL token, need to be set per policy.
+func (t *TargetPlugin) clusterFor(config map[string]string) (*nomadCluster, error) {
+	var keys []string
+	for key := range config {
+		if strings.HasPrefix(key, nomadConfigKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return t.cluster, nil
+	}
+	sort.Strings(keys)
+
+	var id strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&id, "%s=%s\n", key, config[key])
+	}
+
+	t.clusters.lock.Lock()
+	defer t.clusters.lock.Unlock()
+	if cluster, ok := t.clusters.clusters[id.String()]; ok {
+		return cluster, nil
+	}
+
+	merged := make(map[string]string)
+	for key, value := range t.nomadConfig {
+		merged[key] = value
+	}
+	for _, key := range keys {
+		merged[key] = config[key]
+	}
+
+	cluster, err := t.newNomadCluster(merged)
+	if err != nil {
+		return nil, err
+	}
+	t.clusters.clusters[id.String()] = cluster
+	return cluster, nil
+}
+
+func nomadConfigKeys(config map[string]string) map[string]string {
+	nomadConfig := make(map[string]string)
+	for key, value := range config {
+		if strings.HasPrefix(key, nomadConfigKeyPrefix) {
+			nomadConfig[key] = value
+		}
+	}
+	return nomadConfig
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
+	"github.com/hashicorp/nomad/api"
+	"time"
+)
+
+const defaultConfigVariableInterval = 5 * time.Minute
+
+// configVariable reads plugin config, such as the client secret, from a Nomad
+// Variable so it lives in Nomad's encrypted store rather than the autoscaler
+// config. The variable is read again every interval and the config applied
+// anew when it changed.
+type configVariable struct {
+	path     string
+	interval time.Duration
+}
+
+func parseConfigVariable(config map[string]string) (*configVariable, error) {
+	path, ok := config[configKeyConfigVariable]
+	if !ok || path == "" {
+		return nil, nil
+	}
+	cfg := &configVariable{path: path, interval: defaultConfigVariableInterval}
+	if value, ok := config[configKeyConfigVariableInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyConfigVariableInterval, value)
+		}
+		cfg.interval = interval
+	}
+	return cfg, nil
+}
+
+// readConfigVariable reads the variable with the Nomad connection of the
+// plugin config. Unlike the scale event variable, a missing one is an error.
+func readConfigVariable(config map[string]string, cfg *configVariable) (*nomadVariable, error) {
+	client, err := api.NewClient(nomad.ConfigFromNamespacedMap(nomadConfigKeys(config)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate Nomad client: %v", err)
+	}
+	var variable nomadVariable
+	if _, err := client.Raw().Query("/v1/var/"+cfg.path, &variable, nil); err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %v", configKeyConfigVariable, cfg.path, err)
+	}
+	return &variable, nil
+}
+
+// applyConfigVariable returns the config with the items of the variable
+// layered over it. The variable cannot point the plugin at another one.
+func applyConfigVariable(config map[string]string, variable *nomadVariable) (map[string]string, error) {
+	merged := make(map[string]string, len(config)+len(variable.Items))
+	for key, value := range config {
+		merged[key] = value
+	}
+	for key, value := range variable.Items {
+		if key == configKeyConfigVariable || key == configKeyConfigVariableInterval {
+			return nil, fmt.Errorf("%s cannot be set from the config variable %s", key, variable.Path)
+		}
+		merged[key] = value
+	}
+	return merged, nil
+}
+
+// runConfigVariableWatcher reads the config variable every interval and sets
+// the plugin config again, from the config the autoscaler gave, when the
+// variable changed since index.
+func (t *TargetPlugin) runConfigVariableWatcher(ctx context.Context, config map[string]string, cfg *configVariable, index uint64) {
+	log := t.logger.With("task", "config_variable", "path", cfg.path)
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			variable, err := readConfigVariable(config, cfg)
+			if err != nil {
+				log.Warn("failed to read config variable, keeping the current config", "error", err)
+				continue
+			}
+			if variable.ModifyIndex == index {
+				continue
+			}
+			if t.reloadConfig(ctx, config, log) {
+				return
+			}
+		}
+	}
+}
+
+// reloadConfig sets the config again unless the autoscaler set a newer one
+// since ctx was started. It reports whether the config was set, which stops
+// the background tasks of the previous one.
+func (t *TargetPlugin) reloadConfig(ctx context.Context, config map[string]string, log hclog.Logger) bool {
+	t.configLock.Lock()
+	defer t.configLock.Unlock()
+	if ctx.Err() != nil {
+		return true
+	}
+	if err := t.setConfig(config); err != nil {
+		log.Error("failed to apply the changed config variable, keeping the current config", "error", err)
+		return false
+	}
+	log.Info("applied the changed config variable")
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+const (
+	capacityConflictReplan = "replan"
+	capacityConflictAbort  = "abort"
+	capacityConflictIgnore = "ignore"
+
+	defaultCapacityConflictRetries = 1
+)
+
+// capacityConflict is what a scale does when a member set changed between
+// the read its plan is based on and the capacity update: plan again from
+// fresh reads up to retries times, abort with a conflict error, or ignore it
+// and apply the planned capacity regardless.
+type capacityConflict struct {
+	action  string
+	retries int
+}
+
+func parseCapacityConflict(config map[string]string) (capacityConflict, error) {
+	conflict := capacityConflict{action: capacityConflictReplan, retries: defaultCapacityConflictRetries}
+	if value, ok := config[configKeyCapacityConflictAction]; ok {
+		switch value {
+		case capacityConflictReplan, capacityConflictAbort, capacityConflictIgnore:
+			conflict.action = value
+		default:
+			return conflict, fmt.Errorf("invalid %s %q, must be %q, %q or %q", configKeyCapacityConflictAction,
+				value, capacityConflictReplan, capacityConflictAbort, capacityConflictIgnore)
+		}
+	}
+	if value, ok := config[configKeyCapacityConflictRetries]; ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return conflict, fmt.Errorf("invalid %s %q, must be a non-negative integer", configKeyCapacityConflictRetries, value)
+		}
+		conflict.retries = retries
+	}
+	return conflict, nil
+}
+
+// expectedCapacity is the capacity a set must still have for its planned
+// capacity to be applied, or -1 when the update is unconditional.
+func (c capacityConflict) expectedCapacity(read int64) int64 {
+	if c.action == capacityConflictIgnore {
+		return -1
+	}
+	return read
+}
+
+// capacityChangedError reports a set found at another capacity than the one
+// its plan is based on. It is a conflict, like a rejected conditional update.
+func capacityChangedError(ctx context.Context, resourceGroup, vmScaleSet string, read, current int64) error {
+	return &azureError{
+		op:          "refusing to update the vmss capacity",
+		kind:        azureErrorConflict,
+		operationID: operationID(ctx),
+		err:         fmt.Errorf("capacity of %s/%s changed from %d to %d since it was read", resourceGroup, vmScaleSet, read, current),
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+)
+
+// newConsulClient returns a Consul client when service deregistration is
+// enabled, and nil otherwise. Unset connection options fall back to the usual
+// CONSUL_HTTP_* environment variables.
+func newConsulClient(config map[string]string) (*consul.Client, error) {
+	enabledStr, ok := config[configKeyConsulDeregister]
+	if !ok {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", configKeyConsulDeregister, enabledStr, err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	cfg := consul.DefaultConfig()
+	if value, ok := config[configKeyConsulAddress]; ok {
+		cfg.Address = value
+	}
+	if value, ok := config[configKeyConsulToken]; ok {
+		cfg.Token = value
+	}
+	if value, ok := config[configKeyConsulDatacenter]; ok {
+		cfg.Datacenter = value
+	}
+
+	client, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate Consul client: %v", err)
+	}
+	return client, nil
+}
+
+// deregisterConsulNodes removes the drained nodes, and with them all of their
+// services, from the Consul catalog so the entries do not linger once the VMs
+// are deleted. Failures are logged but never block the deletion.
+func (t *TargetPlugin) deregisterConsulNodes(client *api.Client, ids []scaleutils.NodeResourceID, log hclog.Logger) {
+	if t.consul == nil {
+		return
+	}
+
+	for _, id := range ids {
+		node, _, err := client.Nodes().Info(id.NomadNodeID, nil)
+		if err != nil {
+			log.Warn("failed to read Nomad node for Consul deregistration", "node_id", id.NomadNodeID, "error", err)
+			continue
+		}
+
+		if _, err := t.consul.Catalog().Deregister(&consul.CatalogDeregistration{Node: node.Name}, nil); err != nil {
+			log.Warn("failed to deregister node from Consul", "node_id", node.ID, "consul_node", node.Name, "error", err)
+			continue
+		}
+		log.Info("deregistered node from Consul", "node_id", node.ID, "consul_node", node.Name)
+	}
+}
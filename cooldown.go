@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scaleCooldowns are the minimum times between completed operations of the
+// same direction on a member set. They are enforced by the plugin, so they
+// hold even when several policies or external triggers scale the same sets.
+type scaleCooldowns struct {
+	in  time.Duration
+	out time.Duration
+}
+
+func parseScaleCooldowns(config map[string]string) (scaleCooldowns, error) {
+	var cooldowns scaleCooldowns
+	for key, cooldown := range map[string]*time.Duration{
+		configKeyScaleInCooldown:  &cooldowns.in,
+		configKeyScaleOutCooldown: &cooldowns.out,
+	} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return scaleCooldowns{}, fmt.Errorf("invalid %s %q", key, value)
+		}
+		*cooldown = duration
+	}
+	return cooldowns, nil
+}
+
+// cooldownTracker remembers when each scale set last completed a scale in
+// and a scale out. A nil tracker records nothing and reports no cooldown.
+type cooldownTracker struct {
+	lock sync.Mutex
+	last map[string]map[string]time.Time
+}
+
+func newCooldownTracker() *cooldownTracker {
+	return &cooldownTracker{last: make(map[string]map[string]time.Time)}
+}
+
+func (c *cooldownTracker) record(resourceGroup, vmScaleSet, direction string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	if c.last[key] == nil {
+		c.last[key] = make(map[string]time.Time)
+	}
+	c.last[key][direction] = time.Now()
+}
+
+// remaining returns how long the set is still cooling down in direction.
+func (c *cooldownTracker) remaining(resourceGroup, vmScaleSet, direction string, cooldowns scaleCooldowns) time.Duration {
+	if c == nil {
+		return 0
+	}
+	cooldown := cooldowns.out
+	if direction == "in" {
+		cooldown = cooldowns.in
+	}
+	if cooldown == 0 {
+		return 0
+	}
+	c.lock.Lock()
+	last, ok := c.last[vmssKey(resourceGroup, vmScaleSet)][direction]
+	c.lock.Unlock()
+	if !ok {
+		return 0
+	}
+	return max(cooldown-time.Since(last), 0)
+}
+
+// annotate writes when the plugin last scaled the set out and in to Status
+// meta, in the unix nanoseconds of the last event, and returns the later of
+// the two or 0.
+func (c *cooldownTracker) annotate(resourceGroup, vmScaleSet string, meta map[string]string) int64 {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var latest int64
+	for direction, last := range c.last[vmssKey(resourceGroup, vmScaleSet)] {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "last_scale_"+direction)] = strconv.FormatInt(last.UnixNano(), 10)
+		latest = max(latest, last.UnixNano())
+	}
+	return latest
+}
+
+// applyCooldowns keeps member sets which are cooling down in direction out of
+// the operation, as if they only scaled the other way.
+func (t *TargetPlugin) applyCooldowns(members []scaleSetTarget, direction string, cooldowns scaleCooldowns) []string {
+	var cooling []string
+	for idx, member := range members {
+		wait := t.cooldowns.remaining(member.resourceGroup, member.vmScaleSet, direction, cooldowns)
+		if wait <= 0 {
+			continue
+		}
+		cooling = append(cooling, fmt.Sprintf("%s (%s)", member.vmScaleSet, wait.Round(time.Second)))
+		if direction == "out" {
+			members[idx].direction = "in"
+		} else {
+			members[idx].direction = "out"
+		}
+	}
+	return cooling
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// secretFileCheckInterval is how often the secret file is checked for a
+// rotated secret.
+const secretFileCheckInterval = 30 * time.Second
+
+// secretSource is where the client secret of the plugin credentials comes
+// from: a file, read again on every reload so a rotated secret is picked up,
+// or the config and environment.
+type secretSource struct {
+	file  string
+	value string
+}
+
+func newSecretSource(config map[string]string) secretSource {
+	if path := config[configKeySecretKeyFile]; path != "" {
+		return secretSource{file: path}
+	}
+	return secretSource{value: argsOrEnv(config, configKeySecretKey, "ARM_CLIENT_SECRET")}
+}
+
+func (s secretSource) read() (string, error) {
+	if s.file == "" {
+		return s.value, nil
+	}
+	secret, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", configKeySecretKeyFile, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// reloadableAuthorizer authorizes requests with an authorizer that can be
+// rebuilt, after the client secret was rotated, without touching the clients
+// it was handed to.
+type reloadableAuthorizer struct {
+	tenantID string
+	clientID string
+	secret   secretSource
+	resource string
+
+	lock    sync.RWMutex
+	current autorest.Authorizer
+}
+
+func newReloadableAuthorizer(tenantID, clientID string, secret secretSource, resource string) (*reloadableAuthorizer, error) {
+	a := &reloadableAuthorizer{tenantID: tenantID, clientID: clientID, secret: secret, resource: resource}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload builds the authorizer anew from the current secret. On failure the
+// previous one is kept.
+func (a *reloadableAuthorizer) reload() error {
+	secretKey, err := a.secret.read()
+	if err != nil {
+		return err
+	}
+	authorizer, err := buildAuthorizer(a.tenantID, a.clientID, secretKey, a.resource)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.current = authorizer
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *reloadableAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			a.lock.RLock()
+			current := a.current
+			a.lock.RUnlock()
+			return current.WithAuthorization()(p).Prepare(r)
+		})
+	}
+}
+
+// reload rebuilds every authorizer in the cache and returns the failures,
+// which keep their previous authorizer.
+func (c *authorizerCache) reload() []error {
+	c.lock.Lock()
+	entries := make([]*reloadableAuthorizer, 0, len(c.entries))
+	for _, authorizer := range c.entries {
+		entries = append(entries, authorizer)
+	}
+	c.lock.Unlock()
+
+	var errs []error
+	for _, authorizer := range entries {
+		if err := authorizer.reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// runCredentialReloader rebuilds the Azure authorizers when the plugin
+// process receives SIGHUP, or when the secret file changes, so a rotated
+// service principal secret applies without restarting the autoscaler.
+func (t *TargetPlugin) runCredentialReloader(ctx context.Context, secretFile string) {
+	log := t.logger.With("task", "credential_reload")
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	var checks <-chan time.Time
+	var last os.FileInfo
+	if secretFile != "" {
+		ticker := time.NewTicker(secretFileCheckInterval)
+		defer ticker.Stop()
+		checks = ticker.C
+		last, _ = os.Stat(secretFile)
+	}
+
+	for {
+		var reason string
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			reason = "SIGHUP"
+		case <-checks:
+			info, err := os.Stat(secretFile)
+			if err != nil {
+				log.Warn("failed to check secret file", "error", err)
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			reason = "secret file changed"
+		}
+		if errs := t.authorizers.reload(); len(errs) > 0 {
+			log.Error("failed to reload Azure credentials, keeping the previous ones", "reason", reason, "error", errs[0])
+			continue
+		}
+		log.Info("reloaded Azure credentials", "reason", reason)
+	}
+}
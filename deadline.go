@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDeadlineMargin = 5 * time.Second
+
+var (
+	// actionMetaKeysDeadline are the action meta keys the time the
+	// autoscaler gives up on the evaluation is read from, as RFC 3339 or
+	// unix seconds.
+	actionMetaKeysDeadline = []string{"nomad_autoscaler.deadline", "deadline"}
+
+	// actionMetaKeysTimeout are the action meta keys the time the
+	// autoscaler gives the evaluation is read from, as a duration or
+	// seconds from when the action is received.
+	actionMetaKeysTimeout = []string{"nomad_autoscaler.timeout", "timeout"}
+)
+
+// parseActionDeadline returns the deadline the action carries a hint of,
+// an absolute deadline winning over a timeout.
+func parseActionDeadline(action sdk.ScalingAction, now time.Time) (time.Time, bool, error) {
+	for _, key := range actionMetaKeysDeadline {
+		raw, ok := action.Meta[key]
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(fmt.Sprint(raw))
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			return at, true, nil
+		}
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+		}
+		return time.Time{}, false, fmt.Errorf("invalid %s action meta %q, must be an RFC 3339 time or unix seconds", key, value)
+	}
+	for _, key := range actionMetaKeysTimeout {
+		raw, ok := action.Meta[key]
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(fmt.Sprint(raw))
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			var seconds float64
+			if seconds, err = strconv.ParseFloat(value, 64); err == nil {
+				timeout = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		if err != nil || timeout <= 0 {
+			return time.Time{}, false, fmt.Errorf("invalid %s action meta %q, must be a duration or seconds", key, value)
+		}
+		return now.Add(timeout), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// parseDeadlineMargin returns how long before the evaluation deadline Scale
+// returns, so the autoscaler hears back before it gives up on the action.
+func parseDeadlineMargin(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyDeadlineMargin]
+	if !ok {
+		return defaultDeadlineMargin, nil
+	}
+	margin, err := time.ParseDuration(value)
+	if err != nil || margin < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyDeadlineMargin, value)
+	}
+	return margin, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+func TestParseActionDeadline(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name    string
+		meta    map[string]interface{}
+		want    time.Time
+		ok      bool
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "rfc3339", meta: map[string]interface{}{"nomad_autoscaler.deadline": "2026-01-02T03:05:00Z"}, want: now.Add(55 * time.Second), ok: true},
+		{name: "unix", meta: map[string]interface{}{"deadline": now.Unix() + 10}, want: now.Add(10 * time.Second), ok: true},
+		{name: "timeout duration", meta: map[string]interface{}{"timeout": "30s"}, want: now.Add(30 * time.Second), ok: true},
+		{name: "timeout seconds", meta: map[string]interface{}{"nomad_autoscaler.timeout": 45}, want: now.Add(45 * time.Second), ok: true},
+		{name: "deadline wins", meta: map[string]interface{}{"deadline": now.Unix() + 10, "timeout": "1h"}, want: now.Add(10 * time.Second), ok: true},
+		{name: "invalid deadline", meta: map[string]interface{}{"deadline": "soon"}, wantErr: true},
+		{name: "invalid timeout", meta: map[string]interface{}{"timeout": "-5s"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok, err := parseActionDeadline(sdk.ScalingAction{Meta: c.meta}, now)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %t", err, c.wantErr)
+			}
+			if ok != c.ok || !got.Equal(c.want) {
+				t.Errorf("got %s, %t, want %s, %t", got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestScaleRefusesPassedDeadline(t *testing.T) {
+	plugin := factory(nil).(*TargetPlugin)
+	action := sdk.ScalingAction{Count: 3, Meta: map[string]interface{}{"deadline": time.Now().Add(-time.Minute).Unix()}}
+	err := plugin.Scale(action, map[string]string{configKeyResourceGroupList: "rg", configKeyVMSSList: "vmss"})
+	if err == nil || !strings.Contains(err.Error(), "evaluation deadline") {
+		t.Fatalf("got %v, want the passed evaluation deadline refused", err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// azureCalls tracks the outcome of the most recent Azure requests for the
+// health endpoint. It is fed by instrumentSender.
+var azureCalls = &azureCallTracker{}
+
+type azureCallTracker struct {
+	lock        sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	authFailed  bool
+}
+
+func (a *azureCallTracker) observe(resp *http.Response, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch {
+	case err != nil:
+		a.lastFailure = time.Now()
+		a.lastError = err.Error()
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		a.lastFailure = time.Now()
+		a.lastError = resp.Status
+		a.authFailed = true
+	case resp.StatusCode < http.StatusBadRequest:
+		a.lastSuccess = time.Now()
+		a.authFailed = false
+	}
+}
+
+// inFlightOps records the scale operations currently running, keyed by
+// operation ID.
+type inFlightOps struct {
+	lock sync.Mutex
+	ops  map[string]inFlightOp
+}
+
+type inFlightOp struct {
+	Target  string    `json:"target"`
+	Desired int64     `json:"desired_count"`
+	Started time.Time `json:"started"`
+}
+
+func newInFlightOps() *inFlightOps {
+	return &inFlightOps{ops: make(map[string]inFlightOp)}
+}
+
+func (o *inFlightOps) start(event *scaleEvent) func() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.ops[event.OperationID] = inFlightOp{Target: event.Target, Desired: event.Desired, Started: event.Time}
+	return func() {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		delete(o.ops, event.OperationID)
+	}
+}
+
+func (o *inFlightOps) list() map[string]inFlightOp {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	ops := make(map[string]inFlightOp, len(o.ops))
+	for id, op := range o.ops {
+		ops[id] = op
+	}
+	return ops
+}
+
+// debugStateEvents is how many of the latest scale events the state dump
+// carries.
+const debugStateEvents = 20
+
+// debugState keeps what the state dump reports beyond the trackers the plugin
+// scales with: the latest error of each scale set and the latest scale
+// events, as published.
+type debugState struct {
+	lock   sync.Mutex
+	errors map[string]vmssError
+	events []json.RawMessage
+}
+
+type vmssError struct {
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+	OperationID string    `json:"operation_id,omitempty"`
+}
+
+func newDebugState() *debugState {
+	return &debugState{errors: make(map[string]vmssError)}
+}
+
+// record keeps a published scale event and the errors of the sets it failed
+// on. The operations on sets are keyed by resource group and name in the
+// results of an event, or by name for targets within a single group.
+func (d *debugState) record(event *scaleEvent) {
+	if d == nil {
+		return
+	}
+	encoded, err := event.encode()
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.events = append(d.events, encoded)
+	if len(d.events) > debugStateEvents {
+		d.events = d.events[len(d.events)-debugStateEvents:]
+	}
+	event.lock.Lock()
+	defer event.lock.Unlock()
+	for vmScaleSet, result := range event.Results {
+		if result != "success" {
+			d.errors[strings.ToLower(vmScaleSet)] = vmssError{Error: result, Time: event.Time, OperationID: event.OperationID}
+		}
+	}
+}
+
+func (d *debugState) snapshot() (map[string]vmssError, []json.RawMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	errors := make(map[string]vmssError, len(d.errors))
+	for key, err := range d.errors {
+		errors[key] = err
+	}
+	events := make([]json.RawMessage, len(d.events))
+	copy(events, d.events)
+	return errors, events
+}
+
+func parseDebugListen(config map[string]string) (string, error) {
+	value, ok := config[configKeyDebugListen]
+	if !ok || value == "" {
+		return "", nil
+	}
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", configKeyDebugListen, value, err)
+	}
+	// The endpoints expose internal state and profiling; they are only
+	// served on loopback.
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("invalid %s %q, must be a loopback address", configKeyDebugListen, value)
+	}
+	return value, nil
+}
+
+// newDebugServer serves /healthz, /debug/pprof, /debug/state and /debug/nodes
+// on a localhost listener so a stuck plugin can be inspected in place.
+func (t *TargetPlugin) newDebugServer(address string, logger hclog.Logger) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", t.handleHealth)
+	mux.HandleFunc("/debug/state", t.handleState)
+	mux.HandleFunc("/debug/nodes", t.handleNodeMap)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("debug listener stopped", "error", err)
+		}
+	}()
+	logger.Info("serving debug endpoints", "address", listener.Addr().String())
+	return server, nil
+}
+
+func stopDebugServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+type healthResponse struct {
+	Healthy           bool       `json:"healthy"`
+	AzureAuth         string     `json:"azure_auth"`
+	LastAzureSuccess  *time.Time `json:"last_azure_success,omitempty"`
+	LastAzureFailure  *time.Time `json:"last_azure_failure,omitempty"`
+	LastAzureError    string     `json:"last_azure_error,omitempty"`
+	InFlightOperation int        `json:"in_flight_operations"`
+}
+
+// handleHealth reports unhealthy only when Azure rejected the plugin
+// credentials on the most recent request; transient errors are reported but
+// do not fail the check.
+func (t *TargetPlugin) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	azureCalls.lock.Lock()
+	resp := healthResponse{
+		Healthy:           !azureCalls.authFailed,
+		AzureAuth:         "ok",
+		LastAzureError:    azureCalls.lastError,
+		InFlightOperation: len(t.inFlight.list()),
+	}
+	if azureCalls.authFailed {
+		resp.AzureAuth = "failed"
+	} else if azureCalls.lastSuccess.IsZero() {
+		resp.AzureAuth = "unknown"
+	}
+	if !azureCalls.lastSuccess.IsZero() {
+		lastSuccess := azureCalls.lastSuccess
+		resp.LastAzureSuccess = &lastSuccess
+	}
+	if !azureCalls.lastFailure.IsZero() {
+		lastFailure := azureCalls.lastFailure
+		resp.LastAzureFailure = &lastFailure
+	}
+	azureCalls.lock.Unlock()
+
+	status := http.StatusOK
+	if !resp.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+type stateResponse struct {
+	Targets     []string                 `json:"targets"`
+	Members     map[string][]stateMember `json:"members,omitempty"`
+	Desired     map[string]int64         `json:"desired_capacity"`
+	InFlight    map[string]inFlightOp    `json:"in_flight_operations"`
+	StatusCache map[string]time.Time     `json:"status_cache,omitempty"`
+	Capacities  map[string]stateCapacity `json:"cached_capacities,omitempty"`
+	LastErrors  map[string]vmssError     `json:"last_errors,omitempty"`
+	History     []json.RawMessage        `json:"recent_scale_events,omitempty"`
+}
+
+// stateMember is a member set of a target as parsed from its config.
+type stateMember struct {
+	ResourceGroup string `json:"resource_group"`
+	VMScaleSet    string `json:"vmss"`
+	Subscription  string `json:"subscription,omitempty"`
+	Alias         string `json:"alias,omitempty"`
+	Weight        int64  `json:"weight"`
+	Min           int64  `json:"min,omitempty"`
+	Max           int64  `json:"max,omitempty"`
+	Priority      int    `json:"priority,omitempty"`
+	Direction     string `json:"direction,omitempty"`
+	Paused        bool   `json:"paused,omitempty"`
+	Retiring      bool   `json:"retiring,omitempty"`
+}
+
+// stateCapacity is the capacity of a set as last read by Status.
+type stateCapacity struct {
+	Capacity  *int64    `json:"capacity,omitempty"`
+	Running   *int64    `json:"running,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// state collects the plugin's in-memory view of the targets it manages.
+// Targets discovering their sets are listed without members, as resolving
+// them would call Azure.
+func (t *TargetPlugin) state() stateResponse {
+	resp := stateResponse{
+		Members:  make(map[string][]stateMember),
+		Desired:  t.desired.snapshot(),
+		InFlight: t.inFlight.list(),
+	}
+	for _, config := range t.targets.list() {
+		key := targetKey(config)
+		resp.Targets = append(resp.Targets, key)
+		if isDiscoveryConfig(config) {
+			continue
+		}
+		members, err := parseScaleSetTargets(config)
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			resp.Members[key] = append(resp.Members[key], stateMember{
+				ResourceGroup: member.resourceGroup,
+				VMScaleSet:    member.vmScaleSet,
+				Subscription:  member.subscription,
+				Alias:         member.alias,
+				Weight:        member.weight,
+				Min:           member.min,
+				Max:           member.max,
+				Priority:      member.priority,
+				Direction:     member.direction,
+				Paused:        member.paused,
+				Retiring:      member.retiring,
+			})
+		}
+	}
+	sort.Strings(resp.Targets)
+	if t.statusCache != nil {
+		resp.StatusCache = make(map[string]time.Time)
+		resp.Capacities = make(map[string]stateCapacity)
+		for _, entry := range t.statusCache.list() {
+			key := vmssKey(entry.resourceGroup, entry.vmScaleSet)
+			resp.StatusCache[key] = entry.fetchedAt
+			capacity := stateCapacity{FetchedAt: entry.fetchedAt}
+			if entry.status.err != nil {
+				capacity.Error = entry.status.err.Error()
+			}
+			if sku := entry.status.vmss.Sku; sku != nil && sku.Capacity != nil {
+				capacity.Capacity = sku.Capacity
+			}
+			if entry.status.hasInstances {
+				running := entry.status.runningCount(false)
+				capacity.Running = &running
+			}
+			resp.Capacities[key] = capacity
+		}
+	}
+	if t.debugState != nil {
+		resp.LastErrors, resp.History = t.debugState.snapshot()
+	}
+	return resp
+}
+
+// handleState dumps the plugin's in-memory view of the targets it manages.
+func (t *TargetPlugin) handleState(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, t.state())
+}
+
+// runStateDumper logs the state the /debug/state endpoint serves each time
+// the plugin process receives SIGUSR1, so the state of a plugin running
+// without the debug listener can be captured from its logs.
+func (t *TargetPlugin) runStateDumper(ctx context.Context) {
+	dumps := make(chan os.Signal, 1)
+	signal.Notify(dumps, syscall.SIGUSR1)
+	defer signal.Stop(dumps)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dumps:
+		}
+		state, err := json.Marshal(t.state())
+		if err != nil {
+			t.logger.Error("failed to encode the plugin state", "error", err)
+			continue
+		}
+		t.logger.Info("plugin state", "signal", "SIGUSR1", "state", string(state))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+func TestDebugStateRecord(t *testing.T) {
+	d := newDebugState()
+	for idx := 0; idx < debugStateEvents+5; idx++ {
+		event := newScaleEvent(sdk.ScalingAction{Count: int64(idx)}, map[string]string{configKeyTargets: "rg/vmss-a,rg/vmss-b"})
+		event.setResult("vmss-a", nil)
+		if idx == 3 {
+			event.setResult("VMSS-B", errors.New("quota exceeded"))
+		}
+		event.finish(nil)
+		d.record(event)
+	}
+	errs, events := d.snapshot()
+	if len(events) != debugStateEvents {
+		t.Errorf("got %d events, want %d", len(events), debugStateEvents)
+	}
+	if len(errs) != 1 || errs["vmss-b"].Error != "quota exceeded" {
+		t.Errorf("got errors %v", errs)
+	}
+}
+
+func TestHandleState(t *testing.T) {
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.targets.observe(map[string]string{configKeyTargets: "web=rg/nomad-web"})
+	plugin.debugState.errors["nomad-web"] = vmssError{Error: "throttled"}
+
+	recorder := httptest.NewRecorder()
+	plugin.handleState(recorder, httptest.NewRequest("GET", "/debug/state", nil))
+	var resp stateResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	members := resp.Members["web=rg/nomad-web"]
+	if len(members) != 1 || members[0].Alias != "web" || members[0].VMScaleSet != "nomad-web" {
+		t.Errorf("got members %+v", resp.Members)
+	}
+	if resp.LastErrors["nomad-web"].Error != "throttled" {
+		t.Errorf("got last errors %v", resp.LastErrors)
+	}
+}
+
+func TestNodeMappingsNormalized(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 1)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+	if err := nomad.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	nomad.lock.Lock()
+	for _, node := range nomad.nodes {
+		node.Attributes["unique.platform.azure.name"] = " A_0 "
+	}
+	nomad.lock.Unlock()
+
+	mappings, unmapped, err := plugin.nodeMappings(map[string]string{configKeyTargets: "rg/a", "node_class": "fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unmapped) != 0 || len(mappings) != 1 || mappings[0].RemoteID != "a_0" || mappings[0].InstanceID != "0" {
+		t.Errorf("got mappings %+v and unmapped nodes %v, want a_0 as scale in maps it", mappings, unmapped)
+	}
+}
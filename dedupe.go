@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDuplicateActionWindow = time.Minute
+
+// actionMetaKeysEvalID are the action meta keys an evaluation ID is read from,
+// most specific first.
+var actionMetaKeysEvalID = []string{"nomad_autoscaler.eval_id", "eval_id"}
+
+func parseDuplicateActionWindow(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyDuplicateActionWindow]
+	if !ok {
+		return defaultDuplicateActionWindow, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyDuplicateActionWindow, value)
+	}
+	return window, nil
+}
+
+// actionFingerprint identifies a scaling action of a target by its count,
+// direction and, when the autoscaler supplies one, evaluation ID.
+func actionFingerprint(action sdk.ScalingAction) string {
+	var evalID string
+	for _, key := range actionMetaKeysEvalID {
+		if value, ok := action.Meta[key]; ok {
+			evalID = fmt.Sprint(value)
+			break
+		}
+	}
+	return strings.Join([]string{fmt.Sprint(action.Count), action.Direction.String(), evalID}, "|")
+}
+
+// recentActions remembers the last completed action of each target. An
+// autoscaler retrying an action whose previous attempt completed but reported
+// an error would otherwise scale a second time on a stale count. Only the
+// last action is matched, so scaling back to an earlier count is not taken
+// for a retry. A nil or zero window tracker suppresses nothing.
+type recentActions struct {
+	lock      sync.Mutex
+	window    time.Duration
+	completed map[string]completedAction
+}
+
+type completedAction struct {
+	fingerprint string
+	at          time.Time
+}
+
+func newRecentActions() *recentActions {
+	return &recentActions{window: defaultDuplicateActionWindow, completed: make(map[string]completedAction)}
+}
+
+func (r *recentActions) setWindow(window time.Duration) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.window = window
+}
+
+func (r *recentActions) record(target, fingerprint string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.window == 0 {
+		return
+	}
+	now := time.Now()
+	for key, last := range r.completed {
+		if now.Sub(last.at) > r.window {
+			delete(r.completed, key)
+		}
+	}
+	r.completed[target] = completedAction{fingerprint: fingerprint, at: now}
+}
+
+// duplicate reports whether the last action of the target, completed within
+// the window, is identical.
+func (r *recentActions) duplicate(target, fingerprint string) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	last, ok := r.completed[target]
+	return ok && last.fingerprint == fingerprint && r.window > 0 && time.Since(last.at) <= r.window
+}
+
+// completedInAzure reports whether every Azure operation of the event
+// succeeded, even if the scale as a whole reported an error afterwards.
+func (e *scaleEvent) completedInAzure() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.Results) == 0 {
+		return false
+	}
+	for _, result := range e.Results {
+		if result != "success" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryTTL bounds how long the scale sets found in a resource group are
+// reused before the group is listed again.
+const discoveryTTL = 5 * time.Minute
+
+// isDiscoveryConfig reports whether a target lists resource groups without
+// naming scale sets, meaning every scale set in those groups is managed.
+func isDiscoveryConfig(config map[string]string) bool {
+	for _, key := range []string{configKeyVMSSList, configKeyTargets, configKeyTargetsFile} {
+		if _, ok := config[key]; ok {
+			return false
+		}
+	}
+	_, ok := config[configKeyResourceGroupList]
+	return ok
+}
+
+func parseDiscoveryExclude(config map[string]string) (*regexp.Regexp, error) {
+	value, ok := config[configKeyVMSSExclude]
+	if !ok || value == "" {
+		return nil, nil
+	}
+	exclude, err := regexp.Compile(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", configKeyVMSSExclude, value, err)
+	}
+	return exclude, nil
+}
+
+// scaleSetDiscovery caches the scale set names found in each resource group.
+type scaleSetDiscovery struct {
+	lock    sync.Mutex
+	entries map[string]discoveredScaleSets
+}
+
+type discoveredScaleSets struct {
+	names     []string
+	fetchedAt time.Time
+}
+
+func newScaleSetDiscovery() *scaleSetDiscovery {
+	return &scaleSetDiscovery{entries: make(map[string]discoveredScaleSets)}
+}
+
+// scaleSetTargets returns the member scale sets of a target, discovering
+// them when the target only lists resource groups.
+func (t *TargetPlugin) scaleSetTargets(config map[string]string) ([]scaleSetTarget, error) {
+	missingAction, err := parseMissingScaleSetAction(config)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := t.memberScaleSets(config)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range targets {
+		targets[idx].skipMissing = missingAction == missingScaleSetSkip
+	}
+	if err := validateDistinctNames(targets); err != nil {
+		return nil, err
+	}
+	if err := t.validateSubscriptions(targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// validateSubscriptions rejects member sets that other targets list under a
+// different subscription. Capacities, locks and caches are tracked per
+// resource group and scale set name, so sets of the same names in two
+// subscriptions cannot both be managed by the plugin.
+func (t *TargetPlugin) validateSubscriptions(targets []scaleSetTarget) error {
+	var pluginSubscription string
+	if t.AzureController != nil {
+		pluginSubscription = t.AzureController.subscriptionID
+	}
+	for _, target := range targets {
+		distinct := make(map[string]bool)
+		var listed []string
+		for _, subscription := range t.targets.listedSubscriptions(target.resourceGroup, target.vmScaleSet) {
+			if strings.EqualFold(subscription, pluginSubscription) {
+				subscription = ""
+			}
+			if !distinct[strings.ToLower(subscription)] {
+				distinct[strings.ToLower(subscription)] = true
+				listed = append(listed, displaySubscription(subscription))
+			}
+		}
+		if len(listed) > 1 {
+			return fmt.Errorf("scale set %s/%s is listed under %s by different targets, a resource group and scale set name may only be used in one subscription",
+				target.resourceGroup, target.vmScaleSet, strings.Join(listed, " and "))
+		}
+	}
+	return nil
+}
+
+func displaySubscription(subscription string) string {
+	if subscription == "" {
+		return "the plugin subscription"
+	}
+	return subscription
+}
+
+func (t *TargetPlugin) memberScaleSets(config map[string]string) ([]scaleSetTarget, error) {
+	if !isDiscoveryConfig(config) {
+		targets, err := parseScaleSetTargets(config)
+		if err != nil {
+			return nil, err
+		}
+		return t.expandScaleSetPatterns(context.Background(), config, targets)
+	}
+	exclude, err := parseDiscoveryExclude(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceGroups, err := splitList(config, configKeyResourceGroupList, config[configKeyResourceGroupList])
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for idx, resourceGroup := range resourceGroups {
+		resourceGroup = strings.TrimSpace(resourceGroup)
+		if resourceGroup == "" {
+			return nil, fmt.Errorf("empty entry in %s", configKeyResourceGroupList)
+		}
+		if seen[strings.ToLower(resourceGroup)] {
+			return nil, fmt.Errorf("duplicate entry %s in %s", resourceGroup, configKeyResourceGroupList)
+		}
+		seen[strings.ToLower(resourceGroup)] = true
+		resourceGroups[idx] = resourceGroup
+	}
+	t.prefetchScaleSets(context.Background(), "", resourceGroups)
+
+	var targets []scaleSetTarget
+	for _, resourceGroup := range resourceGroups {
+		names, err := t.discoverScaleSets(context.Background(), "", resourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if exclude != nil && exclude.MatchString(name) {
+				continue
+			}
+			targets = append(targets, scaleSetTarget{resourceGroup: resourceGroup, vmScaleSet: name, weight: 1})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no scale sets found in %s", config[configKeyResourceGroupList])
+	}
+	return targets, nil
+}
+
+// discoverScaleSets returns the names of the scale sets in a resource group
+// of the subscription, empty for the plugin subscription.
+func (t *TargetPlugin) discoverScaleSets(ctx context.Context, subscription, resourceGroup string) ([]string, error) {
+	d := t.discovery
+	key := strings.ToLower(subscription + "/" + resourceGroup)
+	d.lock.Lock()
+	entry, ok := d.entries[key]
+	d.lock.Unlock()
+	if ok && time.Since(entry.fetchedAt) < discoveryTTL {
+		return entry.names, nil
+	}
+
+	names, err := t.AzureController.forSubscription(subscription).listScaleSets(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	t.storeDiscovered(subscription, resourceGroup, names)
+	return names, nil
+}
+
+// prefetchScaleSets discovers the scale sets of the resource groups of the
+// subscription whose discovery expired with a single Resource Graph query,
+// when the plugin queries Resource Graph. Groups it fails for are listed one
+// by one through ARM by discoverScaleSets.
+func (t *TargetPlugin) prefetchScaleSets(ctx context.Context, subscription string, resourceGroups []string) {
+	azure := t.AzureController.forSubscription(subscription)
+	if !azure.resourceGraph {
+		return
+	}
+	d := t.discovery
+	var expired []string
+	d.lock.Lock()
+	for _, resourceGroup := range resourceGroups {
+		entry, ok := d.entries[strings.ToLower(subscription+"/"+resourceGroup)]
+		if !ok || time.Since(entry.fetchedAt) >= discoveryTTL {
+			expired = append(expired, resourceGroup)
+		}
+	}
+	d.lock.Unlock()
+	if len(expired) < 2 {
+		return
+	}
+
+	names, err := azure.graphScaleSetNames(ctx, expired)
+	if err != nil {
+		t.logger.Warn("failed to discover scale sets through resource graph, listing resource groups instead",
+			"resource_groups", expired, "error", err)
+		return
+	}
+	for _, resourceGroup := range expired {
+		t.storeDiscovered(subscription, resourceGroup, names[strings.ToLower(resourceGroup)])
+	}
+}
+
+func (t *TargetPlugin) storeDiscovered(subscription, resourceGroup string, names []string) {
+	d := t.discovery
+	key := strings.ToLower(subscription + "/" + resourceGroup)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if entry, ok := d.entries[key]; ok && strings.Join(names, ",") != strings.Join(entry.names, ",") {
+		t.logger.Info("scale sets in resource group changed", "resource_group", resourceGroup,
+			"previous", entry.names, "current", names)
+	}
+	d.entries[key] = discoveredScaleSets{names: names, fetchedAt: time.Now()}
+}
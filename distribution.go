@@ -0,0 +1,57 @@
+package main
+
+import (
+	"azure-vmss-list/distribution"
+)
+
+// distributionSets returns the placement of the member sets the distribution
+// package plans with.
+func distributionSets(sets []scaleSetTarget) []distribution.Set {
+	placed := make([]distribution.Set, len(sets))
+	for idx, set := range sets {
+		placed[idx] = distribution.Set{
+			Min:       set.min,
+			Max:       set.max,
+			Weight:    set.weight,
+			Priority:  set.priority,
+			ScalesOut: set.scalesOut(),
+			ScalesIn:  set.scalesIn(),
+			Retiring:  set.retiring,
+		}
+	}
+	return placed
+}
+
+// planCapacities splits a total capacity across the member scale sets in
+// proportion to their weights, within their min and max, as
+// distribution.Capacities does.
+func planCapacities(total int64, sets []scaleSetTarget) []int64 {
+	return distribution.Capacities(total, distributionSets(sets))
+}
+
+// planScaleOut is planCapacities for a scale out: paused, retiring and
+// scale in only sets keep their current capacity and the rest of the total
+// is planned over the others.
+func planScaleOut(capacities []int64, total int64, sets []scaleSetTarget) []int64 {
+	return distribution.ScaleOut(capacities, total, distributionSets(sets))
+}
+
+// planScaleIn returns how many instances to remove from each scale set to
+// shrink the target by num, as distribution.ScaleIn does. Paused sets and
+// sets which only scale out give up nothing, and retiring sets give up their
+// instances first.
+func planScaleIn(capacities []int64, num int64, sets []scaleSetTarget) []int64 {
+	return distribution.ScaleIn(capacities, num, distributionSets(sets))
+}
+
+// hasPlacement reports whether any member set has placement options, a
+// direction, or is paused or retiring, in which case the plan rather than an
+// even spread decides the capacities.
+func hasPlacement(sets []scaleSetTarget) bool {
+	for _, set := range sets {
+		if set.hasPlacement() || set.direction != "" || set.paused || set.retiring {
+			return true
+		}
+	}
+	return false
+}
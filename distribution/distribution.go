@@ -0,0 +1,181 @@
+// Package distribution splits the capacity of a target across its member
+// scale sets. It does no I/O, so plans can be tested and profiled apart from
+// the plugin.
+package distribution
+
+// Set is the placement of one member scale set.
+type Set struct {
+	// Min and Max bound the capacity of the set; the zero Max means
+	// unbounded.
+	Min int64
+	Max int64
+
+	Weight   int64
+	Priority int
+
+	// ScalesOut and ScalesIn report whether the set may gain and lose
+	// capacity. Retiring sets give up their instances first on scale in,
+	// regardless of their Min.
+	ScalesOut bool
+	ScalesIn  bool
+	Retiring  bool
+}
+
+// Capacities splits a total capacity across the sets in proportion to their
+// weights, keeping every set within its min and max. Capacity a set cannot
+// take because of its max is moved to the others; units left over by the
+// integer split go to the sets with the highest priority, then in list order.
+// With unit weights and no bounds this is an even spread with the remainder
+// on the first sets.
+//
+// The returned capacities sum to less than total only when every set is at
+// its max, and to more than total only when the mins add up to more.
+func Capacities(total int64, sets []Set) []int64 {
+	capacities := make([]int64, len(sets))
+	remaining := total
+	for idx, set := range sets {
+		capacities[idx] = set.Min
+		remaining -= set.Min
+	}
+
+	full := func(idx int) bool {
+		return sets[idx].Max > 0 && capacities[idx] >= sets[idx].Max
+	}
+	// active is reused across rounds so planning allocates nothing but
+	// the result and the working slice.
+	active := make([]int, 0, len(sets))
+	for remaining > 0 {
+		active = active[:0]
+		var weights int64
+		for idx := range sets {
+			if !full(idx) && sets[idx].Weight > 0 {
+				active = append(active, idx)
+				weights += sets[idx].Weight
+			}
+		}
+		if len(active) == 0 {
+			// Zero weight sets only take capacity nobody else can.
+			for idx := range sets {
+				if !full(idx) {
+					active = append(active, idx)
+					weights++
+				}
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+
+		capped := false
+		var assigned int64
+		for _, idx := range active {
+			weight := sets[idx].Weight
+			if weight == 0 {
+				weight = 1
+			}
+			share := remaining * weight / weights
+			if sets[idx].Max > 0 && capacities[idx]+share >= sets[idx].Max {
+				share = sets[idx].Max - capacities[idx]
+				capped = true
+			}
+			capacities[idx] += share
+			assigned += share
+		}
+		remaining -= assigned
+		if capped {
+			continue
+		}
+
+		// The shares were floored; hand out what is left one unit at a
+		// time by priority.
+		sortByPriority(active, sets)
+		for _, idx := range active {
+			if remaining == 0 {
+				break
+			}
+			capacities[idx]++
+			remaining--
+		}
+	}
+	return capacities
+}
+
+// sortByPriority orders the set indexes by descending priority, keeping list
+// order among equal priorities. An insertion sort is enough for target sized
+// lists and, unlike sort.SliceStable, does not allocate.
+func sortByPriority(indexes []int, sets []Set) {
+	for i := 1; i < len(indexes); i++ {
+		for j := i; j > 0 && sets[indexes[j]].Priority > sets[indexes[j-1]].Priority; j-- {
+			indexes[j], indexes[j-1] = indexes[j-1], indexes[j]
+		}
+	}
+}
+
+// ScaleOut is Capacities for a scale out: sets which do not scale out keep
+// their current capacity and the rest of the total is planned over the
+// others.
+func ScaleOut(capacities []int64, total int64, sets []Set) []int64 {
+	plan := make([]int64, len(sets))
+	members := make([]int, 0, len(sets))
+	open := make([]Set, 0, len(sets))
+	for idx, set := range sets {
+		if !set.ScalesOut {
+			plan[idx] = capacities[idx]
+			total -= capacities[idx]
+			continue
+		}
+		members = append(members, idx)
+		open = append(open, set)
+	}
+	if total < 0 {
+		total = 0
+	}
+	for i, capacity := range Capacities(total, open) {
+		plan[members[i]] = capacity
+	}
+	return plan
+}
+
+// ScaleIn returns how many instances to remove from each set to shrink the
+// target by num, never taking a set below its min or growing one. Sets which
+// do not scale in give up nothing. Retiring sets give up their instances
+// first, in list order and regardless of their min, so a rotation drains the
+// old set to zero before touching the new one.
+func ScaleIn(capacities []int64, num int64, sets []Set) []int64 {
+	removals := make([]int64, len(sets))
+	for idx, set := range sets {
+		if set.Retiring && set.ScalesIn && capacities[idx] > 0 && num > 0 {
+			removals[idx] = min(capacities[idx], num)
+			num -= removals[idx]
+		}
+	}
+	if num <= 0 {
+		return removals
+	}
+
+	// Empty sets cannot shrink and are left out, which also keeps their
+	// zero capacity from reading as an unbounded max.
+	var current int64
+	members := make([]int, 0, len(sets))
+	bounded := make([]Set, 0, len(sets))
+	for idx, set := range sets {
+		if capacities[idx] <= 0 || !set.ScalesIn || set.Retiring {
+			continue
+		}
+		current += capacities[idx]
+		if set.Max == 0 || set.Max > capacities[idx] {
+			set.Max = capacities[idx]
+		}
+		if set.Min > set.Max {
+			set.Min = set.Max
+		}
+		members = append(members, idx)
+		bounded = append(bounded, set)
+	}
+
+	planned := Capacities(current-num, bounded)
+	for i, idx := range members {
+		removals[idx] = capacities[idx] - planned[i]
+	}
+	return removals
+}
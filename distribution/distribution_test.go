@@ -0,0 +1,143 @@
+package distribution
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func even(n int) []Set {
+	sets := make([]Set, n)
+	for idx := range sets {
+		sets[idx] = Set{Weight: 1, ScalesOut: true, ScalesIn: true}
+	}
+	return sets
+}
+
+func TestCapacities(t *testing.T) {
+	cases := []struct {
+		name  string
+		total int64
+		sets  []Set
+		want  []int64
+	}{
+		{name: "even with remainder first", total: 7, sets: even(3), want: []int64{3, 2, 2}},
+		{name: "weighted", total: 8, sets: []Set{{Weight: 3}, {Weight: 1}}, want: []int64{6, 2}},
+		{name: "max moves capacity on", total: 10, sets: []Set{{Weight: 1, Max: 2}, {Weight: 1}}, want: []int64{2, 8}},
+		{name: "min first", total: 5, sets: []Set{{Weight: 1, Min: 3}, {Weight: 1}}, want: []int64{4, 1}},
+		{name: "remainder by priority", total: 3, sets: []Set{{Weight: 1}, {Weight: 1, Priority: 1}}, want: []int64{1, 2}},
+		{name: "zero weight takes the overflow", total: 5, sets: []Set{{Weight: 1, Max: 2}, {}}, want: []int64{2, 3}},
+		{name: "every set full", total: 9, sets: []Set{{Weight: 1, Max: 2}, {Weight: 1, Max: 3}}, want: []int64{2, 3}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Capacities(c.total, c.sets); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestScaleOut(t *testing.T) {
+	sets := even(3)
+	sets[1].ScalesOut = false
+	if got, want := ScaleOut([]int64{1, 4, 1}, 10, sets), []int64{3, 4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScaleIn(t *testing.T) {
+	cases := []struct {
+		name       string
+		capacities []int64
+		num        int64
+		sets       []Set
+		want       []int64
+	}{
+		{name: "largest first", capacities: []int64{6, 2, 1}, num: 4, sets: even(3), want: []int64{4, 0, 0}},
+		{name: "never below min", capacities: []int64{3, 3}, num: 5, sets: []Set{
+			{Weight: 1, Min: 2, ScalesIn: true}, {Weight: 1, Min: 2, ScalesIn: true},
+		}, want: []int64{1, 1}},
+		{name: "retiring first", capacities: []int64{3, 5}, num: 4, sets: []Set{
+			{Weight: 1, ScalesIn: true, Retiring: true}, {Weight: 1, ScalesIn: true},
+		}, want: []int64{3, 1}},
+		{name: "scale out only gives up nothing", capacities: []int64{4, 4}, num: 3, sets: []Set{
+			{Weight: 1, ScalesIn: true}, {Weight: 1},
+		}, want: []int64{3, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ScaleIn(c.capacities, c.num, c.sets); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// skewed returns n sets whose weights, bounds and priorities vary widely,
+// with the capacities of a target where a few sets hold most instances.
+func skewed(n int) ([]Set, []int64) {
+	sets := make([]Set, n)
+	capacities := make([]int64, n)
+	for idx := range sets {
+		sets[idx] = Set{
+			Weight:    int64(1 + idx%7*idx%5),
+			Priority:  idx % 3,
+			ScalesOut: idx%11 != 0,
+			ScalesIn:  idx%13 != 0,
+			Retiring:  idx%29 == 0,
+		}
+		if idx%4 == 0 {
+			sets[idx].Max = int64(2 + idx%6)
+		}
+		if idx%6 == 0 {
+			sets[idx].Min = 1
+		}
+		capacities[idx] = int64(1 + idx%3)
+		if idx%10 == 0 {
+			capacities[idx] = 200
+		}
+	}
+	return sets, capacities
+}
+
+func BenchmarkCapacities(b *testing.B) {
+	for _, n := range []int{50, 100} {
+		for _, input := range []string{"even", "skewed"} {
+			sets := even(n)
+			if input == "skewed" {
+				sets, _ = skewed(n)
+			}
+			b.Run(fmt.Sprintf("%s/%d", input, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					Capacities(int64(n*37+3), sets)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkScaleOut(b *testing.B) {
+	for _, n := range []int{50, 100} {
+		sets, capacities := skewed(n)
+		b.Run(fmt.Sprintf("skewed/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ScaleOut(capacities, int64(n*50), sets)
+			}
+		})
+	}
+}
+
+func BenchmarkScaleIn(b *testing.B) {
+	for _, n := range []int{50, 100} {
+		sets, capacities := skewed(n)
+		b.Run(fmt.Sprintf("skewed/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ScaleIn(capacities, int64(n*3), sets)
+			}
+		})
+	}
+}
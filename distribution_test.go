@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// checkGolden compares got with the golden file of the test, rewriting the
+// file instead when the tests run with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file, run the tests with -update to write it: %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the golden file, run the tests with -update and diff it:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// even is n member sets of the default options.
+func even(n int) []scaleSetTarget {
+	sets := make([]scaleSetTarget, n)
+	for idx := range sets {
+		sets[idx] = scaleSetTarget{vmScaleSet: fmt.Sprintf("vmss-%d", idx), weight: 1}
+	}
+	return sets
+}
+
+func describeSets(sets []scaleSetTarget) string {
+	var parts []string
+	for _, set := range sets {
+		var options []string
+		if set.weight != 1 {
+			options = append(options, fmt.Sprintf("weight=%d", set.weight))
+		}
+		if set.min != 0 {
+			options = append(options, fmt.Sprintf("min=%d", set.min))
+		}
+		if set.max != 0 {
+			options = append(options, fmt.Sprintf("max=%d", set.max))
+		}
+		if set.priority != 0 {
+			options = append(options, fmt.Sprintf("priority=%d", set.priority))
+		}
+		if set.direction != "" {
+			options = append(options, "direction="+set.direction)
+		}
+		if set.paused {
+			options = append(options, "paused")
+		}
+		if set.retiring {
+			options = append(options, "retiring")
+		}
+		parts = append(parts, fmt.Sprintf("%s(%s)", set.vmScaleSet, strings.Join(options, ",")))
+	}
+	return strings.Join(parts, " ")
+}
+
+func withOptions(sets []scaleSetTarget, options func(idx int, set *scaleSetTarget)) []scaleSetTarget {
+	for idx := range sets {
+		options(idx, &sets[idx])
+	}
+	return sets
+}
+
+func TestPlanCapacitiesGolden(t *testing.T) {
+	cases := []struct {
+		name  string
+		total int64
+		sets  []scaleSetTarget
+	}{
+		{"zero count", 0, even(3)},
+		{"even split", 9, even(3)},
+		{"remainder on the first sets", 10, even(3)},
+		{"fewer units than sets", 2, even(5)},
+		{"single set", 7, even(1)},
+		{"weighted", 12, withOptions(even(3), func(idx int, set *scaleSetTarget) { set.weight = int64(idx + 1) })},
+		{"weighted remainder", 7, withOptions(even(3), func(idx int, set *scaleSetTarget) { set.weight = int64(3 - idx) })},
+		{"zero weight takes the overflow", 8, withOptions(even(3), func(idx int, set *scaleSetTarget) {
+			if idx == 0 {
+				set.weight = 0
+			} else {
+				set.max = 3
+			}
+		})},
+		{"remainder by priority", 10, withOptions(even(3), func(idx int, set *scaleSetTarget) { set.priority = idx * 10 })},
+		{"max moves capacity to the others", 10, withOptions(even(3), func(idx int, set *scaleSetTarget) {
+			if idx == 0 {
+				set.max = 1
+			}
+		})},
+		{"every set at its max", 20, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.max = 4 })},
+		{"mins above the total", 2, withOptions(even(3), func(idx int, set *scaleSetTarget) { set.min = 2 })},
+		{"min and weight", 10, withOptions(even(2), func(idx int, set *scaleSetTarget) {
+			if idx == 0 {
+				set.min = 6
+			} else {
+				set.weight = 3
+			}
+		})},
+	}
+	var out strings.Builder
+	for _, c := range cases {
+		fmt.Fprintf(&out, "%s: total %d over %s\n  %v\n", c.name, c.total, describeSets(c.sets), planCapacities(c.total, c.sets))
+	}
+	checkGolden(t, "plan_capacities", out.String())
+}
+
+func TestPlanScaleOutGolden(t *testing.T) {
+	cases := []struct {
+		name       string
+		capacities []int64
+		total      int64
+		sets       []scaleSetTarget
+	}{
+		{"from zero", []int64{0, 0, 0}, 5, even(3)},
+		{"rebalances an uneven target", []int64{4, 0, 0}, 6, even(3)},
+		{"paused set keeps its capacity", []int64{2, 2, 2}, 9, withOptions(even(3), func(idx int, set *scaleSetTarget) { set.paused = idx == 1 })},
+		{"scale in only set keeps its capacity", []int64{3, 1}, 8, withOptions(even(2), func(idx int, set *scaleSetTarget) {
+			if idx == 0 {
+				set.direction = "in"
+			}
+		})},
+		{"retiring set gets nothing", []int64{5, 0}, 7, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.retiring = idx == 0 })},
+		{"held capacity above the total", []int64{6, 1}, 4, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.paused = idx == 0 })},
+	}
+	var out strings.Builder
+	for _, c := range cases {
+		fmt.Fprintf(&out, "%s: %v to %d over %s\n  %v\n", c.name, c.capacities, c.total, describeSets(c.sets),
+			planScaleOut(c.capacities, c.total, c.sets))
+	}
+	checkGolden(t, "plan_scale_out", out.String())
+}
+
+func TestPlanScaleInGolden(t *testing.T) {
+	cases := []struct {
+		name       string
+		capacities []int64
+		num        int64
+		sets       []scaleSetTarget
+	}{
+		{"zero count", []int64{3, 3}, 0, even(2)},
+		{"even removal", []int64{4, 4, 4}, 3, even(3)},
+		{"takes from the largest first", []int64{6, 2, 1}, 4, even(3)},
+		{"empty sets give up nothing", []int64{0, 5}, 2, even(2)},
+		{"never below min", []int64{3, 3}, 5, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.min = 2 })},
+		{"retiring set drains first", []int64{3, 5}, 4, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.retiring = idx == 0 })},
+		{"scale out only set gives up nothing", []int64{4, 4}, 3, withOptions(even(2), func(idx int, set *scaleSetTarget) {
+			if idx == 1 {
+				set.direction = "out"
+			}
+		})},
+		{"more than the target holds", []int64{1, 1}, 5, even(2)},
+		{"weighted", []int64{5, 5}, 4, withOptions(even(2), func(idx int, set *scaleSetTarget) { set.weight = int64(idx*2 + 1) })},
+	}
+	var out strings.Builder
+	for _, c := range cases {
+		fmt.Fprintf(&out, "%s: %v by %d over %s\n  %v\n", c.name, c.capacities, c.num, describeSets(c.sets),
+			planScaleIn(c.capacities, c.num, c.sets))
+	}
+	checkGolden(t, "plan_scale_in", out.String())
+}
+
+func TestRemoteIDMappingGolden(t *testing.T) {
+	nodes := []*api.Node{
+		{ID: "attribute", Attributes: map[string]string{"unique.platform.azure.name": "web_0"}},
+		{ID: "meta-fallback", Meta: map[string]string{"unique.platform.azure.name": "web_1"}},
+		{ID: "attribute-wins", Attributes: map[string]string{"unique.platform.azure.name": "web_2"}, Meta: map[string]string{"unique.platform.azure.name": "web_9"}},
+		{ID: "underscore-name", Attributes: map[string]string{"unique.platform.azure.name": "batch_pool_v2_14"}},
+		{ID: "mixed-case", Attributes: map[string]string{"unique.platform.azure.name": "Web_3"}},
+		{ID: "missing-attribute", Attributes: map[string]string{"unique.platform.aws.instance-id": "i-0abc"}},
+		{ID: "no-attributes"},
+	}
+	var out strings.Builder
+	for _, node := range nodes {
+		remoteID, err := azureNodeIDMap(node)
+		if err != nil {
+			fmt.Fprintf(&out, "%s: error %v\n", node.ID, err)
+			continue
+		}
+		sep := strings.LastIndex(remoteID, "_")
+		fmt.Fprintf(&out, "%s: remote ID %q, scale set %q, instance %q\n", node.ID, remoteID, remoteID[:sep], remoteID[sep+1:])
+	}
+
+	registered := map[string]*api.Node{
+		"web_0":           {},
+		"web_1":           {},
+		"web_extra_2":     {},
+		"batch_pool_v2_3": {},
+		"batch_pool_v2_4": {},
+	}
+	for _, vmScaleSet := range []string{"web", "Web", "web_extra", "batch_pool_v2", "batch_pool", "none"} {
+		fmt.Fprintf(&out, "nodes of %s: %d\n", vmScaleSet, countSetNodes(vmScaleSet, nodeFilter{}, registered))
+	}
+	checkGolden(t, "remote_id_mapping", out.String())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// forceDrainDeadline is the deadline Nomad interprets as "stop all
+// allocations immediately", matching `nomad node drain -force`.
+const forceDrainDeadline = "-1s"
+
+var scaleInConfigKeys = []string{
+	sdk.TargetConfigKeyDrainDeadline,
+	sdk.TargetConfigKeyIgnoreSystemJobs,
+	sdk.TargetConfigKeyNodePurge,
+	configKeyNodeDrainForce,
+	configKeyNodeDrainConcurrency,
+}
+
+// parseScaleInDefaults extracts the plugin-level drain and purge options,
+// validating them so that typos surface at SetConfig rather than mid scale-in.
+func parseScaleInDefaults(config map[string]string) (map[string]string, error) {
+	defaults := make(map[string]string)
+	for _, key := range scaleInConfigKeys {
+		if value, ok := config[key]; ok {
+			defaults[key] = value
+		}
+	}
+	if err := validateScaleInConfig(defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+func validateScaleInConfig(config map[string]string) error {
+	if value, ok := config[sdk.TargetConfigKeyDrainDeadline]; ok {
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", sdk.TargetConfigKeyDrainDeadline, value, err)
+		}
+	}
+	for _, key := range []string{sdk.TargetConfigKeyIgnoreSystemJobs, sdk.TargetConfigKeyNodePurge, configKeyNodeDrainForce} {
+		if value, ok := config[key]; ok {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+		}
+	}
+	if _, err := parseDrainConcurrency(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseDrainConcurrency returns how many nodes of a scale in may drain at
+// once, zero when they all drain together.
+func parseDrainConcurrency(config map[string]string) (int, error) {
+	value, ok := config[configKeyNodeDrainConcurrency]
+	if !ok {
+		return 0, nil
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyNodeDrainConcurrency, value)
+	}
+	return concurrency, nil
+}
+
+// scaleInConfig returns a copy of the target config with the plugin-level
+// drain and purge defaults filled in for any option the target does not set
+// itself. Force draining is translated into the negative deadline understood
+// by Nomad.
+func (t *TargetPlugin) scaleInConfig(config map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(config)+len(t.scaleInDefaults))
+	for key, value := range t.scaleInDefaults {
+		merged[key] = value
+	}
+	for key, value := range config {
+		merged[key] = value
+	}
+
+	if err := validateScaleInConfig(merged); err != nil {
+		return nil, err
+	}
+
+	if value, ok := merged[configKeyNodeDrainForce]; ok {
+		if force, _ := strconv.ParseBool(value); force {
+			merged[sdk.TargetConfigKeyDrainDeadline] = forceDrainDeadline
+		}
+	}
+	return merged, nil
+}
+
+// runPreScaleInTasksLimited selects the nodes to remove like the cluster
+// scale utils do, but keeps at most limit of them draining at a time so a
+// large scale in does not reschedule every allocation at once.
+func (u *retryingScaleUtils) runPreScaleInTasksLimited(ctx context.Context, cfg map[string]string, remoteIDs []string, num, limit int) ([]scaleutils.NodeResourceID, error) {
+	if u.ClusterNodeIDLookupFunc == nil {
+		return nil, errors.New("required ClusterNodeIDLookupFunc not set")
+	}
+	nodes, err := u.IdentifyScaleInNodes(cfg, num)
+	if err != nil {
+		return nil, err
+	}
+	nodeResourceIDs, err := u.IdentifyScaleInRemoteIDs(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	targeted := make(map[string]bool, len(remoteIDs))
+	for _, remoteID := range remoteIDs {
+		targeted[remoteID] = true
+	}
+	byNodeID := make(map[string]*api.NodeListStub, len(nodes))
+	for _, node := range nodes {
+		byNodeID[node.ID] = node
+	}
+	resourceIDs := make(map[string]scaleutils.NodeResourceID, len(nodeResourceIDs))
+	var filtered []*api.NodeListStub
+	for _, id := range nodeResourceIDs {
+		if targeted[id.RemoteResourceID] {
+			filtered = append(filtered, byNodeID[id.NomadNodeID])
+			resourceIDs[id.NomadNodeID] = id
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no nodes identified for scaling in action")
+	}
+	if num > len(filtered) {
+		u.log.Warn("can only identify portion of requested nodes for removal",
+			"requested", num, "available", len(filtered))
+	}
+
+	selected, err := u.SelectScaleInNodes(filtered, cfg, num)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]scaleutils.NodeResourceID, 0, len(selected))
+	for _, node := range selected {
+		ids = append(ids, resourceIDs[node.ID])
+	}
+
+	u.log.Info("draining nodes", "count", len(ids), "concurrency", limit)
+	err = drainWithLimit(ctx, ids, limit, func(id scaleutils.NodeResourceID) error {
+		return u.DrainNodes(ctx, cfg, []scaleutils.NodeResourceID{id})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// drainWithLimit runs drain for every node, at most limit at a time, starting
+// the next drain as one completes. No further drain starts once one failed,
+// so nodes the scale in will not remove are left running their work.
+func drainWithLimit(ctx context.Context, ids []scaleutils.NodeResourceID, limit int, drain func(scaleutils.NodeResourceID) error) error {
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		result *multierror.Error
+	)
+	slots := make(chan struct{}, limit)
+	for _, id := range ids {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return multierror.Append(result, ctx.Err()).ErrorOrNil()
+		}
+		lock.Lock()
+		failed := result != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		go func(id scaleutils.NodeResourceID) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := drain(id); err != nil {
+				lock.Lock()
+				result = multierror.Append(result, err)
+				lock.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+)
+
+func TestParseDrainConcurrency(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "5", want: 5},
+		{value: "-1", wantErr: true},
+		{value: "some", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseDrainConcurrency(map[string]string{configKeyNodeDrainConcurrency: c.value})
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("%q: got %d, %v, want %d, error %t", c.value, got, err, c.want, c.wantErr)
+		}
+	}
+	if got, err := parseDrainConcurrency(map[string]string{}); got != 0 || err != nil {
+		t.Errorf("unset: got %d, %v, want 0", got, err)
+	}
+}
+
+func testNodeResourceIDs(n int) []scaleutils.NodeResourceID {
+	ids := make([]scaleutils.NodeResourceID, n)
+	for i := range ids {
+		ids[i] = scaleutils.NodeResourceID{NomadNodeID: fmt.Sprintf("node-%d", i), RemoteResourceID: fmt.Sprintf("vmss_%d", i)}
+	}
+	return ids
+}
+
+func TestDrainWithLimit(t *testing.T) {
+	var (
+		lock              sync.Mutex
+		draining, maxSeen int
+		drained           int
+	)
+	err := drainWithLimit(context.Background(), testNodeResourceIDs(10), 3, func(scaleutils.NodeResourceID) error {
+		lock.Lock()
+		draining++
+		maxSeen = max(maxSeen, draining)
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		draining--
+		drained++
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("drainWithLimit: %v", err)
+	}
+	if drained != 10 {
+		t.Errorf("drained %d nodes, want 10", drained)
+	}
+	if maxSeen != 3 {
+		t.Errorf("got %d nodes draining at once, want 3", maxSeen)
+	}
+}
+
+func TestDrainWithLimitStopsAfterFailure(t *testing.T) {
+	var started int
+	err := drainWithLimit(context.Background(), testNodeResourceIDs(5), 1, func(id scaleutils.NodeResourceID) error {
+		started++
+		if id.NomadNodeID == "node-1" {
+			return errors.New("drain failed")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if started != 2 {
+		t.Errorf("started %d drains, want none after the failing one", started)
+	}
+}
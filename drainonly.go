@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+)
+
+const (
+	scaleInModeDelete    = "delete"
+	scaleInModeDrainOnly = "drain_only"
+
+	// actionMetaDrainOnly has a single scale in action drain its nodes
+	// without deleting their instances, whatever the target mode.
+	actionMetaDrainOnly = "drain_only"
+)
+
+// parseDrainOnly reports whether a scale in only drains the selected nodes
+// and marks them ineligible, leaving their Azure instances in place to be
+// inspected or re-imaged by hand. The action meta overrides the target mode.
+func parseDrainOnly(config map[string]string, action sdk.ScalingAction) (bool, error) {
+	drainOnly := false
+	if value, ok := config[configKeyScaleInMode]; ok {
+		switch value {
+		case scaleInModeDelete:
+		case scaleInModeDrainOnly:
+			drainOnly = true
+		default:
+			return false, fmt.Errorf("invalid %s %q, must be %q or %q", configKeyScaleInMode, value, scaleInModeDelete, scaleInModeDrainOnly)
+		}
+	}
+	if raw, ok := action.Meta[actionMetaDrainOnly]; ok {
+		value := strings.TrimSpace(fmt.Sprint(raw))
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s action meta %q: %v", actionMetaDrainOnly, value, err)
+		}
+		drainOnly = enabled
+	}
+	return drainOnly, nil
+}
+
+// withoutDrainedNodes leaves out the running instances whose node a drain
+// only scale in left registered and ineligible, and returns how many those
+// are. The instances still count towards the capacity, so they cover part of
+// a later scale in rather than being drained again.
+func withoutDrainedNodes(remoteIDs []string, nodes map[string]*api.Node) ([]string, int64) {
+	kept := make([]string, 0, len(remoteIDs))
+	var drained int64
+	for _, remoteID := range remoteIDs {
+		if node, ok := nodes[strings.ToLower(remoteID)]; ok && node.SchedulingEligibility == api.NodeSchedulingIneligible {
+			drained++
+			continue
+		}
+		kept = append(kept, remoteID)
+	}
+	return kept, drained
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+func TestParseDrainOnly(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    string
+		meta    map[string]interface{}
+		want    bool
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "delete", mode: scaleInModeDelete},
+		{name: "drain only", mode: scaleInModeDrainOnly, want: true},
+		{name: "action meta", meta: map[string]interface{}{actionMetaDrainOnly: true}, want: true},
+		{name: "action meta overrides", mode: scaleInModeDrainOnly, meta: map[string]interface{}{actionMetaDrainOnly: "false"}},
+		{name: "invalid mode", mode: "keep", wantErr: true},
+		{name: "invalid meta", meta: map[string]interface{}{actionMetaDrainOnly: "maybe"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := map[string]string{}
+			if c.mode != "" {
+				config[configKeyScaleInMode] = c.mode
+			}
+			got, err := parseDrainOnly(config, sdk.ScalingAction{Meta: c.meta})
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %t", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("got %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestScaleInDrainOnlyCountsDrainedNodes(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 3)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+
+	target := map[string]string{
+		configKeyTargets:         "rg/a",
+		configKeyScaleInMode:     scaleInModeDrainOnly,
+		"node_class":             "fake",
+		"node_selector_strategy": "newest_create_index",
+	}
+	steps := []struct {
+		count       int64
+		wantDrained []string
+	}{
+		{count: 2, wantDrained: []string{"node-a-2"}},
+		// The node drained before already covers the same scale in.
+		{count: 2, wantDrained: []string{"node-a-2"}},
+		{count: 1, wantDrained: []string{"node-a-1", "node-a-2"}},
+	}
+	for idx, step := range steps {
+		action := sdk.ScalingAction{Count: step.count, Direction: sdk.ScaleDirectionDown}
+		if err := plugin.Scale(action, target); err != nil {
+			t.Fatalf("step %d: Scale failed: %v", idx, err)
+		}
+		if got := nomad.drainedNodes(); !equalStrings(got, step.wantDrained) {
+			t.Errorf("step %d: drained %v, want %v", idx, got, step.wantDrained)
+		}
+		checkCapacities(t, fake, "rg", map[string]int64{"a": 3})
+	}
+}
@@ -0,0 +1,306 @@
+//go:build e2e
+
+package main
+
+// The e2e tests run the plugin against real Azure scale sets. They provision
+// a resource group holding two single instance scale sets in the subscription
+// of the ARM_* service principal, scale them out and in through Scale and
+// check the result through Status, then delete the resource group. Azure
+// instances run no Nomad agent, so a fake Nomad API registers a ready node for
+// every instance the sets list.
+//
+//	ARM_SUBSCRIPTION_ID=... ARM_TENANT_ID=... ARM_CLIENT_ID=... ARM_CLIENT_SECRET=... \
+//	    go test -tags e2e -run TestE2E -timeout 60m .
+//
+// E2E_AZURE_LOCATION picks the region, westeurope by default, and
+// E2E_AZURE_VM_SIZE the instance size, Standard_B1s by default.
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2020-06-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2020-06-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+const (
+	e2eNodeClass     = "e2e"
+	e2eReadyTimeout  = 20 * time.Minute
+	e2eDeleteTimeout = 30 * time.Minute
+)
+
+// e2eEnv is the sandbox subscription the e2e tests provision in.
+type e2eEnv struct {
+	subscriptionID string
+	tenantID       string
+	clientID       string
+	clientSecret   string
+	location       string
+	vmSize         string
+	authorizer     autorest.Authorizer
+}
+
+func e2eEnvironment(t *testing.T) e2eEnv {
+	env := e2eEnv{
+		subscriptionID: os.Getenv("ARM_SUBSCRIPTION_ID"),
+		tenantID:       os.Getenv("ARM_TENANT_ID"),
+		clientID:       os.Getenv("ARM_CLIENT_ID"),
+		clientSecret:   os.Getenv("ARM_CLIENT_SECRET"),
+		location:       os.Getenv("E2E_AZURE_LOCATION"),
+		vmSize:         os.Getenv("E2E_AZURE_VM_SIZE"),
+	}
+	if env.subscriptionID == "" || env.tenantID == "" || env.clientID == "" || env.clientSecret == "" {
+		t.Skip("ARM_SUBSCRIPTION_ID, ARM_TENANT_ID, ARM_CLIENT_ID and ARM_CLIENT_SECRET must be set to run the e2e tests")
+	}
+	if env.location == "" {
+		env.location = "westeurope"
+	}
+	if env.vmSize == "" {
+		env.vmSize = "Standard_B1s"
+	}
+	authorizer, err := auth.NewClientCredentialsConfig(env.clientID, env.clientSecret, env.tenantID).Authorizer()
+	if err != nil {
+		t.Fatalf("failed to authorize the service principal: %v", err)
+	}
+	env.authorizer = authorizer
+	return env
+}
+
+// provision creates a resource group with a virtual network and one single
+// instance scale set per name, and deletes the resource group once the test
+// and its cleanups are done.
+func (env e2eEnv) provision(t *testing.T, vmScaleSets []string) string {
+	suffix, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resourceGroup := "nomad-autoscaler-e2e-" + suffix[:8]
+	ctx := context.Background()
+
+	groups := resources.NewGroupsClient(env.subscriptionID)
+	groups.Authorizer = env.authorizer
+	if _, err := groups.CreateOrUpdate(ctx, resourceGroup, resources.Group{
+		Location: to.StringPtr(env.location),
+		Tags:     map[string]*string{"purpose": to.StringPtr("nomad-autoscaler-e2e")},
+	}); err != nil {
+		t.Fatalf("failed to create resource group %s: %v", resourceGroup, err)
+	}
+	t.Logf("created resource group %s", resourceGroup)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), e2eDeleteTimeout)
+		defer cancel()
+		future, err := groups.Delete(ctx, resourceGroup, "")
+		if err == nil {
+			err = future.WaitForCompletionRef(ctx, groups.Client)
+		}
+		if err != nil {
+			t.Errorf("failed to delete resource group %s, delete it by hand: %v", resourceGroup, err)
+			return
+		}
+		t.Logf("deleted resource group %s", resourceGroup)
+	})
+
+	networks := network.NewVirtualNetworksClient(env.subscriptionID)
+	networks.Authorizer = env.authorizer
+	networkFuture, err := networks.CreateOrUpdate(ctx, resourceGroup, "e2e", network.VirtualNetwork{
+		Location: to.StringPtr(env.location),
+		VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
+			AddressSpace: &network.AddressSpace{AddressPrefixes: &[]string{"10.0.0.0/16"}},
+			Subnets: &[]network.Subnet{{
+				Name:                   to.StringPtr("default"),
+				SubnetPropertiesFormat: &network.SubnetPropertiesFormat{AddressPrefix: to.StringPtr("10.0.0.0/24")},
+			}},
+		},
+	})
+	if err == nil {
+		err = networkFuture.WaitForCompletionRef(ctx, networks.Client)
+	}
+	if err != nil {
+		t.Fatalf("failed to create the virtual network: %v", err)
+	}
+	vnet, err := networkFuture.Result(networks)
+	if err != nil {
+		t.Fatalf("failed to read the virtual network: %v", err)
+	}
+	subnetID := (*vnet.Subnets)[0].ID
+
+	password, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := compute.NewVirtualMachineScaleSetsClient(env.subscriptionID)
+	client.Authorizer = env.authorizer
+	futures := make([]compute.VirtualMachineScaleSetsCreateOrUpdateFuture, len(vmScaleSets))
+	for idx, vmScaleSet := range vmScaleSets {
+		futures[idx], err = client.CreateOrUpdate(ctx, resourceGroup, vmScaleSet, env.scaleSet(vmScaleSet, subnetID, "E2e!"+password))
+		if err != nil {
+			t.Fatalf("failed to create scale set %s: %v", vmScaleSet, err)
+		}
+	}
+	for idx, future := range futures {
+		if err := future.WaitForCompletionRef(ctx, client.Client); err != nil {
+			t.Fatalf("failed to create scale set %s: %v", vmScaleSets[idx], err)
+		}
+	}
+	t.Logf("created scale sets %s", strings.Join(vmScaleSets, ", "))
+	return resourceGroup
+}
+
+func (env e2eEnv) scaleSet(name string, subnetID *string, password string) compute.VirtualMachineScaleSet {
+	return compute.VirtualMachineScaleSet{
+		Location: to.StringPtr(env.location),
+		Sku:      &compute.Sku{Name: to.StringPtr(env.vmSize), Tier: to.StringPtr("Standard"), Capacity: to.Int64Ptr(1)},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			Overprovision: to.BoolPtr(false),
+			UpgradePolicy: &compute.UpgradePolicy{Mode: compute.UpgradeModeManual},
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				OsProfile: &compute.VirtualMachineScaleSetOSProfile{
+					ComputerNamePrefix: to.StringPtr(name),
+					AdminUsername:      to.StringPtr("e2e"),
+					AdminPassword:      to.StringPtr(password),
+				},
+				StorageProfile: &compute.VirtualMachineScaleSetStorageProfile{
+					ImageReference: &compute.ImageReference{
+						Publisher: to.StringPtr("Canonical"),
+						Offer:     to.StringPtr("UbuntuServer"),
+						Sku:       to.StringPtr("18.04-LTS"),
+						Version:   to.StringPtr("latest"),
+					},
+					OsDisk: &compute.VirtualMachineScaleSetOSDisk{
+						CreateOption: compute.DiskCreateOptionTypesFromImage,
+						ManagedDisk:  &compute.VirtualMachineScaleSetManagedDiskParameters{StorageAccountType: compute.StorageAccountTypesStandardLRS},
+					},
+				},
+				NetworkProfile: &compute.VirtualMachineScaleSetNetworkProfile{
+					NetworkInterfaceConfigurations: &[]compute.VirtualMachineScaleSetNetworkConfiguration{{
+						Name: to.StringPtr(name),
+						VirtualMachineScaleSetNetworkConfigurationProperties: &compute.VirtualMachineScaleSetNetworkConfigurationProperties{
+							Primary: to.BoolPtr(true),
+							IPConfigurations: &[]compute.VirtualMachineScaleSetIPConfiguration{{
+								Name: to.StringPtr(name),
+								VirtualMachineScaleSetIPConfigurationProperties: &compute.VirtualMachineScaleSetIPConfigurationProperties{
+									Subnet: &compute.APIEntityReference{ID: subnetID},
+								},
+							}},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// instanceNames lists the names of the instances of the scale sets, which
+// are their remote IDs.
+func (env e2eEnv) instanceNames(resourceGroup string, vmScaleSets []string) func(context.Context) ([]string, error) {
+	vms := compute.NewVirtualMachineScaleSetVMsClient(env.subscriptionID)
+	vms.Authorizer = env.authorizer
+	return func(ctx context.Context) ([]string, error) {
+		var names []string
+		for _, vmScaleSet := range vmScaleSets {
+			page, err := vms.List(ctx, resourceGroup, vmScaleSet, "", "", "")
+			for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+				for _, vm := range page.Values() {
+					if vm.Name != nil {
+						names = append(names, *vm.Name)
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return names, nil
+	}
+}
+
+// waitForCount polls Status until the target reports count ready instances.
+func waitForCount(t *testing.T, plugin *TargetPlugin, config map[string]string, count int64) *sdk.TargetStatus {
+	deadline := time.Now().Add(e2eReadyTimeout)
+	for {
+		status, err := plugin.Status(config)
+		if err != nil {
+			t.Fatalf("Status failed: %v", err)
+		}
+		if status.Ready && status.Count == count {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("target did not reach %d ready instances within %s, last status: ready %t, count %d, meta %v",
+				count, e2eReadyTimeout, status.Ready, status.Count, status.Meta)
+		}
+		time.Sleep(15 * time.Second)
+	}
+}
+
+func TestE2EScaleOutIn(t *testing.T) {
+	env := e2eEnvironment(t)
+	vmScaleSets := []string{"e2e-a", "e2e-b"}
+	resourceGroup := env.provision(t, vmScaleSets)
+
+	nomad := newFakeNomad(t, e2eNodeClass, env.instanceNames(resourceGroup, vmScaleSets))
+	server := httptest.NewServer(nomad)
+	t.Cleanup(server.Close)
+
+	plugin := factory(hclog.New(&hclog.LoggerOptions{Name: "e2e", Level: hclog.Debug})).(*TargetPlugin)
+	if err := plugin.SetConfig(map[string]string{
+		configKeySubscriptionID: env.subscriptionID,
+		configKeyTenantID:       env.tenantID,
+		configKeyClientID:       env.clientID,
+		configKeySecretKey:      env.clientSecret,
+		"nomad_address":         server.URL,
+	}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	t.Cleanup(plugin.shutdown)
+
+	target := map[string]string{
+		configKeyResourceGroup:   resourceGroup,
+		configKeyVMSSList:        strings.Join(vmScaleSets, ","),
+		"node_class":             e2eNodeClass,
+		"node_selector_strategy": "newest_create_index",
+	}
+	waitForCount(t, plugin, target, 2)
+
+	if err := plugin.Scale(sdk.ScalingAction{Count: 4, Direction: sdk.ScaleDirectionUp, Reason: "e2e scale out"}, target); err != nil {
+		t.Fatalf("scale out failed: %v", err)
+	}
+	waitForCount(t, plugin, target, 4)
+	env.checkCapacities(t, resourceGroup, vmScaleSets, 2)
+
+	if err := plugin.Scale(sdk.ScalingAction{Count: 2, Direction: sdk.ScaleDirectionDown, Reason: "e2e scale in"}, target); err != nil {
+		t.Fatalf("scale in failed: %v", err)
+	}
+	waitForCount(t, plugin, target, 2)
+	env.checkCapacities(t, resourceGroup, vmScaleSets, 1)
+	if drained := nomad.drainedNodes(); len(drained) != 2 {
+		t.Errorf("drained %v, want 2 nodes", drained)
+	}
+}
+
+// checkCapacities checks that Azure reports every scale set at capacity.
+func (env e2eEnv) checkCapacities(t *testing.T, resourceGroup string, vmScaleSets []string, capacity int64) {
+	t.Helper()
+	client := compute.NewVirtualMachineScaleSetsClient(env.subscriptionID)
+	client.Authorizer = env.authorizer
+	for _, vmScaleSet := range vmScaleSets {
+		vmss, err := client.Get(context.Background(), resourceGroup, vmScaleSet)
+		if err != nil {
+			t.Fatalf("failed to read scale set %s: %v", vmScaleSet, err)
+		}
+		if vmss.Sku == nil || vmss.Sku.Capacity == nil || *vmss.Sku.Capacity != capacity {
+			t.Errorf("scale set %s has capacity %v, want %d", vmScaleSet, vmss.Sku, capacity)
+		}
+	}
+}
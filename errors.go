@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"net/http"
+	"strings"
+)
+
+// azureErrorKind classifies an ARM failure by what the caller can do about
+// it.
+type azureErrorKind string
+
+const (
+	azureErrorThrottled azureErrorKind = "throttled"
+	azureErrorTransient azureErrorKind = "transient"
+	azureErrorAuth      azureErrorKind = "auth"
+	azureErrorConfig    azureErrorKind = "config"
+	azureErrorConflict  azureErrorKind = "conflict"
+	azureErrorUnknown   azureErrorKind = "unknown"
+)
+
+// azureError is an ARM failure annotated with its classification and the IDs
+// Azure support needs to trace the request.
+type azureError struct {
+	op            string
+	kind          azureErrorKind
+	statusCode    int
+	requestID     string
+	correlationID string
+	operationID   string
+	err           error
+}
+
+func (e *azureError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %v (kind=%s", e.op, e.err, e.kind)
+	if e.statusCode != 0 {
+		fmt.Fprintf(&b, ", status=%d", e.statusCode)
+	}
+	if e.requestID != "" {
+		fmt.Fprintf(&b, ", x-ms-request-id=%s", e.requestID)
+	}
+	if e.correlationID != "" {
+		fmt.Fprintf(&b, ", x-ms-correlation-request-id=%s", e.correlationID)
+	}
+	if e.operationID != "" {
+		fmt.Fprintf(&b, ", operation_id=%s", e.operationID)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func (e *azureError) Unwrap() error { return e.err }
+
+// retryable reports whether the same request may succeed if sent again.
+func (e *azureError) retryable() bool {
+	return e.kind == azureErrorThrottled || e.kind == azureErrorTransient
+}
+
+// wrapAzureError turns an error returned by the Azure SDK into an azureError.
+// The op is the message prefix used for the failed call.
+func wrapAzureError(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	wrapped := &azureError{op: op, kind: azureErrorUnknown, operationID: operationID(ctx), err: err}
+
+	var detailed autorest.DetailedError
+	var requestErr *azure.RequestError
+	if errors.As(err, &requestErr) {
+		detailed = requestErr.DetailedError
+		wrapped.requestID = requestErr.RequestID
+	}
+	if requestErr != nil || errors.As(err, &detailed) {
+		if code, ok := detailed.StatusCode.(int); ok {
+			wrapped.statusCode = code
+		}
+		if detailed.Response != nil {
+			if wrapped.requestID == "" {
+				wrapped.requestID = detailed.Response.Header.Get("x-ms-request-id")
+			}
+			wrapped.correlationID = detailed.Response.Header.Get("x-ms-correlation-request-id")
+			if wrapped.statusCode == 0 {
+				wrapped.statusCode = detailed.Response.StatusCode
+			}
+		}
+	}
+	wrapped.kind = classifyStatus(wrapped.statusCode)
+	return wrapped
+}
+
+func classifyStatus(code int) azureErrorKind {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return azureErrorThrottled
+	case code == 0, code == http.StatusRequestTimeout, code == http.StatusConflict, code >= http.StatusInternalServerError:
+		// No status means the request never got a response, for example
+		// a connection reset, which is worth retrying.
+		return azureErrorTransient
+	case code == http.StatusPreconditionFailed:
+		return azureErrorConflict
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return azureErrorAuth
+	case code >= http.StatusBadRequest:
+		return azureErrorConfig
+	}
+	return azureErrorUnknown
+}
+
+// isAzureConflict reports whether err is a conditional update rejected
+// because the resource changed since it was read.
+func isAzureConflict(err error) bool {
+	var azErr *azureError
+	return errors.As(err, &azErr) && azErr.kind == azureErrorConflict
+}
+
+// isAzureNotFound reports whether err is Azure answering that the resource
+// does not exist.
+func isAzureNotFound(err error) bool {
+	var azErr *azureError
+	return errors.As(err, &azErr) && azErr.statusCode == http.StatusNotFound
+}
+
+// isRetryableAzureError reports whether err, or an error it wraps, is an
+// Azure failure worth retrying.
+func isRetryableAzureError(err error) bool {
+	var azErr *azureError
+	return errors.As(err, &azErr) && azErr.retryable()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultScaleEventHistory = 20
+
+// scaleEvent describes a single scale decision and its outcome. It is the
+// record shared by every sink that reports on scaling activity.
+type scaleEvent struct {
+	Time        time.Time         `json:"time"`
+	OperationID string            `json:"operation_id"`
+	Target      string            `json:"target"`
+	Pool        string            `json:"pool,omitempty"`
+	Direction   string            `json:"direction"`
+	Current     int64             `json:"current_count"`
+	Desired     int64             `json:"desired_count"`
+	Deltas      map[string]int64  `json:"deltas,omitempty"`
+	Results     map[string]string `json:"results,omitempty"`
+	Nodes       []string          `json:"nodes,omitempty"`
+	DurationMs  int64             `json:"duration_ms"`
+	Result      string            `json:"result"`
+	Error       string            `json:"error,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+	Skipped     string            `json:"skipped,omitempty"`
+
+	lock  sync.Mutex
+	start time.Time
+}
+
+func newScaleEvent(action sdk.ScalingAction, config map[string]string) *scaleEvent {
+	now := time.Now()
+	return &scaleEvent{
+		Time:        now.UTC(),
+		OperationID: newOperationID(),
+		Target:      targetKey(config),
+		Pool:        config[configKeyPoolName],
+		Desired:     action.Count,
+		Reason:      action.Reason,
+		Deltas:      make(map[string]int64),
+		Results:     make(map[string]string),
+		start:       now,
+	}
+}
+
+func (e *scaleEvent) setDelta(vmScaleSet string, delta int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Deltas[vmScaleSet] = delta
+}
+
+// setResult records the outcome of the Azure operation on one scale set.
+func (e *scaleEvent) setResult(vmScaleSet string, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err != nil {
+		e.Results[vmScaleSet] = err.Error()
+		return
+	}
+	e.Results[vmScaleSet] = "success"
+}
+
+// encode returns the JSON form of the event, shared by the sinks that ship it
+// as is.
+func (e *scaleEvent) encode() ([]byte, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return json.Marshal(e)
+}
+
+func (e *scaleEvent) finish(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.DurationMs = time.Since(e.start).Milliseconds()
+	switch {
+	case err != nil:
+		e.Result = "failed"
+		e.Error = err.Error()
+	case e.Direction == "":
+		e.Result = "noop"
+	default:
+		e.Result = "success"
+	}
+}
+
+type scaleEventVariableConfig struct {
+	path    string
+	history int
+}
+
+func parseScaleEventVariableConfig(config map[string]string) (*scaleEventVariableConfig, error) {
+	path, ok := config[configKeyScaleEventVariable]
+	if !ok {
+		return nil, nil
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("invalid %s, path must not be empty", configKeyScaleEventVariable)
+	}
+
+	cfg := &scaleEventVariableConfig{path: path, history: defaultScaleEventHistory}
+	if value, ok := config[configKeyScaleEventHistory]; ok {
+		history, err := strconv.Atoi(value)
+		if err != nil || history <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyScaleEventHistory, value)
+		}
+		cfg.history = history
+	}
+	return cfg, nil
+}
+
+// nomadVariable is the subset of the Nomad Variables API payload the plugin
+// reads and writes. The vendored Nomad API predates Variables, so the raw
+// client is used.
+type nomadVariable struct {
+	Namespace   string            `json:",omitempty"`
+	Path        string            `json:",omitempty"`
+	Items       map[string]string `json:",omitempty"`
+	ModifyIndex uint64            `json:",omitempty"`
+}
+
+func readNomadVariable(client *api.Client, path string) (*nomadVariable, error) {
+	var variable nomadVariable
+	if _, err := client.Raw().Query("/v1/var/"+path, &variable, nil); err != nil {
+		if strings.Contains(err.Error(), "404") {
+			return &nomadVariable{Path: path, Items: make(map[string]string)}, nil
+		}
+		return nil, err
+	}
+	if variable.Items == nil {
+		variable.Items = make(map[string]string)
+	}
+	return &variable, nil
+}
+
+func writeNomadVariable(client *api.Client, variable *nomadVariable) error {
+	_, err := client.Raw().Write("/v1/var/"+variable.Path, variable, nil, nil)
+	return err
+}
+
+// scaleEventRecorder keeps the last scale events in a Nomad variable so that
+// operators can review scaling decisions through Nomad alone.
+type scaleEventRecorder struct {
+	lock   sync.Mutex
+	client *api.Client
+	cfg    *scaleEventVariableConfig
+}
+
+func (r *scaleEventRecorder) record(event *scaleEvent, log hclog.Logger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	variable, err := readNomadVariable(r.client, r.cfg.path)
+	if err != nil {
+		log.Warn("failed to read scale event variable", "path", r.cfg.path, "error", err)
+		return
+	}
+
+	var events []json.RawMessage
+	if existing, ok := variable.Items["events"]; ok {
+		if err := json.Unmarshal([]byte(existing), &events); err != nil {
+			log.Warn("discarding unreadable scale event history", "path", r.cfg.path, "error", err)
+			events = nil
+		}
+	}
+
+	encoded, err := event.encode()
+	if err != nil {
+		log.Warn("failed to encode scale event", "error", err)
+		return
+	}
+	events = append(events, encoded)
+	if len(events) > r.cfg.history {
+		events = events[len(events)-r.cfg.history:]
+	}
+
+	history, err := json.Marshal(events)
+	if err != nil {
+		log.Warn("failed to encode scale event history", "error", err)
+		return
+	}
+	variable.Path = r.cfg.path
+	variable.Items["events"] = string(history)
+	variable.Items["latest"] = string(encoded)
+
+	if err := writeNomadVariable(r.client, variable); err != nil {
+		log.Warn("failed to write scale event variable", "path", r.cfg.path, "error", err)
+	}
+}
+
+// publishScaleEvent hands a completed scale event to every configured sink.
+func (t *TargetPlugin) publishScaleEvent(event *scaleEvent) {
+	emitScaleEventMetrics(event)
+	t.history.record(event)
+	t.debugState.record(event)
+	if t.eventRecorder != nil {
+		t.eventRecorder.record(event, t.logger)
+	}
+	if t.auditLog != nil {
+		t.auditLog.record(event, t.logger)
+	}
+	if t.webhook != nil {
+		t.webhook.notify(event, t.logger)
+	}
+	if t.chat != nil {
+		t.chat.notify(event, t.logger)
+	}
+}
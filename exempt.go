@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+)
+
+// nodeMetaExemption makes the nodes carrying a meta key, with a value if it
+// is set, ineligible for scale in selection.
+type nodeMetaExemption struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// parseNodeMetaExemptions reads the comma separated key=value or key
+// entries that exempt a node from scale in.
+func parseNodeMetaExemptions(config map[string]string) ([]nodeMetaExemption, error) {
+	value, ok := config[configKeyScaleInExemptMeta]
+	if !ok {
+		return nil, nil
+	}
+	entries, err := splitList(config, configKeyScaleInExemptMeta, value)
+	if err != nil {
+		return nil, err
+	}
+	var exemptions []nodeMetaExemption
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, must be key=value or key", configKeyScaleInExemptMeta, entry)
+		}
+		exemptions = append(exemptions, nodeMetaExemption{key: key, value: strings.TrimSpace(value), anyValue: !hasValue})
+	}
+	if len(exemptions) == 0 {
+		return nil, fmt.Errorf("invalid %s %q, lists no meta key", configKeyScaleInExemptMeta, value)
+	}
+	return exemptions, nil
+}
+
+// exemptByMeta returns the exemption node matches, if any.
+func exemptByMeta(node *api.Node, exemptions []nodeMetaExemption) (nodeMetaExemption, bool) {
+	if node == nil {
+		return nodeMetaExemption{}, false
+	}
+	for _, exemption := range exemptions {
+		value, ok := node.Meta[exemption.key]
+		if ok && (exemption.anyValue || value == exemption.value) {
+			return exemption, true
+		}
+	}
+	return nodeMetaExemption{}, false
+}
+
+func (e nodeMetaExemption) String() string {
+	if e.anyValue {
+		return e.key
+	}
+	return e.key + "=" + e.value
+}
+
+// withoutExemptNodes drops the remote IDs whose node is exempt from scale in.
+// It returns the remote IDs kept and those dropped.
+func withoutExemptNodes(remoteIDs []string, exemptions []nodeMetaExemption, nodes map[string]*api.Node) ([]string, []string) {
+	if len(exemptions) == 0 {
+		return remoteIDs, nil
+	}
+	kept := make([]string, 0, len(remoteIDs))
+	var exempt []string
+	for _, remoteID := range remoteIDs {
+		if _, ok := exemptByMeta(nodes[strings.ToLower(remoteID)], exemptions); ok {
+			exempt = append(exempt, remoteID)
+			continue
+		}
+		kept = append(kept, remoteID)
+	}
+	return kept, exempt
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestParseNodeMetaExemptions(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    []nodeMetaExemption
+		wantErr bool
+	}{
+		{value: "scaling.exempt=true", want: []nodeMetaExemption{{key: "scaling.exempt", value: "true"}}},
+		{value: "scaling.exempt=true, team.hold", want: []nodeMetaExemption{
+			{key: "scaling.exempt", value: "true"},
+			{key: "team.hold", anyValue: true},
+		}},
+		{value: "debug=", want: []nodeMetaExemption{{key: "debug"}}},
+		{value: "=true", wantErr: true},
+		{value: " , ", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseNodeMetaExemptions(map[string]string{configKeyScaleInExemptMeta: c.value})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v, want error %t", c.value, err, c.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestWithoutExemptNodes(t *testing.T) {
+	exemptions := []nodeMetaExemption{{key: "scaling.exempt", value: "true"}, {key: "team.hold", anyValue: true}}
+	nodes := map[string]*api.Node{
+		"vmss_0": {Meta: map[string]string{"scaling.exempt": "true"}},
+		"vmss_1": {Meta: map[string]string{"scaling.exempt": "false"}},
+		"vmss_2": {Meta: map[string]string{"team.hold": "alice"}},
+		"vmss_3": {},
+	}
+	kept, exempt := withoutExemptNodes([]string{"vmss_0", "VMSS_1", "vmss_2", "vmss_3", "vmss_4"}, exemptions, nodes)
+	if want := []string{"VMSS_1", "vmss_3", "vmss_4"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if want := []string{"vmss_0", "vmss_2"}; !reflect.DeepEqual(exempt, want) {
+		t.Errorf("exempt %v, want %v", exempt, want)
+	}
+}
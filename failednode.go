@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFailedNodeCheckInterval = 5 * time.Minute
+
+	// nodeStatusDisconnected is the status of a client that lost its
+	// servers while allowed to reconnect. The API package predates it.
+	nodeStatusDisconnected = "disconnected"
+)
+
+type failedNodeConfig struct {
+	threshold time.Duration
+	interval  time.Duration
+}
+
+func parseFailedNodeConfig(config map[string]string) (*failedNodeConfig, error) {
+	thresholdStr, ok := config[configKeyFailedNodeThreshold]
+	if !ok {
+		return nil, nil
+	}
+	threshold, err := time.ParseDuration(thresholdStr)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyFailedNodeThreshold, thresholdStr)
+	}
+
+	cfg := &failedNodeConfig{threshold: threshold, interval: defaultFailedNodeCheckInterval}
+	if value, ok := config[configKeyFailedNodeCheckInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyFailedNodeCheckInterval, value)
+		}
+		cfg.interval = interval
+	}
+	return cfg, nil
+}
+
+func failedNodeStatus(status string) bool {
+	return status == api.NodeStatusDown || status == nodeStatusDisconnected
+}
+
+// failedNode reports whether a Nomad node has been down or disconnected for
+// longer than threshold.
+func failedNode(node *api.Node, threshold time.Duration, now time.Time) bool {
+	return failedNodeStatus(node.Status) && now.Sub(time.Unix(node.StatusUpdatedAt, 0)) >= threshold
+}
+
+// runFailedNodeReplacement periodically replaces the instances of Nomad
+// clients stuck down or disconnected. Such a client is wedged rather than
+// gone, as its Azure instance still exists and counts toward the capacity.
+func (t *TargetPlugin) runFailedNodeReplacement(ctx context.Context, cfg *failedNodeConfig) {
+	log := t.logger.With("task", "failed_node_replacement")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.replaceFailedNodes(ctx, config, cfg, log); err != nil {
+					log.Warn("failed to replace failed Nomad nodes", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) replaceFailedNodes(ctx context.Context, config map[string]string, cfg *failedNodeConfig, log hclog.Logger) error {
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+	stubs, _, err := cluster.client.Nodes().List(nil)
+	if err != nil {
+		return fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+	now := time.Now()
+	failed := make(map[string]string)
+	for _, stub := range stubs {
+		if !failedNodeStatus(stub.Status) {
+			continue
+		}
+		node, _, err := cluster.client.Nodes().Info(stub.ID, nil)
+		if err != nil {
+			return fmt.Errorf("failed to read Nomad node %s: %v", stub.ID, err)
+		}
+		if !failedNode(node, cfg.threshold, now) {
+			continue
+		}
+		if remoteID, err := t.nodeIDMap(node); err == nil {
+			failed[strings.ToLower(remoteID)] = node.ID
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	for _, member := range members {
+		if member.paused {
+			continue
+		}
+		instances, err := t.azureFor(member.resourceGroup, member.vmScaleSet).listInstances(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			return err
+		}
+		var instanceIDs, nodeIDs []string
+		for _, instance := range instances {
+			nodeID, ok := failed[strings.ToLower(instance.remoteID)]
+			if !ok {
+				continue
+			}
+			log.Warn("Nomad node failed while its Azure instance still exists", "node_id", nodeID,
+				"vmss_name", member.vmScaleSet, "remote_id", instance.remoteID)
+			instanceIDs = append(instanceIDs, instance.instanceID)
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+		if len(instanceIDs) == 0 {
+			continue
+		}
+
+		err = t.replaceStuckInstances(ctx, member, instanceIDs, log)
+		var inProgress *scaleInProgressError
+		if errors.As(err, &inProgress) {
+			log.Debug("skipping failed node replacement", "vmss_name", member.vmScaleSet, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", member.resourceGroup, member.vmScaleSet, err)
+		}
+		// The instances are gone, so are the nodes.
+		for _, nodeID := range nodeIDs {
+			if _, _, err := cluster.client.Nodes().Purge(nodeID, nil); err != nil {
+				log.Warn("failed to purge replaced Nomad node", "node_id", nodeID, "error", err)
+			}
+		}
+	}
+	return nil
+}
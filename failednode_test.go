@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestFailedNode(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		status string
+		since  time.Duration
+		want   bool
+	}{
+		{api.NodeStatusDown, time.Hour, true},
+		{nodeStatusDisconnected, time.Hour, true},
+		{api.NodeStatusDown, time.Minute, false},
+		{api.NodeStatusReady, time.Hour, false},
+		{api.NodeStatusInit, time.Hour, false},
+	}
+	for _, c := range cases {
+		node := &api.Node{Status: c.status, StatusUpdatedAt: now.Add(-c.since).Unix()}
+		if got := failedNode(node, 10*time.Minute, now); got != c.want {
+			t.Errorf("failedNode(%s for %s) = %t, want %t", c.status, c.since, got, c.want)
+		}
+	}
+}
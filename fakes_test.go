@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeScaleSets is an in-memory scaleSetClient. It holds the scale sets in
+// a simulated fleet, which the plugin reaches through the ARM clients when
+// it runs in simulate mode, so a test can drive Scale through the plugin and
+// check the result through the interface.
+type fakeScaleSets struct {
+	fleet *simFleet
+}
+
+var _ scaleSetClient = (*fakeScaleSets)(nil)
+
+// newFakeScaleSets returns fake scale sets which the simulate mode of every
+// plugin configured until the test ends is served from.
+func newFakeScaleSets(t *testing.T) *fakeScaleSets {
+	fleet := &simFleet{sets: make(map[string]*simScaleSet)}
+	previous := simulatedFleet
+	simulatedFleet = fleet
+	t.Cleanup(func() { simulatedFleet = previous })
+	return &fakeScaleSets{fleet: fleet}
+}
+
+func fakeScaleSetKey(resourceGroup, vmScaleSet string) string {
+	return strings.ToLower(fmt.Sprintf("subscriptions/%s/resourcegroups/%s/%s", simulatedSubscriptionID, resourceGroup, vmScaleSet))
+}
+
+// add creates a scale set with capacity running instances.
+func (f *fakeScaleSets) add(resourceGroup, vmScaleSet string, capacity int64) {
+	f.fleet.lock.Lock()
+	defer f.fleet.lock.Unlock()
+	set := &simScaleSet{
+		id: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s",
+			simulatedSubscriptionID, resourceGroup, vmScaleSet),
+		name: vmScaleSet,
+		tags: make(map[string]string),
+	}
+	set.resize(capacity, time.Now().Add(-time.Hour))
+	f.fleet.sets[fakeScaleSetKey(resourceGroup, vmScaleSet)] = set
+}
+
+// locked runs fn on a scale set with the fleet locked.
+func (f *fakeScaleSets) locked(resourceGroup, vmScaleSet string, fn func(set *simScaleSet)) error {
+	f.fleet.lock.Lock()
+	defer f.fleet.lock.Unlock()
+	set, ok := f.fleet.sets[fakeScaleSetKey(resourceGroup, vmScaleSet)]
+	if !ok {
+		return fmt.Errorf("scale set %s/%s not found", resourceGroup, vmScaleSet)
+	}
+	fn(set)
+	return nil
+}
+
+func (f *fakeScaleSets) getCapacity(_ context.Context, resourceGroup string, vmScaleSet string) (int64, error) {
+	var capacity int64
+	err := f.locked(resourceGroup, vmScaleSet, func(set *simScaleSet) { capacity = int64(len(set.instances)) })
+	return capacity, err
+}
+
+func (f *fakeScaleSets) listRunningInstances(_ context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error) {
+	var instances []vmssInstance
+	err := f.locked(resourceGroup, vmScaleSet, func(set *simScaleSet) {
+		for _, instance := range set.instances {
+			instances = append(instances, vmssInstance{
+				remoteID:          set.name + "_" + instance.id,
+				instanceID:        instance.id,
+				powerState:        "PowerState/running",
+				provisioningState: provisioningStateSucceeded,
+				provisionedAt:     instance.createdAt,
+			})
+		}
+	})
+	return instances, err
+}
+
+func (f *fakeScaleSets) setCapacity(_ context.Context, resourceGroup string, vmScaleSet string, capacity int64) error {
+	return f.locked(resourceGroup, vmScaleSet, func(set *simScaleSet) { set.resize(capacity, time.Now()) })
+}
+
+func (f *fakeScaleSets) deleteInstances(_ context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string) error {
+	return f.locked(resourceGroup, vmScaleSet, func(set *simScaleSet) {
+		deleted := make(map[string]bool, len(instanceIDs))
+		for _, id := range instanceIDs {
+			deleted[id] = true
+		}
+		kept := set.instances[:0]
+		for _, instance := range set.instances {
+			if !deleted[instance.id] {
+				kept = append(kept, instance)
+			}
+		}
+		set.instances = kept
+		set.generation++
+	})
+}
+
+// remoteIDs lists the remote IDs of the running instances of the scale sets
+// of a resource group, for a fake Nomad to register nodes for.
+func (f *fakeScaleSets) remoteIDs(resourceGroup string, vmScaleSets ...string) func(context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		var remoteIDs []string
+		for _, vmScaleSet := range vmScaleSets {
+			instances, err := f.listRunningInstances(ctx, resourceGroup, vmScaleSet)
+			if err != nil {
+				return nil, err
+			}
+			for _, instance := range instances {
+				remoteIDs = append(remoteIDs, instance.remoteID)
+			}
+		}
+		return remoteIDs, nil
+	}
+}
+
+// fakeNomad serves the parts of the Nomad API the scale in tasks use, with a
+// ready node for every remote ID instances lists. Drains complete at once and
+// purged nodes stay gone, even while their instance is still listed.
+type fakeNomad struct {
+	t         *testing.T
+	instances func(context.Context) ([]string, error)
+	class     string
+
+	lock    sync.Mutex
+	index   uint64
+	nodes   map[string]*api.Node
+	drained map[string]bool
+	purged  map[string]bool
+}
+
+func newFakeNomad(t *testing.T, class string, instances func(context.Context) ([]string, error)) *fakeNomad {
+	return &fakeNomad{
+		t:         t,
+		instances: instances,
+		class:     class,
+		index:     1,
+		nodes:     make(map[string]*api.Node),
+		drained:   make(map[string]bool),
+		purged:    make(map[string]bool),
+	}
+}
+
+// sync registers a node for every listed instance and drops the nodes of the
+// instances that are gone. New nodes are created in remote ID order, so the
+// newest_create_index selector picks the last remote IDs first.
+func (f *fakeNomad) sync(ctx context.Context) error {
+	remoteIDs, err := f.instances(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(remoteIDs))
+	for _, remoteID := range remoteIDs {
+		listed[remoteID] = true
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for id, node := range f.nodes {
+		if !listed[node.Attributes["unique.platform.azure.name"]] {
+			delete(f.nodes, id)
+		}
+	}
+	sort.Strings(remoteIDs)
+	for _, remoteID := range remoteIDs {
+		id := "node-" + strings.ReplaceAll(remoteID, "_", "-")
+		if _, ok := f.nodes[id]; ok || f.purged[id] {
+			continue
+		}
+		f.index++
+		f.nodes[id] = &api.Node{
+			ID:                    id,
+			Name:                  remoteID,
+			Datacenter:            "dc1",
+			NodeClass:             f.class,
+			Status:                api.NodeStatusReady,
+			SchedulingEligibility: api.NodeSchedulingEligible,
+			Attributes:            map[string]string{"unique.platform.azure.name": remoteID},
+			CreateIndex:           f.index,
+			ModifyIndex:           f.index,
+		}
+	}
+	return nil
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if r.URL.Query().Get("index") != "" {
+		// Stand in for a blocking query so drain monitoring does not spin.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	switch {
+	case path == "nodes" && r.Method == http.MethodGet:
+		if err := f.sync(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		stubs := make([]*api.NodeListStub, 0, len(f.nodes))
+		for _, node := range f.nodes {
+			stubs = append(stubs, &api.NodeListStub{
+				ID:                    node.ID,
+				Name:                  node.Name,
+				Datacenter:            node.Datacenter,
+				NodeClass:             node.NodeClass,
+				Status:                node.Status,
+				SchedulingEligibility: node.SchedulingEligibility,
+				Drain:                 node.DrainStrategy != nil,
+				CreateIndex:           node.CreateIndex,
+				ModifyIndex:           node.ModifyIndex,
+			})
+		}
+		sort.Slice(stubs, func(i, j int) bool { return stubs[i].ID < stubs[j].ID })
+		f.respond(w, stubs)
+	case path == "allocations" && r.Method == http.MethodGet:
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.respond(w, []*api.AllocationListStub{})
+	case strings.HasPrefix(path, "node/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "node/"), "/", 2)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		node, ok := f.nodes[parts[0]]
+		if !ok {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		var action string
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		f.serveNode(w, r, node, action)
+	default:
+		f.t.Logf("fake Nomad API does not serve %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+// serveNode answers a request on a node, with the lock held.
+func (f *fakeNomad) serveNode(w http.ResponseWriter, r *http.Request, node *api.Node, action string) {
+	switch action {
+	case "":
+		f.respond(w, node)
+	case "allocations":
+		f.respond(w, []*api.Allocation{})
+	case "drain":
+		f.index++
+		f.drained[node.ID] = true
+		node.SchedulingEligibility = api.NodeSchedulingIneligible
+		node.ModifyIndex = f.index
+		f.respond(w, api.NodeDrainUpdateResponse{NodeModifyIndex: f.index})
+	case "eligibility":
+		var req api.NodeUpdateEligibilityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.index++
+		node.SchedulingEligibility = req.Eligibility
+		node.ModifyIndex = f.index
+		f.respond(w, api.NodeEligibilityUpdateResponse{NodeModifyIndex: f.index})
+	case "purge":
+		f.index++
+		delete(f.nodes, node.ID)
+		f.purged[node.ID] = true
+		f.respond(w, api.NodePurgeResponse{NodeModifyIndex: f.index})
+	default:
+		f.t.Logf("fake Nomad API does not serve %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+// respond writes body with the query meta headers the Nomad API client
+// requires, with the lock held.
+func (f *fakeNomad) respond(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.index, 10))
+	w.Header().Set("X-Nomad-KnownLeader", "true")
+	w.Header().Set("X-Nomad-LastContact", "0")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		f.t.Errorf("failed to encode the fake Nomad response: %v", err)
+	}
+}
+
+// drainedNodes returns the IDs of the nodes drained so far, sorted.
+func (f *fakeNomad) drainedNodes() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	drained := make([]string, 0, len(f.drained))
+	for id := range f.drained {
+		drained = append(drained, id)
+	}
+	sort.Strings(drained)
+	return drained
+}
+
+// fakeARM is a Resource Manager serving the fake scale sets over HTTP. Scale
+// set updates and instance deletions are answered as long running operations,
+// whose first status poll is throttled and second reports them in progress.
+type fakeARM struct {
+	t      *testing.T
+	sim    autorest.Sender
+	server *httptest.Server
+
+	lock       sync.Mutex
+	operations map[string]int
+	throttled  int
+}
+
+func newFakeARM(t *testing.T, fake *fakeScaleSets) *fakeARM {
+	f := &fakeARM{
+		t:          t,
+		sim:        &simulateSender{sim: &simulation{}, fleet: fake.fleet},
+		operations: make(map[string]int),
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, `{"error":{"code":"AuthenticationFailed","message":"no token"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	if id := strings.TrimPrefix(r.URL.Path, "/operations/"); id != r.URL.Path {
+		w.Header().Set("Retry-After", "0")
+		polls := f.operations[id]
+		f.operations[id]++
+		switch polls {
+		case 0:
+			f.throttled++
+			http.Error(w, `{"error":{"code":"TooManyRequests","message":"throttled"}}`, http.StatusTooManyRequests)
+		case 1:
+			fmt.Fprint(w, `{"status":"InProgress"}`)
+		default:
+			fmt.Fprint(w, `{"status":"Succeeded"}`)
+		}
+		return
+	}
+
+	resp, err := f.sim.Do(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	status := resp.StatusCode
+	if status == http.StatusOK && (r.Method == http.MethodPatch || r.Method == http.MethodPost) {
+		id := strconv.Itoa(len(f.operations) + 1)
+		f.operations[id] = 0
+		w.Header().Set("Azure-AsyncOperation", f.server.URL+"/operations/"+id)
+		w.Header().Set("Retry-After", "0")
+		status = http.StatusAccepted
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		f.t.Errorf("failed to copy the fake Resource Manager response: %v", err)
+	}
+}
+
+// throttledPolls returns how many operation status polls were throttled.
+func (f *fakeARM) throttledPolls() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.throttled
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Faults understood by azure_fault_injection, given as fault=probability
+// pairs such as "throttle=0.1,delete_error=0.5". Fault injection is meant for
+// resilience testing only and must not be set on a production agent.
+const (
+	faultThrottle    = "throttle"
+	faultLROTimeout  = "lro_timeout"
+	faultDeleteError = "delete_error"
+	faultAuthExpiry  = "auth_expiry"
+)
+
+type faultInjection map[string]float64
+
+func parseFaultInjection(config map[string]string) (faultInjection, error) {
+	value, ok := config[configKeyAzureFaultInjection]
+	if !ok || value == "" {
+		return nil, nil
+	}
+	faults := make(faultInjection)
+	for _, pair := range strings.Split(value, ",") {
+		name, probability, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, must be fault=probability", configKeyAzureFaultInjection, pair)
+		}
+		switch name {
+		case faultThrottle, faultLROTimeout, faultDeleteError, faultAuthExpiry:
+		default:
+			return nil, fmt.Errorf("invalid %s fault %q, must be one of %s, %s, %s or %s", configKeyAzureFaultInjection,
+				name, faultThrottle, faultLROTimeout, faultDeleteError, faultAuthExpiry)
+		}
+		p, err := strconv.ParseFloat(probability, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid %s probability %q for %s, must be between 0 and 1", configKeyAzureFaultInjection, probability, name)
+		}
+		faults[name] = p
+	}
+	return faults, nil
+}
+
+func (f faultInjection) hit(name string) bool {
+	return f[name] > 0 && rand.Float64() < f[name]
+}
+
+// faultSender fails requests with the configured probabilities before they
+// reach Azure, shaped like the responses ARM gives so the retry and rollback
+// paths see what they would see in production.
+func faultSender(sender autorest.Sender, faults faultInjection) autorest.Sender {
+	if faults == nil {
+		return sender
+	}
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		path := strings.ToLower(r.URL.Path)
+		switch {
+		case faults.hit(faultAuthExpiry):
+			return faultResponse(r, http.StatusUnauthorized, "ExpiredAuthenticationToken", "injected fault: the access token expired"), nil
+		case faults.hit(faultThrottle):
+			resp := faultResponse(r, http.StatusTooManyRequests, "TooManyRequests", "injected fault: request was throttled")
+			resp.Header.Set("Retry-After", "1")
+			return resp, nil
+		case r.Method == http.MethodGet && strings.Contains(path, "/operations/") && faults.hit(faultLROTimeout):
+			return nil, fmt.Errorf("injected fault: long running operation poll timed out")
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/delete") && faults.hit(faultDeleteError):
+			return faultResponse(r, http.StatusInternalServerError, "InternalServerError", "injected fault: failed to delete instances"), nil
+		}
+		return sender.Do(r)
+	})
+}
+
+func faultResponse(r *http.Request, status int, code, message string) *http.Response {
+	body := fmt.Sprintf(`{"error":{"code":%q,"message":%q}}`, code, message)
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	return resp
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var freezeWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// freezeWindow is a period during which a target does not scale in. It is
+// either a one-off period between two RFC 3339 times, or a daily period
+// between two clock times on a set of weekdays; a daily period ending before
+// it starts runs past midnight and belongs to the day it starts on.
+type freezeWindow struct {
+	spec string
+
+	start, end time.Time
+
+	days         [7]bool
+	from, until  time.Duration
+	pastMidnight bool
+	everyWeekday bool
+}
+
+// scaleInFreeze is the list of windows of a target, in the time zone the
+// daily windows are given in.
+type scaleInFreeze struct {
+	windows  []freezeWindow
+	location *time.Location
+}
+
+// parseScaleInFreeze reads windows separated by semicolons, such as
+// "mon-fri 09:00-17:00; 2026-12-20T00:00:00Z/2027-01-04T00:00:00Z".
+func parseScaleInFreeze(config map[string]string) (*scaleInFreeze, error) {
+	value := strings.TrimSpace(config[configKeyScaleInFreezeWindows])
+	if value == "" {
+		return nil, nil
+	}
+	freeze := &scaleInFreeze{location: time.UTC}
+	if zone, ok := config[configKeyScaleInFreezeTimezone]; ok {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", configKeyScaleInFreezeTimezone, zone)
+		}
+		freeze.location = location
+	}
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		window, err := parseFreezeWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyScaleInFreezeWindows, spec, err)
+		}
+		freeze.windows = append(freeze.windows, window)
+	}
+	if len(freeze.windows) == 0 {
+		return nil, nil
+	}
+	return freeze, nil
+}
+
+func parseFreezeWindow(spec string) (freezeWindow, error) {
+	window := freezeWindow{spec: spec}
+	if from, until, ok := strings.Cut(spec, "/"); ok {
+		start, err := time.Parse(time.RFC3339, strings.TrimSpace(from))
+		if err != nil {
+			return window, err
+		}
+		end, err := time.Parse(time.RFC3339, strings.TrimSpace(until))
+		if err != nil {
+			return window, err
+		}
+		if !end.After(start) {
+			return window, fmt.Errorf("end is not after start")
+		}
+		window.start, window.end = start, end
+		return window, nil
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		window.everyWeekday = true
+	case 2:
+		if err := window.parseDays(fields[0]); err != nil {
+			return window, err
+		}
+	default:
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+	from, until, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return window, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	var err error
+	if window.from, err = parseClock(from); err != nil || window.from == 24*time.Hour {
+		return window, fmt.Errorf("invalid time of day %q", from)
+	}
+	if window.until, err = parseClock(until); err != nil {
+		return window, err
+	}
+	if window.from == window.until {
+		return window, fmt.Errorf("window is empty")
+	}
+	window.pastMidnight = window.until < window.from
+	return window, nil
+}
+
+// parseDays reads comma separated weekdays and weekday ranges, "mon-fri,sun".
+func (w *freezeWindow) parseDays(value string) error {
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := freezeWeekdays[first]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = freezeWeekdays[last]; !ok {
+				return fmt.Errorf("unknown weekday %q", last)
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock reads a HH:MM time of day, 24:00 being the end of the day.
+func parseClock(value string) (time.Duration, error) {
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+func (w freezeWindow) onDay(day time.Weekday) bool {
+	return w.everyWeekday || w.days[day]
+}
+
+func (w freezeWindow) contains(now time.Time) bool {
+	if !w.start.IsZero() {
+		return !now.Before(w.start) && now.Before(w.end)
+	}
+	// The wall clock is used rather than the time since midnight, which
+	// is off by the shift on daylight saving days.
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if !w.pastMidnight {
+		return w.onDay(now.Weekday()) && clock >= w.from && clock < w.until
+	}
+	// The early hours of a window past midnight belong to the day before.
+	return (w.onDay(now.Weekday()) && clock >= w.from) ||
+		(w.onDay((now.Weekday()+6)%7) && clock < w.until)
+}
+
+// active returns the window the time falls in, if any.
+func (f *scaleInFreeze) active(now time.Time) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	now = now.In(f.location)
+	for _, window := range f.windows {
+		if window.contains(now) {
+			return window.spec, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+	"time"
+)
+
+const (
+	ghostNodeActionPurge      = "purge"
+	ghostNodeActionIneligible = "ineligible"
+
+	// nodeAttributeResourceGroup is set by the Nomad Azure fingerprint.
+	nodeAttributeResourceGroup = "platform.azure.resource-group"
+)
+
+type ghostNodeConfig struct {
+	interval time.Duration
+	action   string
+}
+
+func parseGhostNodeConfig(config map[string]string) (*ghostNodeConfig, error) {
+	intervalStr, ok := config[configKeyGhostNodeGCInterval]
+	if !ok {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyGhostNodeGCInterval, intervalStr)
+	}
+
+	action := ghostNodeActionPurge
+	if value, ok := config[configKeyGhostNodeGCAction]; ok {
+		action = value
+	}
+	if action != ghostNodeActionPurge && action != ghostNodeActionIneligible {
+		return nil, fmt.Errorf("invalid %s %q, must be %q or %q",
+			configKeyGhostNodeGCAction, action, ghostNodeActionPurge, ghostNodeActionIneligible)
+	}
+
+	return &ghostNodeConfig{interval: interval, action: action}, nil
+}
+
+// runGhostNodeGC periodically looks for Nomad nodes that map onto one of the
+// observed scale sets but whose Azure instance no longer exists, such as after
+// a spot eviction or a manual deletion.
+func (t *TargetPlugin) runGhostNodeGC(ctx context.Context, cfg *ghostNodeConfig) {
+	log := t.logger.With("task", "ghost_node_gc")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.collectGhostNodes(ctx, config, cfg.action, log); err != nil {
+					log.Warn("failed to collect ghost nodes", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) collectGhostNodes(ctx context.Context, config map[string]string, action string, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	instances := make(map[string]map[string]struct{})
+	resourceGroups := make(map[string]string, len(vmScaleSetList))
+	for idx, vmScaleSet := range vmScaleSetList {
+		names, err := t.azureFor(resourceGroupList[idx], vmScaleSet).listInstanceNames(ctx, resourceGroupList[idx], vmScaleSet)
+		if err != nil {
+			return err
+		}
+		instances[vmssKey(resourceGroupList[idx], vmScaleSet)] = names
+		resourceGroups[strings.ToLower(vmScaleSet)] = resourceGroupList[idx]
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+
+	nodes, _, err := cluster.client.Nodes().List(nil)
+	if err != nil {
+		return fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+
+	for _, stub := range nodes {
+		// Ready nodes are heartbeating, so their instance is alive even if the
+		// listing raced with its creation.
+		if stub.Status == api.NodeStatusReady {
+			continue
+		}
+
+		node, _, err := cluster.client.Nodes().Info(stub.ID, nil)
+		if err != nil {
+			return fmt.Errorf("failed to read Nomad node %s: %v", stub.ID, err)
+		}
+		remoteID, err := t.nodeIDMap(node)
+		if err != nil {
+			continue
+		}
+
+		idx := strings.LastIndex(remoteID, "_")
+		if idx == -1 {
+			continue
+		}
+		// The remote ID only names the scale set; the resource group the
+		// Azure fingerprint reports keeps a node of a same named set
+		// elsewhere from being taken for a ghost of a member.
+		resourceGroup, ok := resourceGroups[strings.ToLower(remoteID[:idx])]
+		if !ok {
+			continue
+		}
+		if nodeGroup := node.Attributes[nodeAttributeResourceGroup]; nodeGroup != "" {
+			resourceGroup = nodeGroup
+		}
+		names, ok := instances[vmssKey(resourceGroup, remoteID[:idx])]
+		if !ok {
+			continue
+		}
+		if _, ok := names[strings.ToLower(remoteID)]; ok {
+			continue
+		}
+
+		switch action {
+		case ghostNodeActionIneligible:
+			if node.SchedulingEligibility == api.NodeSchedulingIneligible {
+				continue
+			}
+			if _, err := cluster.client.Nodes().ToggleEligibility(node.ID, false, nil); err != nil {
+				return fmt.Errorf("failed to mark ghost node %s ineligible: %v", node.ID, err)
+			}
+		default:
+			if _, _, err := cluster.client.Nodes().Purge(node.ID, nil); err != nil {
+				return fmt.Errorf("failed to purge ghost node %s: %v", node.ID, err)
+			}
+		}
+		log.Info("collected ghost Nomad node", "node_id", node.ID, "remote_id", remoteID, "action", action)
+	}
+
+	return nil
+}
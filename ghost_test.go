@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestCollectGhostNodesKeysByResourceGroup(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 1)
+	fake.add("other", "a", 2)
+	// Nomad still lists a node for a_5, whose instance in the member set is
+	// gone.
+	listOther := fake.remoteIDs("other", "a")
+	nomad := newFakeNomad(t, "fake", func(ctx context.Context) ([]string, error) {
+		remoteIDs, err := listOther(ctx)
+		return append(remoteIDs, "a_5"), err
+	})
+	plugin := newFakePlugin(t, nomad)
+
+	if err := nomad.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	nomad.lock.Lock()
+	for id, node := range nomad.nodes {
+		node.Status = api.NodeStatusDown
+		// The ghost comes from a Nomad version whose fingerprint does not
+		// report the resource group.
+		if id != "node-a-5" {
+			node.Attributes[nodeAttributeResourceGroup] = "other"
+		}
+	}
+	nomad.lock.Unlock()
+
+	config := map[string]string{configKeyTargets: "rg/a", "node_class": "fake"}
+	if err := plugin.collectGhostNodes(context.Background(), config, ghostNodeActionPurge, plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	nomad.lock.Lock()
+	defer nomad.lock.Unlock()
+	if !nomad.purged["node-a-5"] {
+		t.Error("ghost node of the member set was not purged")
+	}
+	if nomad.purged["node-a-1"] {
+		t.Error("node of the same named set in another resource group was purged")
+	}
+}
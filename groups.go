@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// configKeyTargetGroupPrefix prefixes the plugin level keys defining named
+// target groups, as in "target_group.batch" = "rg/batch-a,rg/batch-b". The
+// value takes any form the targets key does. A group backing another Nomad
+// cluster than the plugin's sets its connection options below the group, as
+// in "target_group.batch.nomad_address" = "https://batch.nomad:4646".
+const configKeyTargetGroupPrefix = "target_group."
+
+// targetGroup is a named target group: its targets value, the list
+// separator of the plugin config it was written with and the Nomad
+// connection options of the group.
+type targetGroup struct {
+	targets   string
+	separator string
+	nomad     map[string]string
+}
+
+// parseTargetGroups returns the named target groups of the plugin config.
+func parseTargetGroups(config map[string]string) (map[string]targetGroup, error) {
+	groups := make(map[string]targetGroup)
+	options := make(map[string]map[string]string)
+	for key, value := range config {
+		if !strings.HasPrefix(key, configKeyTargetGroupPrefix) {
+			continue
+		}
+		name, option, _ := strings.Cut(strings.TrimPrefix(key, configKeyTargetGroupPrefix), ".")
+		if name == "" {
+			return nil, fmt.Errorf("%s needs a group name after the prefix", key)
+		}
+		if option != "" {
+			if !strings.HasPrefix(option, nomadConfigKeyPrefix) {
+				return nil, fmt.Errorf("%s is not a Nomad connection option, only %s* options can be set per group", key, nomadConfigKeyPrefix)
+			}
+			if options[name] == nil {
+				options[name] = make(map[string]string)
+			}
+			options[name][option] = value
+			continue
+		}
+		group := targetGroup{targets: value, separator: config[configKeyListSeparator]}
+		if _, err := parseScaleSetTargets(group.config()); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		groups[name] = group
+	}
+	for name, nomad := range options {
+		group, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("%s%s has Nomad connection options but no targets", configKeyTargetGroupPrefix, name)
+		}
+		group.nomad = nomad
+		groups[name] = group
+	}
+	return groups, nil
+}
+
+func (g targetGroup) config() map[string]string {
+	config := map[string]string{configKeyTargets: g.targets}
+	if g.separator != "" {
+		config[configKeyListSeparator] = g.separator
+	}
+	return config
+}
+
+// resolveTargetGroup returns the target config with the group it names, if
+// any, expanded into the targets key. Policies sharing a group share the
+// target, as they scale the same sets. The Nomad connection options of the
+// group apply where the target sets none of its own, so clusterFor connects
+// the target to the Nomad cluster of the group.
+func (t *TargetPlugin) resolveTargetGroup(config map[string]string) (map[string]string, error) {
+	name, ok := config[configKeyTargetGroup]
+	if !ok {
+		return config, nil
+	}
+	for _, key := range []string{configKeyTargets, configKeyTargetsFile, configKeyResourceGroupList, configKeyVMSSList} {
+		if _, ok := config[key]; ok {
+			return nil, fmt.Errorf("%s cannot be combined with %s", configKeyTargetGroup, key)
+		}
+	}
+	group, ok := t.targetGroups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q, it must be defined as %s%s in the plugin config", configKeyTargetGroup, name, configKeyTargetGroupPrefix, name)
+	}
+	resolved := make(map[string]string, len(config)+2)
+	for key, value := range config {
+		resolved[key] = value
+	}
+	// The group is split on the separator it was written with.
+	delete(resolved, configKeyListSeparator)
+	for key, value := range group.config() {
+		resolved[key] = value
+	}
+	for key, value := range group.nomad {
+		if _, ok := resolved[key]; !ok {
+			resolved[key] = value
+		}
+	}
+	return resolved, nil
+}
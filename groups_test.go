@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestTargetGroupNomadCluster(t *testing.T) {
+	config := map[string]string{
+		configKeyTargetGroupPrefix + "batch":                 "rg/batch-a,rg/batch-b",
+		configKeyTargetGroupPrefix + "batch.nomad_address":   "http://batch.nomad:4646",
+		configKeyTargetGroupPrefix + "batch.nomad_namespace": "batch",
+		configKeyTargetGroupPrefix + "web":                   "rg/web",
+	}
+	groups, err := parseTargetGroups(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || len(groups["batch"].nomad) != 2 || groups["web"].nomad != nil {
+		t.Fatalf("got groups %+v", groups)
+	}
+
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.targetGroups = groups
+	plugin.nomadConfig = map[string]string{"nomad_address": "http://central.nomad:4646", "nomad_region": "global"}
+	plugin.clusters = newClusterCache()
+	if plugin.cluster, err = plugin.newNomadCluster(plugin.nomadConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := plugin.resolveTargetGroup(map[string]string{configKeyTargetGroup: "batch", "nomad_namespace": "batch-prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch["nomad_address"] != "http://batch.nomad:4646" || batch["nomad_namespace"] != "batch-prod" {
+		t.Errorf("got resolved config %v", batch)
+	}
+	cluster, err := plugin.clusterFor(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster == plugin.cluster || cluster.config["nomad_address"] != "http://batch.nomad:4646" || cluster.config["nomad_region"] != "global" {
+		t.Errorf("got cluster config %v", cluster.config)
+	}
+	if again, _ := plugin.clusterFor(batch); again != cluster {
+		t.Error("the cluster of the group was not reused")
+	}
+
+	web, err := plugin.resolveTargetGroup(map[string]string{configKeyTargetGroup: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster, _ := plugin.clusterFor(web); cluster != plugin.cluster {
+		t.Error("a group without Nomad options did not use the plugin cluster")
+	}
+
+	for _, invalid := range []map[string]string{
+		{configKeyTargetGroupPrefix + "batch": "rg/batch", configKeyTargetGroupPrefix + "batch.weight": "2"},
+		{configKeyTargetGroupPrefix + "other.nomad_address": "http://other.nomad:4646"},
+	} {
+		if _, err := parseTargetGroups(invalid); err == nil {
+			t.Errorf("got no error for %v", invalid)
+		}
+	}
+}
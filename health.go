@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	healthStateHealthy   = "HealthState/healthy"
+	healthStateUnhealthy = "HealthState/unhealthy"
+)
+
+// applicationHealthExtensions are the extension types of the Application
+// Health extension, which probes the application on every instance and
+// reports the result in the instance view.
+var applicationHealthExtensions = map[string]struct{}{
+	"applicationhealthlinux":   {},
+	"applicationhealthwindows": {},
+}
+
+func parseApplicationHealth(config map[string]string) (bool, error) {
+	value, ok := config[configKeyApplicationHealth]
+	if !ok {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", configKeyApplicationHealth, value, err)
+	}
+	return enabled, nil
+}
+
+// usesApplicationHealth reports whether the scale set model runs the
+// Application Health extension.
+func usesApplicationHealth(vmss compute.VirtualMachineScaleSet) bool {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil ||
+		vmss.VirtualMachineProfile.ExtensionProfile == nil || vmss.VirtualMachineProfile.ExtensionProfile.Extensions == nil {
+		return false
+	}
+	for _, extension := range *vmss.VirtualMachineProfile.ExtensionProfile.Extensions {
+		if extension.VirtualMachineScaleSetExtensionProperties == nil || extension.Type == nil {
+			continue
+		}
+		if _, ok := applicationHealthExtensions[strings.ToLower(*extension.Type)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listInstancesWithHealth lists the instances with their whole instance view,
+// as selecting the statuses alone leaves the health and the pending
+// maintenance out.
+func (ac *AzureController) listInstancesWithHealth(ctx context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error) {
+	return ac.queryInstances(ctx, resourceGroup, vmScaleSet, "", "")
+}
+
+func (ac *AzureController) listRunningInstancesWithHealth(ctx context.Context, resourceGroup string, vmScaleSet string) ([]vmssInstance, error) {
+	return ac.queryRunningInstances(ctx, resourceGroup, vmScaleSet, "")
+}
+
+// instanceHealthReady evaluates readiness from the application health of the
+// instances. Instances not reporting healthy block readiness once out of the
+// warm-up window, within the configured tolerance.
+func (r *readinessConfig) instanceHealthReady(instances []vmssInstance) bool {
+	if r.ignoreInstances {
+		return true
+	}
+
+	now := time.Now()
+	var blocked int64
+	for _, instance := range instances {
+		if strings.EqualFold(instance.health, healthStateHealthy) {
+			continue
+		}
+		if r.warmup > 0 && now.Sub(r.ages.since(instance)) < r.warmup {
+			continue
+		}
+		blocked++
+	}
+	return r.withinTolerance(blocked, int64(len(instances)))
+}
+
+// annotateApplicationHealth makes the application health of the instances of
+// a set running the extension part of its readiness, on top of the
+// provisioning states.
+func (t *TargetPlugin) annotateApplicationHealth(ctx context.Context, resourceGroup, vmScaleSet string, readiness *readinessConfig, status *sdk.TargetStatus, meta map[string]string) {
+	instances, err := t.azureFor(resourceGroup, vmScaleSet).listInstancesWithHealth(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		t.logger.Warn("failed to read application health, using provisioning state only", "vmss_name", vmScaleSet, "error", err)
+		return
+	}
+	t.instanceAges.observe(vmssKey(resourceGroup, vmScaleSet), instances)
+
+	var unhealthy int
+	for _, instance := range instances {
+		if strings.EqualFold(instance.health, healthStateUnhealthy) {
+			unhealthy++
+		}
+	}
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "unhealthy_instances")] = strconv.Itoa(unhealthy)
+	if !readiness.instanceHealthReady(instances) {
+		status.Ready = false
+	}
+}
+
+// unhealthyRemoteIDs returns the running instances the Application Health
+// extension reports unhealthy. It is empty unless the set was listed with
+// its health.
+func (s *setSnapshot) unhealthyRemoteIDs() map[string]bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unhealthy := make(map[string]bool)
+	for _, instance := range s.running {
+		if strings.EqualFold(instance.health, healthStateUnhealthy) {
+			unhealthy[instance.remoteID] = true
+		}
+	}
+	return unhealthy
+}
+
+// selectScaleInNodes runs the pre scale in tasks on num of the candidates.
+// Candidates of the preferred tiers with a node that can be drained are taken
+// first, tier by tier, and the node selector strategy only picks among the
+// rest for what is left.
+func selectScaleInNodes(ctx context.Context, utils *retryingScaleUtils, cfg map[string]string, remoteIDs []string, preferred []map[string]bool, nodes map[string]*api.Node, num int) ([]scaleutils.NodeResourceID, error) {
+	var ids []scaleutils.NodeResourceID
+	rest := remoteIDs
+	for _, tier := range preferred {
+		var picked, others []string
+		for _, remoteID := range rest {
+			if tier[remoteID] && drainable(nodes[strings.ToLower(remoteID)]) {
+				picked = append(picked, remoteID)
+			} else {
+				others = append(others, remoteID)
+			}
+		}
+		if len(picked) == 0 {
+			continue
+		}
+		selected, err := utils.RunPreScaleInTasksWithRemoteCheck(ctx, cfg, picked, min(num-len(ids), len(picked)))
+		ids = append(ids, selected...)
+		if err != nil || len(ids) >= num {
+			return ids, err
+		}
+		rest = others
+	}
+	if len(ids) == 0 {
+		return utils.RunPreScaleInTasksWithRemoteCheck(ctx, cfg, rest, num)
+	}
+	if len(rest) == 0 {
+		return ids, nil
+	}
+	more, err := utils.RunPreScaleInTasksWithRemoteCheck(ctx, cfg, rest, num-len(ids))
+	if err != nil {
+		// The preferred nodes are drained already and are removed
+		// along with the others the operation cleans up.
+		return ids, fmt.Errorf("selected %d preferred nodes but failed to select the remaining %d: %v", len(ids), num-len(ids), err)
+	}
+	return append(ids, more...), nil
+}
+
+// drainable reports whether the scale in tasks can select the node: it is
+// ready, eligible and not already draining.
+func drainable(node *api.Node) bool {
+	return node != nil && node.Status == api.NodeStatusReady &&
+		node.SchedulingEligibility == api.NodeSchedulingEligible && !node.Drain
+}
+
+// scaleInPreferences returns the tiers of instances a scale in removes first:
+// those the Application Health extension reports unhealthy, then, when
+// preferMaintenance is set, those with platform maintenance pending. The
+// registered nodes are fetched if the caller has not already.
+func (t *TargetPlugin) scaleInPreferences(snapshot *scaleSnapshot, client *api.Client, nodes map[string]*api.Node, preferMaintenance bool, log hclog.Logger) ([]map[string]bool, map[string]*api.Node) {
+	unhealthy := make(map[string]bool)
+	maintenance := make(map[string]bool)
+	for _, set := range snapshot.sets {
+		for remoteID := range set.unhealthyRemoteIDs() {
+			unhealthy[remoteID] = true
+		}
+		if preferMaintenance {
+			for remoteID := range set.maintenanceRemoteIDs() {
+				maintenance[remoteID] = true
+			}
+		}
+	}
+	if len(unhealthy) == 0 && len(maintenance) == 0 {
+		return nil, nodes
+	}
+	if nodes == nil {
+		var err error
+		if nodes, err = t.registeredNodes(client); err != nil {
+			log.Warn("failed to list Nomad nodes, not preferring unhealthy instances or instances pending maintenance", "error", err)
+			return nil, nil
+		}
+	}
+	return []map[string]bool{unhealthy, maintenance}, nodes
+}
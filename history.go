@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultScaleHistorySize = 5
+
+func parseScaleHistorySize(config map[string]string) (int, error) {
+	value, ok := config[configKeyScaleHistorySize]
+	if !ok {
+		return defaultScaleHistorySize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative integer", configKeyScaleHistorySize, value)
+	}
+	return size, nil
+}
+
+// scaleHistoryEntry is the compact record of one scale operation kept for
+// Status meta.
+type scaleHistoryEntry struct {
+	time      int64
+	direction string
+	delta     int64
+	result    string
+}
+
+func (e scaleHistoryEntry) String() string {
+	return fmt.Sprintf("%d:%s:%+d:%s", e.time, e.direction, e.delta, e.result)
+}
+
+// scaleHistory keeps a ring buffer of the most recent scale operations of
+// each target. A nil history records nothing.
+type scaleHistory struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string][]scaleHistoryEntry
+}
+
+func newScaleHistory(size int) *scaleHistory {
+	if size == 0 {
+		return nil
+	}
+	return &scaleHistory{size: size, entries: make(map[string][]scaleHistoryEntry)}
+}
+
+func (h *scaleHistory) record(event *scaleEvent) {
+	if h == nil {
+		return
+	}
+
+	event.lock.Lock()
+	entry := scaleHistoryEntry{time: event.Time.Unix(), direction: event.Direction, result: event.Result}
+	for _, delta := range event.Deltas {
+		entry.delta += delta
+	}
+	target := event.Target
+	event.lock.Unlock()
+	if entry.direction == "" {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries := append(h.entries[target], entry)
+	if len(entries) > h.size {
+		entries = entries[len(entries)-h.size:]
+	}
+	h.entries[target] = entries
+}
+
+// annotate writes the history of a target to Status meta, oldest first, as
+// comma separated "unix:direction:delta:result" entries.
+func (h *scaleHistory) annotate(target string, meta map[string]string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entries := h.entries[target]
+	if len(entries) == 0 {
+		return
+	}
+	summary := make([]string, len(entries))
+	for i, entry := range entries {
+		summary[i] = entry.String()
+	}
+	meta[metaKeyScaleHistory] = strings.Join(summary, ",")
+}
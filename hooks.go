@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Scale lifecycle phases a hook can be attached to.
+const (
+	hookPreScaleOut  = "pre_scale_out"
+	hookPostScaleOut = "post_scale_out"
+	hookPreDelete    = "pre_node_delete"
+	hookPostScaleIn  = "post_scale_in"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+var hookConfigKeys = map[string]string{
+	hookPreScaleOut:  configKeyHookPreScaleOut,
+	hookPostScaleOut: configKeyHookPostScaleOut,
+	hookPreDelete:    configKeyHookPreDelete,
+	hookPostScaleIn:  configKeyHookPostScaleIn,
+}
+
+// scaleHooks runs the hooks of a target. A hook is an http or https URL,
+// which is sent the payload as a JSON POST, or a command run through the
+// shell with the payload on stdin. A nil set of hooks runs nothing.
+type scaleHooks struct {
+	hooks   map[string]string
+	timeout time.Duration
+}
+
+// hookPayload is what a hook receives about the scale operation.
+type hookPayload struct {
+	Phase       string              `json:"phase"`
+	OperationID string              `json:"operation_id"`
+	Target      string              `json:"target"`
+	Direction   string              `json:"direction"`
+	Current     int64               `json:"current_count"`
+	Desired     int64               `json:"desired_count"`
+	Deltas      map[string]int64    `json:"deltas,omitempty"`
+	Nodes       []string            `json:"nodes,omitempty"`
+	InstanceIDs map[string][]string `json:"instance_ids,omitempty"`
+}
+
+func parseScaleHooks(config map[string]string) (*scaleHooks, error) {
+	h := &scaleHooks{hooks: make(map[string]string), timeout: defaultHookTimeout}
+	for phase, key := range hookConfigKeys {
+		if value := strings.TrimSpace(config[key]); value != "" {
+			h.hooks[phase] = value
+		}
+	}
+	if value, ok := config[configKeyHookTimeout]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyHookTimeout, value)
+		}
+		h.timeout = timeout
+	}
+	if len(h.hooks) == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// scaleHooks returns the hooks of a target, the target config overriding
+// the plugin level hooks phase by phase.
+func (t *TargetPlugin) scaleHooks(config map[string]string) (*scaleHooks, error) {
+	merged := make(map[string]string, len(t.hookDefaults)+len(hookConfigKeys)+1)
+	for key, value := range t.hookDefaults {
+		merged[key] = value
+	}
+	for _, key := range append([]string{configKeyHookTimeout}, hookKeys()...) {
+		if value, ok := config[key]; ok {
+			merged[key] = value
+		}
+	}
+	return parseScaleHooks(merged)
+}
+
+func hookKeys() []string {
+	keys := make([]string, 0, len(hookConfigKeys))
+	for _, key := range hookConfigKeys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func parseHookDefaults(config map[string]string) (map[string]string, error) {
+	defaults := make(map[string]string)
+	for _, key := range append([]string{configKeyHookTimeout}, hookKeys()...) {
+		if value, ok := config[key]; ok {
+			defaults[key] = value
+		}
+	}
+	if _, err := parseScaleHooks(defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+func (e *scaleEvent) hookPayload(phase string, instanceIDs map[string][]string) hookPayload {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	deltas := make(map[string]int64, len(e.Deltas))
+	for vmScaleSet, delta := range e.Deltas {
+		deltas[vmScaleSet] = delta
+	}
+	return hookPayload{
+		Phase:       phase,
+		OperationID: e.OperationID,
+		Target:      e.Target,
+		Direction:   e.Direction,
+		Current:     e.Current,
+		Desired:     e.Desired,
+		Deltas:      deltas,
+		Nodes:       append([]string(nil), e.Nodes...),
+		InstanceIDs: instanceIDs,
+	}
+}
+
+// run runs the hook of the payload phase, if any, waiting for it up to the
+// hook timeout.
+func (h *scaleHooks) run(ctx context.Context, payload hookPayload, log hclog.Logger) error {
+	if h == nil || h.hooks[payload.Phase] == "" {
+		return nil
+	}
+	hook := h.hooks[payload.Phase]
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = runHTTPHook(ctx, hook, body)
+	} else {
+		err = runCommandHook(ctx, hook, payload, body)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %v", payload.Phase, err)
+	}
+	log.Debug("ran scale hook", "phase", payload.Phase, "duration", time.Since(start))
+	return nil
+}
+
+func runHTTPHook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cleanhttp.DefaultClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func runCommandHook(ctx context.Context, command string, payload hookPayload, body []byte) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"NOMAD_AUTOSCALER_HOOK_PHASE="+payload.Phase,
+		"NOMAD_AUTOSCALER_OPERATION_ID="+payload.OperationID,
+		"NOMAD_AUTOSCALER_TARGET="+payload.Target,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
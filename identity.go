@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"sort"
+	"strings"
+)
+
+const (
+	nodeIdentityLowercase = "lowercase"
+	nodeIdentityTrim      = "trim"
+	nodeIdentityNone      = "none"
+)
+
+// nodeIdentity is how remote IDs are normalized on both sides of matching
+// Nomad nodes onto Azure instances. The cluster scale utils compare the
+// remote ID of a node with those of the instances exactly, while Azure and
+// the Nomad fingerprint do not agree on the casing of the scale set name.
+type nodeIdentity struct {
+	lowercase bool
+	trim      bool
+}
+
+// parseNodeIdentity reads the normalization applied to remote IDs, a list of
+// lowercase and trim, or none to compare them as they are. Both are applied
+// by default.
+func parseNodeIdentity(config map[string]string) (nodeIdentity, error) {
+	value, ok := config[configKeyNodeIdentity]
+	if !ok {
+		return nodeIdentity{lowercase: true, trim: true}, nil
+	}
+	var identity nodeIdentity
+	for _, option := range strings.Split(value, ",") {
+		switch strings.TrimSpace(option) {
+		case nodeIdentityLowercase:
+			identity.lowercase = true
+		case nodeIdentityTrim:
+			identity.trim = true
+		case nodeIdentityNone:
+		default:
+			return identity, fmt.Errorf("invalid %s %q, must be a list of %s and %s, or %s", configKeyNodeIdentity,
+				value, nodeIdentityLowercase, nodeIdentityTrim, nodeIdentityNone)
+		}
+	}
+	return identity, nil
+}
+
+func (n nodeIdentity) normalize(remoteID string) string {
+	if n.trim {
+		remoteID = strings.TrimSpace(remoteID)
+	}
+	if n.lowercase {
+		remoteID = strings.ToLower(remoteID)
+	}
+	return remoteID
+}
+
+// normalizeAll returns the remote IDs normalized, leaving remoteIDs as is.
+func (n nodeIdentity) normalizeAll(remoteIDs []string) []string {
+	if !n.lowercase && !n.trim {
+		return remoteIDs
+	}
+	normalized := make([]string, len(remoteIDs))
+	for idx, remoteID := range remoteIDs {
+		normalized[idx] = n.normalize(remoteID)
+	}
+	return normalized
+}
+
+func (n nodeIdentity) String() string {
+	var options []string
+	if n.lowercase {
+		options = append(options, nodeIdentityLowercase)
+	}
+	if n.trim {
+		options = append(options, nodeIdentityTrim)
+	}
+	if len(options) == 0 {
+		return nodeIdentityNone
+	}
+	return strings.Join(options, ",")
+}
+
+// unmatchedIdentities compares the remote IDs of the running instances of
+// the member sets with those the nodes of the sets resolve to, the way the
+// cluster scale utils do, returning the instances no node resolves to and the
+// nodes that resolve to no instance. A node belongs to a set when its remote
+// ID names the set in any casing, so the nodes a casing difference hides are
+// reported too.
+func unmatchedIdentities(instances []string, nodeRemoteIDs map[string]string, vmScaleSets []string) ([]string, []string) {
+	matched := make(map[string]bool, len(nodeRemoteIDs))
+	for _, remoteID := range nodeRemoteIDs {
+		matched[remoteID] = false
+	}
+	var unmatchedInstances []string
+	for _, remoteID := range instances {
+		if _, ok := matched[remoteID]; ok {
+			matched[remoteID] = true
+			continue
+		}
+		unmatchedInstances = append(unmatchedInstances, remoteID)
+	}
+
+	var unmatchedNodes []string
+	for nodeID, remoteID := range nodeRemoteIDs {
+		if matched[remoteID] {
+			continue
+		}
+		sep := strings.LastIndex(remoteID, "_")
+		if sep < 0 {
+			continue
+		}
+		for _, vmScaleSet := range vmScaleSets {
+			if strings.EqualFold(strings.TrimSpace(remoteID[:sep]), vmScaleSet) {
+				unmatchedNodes = append(unmatchedNodes, fmt.Sprintf("%s (%s)", nodeID, remoteID))
+				break
+			}
+		}
+	}
+	sort.Strings(unmatchedInstances)
+	sort.Strings(unmatchedNodes)
+	return unmatchedInstances, unmatchedNodes
+}
+
+// logUnmatchedIdentities logs the running instances of the member sets and
+// the nodes of the sets that do not match by remote ID, for a scale in that
+// did not find as many nodes as asked for. The instances are those the scale
+// listed already; the nodes are listed here unless the scale did.
+func (t *TargetPlugin) logUnmatchedIdentities(snapshot *scaleSnapshot, client *api.Client, nodes map[string]*api.Node, log hclog.Logger) {
+	if nodes == nil {
+		var err error
+		if nodes, err = t.registeredNodes(client); err != nil {
+			log.Warn("failed to list Nomad nodes to diagnose the nodes and instances that did not match", "error", err)
+			return
+		}
+	}
+	nodeRemoteIDs := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		if remoteID, err := t.nodeIDMap(node); err == nil {
+			nodeRemoteIDs[node.ID] = remoteID
+		}
+	}
+
+	var instances []string
+	vmScaleSets := make([]string, 0, len(snapshot.sets))
+	for _, set := range snapshot.sets {
+		vmScaleSets = append(vmScaleSets, set.vmScaleSet)
+		set.lock.Lock()
+		for _, instance := range set.running {
+			instances = append(instances, t.nodeIdentity.normalize(instance.remoteID))
+		}
+		set.lock.Unlock()
+	}
+
+	unmatchedInstances, unmatchedNodes := unmatchedIdentities(instances, nodeRemoteIDs, vmScaleSets)
+	if len(unmatchedInstances) == 0 && len(unmatchedNodes) == 0 {
+		return
+	}
+	log.Warn("nodes and instances did not match by remote ID", "normalization", t.nodeIdentity,
+		"unmatched_instances", unmatchedInstances, "unmatched_nodes", unmatchedNodes)
+}
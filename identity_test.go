@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestParseNodeIdentity(t *testing.T) {
+	cases := []struct {
+		value   string
+		unset   bool
+		want    nodeIdentity
+		wantErr bool
+	}{
+		{unset: true, want: nodeIdentity{lowercase: true, trim: true}},
+		{value: "lowercase", want: nodeIdentity{lowercase: true}},
+		{value: "trim, lowercase", want: nodeIdentity{lowercase: true, trim: true}},
+		{value: "none", want: nodeIdentity{}},
+		{value: "upper", wantErr: true},
+	}
+	for _, c := range cases {
+		config := map[string]string{}
+		if !c.unset {
+			config[configKeyNodeIdentity] = c.value
+		}
+		got, err := parseNodeIdentity(config)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v, want error %t", c.value, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && got != c.want {
+			t.Errorf("%q: got %+v, want %+v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestNodeIDMapNormalized(t *testing.T) {
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.nodeIdentity = nodeIdentity{lowercase: true, trim: true}
+	node := &api.Node{ID: "node-1", Attributes: map[string]string{"unique.platform.azure.name": " Pool-VMSS_3 "}}
+	remoteID, err := plugin.nodeIDMap(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "pool-vmss_3"; remoteID != want {
+		t.Errorf("got remote ID %q, want %q", remoteID, want)
+	}
+
+	plugin.nodeIdentity = nodeIdentity{}
+	if remoteID, _ := plugin.nodeIDMap(node); remoteID != " Pool-VMSS_3 " {
+		t.Errorf("got remote ID %q with no normalization", remoteID)
+	}
+}
+
+func TestUnmatchedIdentities(t *testing.T) {
+	nodes := map[string]string{
+		"node-1": "pool-vmss_1",
+		"node-2": "Pool-VMSS_2",
+		"node-3": "other_7",
+	}
+	instances, unmatched := unmatchedIdentities([]string{"pool-vmss_1", "pool-vmss_2"}, nodes, []string{"pool-vmss"})
+	if want := []string{"pool-vmss_2"}; !reflect.DeepEqual(instances, want) {
+		t.Errorf("got unmatched instances %v, want %v", instances, want)
+	}
+	if want := []string{"node-2 (Pool-VMSS_2)"}; !reflect.DeepEqual(unmatched, want) {
+		t.Errorf("got unmatched nodes %v, want %v", unmatched, want)
+	}
+
+	identity := nodeIdentity{lowercase: true}
+	normalized := map[string]string{"node-2": identity.normalize(nodes["node-2"])}
+	instances, unmatched = unmatchedIdentities(identity.normalizeAll([]string{"Pool-vmss_2"}), normalized, []string{"Pool-vmss"})
+	if len(instances) != 0 || len(unmatched) != 0 {
+		t.Errorf("got unmatched instances %v and nodes %v once normalized", instances, unmatched)
+	}
+}
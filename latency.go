@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultSlowCallThreshold = 30 * time.Second
+
+func parseSlowCallThreshold(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeySlowCallThreshold]
+	if !ok {
+		return defaultSlowCallThreshold, nil
+	}
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeySlowCallThreshold, value)
+	}
+	return threshold, nil
+}
+
+// callTrace collects the ARM request ID of the requests a controller call
+// makes, so a slow call can be looked up on the Azure side.
+type callTrace struct {
+	lock      sync.Mutex
+	requestID string
+}
+
+type callTraceKey struct{}
+
+// traceRequest records the request ID of resp against the call its request
+// is made for, if any. The last request of a call, usually the final poll of
+// a long running operation, wins.
+func traceRequest(r *http.Request, resp *http.Response) {
+	trace, _ := r.Context().Value(callTraceKey{}).(*callTrace)
+	if trace == nil || resp == nil {
+		return
+	}
+	if id := resp.Header.Get("x-ms-request-id"); id != "" {
+		trace.lock.Lock()
+		trace.requestID = id
+		trace.lock.Unlock()
+	}
+}
+
+// timeCall times a controller call on a scale set, including the wait on a
+// long running operation it starts. The returned context traces the requests
+// of the call; done records its duration, and logs the call when it took
+// longer than the slow call threshold.
+func (ac *AzureController) timeCall(ctx context.Context, op, resourceGroup, vmScaleSet string) (context.Context, func()) {
+	trace := &callTrace{}
+	ctx = context.WithValue(ctx, callTraceKey{}, trace)
+	start := time.Now()
+	return ctx, func() {
+		labels := append(vmssLabels(resourceGroup, vmScaleSet), metrics.Label{Name: "operation", Value: op})
+		metrics.MeasureSinceWithLabels([]string{"azure", "call"}, start, labels)
+
+		elapsed := time.Since(start)
+		if ac.slowCallThreshold == 0 || elapsed < ac.slowCallThreshold {
+			return
+		}
+		logger := ac.logger
+		if logger == nil {
+			logger = hclog.NewNullLogger()
+		}
+		trace.lock.Lock()
+		requestID := trace.requestID
+		trace.lock.Unlock()
+		logger.Warn("slow Azure API call", "operation", op, "resource_group", resourceGroup, "vmss_name", vmScaleSet,
+			"duration", elapsed, "request_id", requestID, "operation_id", operationID(ctx))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+// slowScaleSetClient returns a scale set client whose reads take delay and
+// carry the request ID requestID.
+func slowScaleSetClient(delay time.Duration, requestID string) compute.VirtualMachineScaleSetsClient {
+	vmss := compute.NewVirtualMachineScaleSetsClientWithBaseURI("http://fake", "s")
+	vmss.Sender = instrumentSender(autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		time.Sleep(delay)
+		body := `{"sku":{"capacity":2}}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}, "X-Ms-Request-Id": []string{requestID}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	}))
+	return vmss
+}
+
+func TestSlowCallLogged(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		logged    bool
+	}{
+		{name: "slow", threshold: time.Millisecond, delay: 10 * time.Millisecond, logged: true},
+		{name: "fast", threshold: time.Minute, logged: false},
+		{name: "disabled", threshold: 0, delay: 10 * time.Millisecond, logged: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			ac := &AzureController{
+				vmss:              slowScaleSetClient(c.delay, "req-1"),
+				slowCallThreshold: c.threshold,
+				logger:            hclog.New(&hclog.LoggerOptions{Output: &out}),
+			}
+			capacity, err := ac.getCapacity(context.Background(), "rg", "vmss")
+			if err != nil || capacity != 2 {
+				t.Fatalf("getCapacity = %d, %v", capacity, err)
+			}
+			logged := strings.Contains(out.String(), "slow Azure API call")
+			if logged != c.logged {
+				t.Fatalf("logged %t, want %t: %s", logged, c.logged, out.String())
+			}
+			if logged && (!strings.Contains(out.String(), "request_id=req-1") || !strings.Contains(out.String(), "operation=get_capacity")) {
+				t.Errorf("slow call log lacks the request ID or operation: %s", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-uuid"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLeaderLeaseDuration = 30 * time.Second
+
+	// Azure Storage leases last between 15 and 60 seconds unless infinite,
+	// which a leader that died would hold forever.
+	minLeaderLeaseDuration = 15 * time.Second
+	maxLeaderLeaseDuration = 60 * time.Second
+
+	storageResource   = "https://storage.azure.com/"
+	storageAPIVersion = "2020-04-08"
+)
+
+// errStandby is returned by Scale on an autoscaler that does not hold the
+// leader lease.
+var errStandby = errors.New("autoscaler is the standby, scaling is left to the leader")
+
+// leaderElection elects one of several redundant autoscaler agents through
+// the lease of an Azure Storage blob. Only the agent holding the lease
+// scales and runs the background tasks that change scale sets or nodes; the
+// others serve Status. A nil election always leads.
+type leaderElection struct {
+	client   autorest.Client
+	blobURL  string
+	duration time.Duration
+	leaseID  string
+	holder   string
+	logger   hclog.Logger
+
+	leading atomic.Bool
+
+	lock sync.Mutex
+	// elected is closed, and replaced, whenever the lease is acquired.
+	elected chan struct{}
+}
+
+// newLeaderElection reads the leader lease config. The blob URL may carry a
+// SAS token, which then authorizes the lease requests; otherwise they are
+// authorized by the Azure credentials of the plugin. The lease ID derives
+// from the autoscaler instance, so an agent restarting within the lease
+// takes it back rather than waiting for it to expire.
+func newLeaderElection(config map[string]string, holder string, authorizers *authorizerCache, logger hclog.Logger) (*leaderElection, error) {
+	value, ok := config[configKeyLeaderLeaseBlob]
+	if !ok {
+		return nil, nil
+	}
+	blobURL, err := url.Parse(value)
+	if err != nil || blobURL.Host == "" || (blobURL.Scheme != "https" && blobURL.Scheme != "http") ||
+		len(strings.Split(strings.Trim(blobURL.Path, "/"), "/")) < 2 {
+		return nil, fmt.Errorf("invalid %s %q, must be the URL of a blob in a container", configKeyLeaderLeaseBlob, value)
+	}
+
+	election := &leaderElection{
+		blobURL:  value,
+		duration: defaultLeaderLeaseDuration,
+		holder:   holder,
+		logger:   logger.With("task", "leader_election"),
+		elected:  make(chan struct{}),
+	}
+	if value, ok := config[configKeyLeaderLeaseDuration]; ok {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < minLeaderLeaseDuration || duration > maxLeaderLeaseDuration || duration%time.Second != 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be whole seconds between %s and %s", configKeyLeaderLeaseDuration,
+				value, minLeaderLeaseDuration, maxLeaderLeaseDuration)
+		}
+		election.duration = duration
+	}
+
+	if holder != "" {
+		sum := sha256.Sum256([]byte(holder))
+		election.leaseID, err = uuid.FormatUUID(sum[:16])
+	} else {
+		election.leaseID, err = uuid.GenerateUUID()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate lease ID: %v", err)
+	}
+
+	sender, err := newAzureSender(config)
+	if err != nil {
+		return nil, err
+	}
+	election.client = autorest.NewClientWithUserAgent(pluginName)
+	election.client.Sender = sender
+	if blobURL.Query().Get("sig") == "" {
+		if election.client.Authorizer, err = authorizers.get(config, storageResource); err != nil {
+			return nil, err
+		}
+	}
+	return election, nil
+}
+
+// isLeader reports whether the agent holds the lease.
+func (l *leaderElection) isLeader() bool {
+	return l == nil || l.leading.Load()
+}
+
+// wait blocks until the agent holds the lease, returning false when ctx ends
+// first.
+func (l *leaderElection) wait(ctx context.Context) bool {
+	for {
+		l.lock.Lock()
+		elected := l.elected
+		l.lock.Unlock()
+		if l.isLeader() {
+			return true
+		}
+		select {
+		case <-elected:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// run keeps trying to acquire the lease, and renews it once held, until ctx
+// ends. The lease is renewed three times per duration, so renewals failing
+// transiently do not lose it. A leader releases it on the way out.
+func (l *leaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		l.elect(ctx)
+		select {
+		case <-ctx.Done():
+			if l.leading.Swap(false) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := l.lease(ctx, "release"); err != nil {
+					l.logger.Warn("failed to release the leader lease, the standby takes over once it expires", "error", err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *leaderElection) elect(ctx context.Context) {
+	if l.leading.Load() {
+		err := l.lease(ctx, "renew")
+		if err == nil {
+			return
+		}
+		// The lease may still be valid until it expires, but
+		// mutations stop now so they cannot overlap with a new leader.
+		l.leading.Store(false)
+		l.logger.Warn("lost the leader lease, standing by", "error", err)
+	}
+
+	err := l.lease(ctx, "acquire")
+	var storageErr *storageError
+	if errors.As(err, &storageErr) && storageErr.code == "BlobNotFound" {
+		if err = l.createBlob(ctx); err == nil {
+			err = l.lease(ctx, "acquire")
+		}
+	}
+	switch {
+	case errors.As(err, &storageErr) && storageErr.code == "LeaseAlreadyPresent":
+		l.logger.Trace("the leader lease is held by another autoscaler, standing by")
+	case err != nil:
+		l.logger.Warn("failed to acquire the leader lease, standing by", "error", err)
+	default:
+		l.leading.Store(true)
+		l.lock.Lock()
+		close(l.elected)
+		l.elected = make(chan struct{})
+		l.lock.Unlock()
+		l.logger.Info("acquired the leader lease, scaling", "holder", l.holder, "lease_duration", l.duration)
+	}
+}
+
+// storageError is an error response of Azure Storage, with the code of its
+// x-ms-error-code header.
+type storageError struct {
+	status int
+	code   string
+}
+
+func (e *storageError) Error() string {
+	return fmt.Sprintf("Azure Storage responded %d %s", e.status, e.code)
+}
+
+// lease sends a lease action for the blob.
+func (l *leaderElection) lease(ctx context.Context, action string) error {
+	decorators := []autorest.PrepareDecorator{
+		autorest.WithHeader("x-ms-lease-action", action),
+	}
+	switch action {
+	case "acquire":
+		decorators = append(decorators,
+			autorest.WithHeader("x-ms-lease-duration", strconv.Itoa(int(l.duration/time.Second))),
+			autorest.WithHeader("x-ms-proposed-lease-id", l.leaseID))
+	default:
+		decorators = append(decorators, autorest.WithHeader("x-ms-lease-id", l.leaseID))
+	}
+	return l.send(ctx, map[string]interface{}{"comp": "lease"}, decorators...)
+}
+
+// createBlob creates the empty blob the lease is taken on, leaving a blob
+// another agent created meanwhile as it is.
+func (l *leaderElection) createBlob(ctx context.Context) error {
+	err := l.send(ctx, nil,
+		autorest.WithHeader("x-ms-blob-type", "BlockBlob"),
+		autorest.WithHeader("If-None-Match", "*"))
+	var storageErr *storageError
+	if errors.As(err, &storageErr) && storageErr.code == "BlobAlreadyExists" {
+		return nil
+	}
+	return err
+}
+
+func (l *leaderElection) send(ctx context.Context, query map[string]interface{}, decorators ...autorest.PrepareDecorator) error {
+	decorators = append([]autorest.PrepareDecorator{
+		autorest.AsPut(),
+		autorest.WithBaseURL(l.blobURL),
+		autorest.WithQueryParameters(query),
+		autorest.WithHeader("x-ms-version", storageAPIVersion),
+	}, decorators...)
+	if l.client.Authorizer != nil {
+		decorators = append(decorators, l.client.WithAuthorization())
+	}
+	req, err := autorest.CreatePreparer(decorators...).Prepare((&http.Request{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to prepare the lease request: %v", err)
+	}
+	resp, err := l.client.Sender.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the lease request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return &storageError{status: resp.StatusCode, code: resp.Header.Get("x-ms-error-code")}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+)
+
+// fakeLeaseBlob serves the blob and lease operations of Azure Storage for a
+// single blob.
+type fakeLeaseBlob struct {
+	lock    sync.Mutex
+	exists  bool
+	leaseID string
+}
+
+func (f *fakeLeaseBlob) Do(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status, code := http.StatusOK, ""
+	switch {
+	case r.URL.Query().Get("sig") == "":
+		status, code = http.StatusForbidden, "AuthenticationFailed"
+	case r.URL.Query().Get("comp") != "lease":
+		if f.exists {
+			status, code = http.StatusConflict, "BlobAlreadyExists"
+		} else {
+			f.exists, status = true, http.StatusCreated
+		}
+	case !f.exists:
+		status, code = http.StatusNotFound, "BlobNotFound"
+	default:
+		switch r.Header.Get("x-ms-lease-action") {
+		case "acquire":
+			proposed := r.Header.Get("x-ms-proposed-lease-id")
+			if f.leaseID != "" && f.leaseID != proposed {
+				status, code = http.StatusConflict, "LeaseAlreadyPresent"
+			} else {
+				f.leaseID, status = proposed, http.StatusCreated
+			}
+		case "renew", "release":
+			if f.leaseID != r.Header.Get("x-ms-lease-id") {
+				status, code = http.StatusConflict, "LeaseIdMismatchWithLeaseOperation"
+			} else if r.Header.Get("x-ms-lease-action") == "release" {
+				f.leaseID = ""
+			}
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"X-Ms-Error-Code": []string{code}},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func newTestLeaderElection(t *testing.T, blob *fakeLeaseBlob, holder string) *leaderElection {
+	election, err := newLeaderElection(map[string]string{
+		configKeyLeaderLeaseBlob: "https://account.blob.core.windows.net/leases/autoscaler?sv=2020-04-08&sig=test",
+	}, holder, newAuthorizerCache(), hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	election.client.Sender = autorest.SenderFunc(blob.Do)
+	return election
+}
+
+func TestLeaderElection(t *testing.T) {
+	blob := &fakeLeaseBlob{}
+	a := newTestLeaderElection(t, blob, "agent-a")
+	b := newTestLeaderElection(t, blob, "agent-b")
+
+	a.elect(context.Background())
+	b.elect(context.Background())
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("got leaders a=%v b=%v, want only a", a.isLeader(), b.isLeader())
+	}
+	if !blob.exists {
+		t.Error("the missing blob was not created")
+	}
+
+	// An agent restarting within its lease takes it back.
+	restarted := newTestLeaderElection(t, blob, "agent-a")
+	if restarted.elect(context.Background()); !restarted.isLeader() {
+		t.Error("restarted leader did not take its lease back")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	restarted.leading.Store(false)
+
+	waited := make(chan bool)
+	go func() { waited <- b.wait(context.Background()) }()
+	b.elect(context.Background())
+	select {
+	case ok := <-waited:
+		if !ok || !b.isLeader() {
+			t.Error("standby did not take over the released lease")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("standby still waiting for the lease")
+	}
+}
+
+func TestNewLeaderElection(t *testing.T) {
+	for _, config := range []map[string]string{
+		{configKeyLeaderLeaseBlob: "https://account.blob.core.windows.net/leases"},
+		{configKeyLeaderLeaseBlob: "not a url"},
+		{configKeyLeaderLeaseBlob: "https://account.blob.core.windows.net/leases/b?sig=x", configKeyLeaderLeaseDuration: "10s"},
+		{configKeyLeaderLeaseBlob: "https://account.blob.core.windows.net/leases/b?sig=x", configKeyLeaderLeaseDuration: "20500ms"},
+	} {
+		if _, err := newLeaderElection(config, "", newAuthorizerCache(), hclog.NewNullLogger()); err == nil {
+			t.Errorf("got no error for %v", config)
+		}
+	}
+	if election, err := newLeaderElection(map[string]string{}, "", newAuthorizerCache(), hclog.NewNullLogger()); election != nil || err != nil {
+		t.Errorf("got %v, %v without a lease blob", election, err)
+	}
+	var none *leaderElection
+	if !none.isLeader() {
+		t.Error("a nil election must lead")
+	}
+}
+
+func TestResumeCleanupsOnlyOnLeader(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 1)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+	if err := nomad.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	config := map[string]string{configKeyTargets: "rg/a", "node_class": "fake", "node_purge": "true"}
+	plugin.checkpoint(&operationCheckpoint{OperationID: "cleanup", Target: targetKey(config), Direction: checkpointDirectionCleanup,
+		Config: config, Sets: []checkpointScaleSet{{Nodes: []scaleutils.NodeResourceID{{NomadNodeID: "node-a-0", RemoteResourceID: "a_0"}}}}},
+		plugin.logger)
+
+	// A standby leaves the cleanup to the leader.
+	plugin.leader = &leaderElection{}
+	plugin.resumeCleanups(targetKey(config))
+	time.Sleep(50 * time.Millisecond)
+	if pending := plugin.operations.pendingCleanups(targetKey(config)); len(pending) != 1 {
+		t.Fatalf("got %d pending cleanups on a standby, want the cleanup kept", len(pending))
+	}
+
+	plugin.leader.leading.Store(true)
+	plugin.resumeCleanups(targetKey(config))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(plugin.operations.pendingCleanups(targetKey(config))) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending cleanup was not completed by the leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nomad.lock.Lock()
+	defer nomad.lock.Unlock()
+	if !nomad.purged["node-a-0"] {
+		t.Error("node of the cleanup was not purged")
+	}
+}
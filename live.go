@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strings"
+	"sync"
+)
+
+// defaultLiveExclude are the states that leave an instance out of the live
+// capacity: instances on their way out, and deallocated instances, which
+// Azure keeps in the set but which run nothing.
+var defaultLiveExclude = map[string]bool{
+	"provisioningstate/deleting": true,
+	"powerstate/deallocating":    true,
+	"powerstate/deallocated":     true,
+}
+
+// parseLiveExclude reads the power and provisioning states that leave an
+// instance out of the live capacity. An empty list counts every instance.
+func parseLiveExclude(config map[string]string) (map[string]bool, error) {
+	value, ok := config[configKeyLiveExclude]
+	if !ok {
+		return defaultLiveExclude, nil
+	}
+	excluded := make(map[string]bool)
+	for _, state := range strings.Split(value, ",") {
+		state = strings.TrimSpace(state)
+		if state == "" {
+			continue
+		}
+		if !strings.HasPrefix(state, "PowerState/") && !strings.HasPrefix(state, "ProvisioningState/") {
+			return nil, fmt.Errorf("invalid %s %q, %q is not a PowerState or ProvisioningState code", configKeyLiveExclude, value, state)
+		}
+		excluded[strings.ToLower(state)] = true
+	}
+	return excluded, nil
+}
+
+// counted reports whether the instance is part of the live capacity, none of
+// its states being excluded.
+func (i vmssInstance) counted(excluded map[string]bool) bool {
+	return !excluded[strings.ToLower(i.powerState)] && !excluded[strings.ToLower(i.provisioningState)]
+}
+
+// liveCount returns the number of instances counted toward the live
+// capacity.
+func (s vmssStatus) liveCount(excluded map[string]bool) int64 {
+	var count int64
+	for _, instance := range s.instances {
+		if instance.counted(excluded) {
+			count++
+		}
+	}
+	return count
+}
+
+// applyLiveCapacities replaces the capacities a scale plans from with the
+// number of instances Azure lists for every set the scale may change. The
+// capacity written for a set is still planned against its Sku.Capacity.
+func (t *TargetPlugin) applyLiveCapacities(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, excluded map[string]bool, log hclog.Logger) error {
+	errs := make([]error, len(members))
+	pool := newWorkerPool(t.readParallelism())
+	var wg sync.WaitGroup
+	for idx, set := range snapshot.sets {
+		if members[idx].missing || members[idx].paused {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, set *setSnapshot) {
+			defer wg.Done()
+			defer pool.acquire()()
+			instances, err := t.azureFor(set.resourceGroup, set.vmScaleSet).listInstances(ctx, set.resourceGroup, set.vmScaleSet)
+			if err != nil {
+				errs[idx] = err
+				return
+			}
+			var live int64
+			for _, instance := range instances {
+				if instance.counted(excluded) {
+					live++
+				}
+			}
+			if live != set.capacity {
+				log.Debug("planning from the live capacity of the scale set", "vmss_name", set.vmScaleSet,
+					"live_capacity", live, "sku_capacity", set.capacity)
+			}
+			capacities[idx] = live
+		}(idx, set)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to list the instances of %s/%s: %w", snapshot.sets[idx].resourceGroup, snapshot.sets[idx].vmScaleSet, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestParseLiveExclude(t *testing.T) {
+	if got, err := parseLiveExclude(map[string]string{}); err != nil || !reflect.DeepEqual(got, defaultLiveExclude) {
+		t.Errorf("got %v, %v without the key", got, err)
+	}
+	got, err := parseLiveExclude(map[string]string{configKeyLiveExclude: "PowerState/stopped, ProvisioningState/failed"})
+	if want := map[string]bool{"powerstate/stopped": true, "provisioningstate/failed": true}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v, want %v", got, err, want)
+	}
+	if got, err := parseLiveExclude(map[string]string{configKeyLiveExclude: ""}); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v for an empty list", got, err)
+	}
+	if _, err := parseLiveExclude(map[string]string{configKeyLiveExclude: "stopped"}); err == nil {
+		t.Error("got no error for a state without its kind")
+	}
+}
+
+func TestLiveCount(t *testing.T) {
+	status := vmssStatus{instances: []vmssInstance{
+		{powerState: "PowerState/running", provisioningState: "ProvisioningState/succeeded"},
+		{provisioningState: "ProvisioningState/creating"},
+		{powerState: "PowerState/running", provisioningState: "ProvisioningState/deleting"},
+		{powerState: "PowerState/deallocated", provisioningState: "ProvisioningState/succeeded"},
+	}}
+	if got := status.liveCount(defaultLiveExclude); got != 2 {
+		t.Errorf("got live count %d, want 2", got)
+	}
+	if got := status.liveCount(map[string]bool{}); got != 4 {
+		t.Errorf("got live count %d with no excluded state, want 4", got)
+	}
+}
+
+func TestApplyLiveCapacities(t *testing.T) {
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"value":[` +
+			`{"instanceId":"0","properties":{"instanceView":{"statuses":[{"code":"ProvisioningState/succeeded"},{"code":"PowerState/running"}]}}},` +
+			`{"instanceId":"1","properties":{"instanceView":{"statuses":[{"code":"ProvisioningState/creating"}]}}}]}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+
+	members := []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "growing", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "paused", weight: 1, paused: true},
+	}
+	snapshot := &scaleSnapshot{sets: []*setSnapshot{
+		{resourceGroup: "rg", vmScaleSet: "growing", capacity: 5},
+		{resourceGroup: "rg", vmScaleSet: "paused", capacity: 3},
+	}}
+	capacities := snapshot.capacities()
+	if err := plugin.applyLiveCapacities(context.Background(), members, snapshot, capacities, defaultLiveExclude, hclog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+	// An operation raising the capacity to 5 has two instances listed so
+	// far; the paused set is not listed.
+	if want := []int64{2, 3}; !reflect.DeepEqual(capacities, want) {
+		t.Errorf("got capacities %v, want %v", capacities, want)
+	}
+	if snapshot.sets[0].capacity != 5 {
+		t.Error("changed the Sku.Capacity the scale writes over")
+	}
+}
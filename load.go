@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2019-06-01/insights"
+	"github.com/hashicorp/go-hclog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLoadAwareWindow = 10 * time.Minute
+
+	// loadMetric is the host metric Azure Monitor collects for every scale
+	// set without an agent, averaged over all its instances.
+	loadMetric = "Percentage CPU"
+
+	// loadAwareWeight scales the weights of member sets up so that they
+	// can follow the utilization in percent steps.
+	loadAwareWeight = 100
+)
+
+// parseLoadAwareWindow returns the window the utilization of the member sets
+// is averaged over when the distribution is load aware, zero otherwise.
+func parseLoadAwareWindow(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyLoadAwareDistribution]
+	if !ok {
+		return 0, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", configKeyLoadAwareDistribution, value)
+	}
+	if !enabled {
+		return 0, nil
+	}
+	window := defaultLoadAwareWindow
+	if value, ok := config[configKeyLoadAwareWindow]; ok {
+		if window, err = time.ParseDuration(value); err != nil || window < time.Minute {
+			return 0, fmt.Errorf("invalid %s %q, must be at least 1m", configKeyLoadAwareWindow, value)
+		}
+	}
+	return window, nil
+}
+
+// utilization returns the CPU utilization of a scale set averaged over the
+// window, in percent, and false when Azure Monitor has no data for it.
+func (ac *AzureController) utilization(ctx context.Context, resourceGroup, vmScaleSet, vmssID string, window time.Duration) (float64, bool, error) {
+	ctx, done := ac.timeCall(ctx, "get_utilization", resourceGroup, vmScaleSet)
+	defer done()
+
+	now := time.Now().UTC()
+	timespan := now.Add(-window).Format(time.RFC3339) + "/" + now.Format(time.RFC3339)
+	interval := "PT1M"
+	resp, err := ac.metrics.List(ctx, strings.TrimPrefix(vmssID, "/"), timespan, &interval, loadMetric,
+		string(insights.TimeAggregationTypeAverage), nil, "", "", insights.Data, "")
+	if err != nil {
+		return 0, false, wrapAzureError(ctx, "failed to query the utilization of the vmss", err)
+	}
+	points := metricPoints(resp, string(insights.TimeAggregationTypeAverage))
+	if len(points) == 0 {
+		return 0, false, nil
+	}
+	var sum float64
+	for _, point := range points {
+		sum += point.Value
+	}
+	return sum / float64(len(points)), true, nil
+}
+
+// loadWeights returns the weight of every member set for a load aware plan
+// in the direction, from the utilization of each set: scale outs weigh sets
+// by their idle share, so the least utilized get most of the new capacity,
+// and scale ins by their utilized share, so the sets with the most spare
+// capacity give up most instances. Sets whose utilization is unknown are
+// weighed at the mean of the others.
+func loadWeights(members []scaleSetTarget, utilization []float64, known []bool, direction string) []scaleSetTarget {
+	var sum float64
+	var count int
+	for idx := range members {
+		if known[idx] {
+			sum += utilization[idx]
+			count++
+		}
+	}
+	weighted := make([]scaleSetTarget, len(members))
+	copy(weighted, members)
+	if count == 0 {
+		return weighted
+	}
+	mean := sum / float64(count)
+
+	for idx := range weighted {
+		used := mean
+		if known[idx] {
+			used = utilization[idx]
+		}
+		used = max(0, min(used, 100))
+		share := used
+		if direction == "out" {
+			share = 100 - used
+		}
+		weighted[idx].weight = int64(float64(weighted[idx].weight*loadAwareWeight) * share / 100)
+	}
+	return weighted
+}
+
+// loadAwareMembers returns the members with the weights a load aware scale
+// in the direction plans with. Sets the scale leaves alone, or whose
+// utilization cannot be read, keep the mean weight; when no utilization can
+// be read at all the members are returned as they are. A scale out keeps
+// every set at least at its capacity, so only the added capacity follows the
+// weights rather than the plan of the whole target.
+func (t *TargetPlugin) loadAwareMembers(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, direction string, window time.Duration, log hclog.Logger) []scaleSetTarget {
+	utilization := make([]float64, len(members))
+	known := make([]bool, len(members))
+	pool := newWorkerPool(t.readParallelism())
+	var wg sync.WaitGroup
+	for idx, set := range snapshot.sets {
+		member := members[idx]
+		if member.missing || member.paused || set.vmss.ID == nil ||
+			direction == "out" && !member.scalesOut() || direction == "in" && !member.scalesIn() {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, resourceGroup, vmScaleSet, vmssID string) {
+			defer wg.Done()
+			defer pool.acquire()()
+			used, ok, err := t.azureFor(resourceGroup, vmScaleSet).utilization(ctx, resourceGroup, vmScaleSet, vmssID, window)
+			if err != nil {
+				log.Warn("failed to read the utilization of the scale set, weighing it at the mean", "vmss_name", vmScaleSet, "error", err)
+				return
+			}
+			utilization[idx], known[idx] = used, ok
+		}(idx, set.resourceGroup, set.vmScaleSet, *set.vmss.ID)
+	}
+	wg.Wait()
+
+	var read bool
+	for _, ok := range known {
+		read = read || ok
+	}
+	if !read {
+		return members
+	}
+	weighted := loadWeights(members, utilization, known, direction)
+	for idx, set := range snapshot.sets {
+		if direction == "out" {
+			weighted[idx].min = max(weighted[idx].min, capacities[idx])
+		}
+		if known[idx] {
+			log.Debug("weighing scale set by its utilization", "vmss_name", set.vmScaleSet,
+				"utilization", strconv.FormatFloat(utilization[idx], 'f', 1, 64), "weight", weighted[idx].weight)
+		}
+	}
+	return weighted
+}
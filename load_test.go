@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLoadAwareWindow(t *testing.T) {
+	cases := []struct {
+		config  map[string]string
+		want    time.Duration
+		wantErr bool
+	}{
+		{config: map[string]string{}},
+		{config: map[string]string{configKeyLoadAwareDistribution: "false", configKeyLoadAwareWindow: "1s"}},
+		{config: map[string]string{configKeyLoadAwareDistribution: "true"}, want: defaultLoadAwareWindow},
+		{config: map[string]string{configKeyLoadAwareDistribution: "true", configKeyLoadAwareWindow: "30m"}, want: 30 * time.Minute},
+		{config: map[string]string{configKeyLoadAwareDistribution: "true", configKeyLoadAwareWindow: "30s"}, wantErr: true},
+		{config: map[string]string{configKeyLoadAwareDistribution: "sometimes"}, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseLoadAwareWindow(c.config)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: got error %v, want error %t", c.config, err, c.wantErr)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%v: got %s, want %s", c.config, got, c.want)
+		}
+	}
+}
+
+func TestLoadWeights(t *testing.T) {
+	members := []scaleSetTarget{
+		{vmScaleSet: "gen4", weight: 1},
+		{vmScaleSet: "gen5", weight: 1},
+		{vmScaleSet: "gen6", weight: 2},
+	}
+	utilization := []float64{80, 20, 0}
+	known := []bool{true, true, false}
+
+	out := loadWeights(members, utilization, known, "out")
+	if got, want := []int64{out[0].weight, out[1].weight, out[2].weight}, []int64{20, 80, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got scale out weights %v, want %v", got, want)
+	}
+	in := loadWeights(members, utilization, known, "in")
+	if got, want := []int64{in[0].weight, in[1].weight, in[2].weight}, []int64{80, 20, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got scale in weights %v, want %v", got, want)
+	}
+	if members[0].weight != 1 {
+		t.Error("changed the weights of the members")
+	}
+}
+
+func TestLoadAwarePlans(t *testing.T) {
+	members := []scaleSetTarget{
+		{vmScaleSet: "busy", weight: 1},
+		{vmScaleSet: "idle", weight: 1},
+	}
+	utilization := []float64{75, 25}
+	known := []bool{true, true}
+	capacities := []int64{10, 10}
+
+	// The new capacity goes three to one to the idle set, without
+	// planning the busy set below what it runs.
+	out := loadWeights(members, utilization, known, "out")
+	for idx := range out {
+		out[idx].min = max(out[idx].min, capacities[idx])
+	}
+	if got, want := planScaleOut(capacities, 24, out), []int64{11, 13}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got scale out plan %v, want %v", got, want)
+	}
+
+	// The removals come mostly from the idle set.
+	in := loadWeights(members, utilization, known, "in")
+	if got, want := planScaleIn(capacities, 4, in), []int64{0, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got scale in removals %v, want %v", got, want)
+	}
+}
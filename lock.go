@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHALockTTL = 5 * time.Minute
+
+// haLock is a lease kept in a Nomad variable and updated with check-and-set
+// writes, so that only one of several redundant autoscaler agents mutates a
+// given set of scale sets at a time.
+type haLock struct {
+	client *api.Client
+	path   string
+	holder string
+	ttl    time.Duration
+	logger hclog.Logger
+}
+
+func newHALock(client *api.Client, config map[string]string, holder string, logger hclog.Logger) (*haLock, error) {
+	path, ok := config[configKeyHALockPath]
+	if !ok {
+		return nil, nil
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("invalid %s, path must not be empty", configKeyHALockPath)
+	}
+	if holder == "" {
+		return nil, fmt.Errorf("%s requires %s to be set", configKeyHALockPath, configKeyAutoscalerInstance)
+	}
+
+	lock := &haLock{client: client, path: path, holder: holder, ttl: defaultHALockTTL, logger: logger}
+	if value, ok := config[configKeyHALockTTL]; ok {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyHALockTTL, value)
+		}
+		lock.ttl = ttl
+	}
+	return lock, nil
+}
+
+// lockPath maps a target onto a variable path. Target keys contain characters
+// Nomad does not allow in variable paths, so they are hashed.
+func (l *haLock) lockPath(key string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(key)))
+	return l.path + "/" + hex.EncodeToString(sum[:8])
+}
+
+// acquire takes the lease for key, returning a function that releases it. The
+// lease is renewed in the background until released so long running scale
+// actions do not lose it.
+func (l *haLock) acquire(key string) (func(), error) {
+	path := l.lockPath(key)
+
+	variable, err := readNomadVariable(l.client, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scale lock: %v", err)
+	}
+	if holder := variable.Items["holder"]; holder != "" && holder != l.holder {
+		if expires, err := time.Parse(time.RFC3339, variable.Items["expires"]); err == nil && time.Now().Before(expires) {
+			return nil, fmt.Errorf("scale lock for %s is held by autoscaler %s until %s", key, holder, expires)
+		}
+	}
+
+	index, err := l.write(path, variable.ModifyIndex, time.Now().Add(l.ttl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire scale lock for %s: %v", key, err)
+	}
+
+	done := make(chan struct{})
+	released := make(chan uint64)
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				released <- index
+				return
+			case <-ticker.C:
+				renewed, err := l.write(path, index, time.Now().Add(l.ttl))
+				if err != nil {
+					l.logger.Error("failed to renew scale lock", "target", key, "error", err)
+					continue
+				}
+				index = renewed
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if _, err := l.write(path, <-released, time.Time{}); err != nil {
+			l.logger.Warn("failed to release scale lock", "target", key, "error", err)
+		}
+	}, nil
+}
+
+// write stores the lease with a check-and-set against index and returns the
+// new modify index. A zero expiry releases the lease.
+func (l *haLock) write(path string, index uint64, expires time.Time) (uint64, error) {
+	variable := &nomadVariable{Path: path, Items: map[string]string{"holder": "", "expires": ""}}
+	if !expires.IsZero() {
+		variable.Items["holder"] = l.holder
+		variable.Items["expires"] = expires.UTC().Format(time.RFC3339)
+	}
+
+	var out nomadVariable
+	endpoint := fmt.Sprintf("/v1/var/%s?cas=%d", path, index)
+	if _, err := l.client.Raw().Write(endpoint, variable, &out, nil); err != nil {
+		return 0, err
+	}
+	return out.ModifyIndex, nil
+}
+
+// scaleLocks serializes scale operations within the process. Each scale set
+// is held by at most one operation at a time; targets sharing any member set
+// therefore never update capacities concurrently.
+type scaleLocks struct {
+	lock    sync.Mutex
+	holders map[string]string
+
+	// released is closed, and replaced, whenever keys are released.
+	released chan struct{}
+}
+
+// sharedScaleLocks are the scale locks of every plugin instance of the
+// process. The autoscaler starts an instance per target block, whose
+// policies may still list the same scale sets.
+var sharedScaleLocks = newScaleLocks()
+
+func newScaleLocks() *scaleLocks {
+	return &scaleLocks{holders: make(map[string]string), released: make(chan struct{})}
+}
+
+func parseScaleLockWait(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyScaleLockWait]
+	if !ok {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyScaleLockWait, value)
+	}
+	return wait, nil
+}
+
+// scaleInProgressError is returned when a scale set is already being scaled
+// by another operation.
+type scaleInProgressError struct {
+	vmss        string
+	operationID string
+}
+
+func (e *scaleInProgressError) Error() string {
+	return fmt.Sprintf("scale operation %s already in progress on %s", e.operationID, e.vmss)
+}
+
+// tryAcquire takes all keys for the operation or none of them, so overlapping
+// targets cannot deadlock. It does not wait.
+func (s *scaleLocks) tryAcquire(keys []string, operationID string) (func(), error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		if holder, ok := s.holders[key]; ok {
+			return nil, &scaleInProgressError{vmss: key, operationID: holder}
+		}
+	}
+	for _, key := range keys {
+		s.holders[key] = operationID
+	}
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, key := range keys {
+			delete(s.holders, key)
+		}
+		close(s.released)
+		s.released = make(chan struct{})
+	}, nil
+}
+
+// acquire takes all keys like tryAcquire, but waits up to wait for the
+// operations holding any of them to finish. The capacities are read once the
+// keys are held, so an operation queued this way does not act on a stale
+// count.
+func (s *scaleLocks) acquire(keys []string, operationID string, wait time.Duration) (func(), error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		released := s.released
+		s.lock.Unlock()
+		release, err := s.tryAcquire(keys, operationID)
+		if err == nil || wait == 0 {
+			return release, err
+		}
+		select {
+		case <-released:
+		case <-timer.C:
+			return nil, err
+		}
+	}
+}
+
+// holder returns the operation holding any of keys, if any.
+func (s *scaleLocks) holder(keys []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		if holder, ok := s.holders[key]; ok {
+			return holder
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+)
+
+func TestScaleLocksAcquireWaits(t *testing.T) {
+	locks := newScaleLocks()
+	release, err := locks.tryAcquire([]string{"rg/a", "rg/b"}, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var busy *scaleInProgressError
+	if _, err := locks.acquire([]string{"rg/b"}, "second", 0); !errors.As(err, &busy) || busy.operationID != "first" {
+		t.Fatalf("got %v, want the set held by the first operation", err)
+	}
+	if _, err := locks.acquire([]string{"rg/b"}, "second", 10*time.Millisecond); !errors.As(err, &busy) {
+		t.Fatalf("got %v, want the wait to time out", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	second, err := locks.acquire([]string{"rg/b", "rg/c"}, "second", time.Minute)
+	if err != nil {
+		t.Fatalf("got %v, want the set acquired once released", err)
+	}
+	if holder := locks.holder([]string{"rg/c"}); holder != "second" {
+		t.Errorf("rg/c held by %q, want second", holder)
+	}
+	second()
+	if holder := locks.holder([]string{"rg/a", "rg/b", "rg/c"}); holder != "" {
+		t.Errorf("sets still held by %q", holder)
+	}
+}
+
+func TestScaleLocksSharedAcrossInstances(t *testing.T) {
+	a, b := factory(nil).(*TargetPlugin), factory(nil).(*TargetPlugin)
+	release, err := a.scaleLocks.tryAcquire([]string{"rg/shared"}, "op")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if holder := b.scaleLocks.holder([]string{"rg/shared"}); holder != "op" {
+		t.Errorf("got holder %q in the other plugin instance, want op", holder)
+	}
+}
+
+func TestSelfHealSkipsHeldSet(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 3)
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.desired.set("rg", "a", 2)
+
+	release, err := plugin.scaleLocks.tryAcquire([]string{vmssKey("rg", "a")}, "scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.selfHeal(context.Background(), fake, "rg", "a", plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 3})
+
+	release()
+	if err := plugin.selfHeal(context.Background(), fake, "rg", "a", plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2})
+}
+
+func TestReplaceOrphansSkipsHeldSet(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 2)
+	plugin := newFakePlugin(t, newFakeNomad(t, "fake", fake.remoteIDs("rg", "a")))
+	azure := plugin.azureFor("rg", "a")
+
+	release, err := plugin.scaleLocks.tryAcquire([]string{vmssKey("rg", "a")}, "scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced, err := plugin.replaceOrphans(context.Background(), azure, "rg", "a", []string{"0"}, plugin.logger); err != nil || replaced != 0 {
+		t.Fatalf("got %d replaced, %v, want the held set skipped", replaced, err)
+	}
+
+	release()
+	if replaced, err := plugin.replaceOrphans(context.Background(), azure, "rg", "a", []string{"0", "9"}, plugin.logger); err != nil || replaced != 1 {
+		t.Fatalf("got %d replaced, %v, want the running orphan replaced", replaced, err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2})
+	instances, err := fake.listRunningInstances(context.Background(), "rg", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range instances {
+		if instance.instanceID == "0" {
+			t.Errorf("orphan %s still running", instance.instanceID)
+		}
+	}
+}
+
+func TestCompensateEvictionsSkipsHeldSet(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	for _, vmScaleSet := range []string{"spot", "a", "b"} {
+		fake.add("rg", vmScaleSet, 1)
+	}
+	plugin := newFakePlugin(t, newFakeNomad(t, "fake", fake.remoteIDs("rg", "spot", "a", "b")))
+
+	release, err := plugin.scaleLocks.tryAcquire([]string{vmssKey("rg", "b")}, "scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if err := plugin.compensateEvictions(context.Background(), []string{"rg", "rg", "rg"}, []string{"spot", "a", "b"},
+		[]int64{2, 0, 0}, 2, plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"spot": 1, "a": 3, "b": 1})
+}
+
+func TestResumeScaleInSkipsHeldSet(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 2)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+	if err := nomad.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	config := map[string]string{configKeyTargets: "rg/a", "node_class": "fake", "node_purge": "true"}
+	checkpoint := &operationCheckpoint{OperationID: "resumed", Target: targetKey(config), Direction: "in", Config: config,
+		Sets: []checkpointScaleSet{{ResourceGroup: "rg", VMScaleSet: "a", InstanceIDs: []string{"1"},
+			Nodes: []scaleutils.NodeResourceID{{NomadNodeID: "node-a-1", RemoteResourceID: "a_1"}}}}}
+	ctx := withOperationID(context.Background(), checkpoint.OperationID)
+
+	release, err := plugin.scaleLocks.tryAcquire([]string{vmssKey("rg", "a")}, "scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.resumeScaleIn(ctx, checkpoint, plugin.logger); err == nil {
+		t.Fatal("got no error resuming the scale in of a held set")
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2})
+	pending := plugin.operations.pendingCleanups(targetKey(config))
+	if len(pending) != 1 || len(pending[0].Sets) != 1 || !equalStrings(pending[0].Sets[0].InstanceIDs, []string{"1"}) {
+		t.Fatalf("got pending cleanups %+v, want the held set kept for the next attempt", pending)
+	}
+
+	release()
+	if err := plugin.resumeScaleIn(ctx, pending[0], plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 1})
+	nomad.lock.Lock()
+	defer nomad.lock.Unlock()
+	if !nomad.purged["node-a-1"] {
+		t.Error("node of the deleted instance was not purged")
+	}
+}
+
+func TestResumedScaleInDoesNotSelfHeal(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 3)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+	if err := nomad.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The interrupted operation never lowered the desired capacity.
+	plugin.desired.set("rg", "a", 3)
+
+	config := map[string]string{configKeyTargets: "rg/a", "node_class": "fake"}
+	checkpoint := &operationCheckpoint{OperationID: "resumed", Target: targetKey(config), Direction: "in", Config: config,
+		Sets: []checkpointScaleSet{{ResourceGroup: "rg", VMScaleSet: "a", InstanceIDs: []string{"2"},
+			Nodes: []scaleutils.NodeResourceID{{NomadNodeID: "node-a-2", RemoteResourceID: "a_2"}}}}}
+	if err := plugin.resumeScaleIn(withOperationID(context.Background(), checkpoint.OperationID), checkpoint, plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2})
+
+	if err := plugin.selfHeal(context.Background(), fake, "rg", "a", plugin.logger); err != nil {
+		t.Fatal(err)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 2})
+}
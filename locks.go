@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	lockCheckRefuse = "refuse"
+	lockCheckWarn   = "warn"
+	lockCheckIgnore = "ignore"
+
+	locksAPIVersion       = "2016-09-01"
+	policyStateAPIVersion = "2019-10-01"
+
+	lockLevelReadOnly     = "ReadOnly"
+	lockLevelCanNotDelete = "CanNotDelete"
+)
+
+func parseLockCheckAction(config map[string]string) (string, error) {
+	value, ok := config[configKeyAzureLockCheck]
+	if !ok || value == "" {
+		return lockCheckRefuse, nil
+	}
+	switch value {
+	case lockCheckRefuse, lockCheckWarn, lockCheckIgnore:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be one of %s, %s or %s", configKeyAzureLockCheck,
+		value, lockCheckRefuse, lockCheckWarn, lockCheckIgnore)
+}
+
+type managementLock struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		Level string `json:"level"`
+		Notes string `json:"notes"`
+	} `json:"properties"`
+}
+
+type denyPolicyState struct {
+	PolicyAssignmentName string `json:"policyAssignmentName"`
+	PolicyAssignmentID   string `json:"policyAssignmentId"`
+	PolicyDefinitionName string `json:"policyDefinitionName"`
+}
+
+// armRequest sends a request for a provider the SDK has no client for to the
+// path below the Resource Manager endpoint, decoding the response into
+// result.
+func (ac *AzureController) armRequest(ctx context.Context, method, path string, query map[string]interface{}, result interface{}) error {
+	req, err := autorest.CreatePreparer(
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(ac.baseURI),
+		autorest.WithPath(path),
+		autorest.WithQueryParameters(query),
+	).Prepare((&http.Request{}).WithContext(ctx))
+	if err != nil {
+		return wrapAzureError(ctx, "failed to prepare the request", err)
+	}
+	resp, err := ac.authz.Send(req, azure.DoRetryWithRegistration(ac.authz))
+	if err != nil {
+		return wrapAzureError(ctx, "failed to send the request",
+			autorest.NewErrorWithError(err, "authorization", method, resp, "Failure sending request"))
+	}
+	err = autorest.Respond(resp,
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(result),
+		autorest.ByClosing())
+	if err != nil {
+		return wrapAzureError(ctx, "failed to read the response",
+			autorest.NewErrorWithError(err, "authorization", method, resp, "Failure responding to request"))
+	}
+	return nil
+}
+
+// resourceLocks lists the management locks of a scale set, including those
+// it inherits from its resource group and subscription.
+func (ac *AzureController) resourceLocks(ctx context.Context, resourceGroup, vmScaleSet, vmssID string) ([]managementLock, error) {
+	ctx, done := ac.timeCall(ctx, "list_resource_locks", resourceGroup, vmScaleSet)
+	defer done()
+
+	var page struct {
+		Value []managementLock `json:"value"`
+	}
+	err := ac.armRequest(ctx, http.MethodGet, vmssID+"/providers/Microsoft.Authorization/locks",
+		map[string]interface{}{"api-version": locksAPIVersion}, &page)
+	return page.Value, err
+}
+
+// denyPolicyStates lists the deny policy assignments the scale set does not
+// comply with. Azure denies every update of a resource that violates a deny
+// policy, so capacity changes of the set fail until it complies again.
+func (ac *AzureController) denyPolicyStates(ctx context.Context, resourceGroup, vmScaleSet, vmssID string) ([]denyPolicyState, error) {
+	ctx, done := ac.timeCall(ctx, "list_deny_policy_states", resourceGroup, vmScaleSet)
+	defer done()
+
+	var page struct {
+		Value []denyPolicyState `json:"value"`
+	}
+	err := ac.armRequest(ctx, http.MethodPost, vmssID+"/providers/Microsoft.PolicyInsights/policyStates/latest/queryResults",
+		map[string]interface{}{
+			"api-version": policyStateAPIVersion,
+			"$filter":     autorest.Encode("query", "complianceState eq 'NonCompliant' and policyDefinitionAction eq 'deny'"),
+		}, &page)
+	return page.Value, err
+}
+
+// blockingLock returns the lock that denies a scale in the direction, if
+// any. ReadOnly locks deny every write; CanNotDelete locks deny deleting the
+// instances of a scale in but allow adding instances.
+func blockingLock(locks []managementLock, direction string) (managementLock, bool) {
+	for _, lock := range locks {
+		switch {
+		case strings.EqualFold(lock.Properties.Level, lockLevelReadOnly):
+			return lock, true
+		case strings.EqualFold(lock.Properties.Level, lockLevelCanNotDelete) && direction == "in":
+			return lock, true
+		}
+	}
+	return managementLock{}, false
+}
+
+// checkScaleBlockers looks for the resource locks and deny policies which
+// would make Azure refuse the scale of a set, reporting them before any
+// capacity is changed rather than as a 403 from the long running operation.
+// Locks and policy states that cannot be read do not block the scale, so a
+// missing permission to read them does not stop scaling.
+func (t *TargetPlugin) checkScaleBlockers(ctx context.Context, resourceGroup, vmScaleSet, vmssID, direction string, log hclog.Logger) error {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	locks, err := azure.resourceLocks(ctx, resourceGroup, vmScaleSet, vmssID)
+	if err != nil {
+		log.Warn("failed to check the scale set for resource locks", "vmss_name", vmScaleSet, "error", err)
+	} else if lock, ok := blockingLock(locks, direction); ok {
+		message := fmt.Sprintf("%s/%s is locked by %s lock %q", resourceGroup, vmScaleSet, lock.Properties.Level, lock.Name)
+		if lock.Properties.Notes != "" {
+			message += fmt.Sprintf(" (%s)", lock.Properties.Notes)
+		}
+		if scope := strings.TrimSuffix(lock.ID, "/providers/Microsoft.Authorization/locks/"+lock.Name); scope != lock.ID && !strings.EqualFold(scope, vmssID) {
+			message += " inherited from " + scope
+		}
+		return fmt.Errorf("%s, which denies scaling %s", message, direction)
+	}
+
+	if direction != "out" {
+		// Deleting instances is not an update of the set, deny policies
+		// are not evaluated for it.
+		return nil
+	}
+	states, err := azure.denyPolicyStates(ctx, resourceGroup, vmScaleSet, vmssID)
+	if err != nil {
+		log.Warn("failed to check the scale set for deny policies", "vmss_name", vmScaleSet, "error", err)
+		return nil
+	}
+	if len(states) > 0 {
+		name := states[0].PolicyAssignmentName
+		if name == "" {
+			name = states[0].PolicyAssignmentID
+		}
+		return fmt.Errorf("%s/%s violates deny policy assignment %q (definition %s), which denies updating its capacity",
+			resourceGroup, vmScaleSet, name, states[0].PolicyDefinitionName)
+	}
+	return nil
+}
+
+// checkTargetScaleBlockers checks the member sets a scale in the direction
+// changes for locks and deny policies, refusing the scale when the action is
+// to refuse and only logging them otherwise.
+func (t *TargetPlugin) checkTargetScaleBlockers(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, direction, action string, log hclog.Logger) error {
+	blockers := make([]error, len(members))
+	pool := newWorkerPool(t.readParallelism())
+	var wg sync.WaitGroup
+	for idx, set := range snapshot.sets {
+		member := members[idx]
+		if member.missing || member.paused || set.vmss.ID == nil ||
+			direction == "out" && !member.scalesOut() || direction == "in" && !member.scalesIn() {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, resourceGroup, vmScaleSet, vmssID string) {
+			defer wg.Done()
+			defer pool.acquire()()
+			blockers[idx] = t.checkScaleBlockers(ctx, resourceGroup, vmScaleSet, vmssID, direction, log)
+		}(idx, set.resourceGroup, set.vmScaleSet, *set.vmss.ID)
+	}
+	wg.Wait()
+
+	for _, err := range blockers {
+		if err == nil {
+			continue
+		}
+		if action == lockCheckRefuse {
+			return fmt.Errorf("refusing to scale, %v", err)
+		}
+		log.Warn("Azure is expected to refuse scaling the scale set", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+const testVMSSID = "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss"
+
+func newLockTestPlugin(locks, states string) *TargetPlugin {
+	client := autorest.NewClientWithUserAgent(pluginName)
+	client.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, `{"value":[]}`
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/providers/Microsoft.Authorization/locks"):
+			body = `{"value":[` + locks + `]}`
+		case strings.HasSuffix(r.URL.Path, "/queryResults") && r.Method == http.MethodPost:
+			if states == "" {
+				status, body = http.StatusForbidden, `{"error":{"code":"AuthorizationFailed","message":"no access"}}`
+			} else {
+				body = `{"value":[` + states + `]}`
+			}
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{authz: client, baseURI: "http://fake", logger: hclog.NewNullLogger()}
+	return plugin
+}
+
+func TestBlockingLock(t *testing.T) {
+	cases := []struct {
+		level     string
+		direction string
+		blocks    bool
+	}{
+		{lockLevelReadOnly, "out", true},
+		{lockLevelReadOnly, "in", true},
+		{lockLevelCanNotDelete, "out", false},
+		{lockLevelCanNotDelete, "in", true},
+	}
+	for _, tc := range cases {
+		lock := managementLock{Name: "lock"}
+		lock.Properties.Level = tc.level
+		if _, blocks := blockingLock([]managementLock{lock}, tc.direction); blocks != tc.blocks {
+			t.Errorf("%s lock blocking scale %s: got %v, want %v", tc.level, tc.direction, blocks, tc.blocks)
+		}
+	}
+}
+
+func TestCheckScaleBlockers(t *testing.T) {
+	inherited := `{"id":"/subscriptions/s/resourceGroups/rg/providers/Microsoft.Authorization/locks/keep",` +
+		`"name":"keep","properties":{"level":"CanNotDelete","notes":"production"}}`
+	deny := `{"policyAssignmentName":"require-tags","policyDefinitionName":"deny-untagged"}`
+	log := hclog.NewNullLogger()
+	cases := []struct {
+		name      string
+		locks     string
+		states    string
+		direction string
+		want      string
+	}{
+		{"inherited lock", inherited, "", "in", `rg/vmss is locked by CanNotDelete lock "keep" (production) inherited from /subscriptions/s/resourceGroups/rg, which denies scaling in`},
+		{"delete lock on scale out", inherited, "", "out", ""},
+		{"deny policy", "", deny, "out", `rg/vmss violates deny policy assignment "require-tags" (definition deny-untagged)`},
+		{"deny policy on scale in", "", deny, "in", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newLockTestPlugin(tc.locks, tc.states)
+			err := plugin.checkScaleBlockers(context.Background(), "rg", "vmss", testVMSSID, tc.direction, log)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("got %v, want no blocker", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("got %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
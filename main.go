@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins"
+	"os"
 )
 
 const (
@@ -12,27 +13,296 @@ const (
 	configKeyTenantID       = "tenant_id"
 	configKeyClientID       = "client_id"
 	configKeySecretKey      = "secret_access_key"
+	configKeySecretKeyFile  = "secret_access_key_file"
+
+	configKeyResourceManagerEndpoint = "resource_manager_endpoint"
 
 	configKeyResourceGroupList = "resource_group_list"
+	configKeyResourceGroup     = "resource_group"
 	configKeyVMSSList          = "vm_scale_set_list"
+	configKeyTargets           = "targets"
+	configKeyTargetsFile       = "targets_file"
+	configKeyTargetGroup       = "target_group"
+	configKeyListSeparator     = "list_separator"
+	configKeyVMSSExclude       = "vm_scale_set_exclude"
+	configKeyNodeClassList     = "node_class_list"
+	configKeyDatacenterList    = "datacenter_list"
+	configKeyZones             = "zones"
+
+	configKeyNodeDrainForce       = "node_drain_force"
+	configKeyNodeDrainConcurrency = "node_drain_concurrency"
+
+	configKeyGhostNodeGCInterval = "ghost_node_gc_interval"
+	configKeyGhostNodeGCAction   = "ghost_node_gc_action"
+
+	configKeyOrphanThreshold     = "orphan_instance_threshold"
+	configKeyOrphanCheckInterval = "orphan_instance_check_interval"
+	configKeyOrphanAction        = "orphan_instance_action"
+
+	configKeyReconcileInterval = "reconcile_interval"
+	configKeyReconcileSelfHeal = "reconcile_self_heal"
+
+	configKeySpotEvictionInterval      = "spot_eviction_check_interval"
+	configKeySpotEvictionNodeMeta      = "spot_eviction_node_meta"
+	configKeySpotEvictionDrainDeadline = "spot_eviction_drain_deadline"
+	configKeySpotEvictionCompensate    = "spot_eviction_compensate"
+
+	configKeyRecycleMaxAge      = "recycle_max_instance_age"
+	configKeyRecycleInterval    = "recycle_interval"
+	configKeyRecycleConcurrency = "recycle_concurrency"
+	configKeyRecycleOutdated    = "recycle_outdated_model"
+
+	configKeyFailedInstanceThreshold     = "failed_instance_threshold"
+	configKeyFailedInstanceCheckInterval = "failed_instance_check_interval"
+	configKeyFailedNodeThreshold         = "failed_node_threshold"
+	configKeyFailedNodeCheckInterval     = "failed_node_check_interval"
+
+	configKeyHookPreScaleOut  = "hook_pre_scale_out"
+	configKeyHookPostScaleOut = "hook_post_scale_out"
+	configKeyHookPreDelete    = "hook_pre_node_delete"
+	configKeyHookPostScaleIn  = "hook_post_scale_in"
+	configKeyHookTimeout      = "hook_timeout"
+
+	configKeyScaleInCooldown  = "scale_in_cooldown"
+	configKeyScaleOutCooldown = "scale_out_cooldown"
+
+	configKeyDuplicateActionWindow = "duplicate_action_window"
+
+	configKeyMaxTotalInstances      = "max_total_instances"
+	configKeyMaxInstanceHoursPerDay = "max_instance_hours_per_day"
+
+	configKeyScaleInFreezeWindows  = "scale_in_freeze_windows"
+	configKeyScaleInFreezeTimezone = "scale_in_freeze_timezone"
+
+	configKeyPlatformOperationWait = "platform_operation_wait"
+	configKeyPauseOSUpgrades       = "pause_os_upgrades"
+
+	configKeyApplicationHealth        = "application_health"
+	configKeyScaleInPreferMaintenance = "scale_in_prefer_maintenance"
+
+	configKeyRebalance              = "rebalance"
+	configKeyRebalanceSkewThreshold = "rebalance_skew_threshold"
+	configKeyRebalanceInterval      = "rebalance_interval"
+
+	configKeyScaleInCanaryPercent = "scale_in_canary_percent"
+	configKeyScaleInCanaryDelay   = "scale_in_canary_delay"
+
+	configKeyPrewarmMaxAge = "prewarm_max_age"
+
+	configKeyConsulDeregister = "consul_deregister"
+	configKeyConsulAddress    = "consul_address"
+	configKeyConsulToken      = "consul_token"
+	configKeyConsulDatacenter = "consul_datacenter"
+
+	configKeyInstanceTaggingInterval = "instance_tagging_interval"
+	configKeyPoolName                = "pool_name"
+
+	configKeyScaleEventTagging      = "scale_event_tagging"
+	configKeyScaleEventTags         = "scale_event_tags"
+	configKeyScaleEventTagInstances = "scale_event_tag_instances"
+	configKeyPolicyName             = "policy_name"
+	configKeyAutoscalerInstance     = "autoscaler_instance"
+
+	configKeyScaleEventVariable = "scale_event_variable"
+	configKeyScaleEventHistory  = "scale_event_history"
+
+	configKeyHALockPath = "ha_lock_path"
+	configKeyHALockTTL  = "ha_lock_ttl"
+
+	configKeyLeaderLeaseBlob     = "leader_lease_blob"
+	configKeyLeaderLeaseDuration = "leader_lease_duration"
+
+	configKeyStatusCacheTTL      = "status_cache_ttl"
+	configKeyStatusCacheRefresh  = "status_cache_refresh"
+	configKeyStatusWatchInterval = "status_watch_interval"
+
+	configKeyReadinessBlockingStates   = "readiness_blocking_states"
+	configKeyReadinessTolerance        = "readiness_unhealthy_tolerance"
+	configKeyReadinessIgnoreInstances  = "readiness_ignore_instance_states"
+	configKeyReadinessTolerateUpgrades = "readiness_tolerate_upgrades"
+	configKeyReadinessWarmup           = "readiness_instance_warmup"
+
+	configKeyCapacityMode = "capacity_mode"
+	configKeyCapacityUnit = "capacity_unit"
+
+	configKeyCountStarting   = "capacity_count_starting"
+	configKeyScaleInStarting = "scale_in_starting_instances"
+	configKeyLiveExclude     = "capacity_live_exclude_states"
+
+	configKeyScaleOutFailurePolicy = "scale_out_failure_policy"
+	configKeyVMSSIfMatch           = "vmss_update_if_match"
+	configKeyResourceGraph         = "azure_resource_graph"
+	configKeyOperationDeadline     = "azure_operation_deadline"
+	configKeyPollingBudget         = "azure_polling_budget"
+	configKeyScaleAsync            = "scale_async"
+	configKeyOperationStatePath    = "operation_state_path"
+	configKeyShutdownDrainPeriod   = "shutdown_drain_period"
+	configKeyMaxParallel           = "max_parallel"
+	configKeyNomadRetryAttempts    = "scale_in_retry_attempts"
+	configKeyNomadRetryBackoff     = "scale_in_retry_backoff"
+	configKeyNodeIdentity          = "node_identity_normalization"
+
+	configKeyCapacityConflictAction  = "capacity_conflict_action"
+	configKeyCapacityConflictRetries = "capacity_conflict_retries"
+
+	configKeyDeadlineMargin = "evaluation_deadline_margin"
+
+	configKeySlowCallThreshold = "azure_slow_call_threshold"
+
+	configKeyScaleLockWait = "scale_lock_wait"
+
+	configKeyRegisterTimeout = "scale_out_register_timeout"
+	configKeyRegisterRetries = "scale_out_register_retries"
+	configKeyRegisterRetryOn = "scale_out_register_retry_on"
+	configKeyScaleNodeMeta   = "scale_out_node_meta"
+
+	configKeyUpgradeNewInstances = "scale_out_upgrade_new_instances"
+	configKeyUpgradeOutdated     = "scale_out_upgrade_outdated_instances"
+
+	configKeyScaleInExemptMeta = "scale_in_exempt_node_meta"
+	configKeyScaleInMode       = "scale_in_mode"
+
+	configKeyScaleInProtectedJobs = "scale_in_protected_jobs"
+	configKeyScaleInNamespaces    = "scale_in_namespaces"
+
+	configKeyAzureReadRateLimit  = "azure_read_rate_limit"
+	configKeyAzureWriteRateLimit = "azure_write_rate_limit"
+	configKeyAzureRateLimitBurst = "azure_rate_limit_burst"
+	configKeyScaleWriteLimit     = "azure_scale_writes_per_minute"
+
+	configKeyAzureMaxIdleConnsPerHost = "azure_max_idle_conns_per_host"
+	configKeyAzureMaxConnsPerHost     = "azure_max_conns_per_host"
+	configKeyAzureIdleConnTimeout     = "azure_idle_conn_timeout"
+	configKeyAzureKeepAlive           = "azure_keep_alive"
+	configKeyAzureTLSHandshakeTimeout = "azure_tls_handshake_timeout"
+
+	configKeyAzureRecordDir = "azure_record_dir"
+	configKeyAzureReplayDir = "azure_replay_dir"
+
+	configKeyAzureFaultInjection = "azure_fault_injection"
+
+	configKeySimulate                    = "simulate"
+	configKeySimulateProvisioningLatency = "simulate_provisioning_latency"
+	configKeySimulateInitialCapacity     = "simulate_initial_capacity"
+
+	configKeyStatusPartial = "status_partial_on_error"
+	configKeyStatusErrors  = "status_provisioning_errors"
+
+	configKeyMissingScaleSetAction = "missing_scale_set_action"
+
+	configKeyPrometheusListen = "telemetry_prometheus_listen"
+	configKeyStatsdAddress    = "telemetry_statsd_address"
+	configKeyDogStatsdAddress = "telemetry_dogstatsd_address"
+	configKeyDogStatsdTags    = "telemetry_dogstatsd_tags"
+
+	configKeyAuditLogPath     = "audit_log_path"
+	configKeyAuditLogMaxBytes = "audit_log_max_bytes"
+	configKeyAuditLogMaxFiles = "audit_log_max_files"
+
+	configKeyWebhookURL        = "scale_event_webhook_url"
+	configKeyWebhookHeaders    = "scale_event_webhook_headers"
+	configKeyWebhookTimeout    = "scale_event_webhook_timeout"
+	configKeyEventGridEndpoint = "event_grid_topic_endpoint"
+	configKeyEventGridKey      = "event_grid_topic_key"
+
+	configKeySlackWebhook        = "slack_webhook_url"
+	configKeySlackFailureWebhook = "slack_failure_webhook_url"
+	configKeyTeamsWebhook        = "teams_webhook_url"
+	configKeyTeamsFailureWebhook = "teams_failure_webhook_url"
+
+	configKeyDebugListen = "debug_listen"
+
+	configKeyScaleHistorySize = "scale_history_size"
+
+	configKeyAzureMonitorMetrics   = "azure_monitor_metrics"
+	configKeyAzureMonitorInterval  = "azure_monitor_interval"
+	configKeyAzureMonitorNamespace = "azure_monitor_namespace"
+
+	configKeySpotEvictionAvoidRate = "spot_eviction_avoid_rate"
+
+	configKeyLoadAwareDistribution = "load_aware_distribution"
+	configKeyLoadAwareWindow       = "load_aware_window"
+
+	configKeyAzureAutoscaleConflict = "azure_autoscale_conflict_action"
+	configKeyAzureLockCheck         = "azure_lock_check_action"
+	configKeyAKSManagedAction       = "aks_managed_action"
+
+	configKeyConfigVariable         = "config_variable_path"
+	configKeyConfigVariableInterval = "config_variable_interval"
+
+	configKeyScaleStateVariable = "scale_state_variable"
+
+	// defaultNodeClass is the pool name the cluster scale utils use for nodes
+	// without a node class.
+	defaultNodeClass = "autoscaler-default-pool"
+
+	metaKeyPrefix              = "azure_vmss_list."
+	metaKeyOrphanedInstances   = metaKeyPrefix + "orphaned_instances"
+	metaKeyOrphansRemediated   = metaKeyPrefix + "orphans_remediated"
+	metaKeyDegraded            = metaKeyPrefix + "degraded"
+	metaKeyScaleHistory        = metaKeyPrefix + "scale_history"
+	metaKeyOperationInProgress = metaKeyPrefix + "operation_in_progress"
+	metaKeyPluginVersion       = metaKeyPrefix + "plugin_version"
+	metaKeyCapabilities        = metaKeyPrefix + "capabilities"
+	metaKeyStandbyReady        = metaKeyPrefix + "standby_ready"
+	metaKeyBudgetClamped       = metaKeyPrefix + "budget_clamped"
+	metaKeyBudgetInstanceHours = metaKeyPrefix + "budget_instance_hours"
+	metaKeyScaleInFrozen       = metaKeyPrefix + "scale_in_frozen"
+	metaKeyScaleDeferred       = metaKeyPrefix + "scale_deferred"
+	metaKeyCanaryPending       = metaKeyPrefix + "canary_scale_in_pending"
+	metaKeySpotEvictionRate    = metaKeyPrefix + "spot_eviction_rate"
+	metaKeyInstanceStatePrefix = metaKeyPrefix + "instance_state."
+	metaKeyMisconfigured       = metaKeyPrefix + "misconfigured"
+	metaKeyOverlappingTargets  = metaKeyPrefix + "overlapping_targets"
+	metaKeyPendingCleanups     = metaKeyPrefix + "pending_cleanups"
 )
 
 var (
 	PluginConfig = &plugins.InternalPluginConfig{
 		Factory: func(log hclog.Logger) interface{} {
 			return &TargetPlugin{
-				logger: log,
+				logger:      newAliasLogger(log),
+				authorizers: newAuthorizerCache(),
+				targets:     newTargetRegistry(),
+				orphans:     newOrphanTracker(),
+				desired:     newCapacityTracker(),
+
+				spotEvictions: newSpotEvictionWatcher(),
+				nodeTags:      newNodeTagIndex(),
+				instanceAges:  newInstanceAgeTracker(),
+
+				scaleEventCounts:   newScaleEventCounter(),
+				inFlight:           newInFlightOps(),
+				autoscaleConflicts: newAutoscaleConflictTracker(),
+				scaleLocks:         sharedScaleLocks,
+				discovery:          newScaleSetDiscovery(),
+				cooldowns:          newCooldownTracker(),
+				recentActions:      newRecentActions(),
+				budgets:            newBudgetTracker(),
+				deferrals:          newScaleDeferrals(),
+				canaries:           newCanaryScaleIns(),
+				spotStats:          newSpotEvictionStats(),
+				debugState:         newDebugState(),
 			}
 		},
 	}
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == apmCommand {
+		plugins.Serve(apmFactory)
+		return
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
 	plugins.Serve(factory)
 }
 
+// factory builds the plugin served as its own binary, which, unlike the one
+// built into the autoscaler, handles the shutdown signals itself.
 func factory(log hclog.Logger) interface{} {
-	return &TargetPlugin{
-		logger: log,
-	}
+	plugin := PluginConfig.Factory(log).(*TargetPlugin)
+	plugin.handleShutdownSignals()
+	return plugin
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"strconv"
+)
+
+func parsePreferMaintenance(config map[string]string) (bool, error) {
+	value, ok := config[configKeyScaleInPreferMaintenance]
+	if !ok {
+		return false, nil
+	}
+	prefer, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", configKeyScaleInPreferMaintenance, value)
+	}
+	return prefer, nil
+}
+
+// maintenancePending reports whether Azure scheduled platform maintenance
+// for an instance, which redeploys it and disrupts its allocations. While
+// the self-service window is open the instance can be maintained early, and
+// once it closes Azure maintains it regardless.
+func maintenancePending(status *compute.MaintenanceRedeployStatus) bool {
+	if status == nil {
+		return false
+	}
+	if status.IsCustomerInitiatedMaintenanceAllowed != nil && *status.IsCustomerInitiatedMaintenanceAllowed {
+		return true
+	}
+	return status.MaintenanceWindowStartTime != nil || status.PreMaintenanceWindowStartTime != nil
+}
+
+// maintenanceRemoteIDs returns the running instances with platform
+// maintenance pending, which a scale in removes before the node selector
+// picks among the others so the maintenance disrupts no allocation. It is
+// empty unless the set was listed with its maintenance.
+func (s *setSnapshot) maintenanceRemoteIDs() map[string]bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pending := make(map[string]bool)
+	for _, instance := range s.running {
+		if instance.maintenancePending {
+			pending[instance.remoteID] = true
+		}
+	}
+	return pending
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestMaintenancePending(t *testing.T) {
+	allowed, notAllowed := true, false
+	cases := []struct {
+		name   string
+		status *compute.MaintenanceRedeployStatus
+		want   bool
+	}{
+		{"none", nil, false},
+		{"nothing scheduled", &compute.MaintenanceRedeployStatus{IsCustomerInitiatedMaintenanceAllowed: &notAllowed}, false},
+		{"self-service window", &compute.MaintenanceRedeployStatus{IsCustomerInitiatedMaintenanceAllowed: &allowed}, true},
+		{"scheduled", &compute.MaintenanceRedeployStatus{IsCustomerInitiatedMaintenanceAllowed: &notAllowed,
+			MaintenanceWindowStartTime: &date.Time{Time: time.Now().Add(time.Hour)}}, true},
+	}
+	for _, tc := range cases {
+		if got := maintenancePending(tc.status); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMaintenanceRemoteIDs(t *testing.T) {
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"value":[` +
+			`{"instanceId":"0","properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}]}}},` +
+			`{"instanceId":"1","properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}],` +
+			`"maintenanceRedeployStatus":{"isCustomerInitiatedMaintenanceAllowed":true}}}}]}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	azure := &AzureController{vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+
+	set := &setSnapshot{resourceGroup: "rg", vmScaleSet: "vmss", withMaintenance: true}
+	remoteIDs, err := set.runningRemoteIDs(context.Background(), azure)
+	if err != nil || len(remoteIDs) != 2 {
+		t.Fatalf("got %v, %v", remoteIDs, err)
+	}
+	if pending := set.maintenanceRemoteIDs(); len(pending) != 1 || !pending["vmss_1"] {
+		t.Errorf("got %v pending maintenance", pending)
+	}
+}
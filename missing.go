@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	missingScaleSetFail = "fail"
+	missingScaleSetSkip = "skip"
+)
+
+// parseMissingScaleSetAction reads what a target does about a member scale
+// set Azure answers does not exist: fail the Status and Scale calls, or leave
+// the set out and carry on with the remaining ones.
+func parseMissingScaleSetAction(config map[string]string) (string, error) {
+	value, ok := config[configKeyMissingScaleSetAction]
+	if !ok {
+		return missingScaleSetFail, nil
+	}
+	if value != missingScaleSetFail && value != missingScaleSetSkip {
+		return "", fmt.Errorf("invalid %s %q, must be %q or %q",
+			configKeyMissingScaleSetAction, value, missingScaleSetFail, missingScaleSetSkip)
+	}
+	return value, nil
+}
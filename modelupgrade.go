@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"sort"
+	"strconv"
+)
+
+// modelUpgradeConfig says which instances of a set a scale out brings onto
+// the latest scale set model. Without it sets keep converging through their
+// own upgrade policy only.
+type modelUpgradeConfig struct {
+	// newInstances upgrades the instances the scale out created that do
+	// not run the latest model, such as when the model changed while they
+	// were being provisioned.
+	newInstances bool
+
+	// outdated is how many of the older instances running an outdated
+	// model are upgraded along with each scale out. Upgrading an instance
+	// may restart it, so the allocations on those nodes are disrupted.
+	outdated int
+}
+
+func parseModelUpgradeConfig(config map[string]string) (*modelUpgradeConfig, error) {
+	cfg := &modelUpgradeConfig{}
+	if value, ok := config[configKeyUpgradeNewInstances]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", configKeyUpgradeNewInstances, value)
+		}
+		cfg.newInstances = enabled
+	}
+	if value, ok := config[configKeyUpgradeOutdated]; ok {
+		outdated, err := strconv.Atoi(value)
+		if err != nil || outdated < 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyUpgradeOutdated, value)
+		}
+		cfg.outdated = outdated
+	}
+	if !cfg.newInstances && cfg.outdated == 0 {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// upgradeInstances brings instances onto the latest scale set model.
+func (ac *AzureController) upgradeInstances(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string) error {
+	ctx, done := ac.timeCall(ctx, "upgrade_instances", resourceGroup, vmScaleSet)
+	defer done()
+
+	if err := scaleWrites.wait(ctx, "upgrade_instances"); err != nil {
+		return wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	future, err := ac.vmss.UpdateInstances(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: ptr.StringArrToPtr(instanceIDs),
+	})
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss update instances response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss update instances future response")
+}
+
+// pickModelUpgrades returns the outdated instances a scale out upgrades: the
+// ones it created when asked to, and the configured number of the others,
+// lowest instance ID first so the oldest go first.
+func pickModelUpgrades(cfg *modelUpgradeConfig, outdated map[string]bool, before map[string]map[string]string) []string {
+	var created, older []string
+	for instanceID := range outdated {
+		if _, existed := before[instanceID]; existed {
+			older = append(older, instanceID)
+		} else {
+			created = append(created, instanceID)
+		}
+	}
+	sortInstanceIDs(created)
+	sortInstanceIDs(older)
+
+	var picked []string
+	if cfg.newInstances {
+		picked = append(picked, created...)
+	}
+	return append(picked, older[:min(cfg.outdated, len(older))]...)
+}
+
+// sortInstanceIDs orders instance IDs numerically, as Azure assigns them in
+// increasing order.
+func sortInstanceIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		if errA != nil || errB != nil {
+			return ids[i] < ids[j]
+		}
+		return a < b
+	})
+}
+
+// upgradeTouchedInstances upgrades the instances of a set picked after a
+// scale out. before lists the instances present before it; when unknown no
+// instance counts as created by the scale out. Upgrades are best-effort and
+// never fail the scaling action.
+func (t *TargetPlugin) upgradeTouchedInstances(ctx context.Context, resourceGroup, vmScaleSet string, cfg *modelUpgradeConfig, before map[string]map[string]string, log hclog.Logger) {
+	if cfg == nil {
+		return
+	}
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	outdated, err := azure.listOutdatedInstances(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to list instances with an outdated model", "vmss_name", vmScaleSet, "error", err)
+		return
+	}
+	if before == nil {
+		// Without the instances present before, every instance could
+		// be an old one.
+		cfg = &modelUpgradeConfig{outdated: cfg.outdated}
+		before = make(map[string]map[string]string, len(outdated))
+		for instanceID := range outdated {
+			before[instanceID] = nil
+		}
+	}
+	picked := pickModelUpgrades(cfg, outdated, before)
+	if len(picked) == 0 {
+		return
+	}
+	if err := azure.upgradeInstances(ctx, resourceGroup, vmScaleSet, picked); err != nil {
+		log.Warn("failed to upgrade instances to the latest model", "vmss_name", vmScaleSet, "instances", picked, "error", err)
+		return
+	}
+	log.Info("upgraded instances to the latest model", "vmss_name", vmScaleSet, "instances", picked)
+}
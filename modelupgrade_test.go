@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModelUpgradeConfig(t *testing.T) {
+	cases := []struct {
+		config  map[string]string
+		want    *modelUpgradeConfig
+		wantErr bool
+	}{
+		{config: map[string]string{}},
+		{config: map[string]string{configKeyUpgradeNewInstances: "false"}},
+		{config: map[string]string{configKeyUpgradeNewInstances: "true"}, want: &modelUpgradeConfig{newInstances: true}},
+		{config: map[string]string{configKeyUpgradeOutdated: "2"}, want: &modelUpgradeConfig{outdated: 2}},
+		{config: map[string]string{configKeyUpgradeNewInstances: "yes please"}, wantErr: true},
+		{config: map[string]string{configKeyUpgradeOutdated: "-1"}, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseModelUpgradeConfig(c.config)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: got error %v, want error %t", c.config, err, c.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %+v, want %+v", c.config, got, c.want)
+		}
+	}
+}
+
+func TestPickModelUpgrades(t *testing.T) {
+	outdated := map[string]bool{"2": true, "10": true, "3": true, "11": true, "12": true}
+	before := map[string]map[string]string{"1": nil, "2": nil, "3": nil, "10": nil}
+
+	cases := []struct {
+		cfg  *modelUpgradeConfig
+		want []string
+	}{
+		{&modelUpgradeConfig{newInstances: true}, []string{"11", "12"}},
+		{&modelUpgradeConfig{outdated: 2}, []string{"2", "3"}},
+		{&modelUpgradeConfig{newInstances: true, outdated: 5}, []string{"11", "12", "2", "3", "10"}},
+	}
+	for _, c := range cases {
+		if got := pickModelUpgrades(c.cfg, outdated, before); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: got %v, want %v", c.cfg, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// azureMonitorResource is the AAD audience of the custom metrics
+	// ingestion endpoint, which differs from Resource Manager.
+	azureMonitorResource = "https://monitoring.azure.com/"
+
+	defaultAzureMonitorNamespace = "NomadAutoscaler"
+	defaultAzureMonitorInterval  = time.Minute
+)
+
+type azureMonitorConfig struct {
+	interval   time.Duration
+	namespace  string
+	authorizer autorest.Authorizer
+}
+
+func parseAzureMonitorConfig(config map[string]string, authorizers *authorizerCache) (*azureMonitorConfig, error) {
+	value, ok := config[configKeyAzureMonitorMetrics]
+	if !ok || !isTruthy(value) {
+		return nil, nil
+	}
+
+	cfg := &azureMonitorConfig{interval: defaultAzureMonitorInterval, namespace: defaultAzureMonitorNamespace}
+	if value, ok := config[configKeyAzureMonitorInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < time.Minute {
+			return nil, fmt.Errorf("invalid %s %q, must be a duration of at least 1m", configKeyAzureMonitorInterval, value)
+		}
+		cfg.interval = interval
+	}
+	if value, ok := config[configKeyAzureMonitorNamespace]; ok && value != "" {
+		cfg.namespace = value
+	}
+
+	authorizer, err := authorizers.get(config, azureMonitorResource)
+	if err != nil {
+		return nil, err
+	}
+	cfg.authorizer = authorizer
+	return cfg, nil
+}
+
+// scaleEventCounter counts the scale events that touched each scale set since
+// the exporter last published them.
+type scaleEventCounter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func newScaleEventCounter() *scaleEventCounter {
+	return &scaleEventCounter{counts: make(map[string]int64)}
+}
+
+func (c *scaleEventCounter) increment(resourceGroup, vmScaleSet string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[vmssKey(resourceGroup, vmScaleSet)]++
+}
+
+// take returns the count of a scale set and resets it.
+func (c *scaleEventCounter) take(resourceGroup, vmScaleSet string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	count := c.counts[key]
+	delete(c.counts, key)
+	return count
+}
+
+// runAzureMonitorExporter periodically publishes the desired and actual
+// capacity and the scale event count of every observed scale set as Azure
+// Monitor custom metrics on the scale set resource.
+func (t *TargetPlugin) runAzureMonitorExporter(ctx context.Context, cfg *azureMonitorConfig) {
+	log := t.logger.With("task", "azure_monitor_exporter")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	sender := instrumentSender(autorest.CreateSender())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, config := range t.targets.list() {
+				if err := t.exportAzureMonitorMetrics(ctx, cfg, sender, config, log); err != nil {
+					log.Warn("failed to publish Azure Monitor metrics", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) exportAzureMonitorMetrics(ctx context.Context, cfg *azureMonitorConfig, sender autorest.Sender, config map[string]string, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	target := targetKey(config)
+	for idx, vmScaleSet := range vmScaleSetList {
+		resourceGroup := resourceGroupList[idx]
+		vmss, err := t.azureFor(resourceGroup, vmScaleSet).vmss.Get(ctx, resourceGroup, vmScaleSet)
+		if err != nil {
+			return wrapAzureError(ctx, "failed to get Azure vmss", err)
+		}
+		if vmss.ID == nil || vmss.Location == nil {
+			continue
+		}
+
+		actual := ptr.PtrToInt64(vmss.Sku.Capacity)
+		values := map[string]int64{
+			"ActualCapacity": actual,
+			"ScaleEvents":    t.scaleEventCounts.take(resourceGroup, vmScaleSet),
+		}
+		if desired, ok := t.desired.get(resourceGroup, vmScaleSet); ok {
+			values["DesiredCapacity"] = desired
+		}
+
+		url := fmt.Sprintf("https://%s.monitoring.azure.com%s/metrics", strings.ReplaceAll(strings.ToLower(*vmss.Location), " ", ""), *vmss.ID)
+		for name, value := range values {
+			if err := postCustomMetric(ctx, sender, cfg, url, now, name, target, value); err != nil {
+				return err
+			}
+		}
+		log.Trace("published Azure Monitor metrics", "vmss_name", vmScaleSet, "values", values)
+	}
+	return nil
+}
+
+// customMetric is the payload of the Azure Monitor custom metrics ingestion
+// API for a single metric with one series.
+type customMetric struct {
+	Time string `json:"time"`
+	Data struct {
+		BaseData struct {
+			Metric    string               `json:"metric"`
+			Namespace string               `json:"namespace"`
+			DimNames  []string             `json:"dimNames"`
+			Series    []customMetricSeries `json:"series"`
+		} `json:"baseData"`
+	} `json:"data"`
+}
+
+type customMetricSeries struct {
+	DimValues []string `json:"dimValues"`
+	Min       int64    `json:"min"`
+	Max       int64    `json:"max"`
+	Sum       int64    `json:"sum"`
+	Count     int64    `json:"count"`
+}
+
+func postCustomMetric(ctx context.Context, sender autorest.Sender, cfg *azureMonitorConfig, url string, now time.Time, name, target string, value int64) error {
+	var metric customMetric
+	metric.Time = now.Format(time.RFC3339)
+	metric.Data.BaseData.Metric = name
+	metric.Data.BaseData.Namespace = cfg.namespace
+	metric.Data.BaseData.DimNames = []string{"Target"}
+	metric.Data.BaseData.Series = []customMetricSeries{{
+		DimValues: []string{target},
+		Min:       value,
+		Max:       value,
+		Sum:       value,
+		Count:     1,
+	}}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.AsPost(),
+		autorest.AsJSON(),
+		autorest.WithBaseURL(url),
+		autorest.WithJSON(metric),
+		cfg.authorizer.WithAuthorization())
+	if err != nil {
+		return fmt.Errorf("failed to prepare custom metric request: %v", err)
+	}
+	resp, err := sender.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send custom metric %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send custom metric %s: unexpected status %s", name, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+)
+
+// allNamespaces is the Nomad wildcard namespace.
+const allNamespaces = "*"
+
+// parseScaleInNamespaces returns the namespaces whose allocations scale in
+// selection considers, allNamespaces alone for all of them, or nil for the
+// namespace of the Nomad client only.
+func parseScaleInNamespaces(config map[string]string) ([]string, error) {
+	value, ok := config[configKeyScaleInNamespaces]
+	if !ok {
+		return nil, nil
+	}
+	entries, err := splitList(config, configKeyScaleInNamespaces, value)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == allNamespaces {
+			return []string{allNamespaces}, nil
+		}
+		namespaces = append(namespaces, entry)
+	}
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("invalid %s %q, lists no namespace", configKeyScaleInNamespaces, value)
+	}
+	return namespaces, nil
+}
+
+// activeAlloc reports whether an allocation is, or is about to be, running.
+func activeAlloc(alloc *api.AllocationListStub) bool {
+	switch alloc.ClientStatus {
+	case api.AllocClientStatusComplete, api.AllocClientStatusFailed, api.AllocClientStatusLost:
+		return false
+	}
+	return alloc.DesiredStatus == "" || alloc.DesiredStatus == "run"
+}
+
+// busyNodes returns the IDs of the nodes with an active allocation in any of
+// namespaces, leaving system jobs out if asked to.
+func busyNodes(client *api.Client, namespaces []string, ignoreSystemJobs bool) (map[string]struct{}, error) {
+	busy := make(map[string]struct{})
+	for _, namespace := range namespaces {
+		allocs, _, err := client.Allocations().List(&api.QueryOptions{Namespace: namespace})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the allocations of namespace %s: %v", namespace, err)
+		}
+		for _, alloc := range allocs {
+			if !activeAlloc(alloc) || (ignoreSystemJobs && alloc.JobType == api.JobTypeSystem) {
+				continue
+			}
+			busy[alloc.NodeID] = struct{}{}
+		}
+	}
+	return busy, nil
+}
+
+// emptyNodeStrategy reports whether the node selector of a scale in config
+// only selects empty nodes, and whether it ignores system jobs doing so.
+func emptyNodeStrategy(config map[string]string) (bool, bool) {
+	switch config[sdk.TargetConfigNodeSelectorStrategy] {
+	case sdk.TargetNodeSelectorStrategyEmpty:
+		return true, false
+	case sdk.TargetNodeSelectorStrategyEmptyIgnoreSystemJobs:
+		return true, true
+	}
+	return false, false
+}
+
+// withoutBusyNodes drops the remote IDs whose node is busy.
+func withoutBusyNodes(remoteIDs []string, busy map[string]struct{}, nodes map[string]*api.Node) []string {
+	kept := make([]string, 0, len(remoteIDs))
+	for _, remoteID := range remoteIDs {
+		if node := nodes[strings.ToLower(remoteID)]; node != nil {
+			if _, ok := busy[node.ID]; ok {
+				continue
+			}
+		}
+		kept = append(kept, remoteID)
+	}
+	return kept
+}
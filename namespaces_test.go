@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestParseScaleInNamespaces(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "web, batch", want: []string{"web", "batch"}},
+		{value: "web,*", want: []string{"*"}},
+		{value: " , ", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseScaleInNamespaces(map[string]string{configKeyScaleInNamespaces: c.value})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v, want error %t", c.value, err, c.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestBusyNodes(t *testing.T) {
+	allocs := map[string][]*api.AllocationListStub{
+		"web": {
+			{NodeID: "n1", ClientStatus: api.AllocClientStatusRunning, DesiredStatus: "run", JobType: api.JobTypeService},
+			{NodeID: "n2", ClientStatus: api.AllocClientStatusComplete, DesiredStatus: "run", JobType: api.JobTypeService},
+		},
+		"batch": {
+			{NodeID: "n3", ClientStatus: api.AllocClientStatusRunning, DesiredStatus: "run", JobType: api.JobTypeSystem},
+			{NodeID: "n4", ClientStatus: api.AllocClientStatusRunning, DesiredStatus: "stop", JobType: api.JobTypeBatch},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(allocs[r.URL.Query().Get("namespace")])
+	}))
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy, err := busyNodes(client, []string{"web", "batch"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]struct{}{"n1": {}, "n3": {}}; !reflect.DeepEqual(busy, want) {
+		t.Errorf("got %v, want %v", busy, want)
+	}
+	if busy, _ = busyNodes(client, []string{"web", "batch"}, true); len(busy) != 1 {
+		t.Errorf("got %v ignoring system jobs, want n1 only", busy)
+	}
+
+	nodes := map[string]*api.Node{"vmss_1": {ID: "n1"}, "vmss_2": {ID: "n2"}}
+	if got := withoutBusyNodes([]string{"vmss_1", "vmss_2"}, busy, nodes); !reflect.DeepEqual(got, []string{"vmss_2"}) {
+		t.Errorf("got candidates %v, want vmss_2", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// nodeMapping is how the plugin resolves a Nomad node onto an Azure instance,
+// as served on /debug/nodes.
+type nodeMapping struct {
+	NodeID        string `json:"node_id"`
+	NodeName      string `json:"node_name"`
+	NodeStatus    string `json:"node_status"`
+	Eligibility   string `json:"eligibility"`
+	Draining      bool   `json:"draining"`
+	RemoteID      string `json:"remote_id"`
+	ResourceGroup string `json:"resource_group"`
+	VMScaleSet    string `json:"vm_scale_set"`
+	InstanceID    string `json:"instance_id"`
+	ResourceID    string `json:"resource_id"`
+	Source        string `json:"source"`
+}
+
+type nodeMapResponse struct {
+	Targets  map[string][]nodeMapping `json:"targets"`
+	Unmapped []string                 `json:"unmapped_nodes,omitempty"`
+	Errors   map[string]string        `json:"errors,omitempty"`
+}
+
+// handleNodeMap dumps the mapping of the Nomad nodes of every target onto
+// the instances of its member sets, the view scale in picks nodes from.
+// Nodes the plugin cannot map onto any instance are listed as unmapped.
+func (t *TargetPlugin) handleNodeMap(w http.ResponseWriter, _ *http.Request) {
+	resp := nodeMapResponse{Targets: make(map[string][]nodeMapping)}
+	unmapped := make(map[string]bool)
+	for _, config := range t.targets.list() {
+		target := targetKey(config)
+		mappings, missing, err := t.nodeMappings(config)
+		if err != nil {
+			if resp.Errors == nil {
+				resp.Errors = make(map[string]string)
+			}
+			resp.Errors[target] = err.Error()
+			continue
+		}
+		resp.Targets[target] = mappings
+		for _, nodeID := range missing {
+			unmapped[nodeID] = true
+		}
+	}
+	for nodeID := range unmapped {
+		resp.Unmapped = append(resp.Unmapped, nodeID)
+	}
+	sort.Strings(resp.Unmapped)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// nodeMappings returns the mapping of the nodes of the target's Nomad cluster
+// that belong to its member sets, and the IDs of the nodes that map onto no
+// instance at all.
+func (t *TargetPlugin) nodeMappings(config map[string]string) ([]nodeMapping, []string, error) {
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	stubs, _, err := cluster.client.Nodes().List(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+
+	var mappings []nodeMapping
+	var unmapped []string
+	for _, stub := range stubs {
+		node, _, err := cluster.client.Nodes().Info(stub.ID, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read Nomad node %s: %v", stub.ID, err)
+		}
+		remoteID, err := t.nodeIDMap(node)
+		if err != nil {
+			unmapped = append(unmapped, node.ID)
+			continue
+		}
+		source := "fingerprint"
+		if _, err := azureNodeIDMap(node); err != nil {
+			source = "instance_tag"
+		}
+		sep := strings.LastIndex(remoteID, "_")
+		if sep < 0 {
+			unmapped = append(unmapped, node.ID)
+			continue
+		}
+		for _, member := range members {
+			if !strings.EqualFold(remoteID[:sep], member.vmScaleSet) {
+				continue
+			}
+			instanceID := remoteID[sep+1:]
+			mappings = append(mappings, nodeMapping{
+				NodeID:        node.ID,
+				NodeName:      node.Name,
+				NodeStatus:    node.Status,
+				Eligibility:   node.SchedulingEligibility,
+				Draining:      node.Drain,
+				RemoteID:      remoteID,
+				ResourceGroup: member.resourceGroup,
+				VMScaleSet:    member.vmScaleSet,
+				InstanceID:    instanceID,
+				ResourceID: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%s",
+					t.azureFor(member.resourceGroup, member.vmScaleSet).subscriptionID, member.resourceGroup, member.vmScaleSet, instanceID),
+				Source: source,
+			})
+			break
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].RemoteID < mappings[j].RemoteID })
+	return mappings, unmapped, nil
+}
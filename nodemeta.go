@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+)
+
+// The node meta keys a scale out writes onto the nodes it created, so an
+// allocation or a debugging session can trace a node back to the scale event.
+const (
+	nodeMetaPool        = metaKeyPrefix + "pool"
+	nodeMetaVMSS        = metaKeyPrefix + "vmss"
+	nodeMetaInstanceID  = metaKeyPrefix + "instance_id"
+	nodeMetaOperationID = metaKeyPrefix + "scale_operation_id"
+)
+
+// nodeMetaApplyRequest is the body of the dynamic node metadata endpoint,
+// which the API package predates. A nil value unsets the key.
+type nodeMetaApplyRequest struct {
+	NodeID string
+	Meta   map[string]*string
+}
+
+// scaleNodeMeta returns the meta a scale out writes onto a node it created.
+func scaleNodeMeta(member scaleSetTarget, remoteID string, node *api.Node, operationID string) map[string]*string {
+	pool := node.NodeClass
+	if pool == "" {
+		pool = defaultNodeClass
+	}
+	instanceID := remoteID[strings.LastIndex(remoteID, "_")+1:]
+	vmss := vmssKey(member.resourceGroup, member.vmScaleSet)
+	meta := map[string]*string{
+		nodeMetaPool:       &pool,
+		nodeMetaVMSS:       &vmss,
+		nodeMetaInstanceID: &instanceID,
+	}
+	if operationID != "" {
+		meta[nodeMetaOperationID] = &operationID
+	}
+	return meta
+}
+
+// writeScaleNodeMeta writes the scale event onto a node registered by a
+// scale out. It needs Nomad 1.5 or later; a failure is only logged, the
+// node serves all the same.
+func (t *TargetPlugin) writeScaleNodeMeta(ctx context.Context, cluster *nomadCluster, member scaleSetTarget, remoteID string, node *api.Node, log hclog.Logger) {
+	req := nodeMetaApplyRequest{NodeID: node.ID, Meta: scaleNodeMeta(member, remoteID, node, operationID(ctx))}
+	if _, err := cluster.client.Raw().Write("/v1/client/metadata", req, nil, nil); err != nil {
+		log.Warn("failed to write scale event meta onto node", "node_id", node.ID, "remote_id", remoteID, "error", err)
+		return
+	}
+	log.Debug("wrote scale event meta onto node", "node_id", node.ID, "remote_id", remoteID)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestScaleNodeMeta(t *testing.T) {
+	member := scaleSetTarget{resourceGroup: "rg", vmScaleSet: "batch"}
+	meta := scaleNodeMeta(member, "batch_12", &api.Node{NodeClass: "compute"}, "op-1")
+	want := map[string]string{
+		nodeMetaPool:        "compute",
+		nodeMetaVMSS:        vmssKey("rg", "batch"),
+		nodeMetaInstanceID:  "12",
+		nodeMetaOperationID: "op-1",
+	}
+	if len(meta) != len(want) {
+		t.Fatalf("got %d meta keys, want %d", len(meta), len(want))
+	}
+	for key, value := range want {
+		if meta[key] == nil || *meta[key] != value {
+			t.Errorf("meta %s = %v, want %q", key, meta[key], value)
+		}
+	}
+
+	meta = scaleNodeMeta(member, "batch_3", &api.Node{}, "")
+	if *meta[nodeMetaPool] != defaultNodeClass {
+		t.Errorf("pool of a node without class = %q, want %q", *meta[nodeMetaPool], defaultNodeClass)
+	}
+	if _, ok := meta[nodeMetaOperationID]; ok {
+		t.Error("operation ID written without an operation")
+	}
+}
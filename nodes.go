@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+)
+
+// registeredNodes returns every Nomad node that can be mapped onto an Azure
+// instance, keyed by its lower-cased remote ID.
+func (t *TargetPlugin) registeredNodes(client *api.Client) (map[string]*api.Node, error) {
+	stubs, _, err := client.Nodes().List(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+
+	nodes := make(map[string]*api.Node, len(stubs))
+	for _, stub := range stubs {
+		node, _, err := client.Nodes().Info(stub.ID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Nomad node %s: %v", stub.ID, err)
+		}
+		remoteID, err := t.nodeIDMap(node)
+		if err != nil {
+			continue
+		}
+		nodes[strings.ToLower(remoteID)] = node
+	}
+	return nodes, nil
+}
+
+// nodeFilter restricts the Nomad nodes considered part of a member scale set.
+// Empty fields leave that dimension unrestricted.
+type nodeFilter struct {
+	class      string
+	datacenter string
+}
+
+// matches reports whether node belongs to the pool described by the filter.
+// Nodes without a class are matched by the autoscaler's default pool name, in
+// line with how the cluster scale utils identify the class pool.
+func (f nodeFilter) matches(node *api.Node) bool {
+	if f.datacenter != "" && node.Datacenter != f.datacenter {
+		return false
+	}
+	if f.class == "" {
+		return true
+	}
+	if node.NodeClass == "" {
+		return f.class == defaultNodeClass
+	}
+	return node.NodeClass == f.class
+}
+
+func (f nodeFilter) empty() bool {
+	return f.class == "" && f.datacenter == ""
+}
+
+// parseNodeFilters returns the node filter of each member scale set, built
+// from the node class and datacenter lists. A nil result means no per-set
+// filtering was configured so callers can skip the extra Nomad lookups.
+func parseNodeFilters(config map[string]string, vmScaleSetList []string) ([]nodeFilter, error) {
+	classList, err := parseFilterList(config, configKeyNodeClassList, vmScaleSetList)
+	if err != nil {
+		return nil, err
+	}
+	datacenterList, err := parseFilterList(config, configKeyDatacenterList, vmScaleSetList)
+	if err != nil {
+		return nil, err
+	}
+	if classList == nil && datacenterList == nil {
+		return nil, nil
+	}
+
+	filters := make([]nodeFilter, len(vmScaleSetList))
+	for idx := range filters {
+		if classList != nil {
+			filters[idx].class = classList[idx]
+		}
+		if datacenterList != nil {
+			filters[idx].datacenter = datacenterList[idx]
+		}
+	}
+	return filters, nil
+}
+
+func parseFilterList(config map[string]string, key string, vmScaleSetList []string) ([]string, error) {
+	listStr, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	list := strings.Split(listStr, ",")
+	if len(list) != len(vmScaleSetList) {
+		return nil, fmt.Errorf("%s has %d entries but %s has %d",
+			key, len(list), configKeyVMSSList, len(vmScaleSetList))
+	}
+	for idx := range list {
+		list[idx] = strings.TrimSpace(list[idx])
+	}
+	return list, nil
+}
+
+// filterRemoteIDs drops the remote IDs whose Nomad node does not match the
+// filter of the scale set they live in. Instances without a registered node
+// are dropped too since they cannot be drained. Sets without a filter keep
+// all of their remote IDs.
+func filterRemoteIDs(remoteIDs []string, filter nodeFilter, nodes map[string]*api.Node) []string {
+	if filter.empty() {
+		return remoteIDs
+	}
+	filtered := remoteIDs[:0]
+	for _, remoteID := range remoteIDs {
+		if node, ok := nodes[strings.ToLower(remoteID)]; ok && filter.matches(node) {
+			filtered = append(filtered, remoteID)
+		}
+	}
+	return filtered
+}
+
+// countSetNodes returns the number of registered nodes backed by vmScaleSet
+// that match its node filter.
+func countSetNodes(vmScaleSet string, filter nodeFilter, nodes map[string]*api.Node) int {
+	prefix := strings.ToLower(vmScaleSet) + "_"
+	count := 0
+	for remoteID, node := range nodes {
+		if strings.HasPrefix(remoteID, prefix) && !strings.Contains(remoteID[len(prefix):], "_") && filter.matches(node) {
+			count++
+		}
+	}
+	return count
+}
+
+// poolConfig fills in the target-level node pool keys used by the cluster
+// scale utils from the per-set filters, when the target does not set them and
+// every member set agrees on the value. This keeps candidate identification
+// scoped to the pool even when only per-set filters are configured.
+func poolConfig(config map[string]string, filters []nodeFilter) map[string]string {
+	if filters == nil {
+		return config
+	}
+	if _, ok := config[sdk.TargetConfigKeyClass]; ok {
+		return config
+	}
+	if _, ok := config[sdk.TargetConfigKeyDatacenter]; ok {
+		return config
+	}
+
+	class, datacenter := filters[0].class, filters[0].datacenter
+	for _, filter := range filters[1:] {
+		if filter.class != class {
+			class = ""
+		}
+		if filter.datacenter != datacenter {
+			datacenter = ""
+		}
+	}
+
+	merged := make(map[string]string, len(config)+2)
+	for key, value := range config {
+		merged[key] = value
+	}
+	if class != "" {
+		merged[sdk.TargetConfigKeyClass] = class
+	}
+	if datacenter != "" {
+		merged[sdk.TargetConfigKeyDatacenter] = datacenter
+	}
+	return merged
+}
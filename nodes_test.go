@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestFilterRemoteIDs(t *testing.T) {
+	nodes := map[string]*api.Node{
+		"vmss_0": {NodeClass: "web"},
+		"vmss_1": {NodeClass: "batch"},
+	}
+	cases := []struct {
+		name   string
+		filter nodeFilter
+		nodes  map[string]*api.Node
+		want   []string
+	}{
+		{name: "empty filter keeps all", nodes: nodes, want: []string{"vmss_0", "vmss_1", "vmss_2"}},
+		{name: "empty filter without nodes keeps all", want: []string{"vmss_0", "vmss_1", "vmss_2"}},
+		{name: "class", filter: nodeFilter{class: "web"}, nodes: nodes, want: []string{"vmss_0"}},
+		{name: "unregistered dropped", filter: nodeFilter{class: "batch"}, nodes: nodes, want: []string{"vmss_1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := filterRemoteIDs([]string{"vmss_0", "vmss_1", "vmss_2"}, c.filter, c.nodes)
+			if !equalStrings(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultNomadRetryAttempts = 3
+	defaultNomadRetryBackoff  = time.Second
+)
+
+// nomadRetry is how often, and how far apart, the Nomad side of a scale in
+// is attempted when the Nomad API fails transiently. The backoff doubles
+// after every attempt.
+type nomadRetry struct {
+	attempts int
+	backoff  time.Duration
+}
+
+func parseNomadRetry(config map[string]string) (nomadRetry, error) {
+	retry := nomadRetry{attempts: defaultNomadRetryAttempts, backoff: defaultNomadRetryBackoff}
+	if value, ok := config[configKeyNomadRetryAttempts]; ok {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return retry, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyNomadRetryAttempts, value)
+		}
+		retry.attempts = attempts
+	}
+	if value, ok := config[configKeyNomadRetryBackoff]; ok {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff < 0 {
+			return retry, fmt.Errorf("invalid %s %q", configKeyNomadRetryBackoff, value)
+		}
+		retry.backoff = backoff
+	}
+	return retry, nil
+}
+
+// nomadResponseCode matches the status code in the errors the Nomad API
+// client returns for non 2xx responses. The vendored client has no typed
+// error for them, it formats the code into the message.
+var nomadResponseCode = regexp.MustCompile(`Unexpected response code: (\d{3})`)
+
+// nomadStatusCoder is implemented by the response errors of newer Nomad API
+// clients.
+type nomadStatusCoder interface {
+	StatusCode() int
+}
+
+// nomadStatusCode returns the HTTP status code of a failed Nomad API call.
+func nomadStatusCode(err error) (int, bool) {
+	var coder nomadStatusCoder
+	if errors.As(err, &coder) {
+		return coder.StatusCode(), true
+	}
+	match := nomadResponseCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(match[1])
+	return code, err == nil
+}
+
+// isTransientNomadError reports whether err is the Nomad API failing in a way
+// a later attempt may not, such as a leader election or a dropped connection.
+// Errors returned by an API call, including a drain request, are classified
+// by their type and status code. The scale utils flatten some errors of the
+// API client into their message, hence the fallback on it. A drain that
+// failed while being monitored is never retried, the node is already
+// draining and a new attempt would select others.
+func isTransientNomadError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "received error while draining node") ||
+		strings.Contains(msg, "context done while monitoring node drain") {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if code, ok := nomadStatusCode(err); ok {
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	for _, transient := range []string{
+		"No cluster leader",
+		"connection refused",
+		"connection reset",
+		"i/o timeout",
+		"TLS handshake timeout",
+		"EOF",
+	} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// do runs fn until it succeeds, fails other than transiently, or the
+// attempts are used up.
+func (r nomadRetry) do(ctx context.Context, log hclog.Logger, task string, fn func() error) error {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.attempts || !isTransientNomadError(err) {
+			return err
+		}
+		log.Warn("Nomad API failed transiently, retrying", "task", task, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryingScaleUtils runs the pre and post scale in tasks of the cluster
+// scale utils with the Nomad retry policy of the plugin. The remote IDs of
+// the candidates are normalized like those the node lookup returns.
+type retryingScaleUtils struct {
+	*scaleutils.ClusterScaleUtils
+	retry    nomadRetry
+	identity nodeIdentity
+	log      hclog.Logger
+}
+
+func (u *retryingScaleUtils) RunPreScaleInTasksWithRemoteCheck(ctx context.Context, cfg map[string]string, remoteIDs []string, num int) ([]scaleutils.NodeResourceID, error) {
+	limit, err := parseDrainConcurrency(cfg)
+	if err != nil {
+		return nil, err
+	}
+	remoteIDs = u.identity.normalizeAll(remoteIDs)
+	var ids []scaleutils.NodeResourceID
+	err = u.retry.do(ctx, u.log, "pre_scale_in", func() error {
+		var err error
+		if limit > 0 && limit < num {
+			ids, err = u.runPreScaleInTasksLimited(ctx, cfg, remoteIDs, num, limit)
+		} else {
+			ids, err = u.ClusterScaleUtils.RunPreScaleInTasksWithRemoteCheck(ctx, cfg, remoteIDs, num)
+		}
+		return err
+	})
+	return ids, err
+}
+
+func (u *retryingScaleUtils) RunPostScaleInTasks(ctx context.Context, cfg map[string]string, ids []scaleutils.NodeResourceID) error {
+	return u.retry.do(ctx, u.log, "post_scale_in", func() error {
+		return u.ClusterScaleUtils.RunPostScaleInTasks(ctx, cfg, ids)
+	})
+}
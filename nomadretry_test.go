@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+type statusCodeError int
+
+func (e statusCodeError) Error() string   { return fmt.Sprintf("status %d", int(e)) }
+func (e statusCodeError) StatusCode() int { return int(e) }
+
+func TestIsTransientNomadError(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: &timeoutError{}}
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil"},
+		{name: "canceled", err: fmt.Errorf("list nodes: %w", context.Canceled)},
+		{name: "eof", err: &url.Error{Op: "Get", URL: "http://nomad", Err: io.EOF}, want: true},
+		{name: "connection refused", err: &url.Error{Op: "Get", URL: "http://nomad", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "timeout", err: multierror.Append(nil, &url.Error{Op: "Get", URL: "http://nomad", Err: timeout}), want: true},
+		{name: "status code", err: statusCodeError(502), want: true},
+		{name: "status code not found", err: statusCodeError(404)},
+		{name: "too many requests", err: errors.New("Unexpected response code: 429 (rate limited)"), want: true},
+		{name: "not found", err: errors.New("Unexpected response code: 404 (node not found)")},
+		{name: "drain request unavailable", err: errors.New("failed to drain node: Unexpected response code: 503 (No cluster leader)"), want: true},
+		{name: "drain request forbidden", err: errors.New("failed to drain node: Unexpected response code: 403 (Permission denied)")},
+		{name: "drain monitor", err: errors.New("received error while draining node: connection reset by peer")},
+		{name: "drain deadline", err: errors.New("context done while monitoring node drain: context deadline exceeded")},
+		{name: "flattened no leader", err: errors.New("failed to list Nomad nodes: No cluster leader"), want: true},
+		{name: "no nodes", err: errors.New("no nodes identified for scaling in action")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransientNomadError(c.err); got != c.want {
+				t.Errorf("got %v, want %v for %v", got, c.want, c.err)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"github.com/hashicorp/go-uuid"
+)
+
+// headerOperationID is sent on Nomad requests made during a scale operation.
+const headerOperationID = "X-Nomad-Autoscaler-Operation-ID"
+
+type operationIDKey struct{}
+
+// newOperationID returns a unique ID for a single Scale invocation. It is a
+// UUID so it can double as the Azure client request ID.
+func newOperationID() string {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+func withOperationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+func operationID(ctx context.Context) string {
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
+}
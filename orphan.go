@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	orphanActionReport  = "report"
+	orphanActionReplace = "replace"
+
+	defaultOrphanCheckInterval = time.Minute
+)
+
+type orphanConfig struct {
+	threshold time.Duration
+	interval  time.Duration
+	action    string
+}
+
+func parseOrphanConfig(config map[string]string) (*orphanConfig, error) {
+	thresholdStr, ok := config[configKeyOrphanThreshold]
+	if !ok {
+		return nil, nil
+	}
+	threshold, err := time.ParseDuration(thresholdStr)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyOrphanThreshold, thresholdStr)
+	}
+
+	cfg := &orphanConfig{threshold: threshold, interval: defaultOrphanCheckInterval, action: orphanActionReport}
+	if value, ok := config[configKeyOrphanCheckInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyOrphanCheckInterval, value)
+		}
+		cfg.interval = interval
+	}
+	if value, ok := config[configKeyOrphanAction]; ok {
+		if value != orphanActionReport && value != orphanActionReplace {
+			return nil, fmt.Errorf("invalid %s %q, must be %q or %q",
+				configKeyOrphanAction, value, orphanActionReport, orphanActionReplace)
+		}
+		cfg.action = value
+	}
+	return cfg, nil
+}
+
+// orphanTracker records, per target, the instances currently considered
+// orphaned and how many have been remediated so it can be reported through
+// Status.
+type orphanTracker struct {
+	lock       sync.Mutex
+	detected   map[string][]string
+	remediated map[string]int
+}
+
+func newOrphanTracker() *orphanTracker {
+	return &orphanTracker{
+		detected:   make(map[string][]string),
+		remediated: make(map[string]int),
+	}
+}
+
+func (o *orphanTracker) record(key string, detected []string, remediated int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.detected[key] = detected
+	o.remediated[key] += remediated
+}
+
+func (o *orphanTracker) annotate(key string, meta map[string]string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if detected, ok := o.detected[key]; ok {
+		meta[metaKeyOrphanedInstances] = strings.Join(detected, ",")
+		meta[metaKeyOrphansRemediated] = strconv.Itoa(o.remediated[key])
+	}
+}
+
+// runOrphanGC periodically looks for running instances that never registered
+// with Nomad, which usually points at a broken image or cloud-init.
+func (t *TargetPlugin) runOrphanGC(ctx context.Context, cfg *orphanConfig) {
+	log := t.logger.With("task", "orphan_instance_gc")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.collectOrphanInstances(ctx, config, cfg, log); err != nil {
+					log.Warn("failed to collect orphaned instances", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) collectOrphanInstances(ctx context.Context, config map[string]string, cfg *orphanConfig, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+
+	registered, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return err
+	}
+
+	var detected []string
+	remediated := 0
+	for idx, vmScaleSet := range vmScaleSetList {
+		azure := t.azureFor(resourceGroupList[idx], vmScaleSet)
+		instances, err := azure.listRunningInstances(ctx, resourceGroupList[idx], vmScaleSet)
+		if err != nil {
+			return err
+		}
+
+		var orphanIDs []string
+		for _, instance := range instances {
+			if _, ok := registered[strings.ToLower(instance.remoteID)]; ok {
+				continue
+			}
+			if instance.provisionedAt.IsZero() || time.Since(instance.provisionedAt) < cfg.threshold {
+				continue
+			}
+			log.Warn("Azure instance never registered as a Nomad node", "vmss_name", vmScaleSet,
+				"remote_id", instance.remoteID, "provisioned_at", instance.provisionedAt)
+			detected = append(detected, instance.remoteID)
+			orphanIDs = append(orphanIDs, instance.instanceID)
+		}
+
+		if len(orphanIDs) == 0 || cfg.action != orphanActionReplace {
+			continue
+		}
+
+		replaced, err := t.replaceOrphans(ctx, azure, resourceGroupList[idx], vmScaleSet, orphanIDs, log)
+		if err != nil {
+			return err
+		}
+		remediated += replaced
+	}
+
+	sort.Strings(detected)
+	t.orphans.record(targetKey(config), detected, remediated)
+	return nil
+}
+
+// replaceOrphans deletes the orphaned instances of one scale set and sets its
+// capacity back to what it was, so Azure provisions replacements, returning
+// how many were replaced. The scale lock covers reading the capacity through
+// restoring it; a set another operation holds is skipped until the next
+// check. Orphans an operation removed before the lock was taken are dropped.
+func (t *TargetPlugin) replaceOrphans(ctx context.Context, azure *AzureController, resourceGroup, vmScaleSet string,
+	orphanIDs []string, log hclog.Logger) (int, error) {
+
+	id := newOperationID()
+	release, err := t.scaleLocks.tryAcquire([]string{vmssKey(resourceGroup, vmScaleSet)}, id)
+	if err != nil {
+		log.Debug("skipping replacement of orphaned instances in busy scale set", "vmss_name", vmScaleSet, "error", err)
+		return 0, nil
+	}
+	defer release()
+	ctx = withOperationID(ctx, id)
+
+	instances, err := azure.listRunningInstances(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return 0, err
+	}
+	running := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		running[instance.instanceID] = struct{}{}
+	}
+	var ids []string
+	for _, orphanID := range orphanIDs {
+		if _, ok := running[orphanID]; ok {
+			ids = append(ids, orphanID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	vmss, err := azure.vmss.Get(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return 0, wrapAzureError(ctx, "failed to get Azure vmss", err)
+	}
+	capacity := ptr.PtrToInt64(vmss.Sku.Capacity)
+
+	if err := azure.deleteInstances(ctx, resourceGroup, vmScaleSet, ids); err != nil {
+		return 0, err
+	}
+	if err := azure.setCapacity(ctx, resourceGroup, vmScaleSet, capacity); err != nil {
+		return 0, err
+	}
+	log.Info("replaced orphaned Azure instances", "vmss_name", vmScaleSet, "instances", ids,
+		"capacity", capacity, "operation_id", id)
+	return len(ids), nil
+}
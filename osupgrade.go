@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"strconv"
+	"strings"
+)
+
+// tagOSUpgradesPaused marks a scale set whose automatic OS image upgrades the
+// plugin turned off for a scale operation, set to the ID of the operation. A
+// set still carrying it while no scale is in flight, as after the plugin
+// stopped during the operation, gets its upgrades turned back on.
+const tagOSUpgradesPaused = "nomad-autoscaler:os-upgrades-paused"
+
+func parsePauseOSUpgrades(config map[string]string) (bool, error) {
+	value, ok := config[configKeyPauseOSUpgrades]
+	if !ok {
+		return false, nil
+	}
+	pause, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", configKeyPauseOSUpgrades, value)
+	}
+	return pause, nil
+}
+
+// automaticOSUpgrades reports whether Azure rolls out new OS images to the
+// scale set by itself.
+func automaticOSUpgrades(vmss compute.VirtualMachineScaleSet) bool {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.UpgradePolicy == nil {
+		return false
+	}
+	policy := vmss.UpgradePolicy.AutomaticOSUpgradePolicy
+	return policy != nil && policy.EnableAutomaticOSUpgrade != nil && *policy.EnableAutomaticOSUpgrade
+}
+
+// setAutomaticOSUpgrades turns the automatic OS image upgrades of a scale set
+// on or off, tagging the set with the operation while they are off. The rest
+// of the upgrade policy is kept as read from the set.
+func (ac *AzureController) setAutomaticOSUpgrades(ctx context.Context, resourceGroup string, vmScaleSet string, enable bool, operationID string) error {
+	ctx, done := ac.timeCall(ctx, "set_automatic_os_upgrades", resourceGroup, vmScaleSet)
+	defer done()
+
+	vmss, err := ac.vmss.Get(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get Azure vmss", err)
+	}
+	upgradePolicy := compute.UpgradePolicy{AutomaticOSUpgradePolicy: &compute.AutomaticOSUpgradePolicy{}}
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.UpgradePolicy != nil {
+		upgradePolicy.Mode = vmss.UpgradePolicy.Mode
+		if vmss.UpgradePolicy.AutomaticOSUpgradePolicy != nil {
+			*upgradePolicy.AutomaticOSUpgradePolicy = *vmss.UpgradePolicy.AutomaticOSUpgradePolicy
+		}
+	}
+	upgradePolicy.AutomaticOSUpgradePolicy.EnableAutomaticOSUpgrade = ptr.BoolToPtr(enable)
+
+	tags := make(map[string]*string, len(vmss.Tags)+1)
+	tagged := false
+	for key, value := range vmss.Tags {
+		if strings.EqualFold(key, tagOSUpgradesPaused) {
+			tagged = true
+		} else {
+			tags[key] = value
+		}
+	}
+	if enable && !tagged {
+		// Someone else resumed them already, or they were never paused
+		// by the plugin and are left as configured.
+		return nil
+	}
+	if !enable {
+		tags[tagOSUpgradesPaused] = ptr.StringToPtr(operationID)
+	}
+
+	if err := scaleWrites.wait(ctx, "set_automatic_os_upgrades"); err != nil {
+		return wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	future, err := ac.vmss.Update(ctx, resourceGroup, vmScaleSet, compute.VirtualMachineScaleSetUpdate{
+		Tags: tags,
+		VirtualMachineScaleSetUpdateProperties: &compute.VirtualMachineScaleSetUpdateProperties{
+			UpgradePolicy: &upgradePolicy,
+		},
+	})
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss update response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss update future response")
+}
+
+// cancelRollingUpgrade stops the upgrade rolling out to a scale set. The
+// instances already upgraded stay upgraded.
+func (ac *AzureController) cancelRollingUpgrade(ctx context.Context, resourceGroup string, vmScaleSet string) error {
+	ctx, done := ac.timeCall(ctx, "cancel_rolling_upgrade", resourceGroup, vmScaleSet)
+	defer done()
+
+	future, err := ac.upgrades.Cancel(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the rolling upgrade cancel response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.upgrades.Client, "cannot get the rolling upgrade cancel future response")
+}
+
+// pauseOSUpgrades turns off the automatic OS image upgrades of the member
+// sets a scale may change, stopping an upgrade already rolling out, so they
+// do not race the capacity changes with update conflicts. It returns the
+// function turning them back on, nil when no set was paused. Sets whose
+// upgrades cannot be paused are scaled anyway.
+func (t *TargetPlugin) pauseOSUpgrades(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, operationID string, log hclog.Logger) func() {
+	var paused []*setSnapshot
+	for idx, set := range snapshot.sets {
+		if members[idx].missing || members[idx].paused || !automaticOSUpgrades(set.vmss) {
+			continue
+		}
+		azure := t.azureFor(set.resourceGroup, set.vmScaleSet)
+		if err := azure.setAutomaticOSUpgrades(ctx, set.resourceGroup, set.vmScaleSet, false, operationID); err != nil {
+			log.Warn("failed to pause automatic OS upgrades", "vmss_name", set.vmScaleSet, "error", err)
+			continue
+		}
+		paused = append(paused, set)
+		if azure.upgradeInProgress(ctx, set.resourceGroup, set.vmScaleSet) {
+			if err := azure.cancelRollingUpgrade(ctx, set.resourceGroup, set.vmScaleSet); err != nil {
+				log.Warn("failed to cancel the OS upgrade rolling out", "vmss_name", set.vmScaleSet, "error", err)
+			} else {
+				log.Info("cancelled the OS upgrade rolling out for the scale", "vmss_name", set.vmScaleSet)
+			}
+		}
+		log.Debug("paused automatic OS upgrades", "vmss_name", set.vmScaleSet)
+	}
+	if len(paused) == 0 {
+		return nil
+	}
+	return func() {
+		// The upgrades are turned back on even when the scale ran out of
+		// time.
+		ctx := context.WithoutCancel(ctx)
+		for _, set := range paused {
+			if err := t.azureFor(set.resourceGroup, set.vmScaleSet).setAutomaticOSUpgrades(ctx, set.resourceGroup, set.vmScaleSet, true, ""); err != nil {
+				log.Error("failed to resume automatic OS upgrades, resuming on a later status", "vmss_name", set.vmScaleSet, "error", err)
+				continue
+			}
+			log.Debug("resumed automatic OS upgrades", "vmss_name", set.vmScaleSet)
+		}
+	}
+}
+
+// resumeStaleOSUpgrades turns back on the automatic OS image upgrades of a
+// set left paused by a scale operation that is no longer in flight.
+func (t *TargetPlugin) resumeStaleOSUpgrades(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet) {
+	var operationID string
+	var ok bool
+	for key, value := range vmss.Tags {
+		if strings.EqualFold(key, tagOSUpgradesPaused) && value != nil {
+			operationID, ok = *value, true
+		}
+	}
+	if !ok || !t.leader.isLeader() || t.scaleLocks.holder([]string{vmssKey(resourceGroup, vmScaleSet)}) != "" {
+		return
+	}
+	if err := t.azureFor(resourceGroup, vmScaleSet).setAutomaticOSUpgrades(ctx, resourceGroup, vmScaleSet, true, ""); err != nil {
+		t.logger.Warn("failed to resume automatic OS upgrades left paused", "vmss_name", vmScaleSet,
+			"operation_id", operationID, "error", err)
+		return
+	}
+	t.statusCache.invalidate(resourceGroup, vmScaleSet)
+	t.logger.Info("resumed automatic OS upgrades left paused by an earlier scale", "resource_group", resourceGroup,
+		"vmss_name", vmScaleSet, "operation_id", operationID)
+}
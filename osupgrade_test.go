@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+// fakeUpgradeARM serves a scale set with automatic OS upgrades, applying the
+// upgrade policy and tags of updates, and records rolling upgrade cancels.
+type fakeUpgradeARM struct {
+	lock      sync.Mutex
+	enabled   bool
+	tags      map[string]string
+	rolling   bool
+	updates   int
+	cancelled bool
+}
+
+func (f *fakeUpgradeARM) Do(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status, body := http.StatusOK, `{}`
+	path := strings.ToLower(r.URL.Path)
+	switch {
+	case strings.HasSuffix(path, "/rollingupgrades/latest"):
+		if !f.rolling {
+			status, body = http.StatusNotFound, `{"error":{"code":"NotFound","message":"no upgrade"}}`
+		} else {
+			body = `{"properties":{"runningStatus":{"code":"RollingForward"}}}`
+		}
+	case strings.HasSuffix(path, "/rollingupgrades/cancel"):
+		f.cancelled, f.rolling = true, false
+	case r.Method == http.MethodPatch:
+		var update compute.VirtualMachineScaleSetUpdate
+		raw, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(raw, &update)
+		f.updates++
+		f.enabled = *update.UpgradePolicy.AutomaticOSUpgradePolicy.EnableAutomaticOSUpgrade
+		f.tags = make(map[string]string)
+		for key, value := range update.Tags {
+			f.tags[key] = *value
+		}
+		fallthrough
+	case r.Method == http.MethodGet:
+		vmss := map[string]interface{}{
+			"sku":  map[string]interface{}{"capacity": 2},
+			"tags": f.tags,
+			"properties": map[string]interface{}{"upgradePolicy": map[string]interface{}{
+				"mode":                     "Rolling",
+				"automaticOSUpgradePolicy": map[string]interface{}{"enableAutomaticOSUpgrade": f.enabled},
+			}},
+		}
+		raw, _ := json.Marshal(vmss)
+		body = string(raw)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func newUpgradeTestPlugin(arm *fakeUpgradeARM) *TargetPlugin {
+	vmss := compute.NewVirtualMachineScaleSetsClientWithBaseURI("http://fake", "s")
+	vmss.Sender = arm
+	upgrades := compute.NewVirtualMachineScaleSetRollingUpgradesClientWithBaseURI("http://fake", "s")
+	upgrades.Sender = autorest.SenderFunc(arm.Do)
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmss: vmss, upgrades: upgrades, logger: hclog.NewNullLogger()}
+	return plugin
+}
+
+func TestPauseOSUpgrades(t *testing.T) {
+	arm := &fakeUpgradeARM{enabled: true, rolling: true, tags: map[string]string{"team": "web"}}
+	plugin := newUpgradeTestPlugin(arm)
+	members := []scaleSetTarget{{resourceGroup: "rg", vmScaleSet: "vmss"}}
+	snapshot, err := plugin.takeScaleSnapshot(context.Background(), members)
+	if err != nil {
+		t.Fatalf("takeScaleSnapshot: %v", err)
+	}
+
+	resume := plugin.pauseOSUpgrades(context.Background(), members, snapshot, "op-1", hclog.NewNullLogger())
+	if resume == nil {
+		t.Fatal("got no resume for a set with automatic OS upgrades")
+	}
+	if arm.enabled || arm.tags[tagOSUpgradesPaused] != "op-1" || arm.tags["team"] != "web" {
+		t.Errorf("got upgrades enabled %v and tags %v while paused", arm.enabled, arm.tags)
+	}
+	if !arm.cancelled {
+		t.Error("got the rolling upgrade left running")
+	}
+
+	resume()
+	if !arm.enabled || arm.tags[tagOSUpgradesPaused] != "" || arm.tags["team"] != "web" {
+		t.Errorf("got upgrades enabled %v and tags %v after resuming", arm.enabled, arm.tags)
+	}
+
+	// Paused upgrades carry the tag, so nothing is paused again from them.
+	arm.enabled = false
+	snapshot, _ = plugin.takeScaleSnapshot(context.Background(), members)
+	if resume := plugin.pauseOSUpgrades(context.Background(), members, snapshot, "op-2", hclog.NewNullLogger()); resume != nil {
+		t.Error("paused a set without automatic OS upgrades")
+	}
+}
+
+func TestResumeStaleOSUpgrades(t *testing.T) {
+	arm := &fakeUpgradeARM{tags: map[string]string{tagOSUpgradesPaused: "op-1"}}
+	plugin := newUpgradeTestPlugin(arm)
+	snapshot, _ := plugin.takeScaleSnapshot(context.Background(), []scaleSetTarget{{resourceGroup: "rg", vmScaleSet: "vmss"}})
+	vmss := snapshot.sets[0].vmss
+
+	release, err := plugin.scaleLocks.tryAcquire([]string{vmssKey("rg", "vmss")}, "op-2")
+	if err != nil {
+		t.Fatalf("tryAcquire: %v", err)
+	}
+	plugin.resumeStaleOSUpgrades(context.Background(), "rg", "vmss", vmss)
+	if arm.updates != 0 {
+		t.Error("resumed upgrades of a set being scaled")
+	}
+	release()
+
+	plugin.resumeStaleOSUpgrades(context.Background(), "rg", "vmss", vmss)
+	if !arm.enabled || arm.tags[tagOSUpgradesPaused] != "" {
+		t.Errorf("got upgrades enabled %v and tags %v, want them resumed", arm.enabled, arm.tags)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strings"
+)
+
+// allocationFailureCodes are the ARM error codes of a scale out Azure could
+// not find capacity for, typically because a proximity placement group or a
+// zone has no more room for the size.
+var allocationFailureCodes = []string{
+	"AllocationFailed",
+	"ZonalAllocationFailed",
+	"OverconstrainedAllocationRequest",
+	"OverconstrainedZonalAllocationRequest",
+}
+
+// isAllocationFailure reports whether err is an allocation failure. The code
+// is matched in the message, as the long running operation returns it in a
+// service error nested differently depending on where it failed.
+func isAllocationFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	for _, code := range allocationFailureCodes {
+		if strings.Contains(message, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// overflowIndex returns the member the capacity of members[idx] spills to,
+// or -1 when there is none or it does not scale out.
+func overflowIndex(members []scaleSetTarget, idx int) int {
+	if members[idx].overflow == "" {
+		return -1
+	}
+	for other, member := range members {
+		if vmssKey(member.resourceGroup, member.vmScaleSet) == members[idx].overflow {
+			if !member.scalesOut() {
+				return -1
+			}
+			return other
+		}
+	}
+	return -1
+}
+
+// spillToOverflow moves what a set could not allocate of its scale out to its
+// overflow set. The instances that failed to allocate are deleted, and the
+// overflow set grows from base by the capacity the set is still short of
+// target. It returns the capacities the two sets end up with.
+func (t *TargetPlugin) spillToOverflow(ctx context.Context, from, to scaleSetTarget, target, base int64, log hclog.Logger) (int64, int64, error) {
+	azure := t.azureFor(from.resourceGroup, from.vmScaleSet)
+	instances, err := azure.listInstances(ctx, from.resourceGroup, from.vmScaleSet)
+	if err != nil {
+		return 0, 0, err
+	}
+	var failedIDs []string
+	for _, instance := range instances {
+		if strings.HasPrefix(strings.ToLower(instance.provisioningState), "provisioningstate/failed") {
+			failedIDs = append(failedIDs, instance.instanceID)
+		}
+	}
+	if len(failedIDs) > 0 {
+		if err := azure.deleteInstances(ctx, from.resourceGroup, from.vmScaleSet, failedIDs); err != nil {
+			return 0, 0, fmt.Errorf("failed to delete unallocated instances: %w", err)
+		}
+	}
+	placed, err := azure.getCapacity(ctx, from.resourceGroup, from.vmScaleSet)
+	if err != nil {
+		return 0, 0, err
+	}
+	t.desired.set(from.resourceGroup, from.vmScaleSet, placed)
+	t.statusCache.invalidate(from.resourceGroup, from.vmScaleSet)
+
+	shortfall := target - placed
+	if shortfall <= 0 {
+		return placed, base, nil
+	}
+	desired := base + shortfall
+	if to.max > 0 && desired > to.max {
+		log.Warn("overflow set max does not allow the whole shortfall", "vmss_name", to.vmScaleSet,
+			"shortfall", shortfall, "max", to.max)
+		desired = max(to.max, base)
+	}
+	if desired == base {
+		return placed, base, nil
+	}
+	log.Warn("spilling scale out to overflow set", "vmss_name", from.vmScaleSet, "overflow", to.vmScaleSet,
+		"shortfall", shortfall, "desired_count", desired)
+	if err := t.azureFor(to.resourceGroup, to.vmScaleSet).setCapacity(ctx, to.resourceGroup, to.vmScaleSet, desired); err != nil {
+		return placed, base, fmt.Errorf("failed to scale out overflow set %s/%s: %w", to.resourceGroup, to.vmScaleSet, err)
+	}
+	t.desired.set(to.resourceGroup, to.vmScaleSet, desired)
+	t.cooldowns.record(to.resourceGroup, to.vmScaleSet, "out")
+	t.statusCache.invalidate(to.resourceGroup, to.vmScaleSet)
+	return placed, desired, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// parseMaxParallel reads how many per scale set operations may run at once.
+// Zero, the default, leaves scale operations unbounded and Status at
+// defaultStatusParallelism.
+func parseMaxParallel(config map[string]string) (int, error) {
+	value, ok := config[configKeyMaxParallel]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyMaxParallel, value)
+	}
+	return n, nil
+}
+
+// readParallelism is how many scale sets are read at once, for Status and
+// for collecting scale in candidates.
+func (t *TargetPlugin) readParallelism() int {
+	if t.maxParallel > 0 {
+		return t.maxParallel
+	}
+	return defaultStatusParallelism
+}
+
+// workerPool bounds the number of goroutines of one operation calling ARM at
+// the same time. A nil pool does not limit anything.
+type workerPool chan struct{}
+
+func newWorkerPool(size int) workerPool {
+	if size < 1 {
+		return nil
+	}
+	return make(workerPool, size)
+}
+
+// acquire blocks until a worker slot is free and returns the function that
+// frees it again.
+func (p workerPool) acquire() func() {
+	if p == nil {
+		return func() {}
+	}
+	p <- struct{}{}
+	return func() { <-p }
+}
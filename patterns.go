@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// scaleSetPattern returns the matcher of a scale set entry that selects sets
+// by pattern rather than naming one: a glob such as "nomad-batch-*", or a
+// regular expression prefixed by "~". It returns nil for a plain name.
+func scaleSetPattern(name string) (func(string) bool, error) {
+	if expr, ok := strings.CutPrefix(name, "~"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale set pattern %q: %v", name, err)
+		}
+		return re.MatchString, nil
+	}
+	if !strings.ContainsAny(name, "*?[") {
+		return nil, nil
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return nil, fmt.Errorf("invalid scale set pattern %q: %v", name, err)
+	}
+	return func(candidate string) bool {
+		matched, _ := path.Match(name, candidate)
+		return matched
+	}, nil
+}
+
+// validatePatternEntry rejects the options a pattern entry cannot carry, as
+// they name or point at a single set.
+func validatePatternEntry(target scaleSetTarget) error {
+	match, err := scaleSetPattern(target.vmScaleSet)
+	if err != nil || match == nil {
+		return err
+	}
+	if target.alias != "" {
+		return fmt.Errorf("%s entry %s/%s is a pattern and cannot have an alias", configKeyTargets, target.resourceGroup, target.vmScaleSet)
+	}
+	return nil
+}
+
+// expandScaleSetPatterns replaces the pattern entries of a target by the sets
+// of their resource group they match, in name order and with the options of
+// the entry. The sets are listed through discovery, so a new set matching a
+// pattern joins the target once the listing is refreshed. Sets also named by
+// an entry of their own, or matched by an earlier pattern, are not repeated.
+func (t *TargetPlugin) expandScaleSetPatterns(ctx context.Context, config map[string]string, targets []scaleSetTarget) ([]scaleSetTarget, error) {
+	named := make(map[string]bool, len(targets))
+	patterns := false
+	for _, target := range targets {
+		match, err := scaleSetPattern(target.vmScaleSet)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil {
+			named[vmssKey(target.resourceGroup, target.vmScaleSet)] = true
+		} else {
+			patterns = true
+		}
+	}
+	if !patterns {
+		return targets, nil
+	}
+
+	groups := make(map[string][]string)
+	for _, target := range targets {
+		if match, _ := scaleSetPattern(target.vmScaleSet); match != nil {
+			groups[target.subscription] = append(groups[target.subscription], target.resourceGroup)
+		}
+	}
+	for subscription, resourceGroups := range groups {
+		t.prefetchScaleSets(ctx, subscription, resourceGroups)
+	}
+
+	expanded := make([]scaleSetTarget, 0, len(targets))
+	for _, target := range targets {
+		match, _ := scaleSetPattern(target.vmScaleSet)
+		if match == nil {
+			expanded = append(expanded, target)
+			continue
+		}
+		names, err := t.discoverScaleSets(ctx, target.subscription, target.resourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			key := vmssKey(target.resourceGroup, name)
+			if !match(name) || named[key] {
+				continue
+			}
+			named[key] = true
+			set := target
+			set.vmScaleSet = name
+			expanded = append(expanded, set)
+		}
+	}
+	if len(expanded) == 0 {
+		return nil, fmt.Errorf("no scale sets match the patterns of the target")
+	}
+	t.targets.register(config, expanded)
+	return expanded, nil
+}
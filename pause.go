@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// tagPaused marks a member scale set as under maintenance. While it is set to
+// true, or empty, the set keeps its capacity and is left out of scaling.
+const tagPaused = "nomad-autoscaler:paused"
+
+// tagDisabled takes a member scale set out of rotation altogether. While it is
+// set to true, or empty, the set is left out of scaling and its capacity is
+// not counted toward the target.
+const tagDisabled = "nomad-autoscaler:disabled"
+
+// pausedByTag reports whether the scale set tags pause it.
+func pausedByTag(tags map[string]*string) bool {
+	return booleanTag(tags, tagPaused)
+}
+
+// disabledByTag reports whether the scale set tags disable it.
+func disabledByTag(tags map[string]*string) bool {
+	return booleanTag(tags, tagDisabled)
+}
+
+func booleanTag(tags map[string]*string, name string) bool {
+	for key, value := range tags {
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+		if value == nil || strings.TrimSpace(*value) == "" {
+			return true
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(*value))
+		return err == nil && enabled
+	}
+	return false
+}
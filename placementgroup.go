@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+)
+
+// singlePlacementGroupLimit is the most instances a scale set limited to a
+// single placement group can hold. Azure rejects a capacity above it only
+// once the update is underway.
+const singlePlacementGroupLimit = 100
+
+// singlePlacementGroup reports whether the scale set is limited to a single
+// placement group.
+func singlePlacementGroup(vmss compute.VirtualMachineScaleSet) bool {
+	return vmss.VirtualMachineScaleSetProperties != nil && vmss.SinglePlacementGroup != nil && *vmss.SinglePlacementGroup
+}
+
+// capPlacementGroups lowers the max of the members limited to a single
+// placement group to the limit, so the distribution spreads what they cannot
+// hold over the other sets.
+func capPlacementGroups(members []scaleSetTarget, snapshot *scaleSnapshot, log hclog.Logger) {
+	for idx, set := range snapshot.sets {
+		if !singlePlacementGroup(set.vmss) {
+			continue
+		}
+		if members[idx].max == 0 || members[idx].max > singlePlacementGroupLimit {
+			log.Debug("capping scale set to its placement group limit", "vmss_name", set.vmScaleSet, "limit", singlePlacementGroupLimit)
+			members[idx].max = singlePlacementGroupLimit
+			if members[idx].min > members[idx].max {
+				members[idx].min = members[idx].max
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"io"
+	"strings"
+)
+
+// runPlan prints what Scale would do to reach a count, reading Azure and
+// Nomad only: no capacity is changed and no node is drained.
+func runPlan(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(pluginName+" plan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	count := flags.Int64("count", -1, "desired total count of the target")
+	configFile, overrides := addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *count < 0 {
+		fmt.Fprintln(stderr, "-count is required")
+		return 2
+	}
+	config, err := loadCommandConfig(*configFile, overrides)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := validatePluginConfig(config); err != nil {
+		fmt.Fprintf(stderr, "config is invalid: %v\n", err)
+		return 1
+	}
+	t, err := newCommandPlugin(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := t.plan(context.Background(), config, *count, stdout); err != nil {
+		fmt.Fprintf(stderr, "failed to plan: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (t *TargetPlugin) plan(ctx context.Context, config map[string]string, count int64, out io.Writer) error {
+	config, err := t.resolveTargetGroup(config)
+	if err != nil {
+		return err
+	}
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+	snapshot, err := t.takeScaleSnapshot(ctx, members)
+	if err != nil {
+		return err
+	}
+	capacities := snapshot.capacities()
+	if mode, err := parseCapacityMode(config); err != nil {
+		return err
+	} else if mode == capacityModeLive {
+		excluded, err := parseLiveExclude(config)
+		if err != nil {
+			return err
+		}
+		if err := t.applyLiveCapacities(ctx, members, snapshot, capacities, excluded, t.logger); err != nil {
+			return err
+		}
+	}
+	var total int64
+	for idx, set := range snapshot.sets {
+		if members[idx].missing {
+			continue
+		}
+		if disabledByTag(set.vmss.Tags) {
+			members[idx].paused = true
+			capacities[idx] = 0
+			continue
+		}
+		if pausedByTag(set.vmss.Tags) {
+			members[idx].paused = true
+		}
+		total += capacities[idx]
+	}
+
+	num, direction := calculateScaleDirection(total, count)
+	fmt.Fprintf(out, "current count %d, desired count %d\n", total, count)
+	switch direction {
+	case "out":
+		plan := planScaleOut(capacities, num, members)
+		for idx, set := range snapshot.sets {
+			printPlannedSet(out, set, members[idx], plan[idx])
+		}
+	case "in":
+		return t.planScaleInCandidates(ctx, config, members, snapshot, capacities, num, out)
+	default:
+		fmt.Fprintln(out, "no change")
+	}
+	return nil
+}
+
+func (t *TargetPlugin) planScaleInCandidates(ctx context.Context, config map[string]string, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, num int64, out io.Writer) error {
+	_, vmScaleSetList := splitScaleSetTargets(members)
+	filters, err := parseNodeFilters(config, vmScaleSetList)
+	if err != nil {
+		return err
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+	var nodes map[string]*api.Node
+	if filters != nil {
+		if nodes, err = t.registeredNodes(cluster.client); err != nil {
+			return err
+		}
+	}
+	scaleInConfig, err := t.scaleInConfig(poolConfig(config, filters))
+	if err != nil {
+		return err
+	}
+
+	setRemoteIDs := make([][]string, len(members))
+	var remoteIDs []string
+	for idx, set := range snapshot.sets {
+		ids, err := set.runningRemoteIDs(ctx, t.azureFor(set.resourceGroup, set.vmScaleSet))
+		if err != nil {
+			return err
+		}
+		var filter nodeFilter
+		if filters != nil {
+			filter = filters[idx]
+		}
+		setRemoteIDs[idx] = filterRemoteIDs(ids, filter, nodes)
+		remoteIDs = append(remoteIDs, setRemoteIDs[idx]...)
+	}
+
+	var selected []scaleutils.NodeResourceID
+	if !hasPlacement(members) {
+		if selected, err = previewScaleIn(cluster.utils, scaleInConfig, t.nodeIdentity.normalizeAll(remoteIDs), int(num)); err != nil {
+			return err
+		}
+	} else {
+		for idx, removal := range planScaleIn(capacities, num, members) {
+			if removal <= 0 {
+				continue
+			}
+			ids, err := previewScaleIn(cluster.utils, scaleInConfig, t.nodeIdentity.normalizeAll(setRemoteIDs[idx]), int(removal))
+			if err != nil {
+				return fmt.Errorf("%s/%s: %v", members[idx].resourceGroup, members[idx].vmScaleSet, err)
+			}
+			selected = append(selected, ids...)
+		}
+	}
+
+	for idx, set := range snapshot.sets {
+		var candidates []string
+		for _, id := range selected {
+			if i := strings.LastIndex(id.RemoteResourceID, "_"); i != -1 && strings.EqualFold(id.RemoteResourceID[:i], set.vmScaleSet) {
+				candidates = append(candidates, fmt.Sprintf("%s (node %s)", id.RemoteResourceID, id.NomadNodeID))
+			}
+		}
+		printPlannedSet(out, set, members[idx], set.capacity-int64(len(candidates)))
+		for _, candidate := range candidates {
+			fmt.Fprintf(out, "    remove %s\n", candidate)
+		}
+	}
+	return nil
+}
+
+func printPlannedSet(out io.Writer, set *setSnapshot, member scaleSetTarget, planned int64) {
+	note := ""
+	switch {
+	case member.missing:
+		note = " (missing)"
+	case member.paused:
+		note = " (paused)"
+	case member.retiring:
+		note = " (retiring)"
+	}
+	fmt.Fprintf(out, "  %s/%s: %d -> %d (%+d)%s\n", set.resourceGroup, set.vmScaleSet,
+		set.capacity, planned, planned-set.capacity, note)
+}
+
+// previewScaleIn selects the nodes RunPreScaleInTasksWithRemoteCheck would
+// drain, without draining them.
+func previewScaleIn(utils *scaleutils.ClusterScaleUtils, cfg map[string]string, remoteIDs []string, num int) ([]scaleutils.NodeResourceID, error) {
+	nodes, err := utils.IdentifyScaleInNodes(cfg, num)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := utils.IdentifyScaleInRemoteIDs(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[string]bool, len(remoteIDs))
+	for _, remoteID := range remoteIDs {
+		candidates[remoteID] = true
+	}
+	stubs := make(map[string]*api.NodeListStub, len(nodes))
+	for _, node := range nodes {
+		stubs[node.ID] = node
+	}
+	byNode := make(map[string]scaleutils.NodeResourceID, len(ids))
+	var filtered []*api.NodeListStub
+	for _, id := range ids {
+		if candidates[id.RemoteResourceID] {
+			byNode[id.NomadNodeID] = id
+			filtered = append(filtered, stubs[id.NomadNodeID])
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no nodes identified for scaling in action")
+	}
+
+	selected, err := utils.SelectScaleInNodes(filtered, cfg, num)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]scaleutils.NodeResourceID, len(selected))
+	for idx, node := range selected {
+		out[idx] = byNode[node.ID]
+	}
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const platformOperationPollInterval = 15 * time.Second
+
+func parsePlatformOperationWait(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyPlatformOperationWait]
+	if !ok {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyPlatformOperationWait, value)
+	}
+	return wait, nil
+}
+
+// platformOperationError is returned when a scale is deferred because Azure
+// is still busy with a member scale set. Updating the set meanwhile races
+// the operation and fails with errors that do not point at the cause.
+type platformOperationError struct {
+	vmss      string
+	operation string
+}
+
+func (e *platformOperationError) Error() string {
+	return fmt.Sprintf("deferring scale, %s has a platform operation in progress: %s", e.vmss, e.operation)
+}
+
+// platformOperation returns the operation Azure is running on the scale set,
+// if any: a rolling upgrade, or an update of the set itself such as a capacity
+// change still provisioning or an instance repair.
+func platformOperation(ctx context.Context, set *setSnapshot, azure *AzureController) string {
+	if state := vmssProvisioningState(set.vmss); state != "" && !strings.EqualFold(state, "Succeeded") {
+		return "provisioning state " + state
+	}
+	if azure.upgradeInProgress(ctx, set.resourceGroup, set.vmScaleSet) {
+		return "rolling upgrade"
+	}
+	return ""
+}
+
+func vmssProvisioningState(vmss compute.VirtualMachineScaleSet) string {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.ProvisioningState == nil {
+		return ""
+	}
+	return *vmss.ProvisioningState
+}
+
+// awaitPlatformOperations returns a snapshot of the member sets taken when
+// none of the sets being scaled has a platform operation in progress. It
+// waits up to wait before deferring the scale, taking a new snapshot as
+// operations complete.
+func (t *TargetPlugin) awaitPlatformOperations(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, target string, wait time.Duration, log hclog.Logger) (*scaleSnapshot, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		var busy *platformOperationError
+		for idx, set := range snapshot.sets {
+			if members[idx].paused || pausedByTag(set.vmss.Tags) || disabledByTag(set.vmss.Tags) {
+				continue
+			}
+			if operation := platformOperation(ctx, set, t.azureFor(set.resourceGroup, set.vmScaleSet)); operation != "" {
+				busy = &platformOperationError{vmss: set.resourceGroup + "/" + set.vmScaleSet, operation: operation}
+				break
+			}
+		}
+		if busy == nil {
+			t.deferrals.set(target, "")
+			return snapshot, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			t.deferrals.set(target, busy.Error())
+			return nil, busy
+		}
+		log.Info("waiting for platform operation to complete", "vmss", busy.vmss, "operation", busy.operation,
+			"remaining", remaining.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(platformOperationPollInterval, remaining)):
+		}
+
+		var err error
+		if snapshot, err = t.takeScaleSnapshot(ctx, members); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// scaleDeferrals remembers why the last scale of each target was deferred,
+// for Status. A nil tracker records nothing.
+type scaleDeferrals struct {
+	lock    sync.Mutex
+	reasons map[string]string
+}
+
+func newScaleDeferrals() *scaleDeferrals {
+	return &scaleDeferrals{reasons: make(map[string]string)}
+}
+
+// set records the reason the target was deferred, an empty reason clearing
+// it.
+func (d *scaleDeferrals) set(target, reason string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if reason == "" {
+		delete(d.reasons, target)
+		return
+	}
+	d.reasons[target] = reason
+}
+
+func (d *scaleDeferrals) annotate(target string, meta map[string]string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if reason, ok := d.reasons[target]; ok {
+		meta[metaKeyScaleDeferred] = reason
+	}
+}
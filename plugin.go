@@ -5,45 +5,404 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	metrics "github.com/armon/go-metrics"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad-autoscaler/plugins/base"
+	"github.com/hashicorp/nomad-autoscaler/plugins/target"
 	"github.com/hashicorp/nomad-autoscaler/sdk"
-	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
 	"github.com/hashicorp/nomad/api"
 	"math"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+var _ target.Target = (*TargetPlugin)(nil)
+
 type TargetPlugin struct {
 	logger          hclog.Logger
 	AzureController *AzureController
-	clusterUtils    *scaleutils.ClusterScaleUtils
+	authorizers     *authorizerCache
+	cluster         *nomadCluster
+	clusters        *clusterCache
+	nomadConfig     map[string]string
+	scaleInDefaults map[string]string
+	hookDefaults    map[string]string
+	targetGroups    map[string]targetGroup
+	targets         *targetRegistry
+	orphans         *orphanTracker
+	desired         *capacityTracker
+	spotEvictions   *spotEvictionWatcher
+	consul          *consul.Client
+	nodeTags        *nodeTagIndex
+	instanceAges    *instanceAgeTracker
+	instanceName    string
+	eventRecorder   *scaleEventRecorder
+	scaleState      *scaleStateCheckpoints
+	haLock          *haLock
+	leader          *leaderElection
+	statusCache     *statusCache
+	stopBackground  context.CancelFunc
+	telemetry       *telemetry
+	auditLog        *auditLog
+	webhook         *webhookNotifier
+	chat            *chatNotifier
+	inFlight        *inFlightOps
+	history         *scaleHistory
+	debugServer     *http.Server
+	debugState      *debugState
+
+	scaleEventCounts   *scaleEventCounter
+	autoscaleConflicts *autoscaleConflictTracker
+	scaleLocks         *scaleLocks
+	cooldowns          *cooldownTracker
+	recentActions      *recentActions
+	canaries           *canaryScaleIns
+	spotStats          *spotEvictionStats
+	budgets            *budgetTracker
+	deferrals          *scaleDeferrals
+	discovery          *scaleSetDiscovery
+	operations         *operationStore
+	shutdownState      shutdownState
+	maxParallel        int
+	nomadRetry         nomadRetry
+	nodeIdentity       nodeIdentity
+	statusWatch        time.Duration
+
+	// configLock serialises setting the config, by the autoscaler or after
+	// the config variable changed.
+	configLock sync.Mutex
 }
 
 func (t *TargetPlugin) SetConfig(config map[string]string) error {
-	t.AzureController = &AzureController{}
-	if err := t.AzureController.init(config); err != nil {
+	t.configLock.Lock()
+	defer t.configLock.Unlock()
+	return t.setConfig(config)
+}
+
+func (t *TargetPlugin) setConfig(config map[string]string) error {
+	configVariable, err := parseConfigVariable(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	givenConfig := config
+	var configVariableIndex uint64
+	if configVariable != nil {
+		variable, err := readConfigVariable(config, configVariable)
+		if err != nil {
+			return fmt.Errorf("cannot set config, %s", err.Error())
+		}
+		if config, err = applyConfigVariable(config, variable); err != nil {
+			return fmt.Errorf("cannot set config, %s", err.Error())
+		}
+		configVariableIndex = variable.ModifyIndex
+	}
+
+	if err := validatePluginConfig(config); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	t.AzureController = &AzureController{logger: t.logger}
+	if err := t.AzureController.init(config, t.authorizers); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	if value := config[configKeyAzureFaultInjection]; value != "" {
+		t.logger.Warn("Azure fault injection is enabled, do not use in production", "faults", value)
+	}
+	if sim, _ := parseSimulation(config); sim != nil {
+		t.logger.Warn("simulating Azure, no request reaches Azure", "provisioning_latency", sim.latency)
+	}
+
+	scaleInDefaults, err := parseScaleInDefaults(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.scaleInDefaults = scaleInDefaults
+
+	if t.hookDefaults, err = parseHookDefaults(config); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	if t.targetGroups, err = parseTargetGroups(config); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	duplicateWindow, err := parseDuplicateActionWindow(config)
+	if err != nil {
 		return fmt.Errorf("cannot set config, %s", err.Error())
 	}
+	t.recentActions.setWindow(duplicateWindow)
 
-	clusterUtils, err := scaleutils.NewClusterScaleUtils(nomad.ConfigFromNamespacedMap(config), t.logger)
+	if t.nomadRetry, err = parseNomadRetry(config); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	if t.nodeIdentity, err = parseNodeIdentity(config); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.nomadConfig = nomadConfigKeys(config)
+	t.cluster, err = t.newNomadCluster(t.nomadConfig)
 	if err != nil {
 		return err
 	}
+	t.clusters = newClusterCache()
+
+	t.consul, err = newConsulClient(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	ghostNodeConfig, err := parseGhostNodeConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	orphanConfig, err := parseOrphanConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	reconcileConfig, err := parseReconcileConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	spotEvictionConfig, err := parseSpotEvictionConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	recycleConfig, err := parseRecycleConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	failedInstanceConfig, err := parseFailedInstanceConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	failedNodeConfig, err := parseFailedNodeConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	rebalanceInterval, err := parseRebalanceInterval(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	t.instanceName = config[configKeyAutoscalerInstance]
+	if t.instanceName == "" {
+		t.instanceName, _ = os.Hostname()
+	}
+
+	eventVariableConfig, err := parseScaleEventVariableConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.eventRecorder = nil
+	if eventVariableConfig != nil {
+		t.eventRecorder = &scaleEventRecorder{client: t.cluster.client, cfg: eventVariableConfig}
+	}
+
+	stateVariablePath, err := parseScaleStateVariable(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.scaleState = nil
+	if stateVariablePath != "" {
+		t.scaleState = newScaleStateCheckpoints(t.cluster.client, stateVariablePath)
+	}
+
+	t.haLock, err = newHALock(t.cluster.client, config, t.instanceName, t.logger)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.leader, err = newLeaderElection(config, t.instanceName, t.authorizers, t.logger)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	t.maxParallel, err = parseMaxParallel(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	statusCacheConfig, err := parseStatusCacheConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.statusWatch, err = parseStatusWatchInterval(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.statusCache = nil
+	switch {
+	case statusCacheConfig != nil && statusCacheConfig.ttl >= statusWatchStaleness(t.statusWatch):
+		t.statusCache = newStatusCache(statusCacheConfig.ttl)
+	case t.statusWatch > 0:
+		// Watched statuses stay usable until they are stale, and Status
+		// only goes back to ARM when the watcher has fallen that far behind.
+		t.statusCache = newStatusCache(statusWatchStaleness(t.statusWatch))
+	}
+
+	taggingInterval, err := parseInstanceTaggingInterval(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	telemetryConfig, err := parseTelemetryConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	auditLogConfig, err := parseAuditLogConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.auditLog.close()
+	t.auditLog = nil
+	if auditLogConfig != nil {
+		if t.auditLog, err = newAuditLog(auditLogConfig); err != nil {
+			return fmt.Errorf("cannot set config, %s", err.Error())
+		}
+	}
 
-	t.clusterUtils = clusterUtils
-	t.clusterUtils.ClusterNodeIDLookupFunc = azureNodeIDMap
+	webhookConfig, err := parseWebhookConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.webhook = nil
+	if webhookConfig != nil {
+		t.webhook = newWebhookNotifier(webhookConfig)
+	}
+
+	chatConfig, err := parseChatConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.chat = nil
+	if chatConfig != nil {
+		t.chat = newChatNotifier(chatConfig)
+	}
+
+	historySize, err := parseScaleHistorySize(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.history = newScaleHistory(historySize)
+
+	debugListen, err := parseDebugListen(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	stopDebugServer(t.debugServer)
+	t.debugServer = nil
+	if debugListen != "" {
+		if t.debugServer, err = t.newDebugServer(debugListen, t.logger); err != nil {
+			return fmt.Errorf("cannot set config, %s", err.Error())
+		}
+	}
+
+	drainPeriod, err := parseShutdownDrainPeriod(config)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+	t.shutdownState.drainPeriod.Store(int64(drainPeriod))
+
+	var resume *operationStore
+	if path := config[configKeyOperationStatePath]; path == "" {
+		if t.operations.persistent() || t.operations == nil {
+			t.operations = newMemoryOperationStore()
+		}
+	} else if t.operations == nil || t.operations.path != path {
+		if t.operations, err = newOperationStore(path); err != nil {
+			return fmt.Errorf("cannot set config, %s", err.Error())
+		}
+		resume = t.operations
+	}
+
+	azureMonitorConfig, err := parseAzureMonitorConfig(config, t.authorizers)
+	if err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	t.telemetry.stop()
+	if t.telemetry, err = newTelemetry(telemetryConfig, t.logger); err != nil {
+		return fmt.Errorf("cannot set config, %s", err.Error())
+	}
+
+	if t.stopBackground != nil {
+		t.stopBackground()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stopBackground = cancel
+
+	if t.leader != nil {
+		go t.leader.run(ctx)
+	}
+	if ghostNodeConfig != nil {
+		go t.runGhostNodeGC(ctx, ghostNodeConfig)
+	}
+	if orphanConfig != nil {
+		go t.runOrphanGC(ctx, orphanConfig)
+	}
+	if reconcileConfig != nil {
+		go t.runReconciler(ctx, reconcileConfig)
+	}
+	if spotEvictionConfig != nil {
+		go t.runSpotEvictionWatcher(ctx, spotEvictionConfig)
+	}
+	if recycleConfig != nil {
+		go t.runRecycler(ctx, recycleConfig)
+	}
+	if failedInstanceConfig != nil {
+		go t.runFailedInstanceRemediation(ctx, failedInstanceConfig)
+	}
+	if failedNodeConfig != nil {
+		go t.runFailedNodeReplacement(ctx, failedNodeConfig)
+	}
+	// Targets opt in to rebalancing in their own config, so the loop
+	// always runs.
+	go t.runRebalancer(ctx, rebalanceInterval)
+	go t.runPrewarmReleaser(ctx)
+	if taggingInterval > 0 {
+		go t.runInstanceTagger(ctx, taggingInterval)
+	}
+	if azureMonitorConfig != nil {
+		go t.runAzureMonitorExporter(ctx, azureMonitorConfig)
+	}
+	if resume != nil {
+		go t.resumeOperations(ctx, resume)
+	}
+	if statusCacheConfig != nil && statusCacheConfig.refresh {
+		go t.runStatusRefresher(ctx, statusCacheConfig.ttl)
+	}
+	if t.statusWatch > 0 {
+		go t.runStatusWatcher(ctx, t.statusWatch)
+	}
+	go t.runCredentialReloader(ctx, config[configKeySecretKeyFile])
+	go t.runStateDumper(ctx)
+	if configVariable != nil {
+		go t.runConfigVariableWatcher(ctx, givenConfig, configVariable, configVariableIndex)
+	}
 
-	t.logger.Debug("config is set")
+	t.authorizers.evictUnused()
+	t.logger.Debug("config is set", "version", versionString())
 	return nil
 }
 
+// PluginInfo has no version field in the SDK, so the version is logged here
+// and reported in Status meta, along with the plugin capabilities, instead.
 func (t *TargetPlugin) PluginInfo() (*base.PluginInfo, error) {
+	if t.logger != nil {
+		t.logger.Debug("plugin info requested", "version", versionString())
+	}
 	return &base.PluginInfo{
 		Name:       pluginName,
 		PluginType: sdk.PluginTypeTarget,
@@ -51,98 +410,894 @@ func (t *TargetPlugin) PluginInfo() (*base.PluginInfo, error) {
 }
 
 func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string) error {
+	if err := checkRequiredCapabilities(action); err != nil {
+		return err
+	}
 	if action.Count == sdk.StrategyActionMetaValueDryRunCount {
 		return nil
 	}
-
-	resourceGroupListStr, ok := config[configKeyResourceGroupList]
-	if !ok {
-		return fmt.Errorf("required config param %s not found", configKeyResourceGroupList)
+	config, err := t.resolveTargetGroup(config)
+	if err != nil {
+		return err
+	}
+
+	if t.shutdownState.stopping.Load() {
+		return errShuttingDown
+	}
+	if !t.leader.isLeader() {
+		return errStandby
+	}
+
+	if t.recentActions.duplicate(targetKey(config), actionFingerprint(action)) {
+		t.logger.Info("ignoring duplicate of a recently completed scale action", "target", targetKey(config),
+			"count", action.Count, "direction", action.Direction)
+		return nil
+	}
+
+	event := newScaleEvent(action, config)
+	keys, err := t.targetVMSSKeys(config)
+	if err != nil {
+		return err
+	}
+	async, err := parseScaleAsync(config)
+	if err != nil {
+		return err
+	}
+	deadline, hasDeadline, err := parseActionDeadline(action, time.Now())
+	if err != nil {
+		return err
+	}
+	margin, err := parseDeadlineMargin(config)
+	if err != nil {
+		return err
+	}
+	handoff := deadline.Add(-margin)
+	if hasDeadline && !time.Now().Before(handoff) {
+		// The autoscaler is about to give up on the action and dispatch
+		// it again, starting now would only overlap with that.
+		return fmt.Errorf("evaluation deadline %s has passed, not starting the scale operation", deadline.Format(time.RFC3339))
+	}
+	wait, err := parseScaleLockWait(config)
+	if err != nil {
+		return err
+	}
+	if hasDeadline {
+		wait = min(wait, time.Until(handoff))
+	}
+	release, err := t.scaleLocks.acquire(keys, event.OperationID, wait)
+	if err != nil {
+		t.logger.Warn("skipping scale action", "target", targetKey(config), "error", err)
+		return err
+	}
+	if !async && !hasDeadline {
+		defer release()
+		return t.runScale(context.Background(), action, config, event)
+	}
+
+	// In async mode, and once the evaluation deadline nears, the scale set
+	// locks are held until the operation completes, which keeps Status
+	// not-ready in the meantime.
+	ctx := context.Background()
+	var submitted <-chan struct{}
+	if async {
+		sub := newSubmission()
+		ctx = withSubmission(ctx, sub)
+		submitted = sub.done
+	}
+	var expired <-chan time.Time
+	if hasDeadline {
+		timer := time.NewTimer(time.Until(handoff))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer release()
+		done <- t.runScale(ctx, action, config, event)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-submitted:
+		t.logger.Info("scale operation submitted, completing in background", "operation_id", event.OperationID)
+		return nil
+	case <-expired:
+		t.logger.Warn("evaluation deadline nears, completing scale operation in background", "operation_id", event.OperationID,
+			"deadline", deadline)
+		return nil
+	}
+}
+
+func (t *TargetPlugin) runScale(ctx context.Context, action sdk.ScalingAction, config map[string]string, event *scaleEvent) error {
+	if t.haLock != nil {
+		release, err := t.haLock.acquire(targetKey(config))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	conflict, err := parseCapacityConflict(config)
+	if err != nil {
+		return err
+	}
+
+	defer t.inFlight.start(event)()
+	err = t.scale(withOperationID(ctx, event.OperationID), action, config, event)
+	for replans := 0; isAzureConflict(err); replans++ {
+		if conflict.action == capacityConflictAbort || replans >= conflict.retries {
+			err = fmt.Errorf("scale set modified concurrently, aborting after %d re-plans: %w", replans, err)
+			break
+		}
+		// A scale set changed between our read and the update; re-read
+		// the capacities and plan again.
+		t.logger.Warn("scale set modified concurrently, re-planning", "operation_id", event.OperationID, "error", err)
+		event.finish(err)
+		t.publishScaleEvent(event)
+		event = newScaleEvent(action, config)
+		err = t.scale(withOperationID(ctx, event.OperationID), action, config, event)
+	}
+	if err != nil {
+		t.logger.Error("scale operation failed", "operation_id", event.OperationID,
+			"retryable", isRetryableAzureError(err), "error", err)
+	}
+	if (err == nil && event.Skipped == "") || event.completedInAzure() {
+		// The scale set changes are in place even if a later step
+		// failed, so a retry of this action must not apply them again.
+		t.recentActions.record(targetKey(config), actionFingerprint(action))
+	}
+	if err == nil && event.Skipped == "" && t.scaleState != nil {
+		if members, err := t.scaleSetTargets(config); err == nil {
+			t.scaleState.record(action, event, members, t.desired, t.logger)
+		}
+	}
+	event.finish(err)
+	t.publishScaleEvent(event)
+	return err
+}
+
+func (t *TargetPlugin) scale(ctx context.Context, action sdk.ScalingAction, config map[string]string, event *scaleEvent) error {
+	logger := t.logger.With("operation_id", event.OperationID)
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+	resourceGroupList, vmScaleSetList := splitScaleSetTargets(members)
+	filters, err := parseNodeFilters(config, vmScaleSetList)
+	if err != nil {
+		return err
+	}
+	tags, err := t.parseScaleEventTags(config)
+	if err != nil {
+		return err
+	}
+	tags.withActionPolicy(action)
+	modelUpgrade, err := parseModelUpgradeConfig(config)
+	if err != nil {
+		return err
+	}
+	failurePolicy, err := parseScaleOutFailurePolicy(config)
+	if err != nil {
+		return err
+	}
+	conflictAction, err := parseAutoscaleConflictAction(config)
+	if err != nil {
+		return err
+	}
+	lockCheck, err := parseLockCheckAction(config)
+	if err != nil {
+		return err
+	}
+	aksAction, err := parseAKSManagedAction(config)
+	if err != nil {
+		return err
+	}
+	avoidRate, err := parseSpotEvictionAvoidRate(config)
+	if err != nil {
+		return err
+	}
+	loadWindow, err := parseLoadAwareWindow(config)
+	if err != nil {
+		return err
+	}
+	zones, err := parseZones(config)
+	if err != nil {
+		return err
+	}
+	preferMaintenance, err := parsePreferMaintenance(config)
+	if err != nil {
+		return err
+	}
+	hooks, err := t.scaleHooks(config)
+	if err != nil {
+		return err
+	}
+	cooldowns, err := parseScaleCooldowns(config)
+	if err != nil {
+		return err
+	}
+	budget, err := parseCapacityBudget(config)
+	if err != nil {
+		return err
+	}
+	freeze, err := parseScaleInFreeze(config)
+	if err != nil {
+		return err
+	}
+	platformWait, err := parsePlatformOperationWait(config)
+	if err != nil {
+		return err
+	}
+	pauseUpgrades, err := parsePauseOSUpgrades(config)
+	if err != nil {
+		return err
+	}
+	applicationHealth, err := parseApplicationHealth(config)
+	if err != nil {
+		return err
+	}
+	canary, err := parseScaleInCanary(config)
+	if err != nil {
+		return err
+	}
+	prewarm, err := parsePrewarmHint(action)
+	if err != nil {
+		return err
+	}
+	conflict, err := parseCapacityConflict(config)
+	if err != nil {
+		return err
+	}
+	register, err := parseRegisterConfig(config)
+	if err != nil {
+		return err
+	}
+	capacityUnit, err := parseCapacityUnit(config)
+	if err != nil {
+		return err
+	}
+	capacityMode, err := parseCapacityMode(config)
+	if err != nil {
+		return err
+	}
+	liveExclude, err := parseLiveExclude(config)
+	if err != nil {
+		return err
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+	t.targets.observe(config)
+	if overlaps := t.targets.overlapping(config); len(overlaps) > 0 {
+		logger.Warn("scale sets of the target are listed by other targets too, which scale them as well", "overlapping_targets", overlaps)
+	}
+	logger.Debug("scale triggered", configKeyResourceGroupList, resourceGroupList, configKeyVMSSList, vmScaleSetList)
+
+	snapshot, err := t.takeScaleSnapshot(ctx, members)
+	if err != nil {
+		return err
+	}
+	if pauseUpgrades {
+		if resume := t.pauseOSUpgrades(ctx, members, snapshot, event.OperationID, logger); resume != nil {
+			defer resume()
+			// Pausing updated the sets, which the capacity updates of
+			// the scale must start from.
+			if snapshot, err = t.takeScaleSnapshot(ctx, members); err != nil {
+				return err
+			}
+		}
+	}
+	if snapshot, err = t.awaitPlatformOperations(ctx, members, snapshot, event.Target, platformWait, logger); err != nil {
+		return err
+	}
+	for _, set := range snapshot.sets {
+		set.withHealth = applicationHealth && usesApplicationHealth(set.vmss)
+		set.withMaintenance = preferMaintenance
+		set.excludeRepairs = automaticRepairsActive(set.vmss, nil)
 	}
-	resourceGroupList := strings.Split(resourceGroupListStr, ",")
-
-	vmScaleSetListStr, ok := config[configKeyVMSSList]
-	if !ok {
-		return fmt.Errorf("required config param %s not found", configKeyVMSSList)
+	defer t.sizeStandbyPools(ctx, members, logger)
+	capacities := snapshot.capacities()
+	if capacityMode == capacityModeLive {
+		if err := t.applyLiveCapacities(ctx, members, snapshot, capacities, liveExclude, logger); err != nil {
+			return err
+		}
+	}
+	outsideZones := make([]map[string]bool, len(members))
+	if zones != nil {
+		if outsideZones, err = t.applyZonePinning(ctx, members, snapshot, capacities, zones, logger); err != nil {
+			return err
+		}
+	}
+	// Instances outside the zones of the target are part of the capacity
+	// of their set, but not of the target.
+	var zoneOffset int64
+	for _, outside := range outsideZones {
+		zoneOffset += int64(len(outside))
 	}
-	vmScaleSetList := strings.Split(vmScaleSetListStr, ",")
-	t.logger.Debug("scale triggered", configKeyResourceGroupList, resourceGroupList, configKeyVMSSList, vmScaleSetList)
-
 	var totalVMSSCapacity int64
-	for idx, vmScaleSet := range vmScaleSetList {
-		ctx := context.Background()
-		currVMSS, err := t.AzureController.vmss.Get(ctx, resourceGroupList[idx], vmScaleSet)
+	for idx, set := range snapshot.sets {
+		if members[idx].missing {
+			logger.Warn("skipping member scale set missing from Azure", "resource_group", set.resourceGroup, "vmss_name", set.vmScaleSet)
+			continue
+		}
+		if disabledByTag(set.vmss.Tags) {
+			logger.Info("skipping scale set disabled by tag", "resource_group", set.resourceGroup, "vmss_name", set.vmScaleSet, "tag", tagDisabled)
+			members[idx].paused = true
+			capacities[idx] = 0
+			continue
+		}
+		if !members[idx].paused && pausedByTag(set.vmss.Tags) {
+			members[idx].paused = true
+		}
+		if members[idx].paused {
+			logger.Info("skipping paused scale set", "resource_group", set.resourceGroup, "vmss_name", set.vmScaleSet)
+		}
+		if conflictAction == autoscaleConflictRefuse && set.vmss.ID != nil {
+			// Fail open when the settings cannot be read so a missing
+			// Microsoft.Insights permission does not block scaling.
+			setting, err := t.autoscaleConflict(ctx, set.resourceGroup, set.vmScaleSet, *set.vmss.ID, logger)
+			if err != nil {
+				logger.Warn("failed to check for Azure autoscale settings", "vmss_name", set.vmScaleSet, "error", err)
+			} else if setting != "" {
+				return fmt.Errorf("refusing to scale, %s/%s is managed by Azure autoscale setting %q", set.resourceGroup, set.vmScaleSet, setting)
+			}
+		}
+		if pool, err := t.checkAKSManaged(ctx, set.resourceGroup, set.vmScaleSet, set.vmss, aksAction); err != nil {
+			return err
+		} else if pool != "" {
+			logger.Debug("scale set backs an AKS node pool", "vmss_name", set.vmScaleSet, "node_pool", pool, "action", aksAction)
+		}
+		totalVMSSCapacity = totalVMSSCapacity + capacities[idx] - int64(len(outsideZones[idx]))
+	}
+	if capacityUnit == capacityUnitVCPU {
+		count, err := t.vcpuInstanceCount(ctx, members, snapshot, capacities, action.Count, logger)
 		if err != nil {
-			return fmt.Errorf("failed to get Azure vmss: %v", err)
+			return err
+		}
+		action.Count = count
+	}
+	var clamped error
+	if budget != nil {
+		usedHours := t.budgets.observe(event.Target, totalVMSSCapacity, time.Now())
+		// The clamped count is still scaled to; the error tells the
+		// autoscaler the strategy did not get what it asked for.
+		action.Count, clamped = budget.clamp(totalVMSSCapacity, action.Count, usedHours, time.Now())
+		if clamped != nil {
+			logger.Warn("capacity budget clamps the scale out", "error", clamped)
+			event.Desired = action.Count
+			t.budgets.setClamped(event.Target, clamped.Error())
+		} else {
+			t.budgets.setClamped(event.Target, "")
 		}
-		totalVMSSCapacity = totalVMSSCapacity + ptr.PtrToInt64(currVMSS.Sku.Capacity)
 	}
 	num, direction := calculateScaleDirection(totalVMSSCapacity, action.Count)
-	modulo := num / int64(len(vmScaleSetList))
-	reminder := num % int64(len(vmScaleSetList))
-	t.logger.Debug("scale direction calculated", "modulo", modulo, "reminder", reminder)
+	event.Current = totalVMSSCapacity
+	event.Direction = direction
+	logger.Debug("scale direction calculated", "num", num, "direction", direction)
+	if window, frozen := freeze.active(time.Now()); frozen && direction == "in" {
+		logger.Info("skipping scale in inside a no scale in window", "window", window,
+			"current_count", totalVMSSCapacity, "strategy_count", action.Count)
+		event.Direction = ""
+		event.Skipped = fmt.Sprintf("scale in from %d to %d inside no scale in window %q", totalVMSSCapacity, action.Count, window)
+		return nil
+	}
+	var canaryRemaining int64
+	if !isCanaryFollowUp(ctx) {
+		switch {
+		case direction != "in" || canary == nil:
+			if t.canaries.cancel(event.Target) {
+				logger.Info("dropping rest of canary scale in superseded by a newer action")
+			}
+		case t.canaries.update(event.Target, action, config, num):
+			// A scale in while the canary is verified waits for it.
+			logger.Info("canary scale in pending verification, deferring scale in", "desired_count", action.Count)
+			event.Direction = ""
+			event.Skipped = fmt.Sprintf("scale in from %d to %d waits for canary scale in verification", totalVMSSCapacity, action.Count)
+			return nil
+		default:
+			if immediate := canary.immediate(num); immediate < num {
+				canaryRemaining = num - immediate
+				num = immediate
+			}
+		}
+	}
+	if cooling := t.applyCooldowns(members, direction, cooldowns); len(cooling) > 0 {
+		logger.Info("member sets are cooling down and left out", "direction", direction, "vmss", cooling)
+	}
+	if lockCheck != lockCheckIgnore && direction != "" {
+		if err := t.checkTargetScaleBlockers(ctx, members, snapshot, direction, lockCheck, logger); err != nil {
+			return err
+		}
+	}
 
 	var wg sync.WaitGroup
+	errs := make(chan error, len(vmScaleSetList))
+	pool := newWorkerPool(t.maxParallel)
 	switch direction {
 	case "out":
-		log := t.logger.With("action", "scale_out")
+		log := logger.With("action", "scale_out")
 		wg.Add(len(vmScaleSetList))
-		for idx, vmScaleSet := range vmScaleSetList {
-			count := modulo
-			if reminder > 0 {
-				count++
-				reminder--
+		targets := make([]int64, len(vmScaleSetList))
+		failed := make([]bool, len(vmScaleSetList))
+		unallocated := make([]error, len(vmScaleSetList))
+		registerBefore := make([]map[string]struct{}, len(vmScaleSetList))
+		t.checkpoint(&operationCheckpoint{
+			OperationID: event.OperationID,
+			Target:      event.Target,
+			Direction:   direction,
+			Started:     event.Time,
+			Config:      config,
+		}, log)
+		defer t.completeCheckpoint(event.OperationID, log)
+		capPlacementGroups(members, snapshot, log)
+		weighted := members
+		if avoidRate > 0 {
+			weighted = t.avoidSpotEvictions(members, snapshot, capacities, avoidRate, log)
+		}
+		if loadWindow > 0 {
+			weighted = t.loadAwareMembers(ctx, weighted, snapshot, capacities, direction, loadWindow, log)
+		}
+		plan := planScaleOut(capacities, num+zoneOffset, weighted)
+		var planned, changing int64
+		for idx, count := range plan {
+			planned += count
+			if count > 0 && members[idx].scalesOut() {
+				changing++
 			}
-
-			if count > 0 {
+		}
+		planned -= zoneOffset
+		if planned != num {
+			log.Warn("member set limits do not allow the requested capacity", "desired_count", num, "planned_count", planned)
+		}
+		prewarmQuotas := make([]int64, len(vmScaleSetList))
+		for idx, count := range plan {
+			if prewarm == 0 || count <= capacities[idx] || !members[idx].scalesOut() {
+				continue
+			}
+			prewarmQuotas[idx] = count - capacities[idx]
+			if prewarm > 0 {
+				prewarmQuotas[idx] = min(prewarmQuotas[idx], prewarm)
+				prewarm -= prewarmQuotas[idx]
+			}
+		}
+		// A failing pre scale out hook vetoes the scale out, nothing has
+		// changed yet.
+		if err := hooks.run(ctx, event.hookPayload(hookPreScaleOut, nil), log); err != nil {
+			return err
+		}
+		submissionFrom(ctx).expect(int(changing))
+		for idx, vmScaleSet := range vmScaleSetList {
+			count := plan[idx]
+			if count > 0 && members[idx].scalesOut() {
+				event.setDelta(vmScaleSet, count-capacities[idx])
+				t.scaleEventCounts.increment(resourceGroupList[idx], vmScaleSet)
 				log.Info("creating Azure ScaleSet instances", "vmss_name", vmScaleSet, "desired_count", count)
-				ctx := context.Background()
-				go t.AzureController.scaleOut(ctx, resourceGroupList[idx], vmScaleSet, count, &wg, log)
+				targets[idx] = count
+				go func(idx int, resourceGroup, vmScaleSet string, count int64) {
+					defer wg.Done()
+					defer pool.acquire()()
+					before := t.snapshotInstancesForTagging(ctx, resourceGroup, vmScaleSet, tags, log)
+					upgradeBefore := before
+					if upgradeBefore == nil && modelUpgrade != nil && modelUpgrade.newInstances {
+						var err error
+						if upgradeBefore, err = t.azureFor(resourceGroup, vmScaleSet).listInstanceTags(ctx, resourceGroup, vmScaleSet); err != nil {
+							log.Warn("failed to list instances before scaling out, not upgrading the new ones", "vmss_name", vmScaleSet, "error", err)
+						}
+					}
+					var existing map[string]map[string]string
+					if prewarmQuotas[idx] > 0 {
+						var err error
+						if existing, err = t.azureFor(resourceGroup, vmScaleSet).listInstanceTags(ctx, resourceGroup, vmScaleSet); err != nil {
+							log.Warn("failed to list instances before pre-warming", "vmss_name", vmScaleSet, "error", err)
+						}
+					}
+					if register != nil {
+						names, err := t.azureFor(resourceGroup, vmScaleSet).listInstanceNames(ctx, resourceGroup, vmScaleSet)
+						if err != nil {
+							log.Warn("failed to list instances before scaling out, not verifying their registration", "vmss_name", vmScaleSet, "error", err)
+						}
+						registerBefore[idx] = names
+					}
+					// Restarted spot instances are part of the capacity
+					// already, the set grows by the rest.
+					if restarted := t.restartEvictedInstances(ctx, resourceGroup, vmScaleSet, snapshot.sets[idx].vmss, count-capacities[idx], log); restarted > 0 {
+						count -= restarted
+						targets[idx] = count
+					}
+					// The planned count is written over the Sku.Capacity,
+					// which a live capacity plan may already be under
+					// while instances are still being created.
+					var err error
+					if written := snapshot.sets[idx].capacity; count > written {
+						err = t.azureFor(resourceGroup, vmScaleSet).scaleOut(ctx, resourceGroup, vmScaleSet, count, snapshot.sets[idx].etag, conflict.expectedCapacity(written), log)
+					} else {
+						submissionFrom(ctx).accept()
+					}
+					if err != nil && isAllocationFailure(err) && overflowIndex(members, idx) != -1 {
+						// Spilled to the overflow set once the others
+						// are done.
+						unallocated[idx] = err
+						return
+					}
+					event.setResult(vmScaleSet, err)
+					if err != nil {
+						failed[idx] = true
+						errs <- fmt.Errorf("%s/%s: %w", resourceGroup, vmScaleSet, err)
+						return
+					}
+					t.desired.set(resourceGroup, vmScaleSet, count)
+					t.cooldowns.record(resourceGroup, vmScaleSet, "out")
+					t.statusCache.invalidate(resourceGroup, vmScaleSet)
+					t.applyScaleEventTags(ctx, resourceGroup, vmScaleSet, tags, capacities[idx], count, before, log)
+					t.upgradeTouchedInstances(ctx, resourceGroup, vmScaleSet, modelUpgrade, upgradeBefore, log)
+					if existing != nil {
+						t.prewarmInstances(ctx, resourceGroup, vmScaleSet, existing, prewarmQuotas[idx], log)
+					}
+				}(idx, resourceGroupList[idx], vmScaleSet, count)
 			} else {
 				wg.Done()
 				log.Debug("no new Azure ScaleSet instance needed", "vmss_name", vmScaleSet, "desired_count", count)
 			}
 		}
 		wg.Wait()
+		for idx, err := range unallocated {
+			if err == nil {
+				continue
+			}
+			to := overflowIndex(members, idx)
+			base := capacities[to]
+			if targets[to] > 0 && !failed[to] && unallocated[to] == nil {
+				base = targets[to]
+			}
+			placed, spilled, spillErr := t.spillToOverflow(ctx, members[idx], members[to], targets[idx], base, log)
+			if spillErr != nil {
+				failed[idx] = true
+				event.setResult(vmScaleSetList[idx], err)
+				errs <- fmt.Errorf("%s/%s: %w, and spilling to the overflow set failed: %v", resourceGroupList[idx], vmScaleSetList[idx], err, spillErr)
+				continue
+			}
+			event.setResult(vmScaleSetList[idx], nil)
+			event.setDelta(vmScaleSetList[idx], placed-capacities[idx])
+			event.setDelta(vmScaleSetList[to], spilled-capacities[to])
+			targets[idx] = placed
+			if targets[to] > 0 || spilled != capacities[to] {
+				targets[to] = spilled
+				event.setResult(vmScaleSetList[to], nil)
+			}
+		}
+		if register != nil {
+			var registerWG sync.WaitGroup
+			for idx := range vmScaleSetList {
+				if registerBefore[idx] == nil || failed[idx] || targets[idx] <= capacities[idx] {
+					continue
+				}
+				registerWG.Add(1)
+				go func(idx int) {
+					defer registerWG.Done()
+					if err := t.verifyRegistration(ctx, cluster, register, members, idx, registerBefore[idx], log); err != nil {
+						errs <- fmt.Errorf("%s/%s: %w", resourceGroupList[idx], vmScaleSetList[idx], err)
+					}
+				}(idx)
+			}
+			registerWG.Wait()
+		}
+		result := collectScaleErrors(errs)
+		if result.ErrorOrNil() != nil && failurePolicy != scaleOutFailureNone {
+			plan := scaleOutPlan{
+				resourceGroups: resourceGroupList,
+				vmScaleSets:    vmScaleSetList,
+				previous:       capacities,
+				targets:        targets,
+				failed:         failed,
+			}
+			if err := t.recoverScaleOut(ctx, failurePolicy, plan, log); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+		if err := result.ErrorOrNil(); err != nil {
+			return fmt.Errorf("failed to scale out: %w", err)
+		}
+		if hint, _ := parsePrewarmHint(action); hint == 0 {
+			// Demand beyond the current capacity has arrived, which the
+			// pre-warmed instances were created for.
+			for _, set := range snapshot.sets {
+				if prewarmedCount(set.vmss.Tags) > 0 {
+					t.releasePrewarmed(ctx, set.resourceGroup, set.vmScaleSet, nil, "scale out without pre-warm hint", log)
+				}
+			}
+		}
+		if err := hooks.run(ctx, event.hookPayload(hookPostScaleOut, nil), log); err != nil {
+			log.Warn("scale hook failed", "error", err)
+		}
 		log.Info("successfully performed and verified scaling out")
 	case "in":
-		log := t.logger.With("action", "scale_in")
+		log := logger.With("action", "scale_in")
 		wg.Add(len(vmScaleSetList))
-		var err error
-		var remoteIDs []string
+		exemptions, err := parseNodeMetaExemptions(config)
+		if err != nil {
+			return err
+		}
+		drainOnly, err := parseDrainOnly(config, action)
+		if err != nil {
+			return err
+		}
+		scaleInStarting, err := parseScaleInStarting(config)
+		if err != nil {
+			return err
+		}
+		protectedJobs, err := parseProtectedJobs(config)
+		if err != nil {
+			return err
+		}
+		namespaces, err := parseScaleInNamespaces(config)
+		if err != nil {
+			return err
+		}
+		var nodes map[string]*api.Node
+		if filters != nil || exemptions != nil || protectedJobs != nil || namespaces != nil || drainOnly {
+			if nodes, err = t.registeredNodes(cluster.client); err != nil {
+				return err
+			}
+		}
+		var protected map[string]string
+		if protectedJobs != nil {
+			if protected, err = protectedNodes(cluster.client, protectedJobs, namespaces); err != nil {
+				return err
+			}
+		}
+
+		// Listing instances with their instance views is slow, so the
+		// candidates of all sets are collected concurrently.
+		setRemoteIDs := make([][]string, len(vmScaleSetList))
+		setDrained := make([]int64, len(vmScaleSetList))
+		listErrs := make([]error, len(vmScaleSetList))
+		listPool := newWorkerPool(t.readParallelism())
+		var listWG sync.WaitGroup
+		listWG.Add(len(vmScaleSetList))
 		for idx, vmScaleSet := range vmScaleSetList {
-			log.Debug("collection Azure ScaleSet instances IDs", "resource_group", resourceGroupList[idx], "vmss_name", vmScaleSet)
-			ctx := context.Background()
-			remoteIDs, err = t.AzureController.getRemoteIds(ctx, resourceGroupList[idx], vmScaleSet, remoteIDs)
-			if err != nil {
-				return fmt.Errorf("failed to egt remote ids in tasks: %v", err)
+			go func(idx int, resourceGroup, vmScaleSet string) {
+				defer listWG.Done()
+				defer listPool.acquire()()
+				log.Debug("collection Azure ScaleSet instances IDs", "resource_group", resourceGroup, "vmss_name", vmScaleSet)
+				vmssRemoteIDs, err := snapshot.sets[idx].runningRemoteIDs(ctx, t.azureFor(resourceGroup, vmScaleSet))
+				if err != nil {
+					listErrs[idx] = err
+					return
+				}
+				if drainOnly {
+					vmssRemoteIDs, setDrained[idx] = withoutDrainedNodes(vmssRemoteIDs, nodes)
+				}
+				prewarmed, err := t.prewarmRemoteIDs(ctx, snapshot.sets[idx])
+				if err != nil {
+					listErrs[idx] = err
+					return
+				}
+				var filter nodeFilter
+				if filters != nil {
+					filter = filters[idx]
+				}
+				vmssRemoteIDs = withoutRemoteIDs(withoutRemoteIDs(vmssRemoteIDs, prewarmed), outsideZones[idx])
+				candidates, exempt := withoutExemptNodes(filterRemoteIDs(vmssRemoteIDs, filter, nodes), exemptions, nodes)
+				if len(exempt) > 0 {
+					log.Info("leaving out nodes exempt from scale in by their meta", "vmss_name", vmScaleSet, "remote_ids", exempt)
+				}
+				candidates, running := withoutProtectedNodes(candidates, protected, nodes)
+				if len(running) > 0 {
+					log.Info("leaving out nodes running protected jobs", "vmss_name", vmScaleSet, "remote_ids", running)
+				}
+				setRemoteIDs[idx] = candidates
+			}(idx, resourceGroupList[idx], vmScaleSet)
+		}
+		listWG.Wait()
+
+		var candidates int
+		var drained int64
+		for idx := range vmScaleSetList {
+			if listErrs[idx] != nil {
+				return fmt.Errorf("failed to egt remote ids in tasks: %w", listErrs[idx])
+			}
+			candidates += len(setRemoteIDs[idx])
+			drained += setDrained[idx]
+		}
+		if drainOnly && drained > 0 {
+			// Nodes drained by an earlier drain only scale in keep their
+			// instances, so the capacity still counts them.
+			if drained >= num {
+				log.Info("nodes drained earlier already cover the scale in, not draining more",
+					"drained", drained, "desired_count", num)
+				event.Direction = ""
+				event.Skipped = fmt.Sprintf("scale in to %d covered by %d nodes drained earlier", action.Count, drained)
+				return nil
 			}
+			log.Info("nodes drained earlier cover part of the scale in", "drained", drained, "desired_count", num)
+			num -= drained
+		}
+		if (exemptions != nil || protected != nil) && candidates < int(num) {
+			log.Warn("fewer nodes may be scaled in than asked for, the others are exempt or run protected jobs",
+				"desired_count", num, "candidates", candidates)
+		}
+		remoteIDs := make([]string, 0, candidates)
+		for idx := range vmScaleSetList {
+			remoteIDs = append(remoteIDs, setRemoteIDs[idx]...)
+		}
+
+		// The drains are issued through cluster utils bound to this
+		// operation, so every Nomad request carries the operation ID.
+		utils, err := cluster.operationUtils(event.OperationID, logger)
+		if err != nil {
+			return err
 		}
 
-		log.Debug("running pre scale tasks", "IDs", remoteIDs)
-		ids, err := t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(context.Background(), config, remoteIDs, int(num))
+		scaleInConfig, err := t.scaleInConfig(poolConfig(config, filters))
 		if err != nil {
-			return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+			return fmt.Errorf("failed to build node drain config: %v", err)
+		}
+		if empty, ignoreSystemJobs := emptyNodeStrategy(scaleInConfig); empty && namespaces != nil {
+			// The node selector only sees the allocations the Nomad client
+			// namespace lets it; the configured namespaces are checked here.
+			busy, err := busyNodes(cluster.client, namespaces, ignoreSystemJobs)
+			if err != nil {
+				return err
+			}
+			remoteIDs = withoutBusyNodes(remoteIDs, busy, nodes)
+			for idx := range setRemoteIDs {
+				setRemoteIDs[idx] = withoutBusyNodes(setRemoteIDs[idx], busy, nodes)
+			}
+		}
+
+		// Instances the Application Health extension reports unhealthy
+		// are removed first, then those Azure has maintenance pending for.
+		preferred, preferredNodes := t.scaleInPreferences(snapshot, cluster.client, nodes, preferMaintenance, log)
+
+		// A load aware scale in takes the instances set by set, mostly
+		// from the sets with the most spare capacity.
+		placed := members
+		if loadWindow > 0 {
+			placed = t.loadAwareMembers(ctx, members, snapshot, capacities, direction, loadWindow, log)
+		}
+
+		var ids []scaleutils.NodeResourceID
+		if !hasPlacement(placed) {
+			log.Debug("running pre scale tasks", "IDs", remoteIDs)
+			if ids, err = selectScaleInNodes(ctx, utils, scaleInConfig, remoteIDs, preferred, preferredNodes, int(num)); err != nil {
+				t.logUnmatchedIdentities(snapshot, cluster.client, nodes, log)
+				return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+			}
+		} else {
+			// Placement options fix how many instances each set gives
+			// up, so the nodes are selected set by set.
+			var selectErrs *multierror.Error
+			for idx, removal := range planScaleIn(capacities, num, placed) {
+				if removal <= 0 {
+					continue
+				}
+				log.Debug("running pre scale tasks", "vmss_name", vmScaleSetList[idx], "count", removal, "IDs", setRemoteIDs[idx])
+				setIDs, err := selectScaleInNodes(ctx, utils, scaleInConfig, setRemoteIDs[idx], preferred, preferredNodes, int(removal))
+				if err != nil {
+					selectErrs = multierror.Append(selectErrs, fmt.Errorf("%s/%s: %v", resourceGroupList[idx], vmScaleSetList[idx], err))
+					continue
+				}
+				ids = append(ids, setIDs...)
+			}
+			if len(ids) == 0 {
+				if err := selectErrs.ErrorOrNil(); err != nil {
+					t.logUnmatchedIdentities(snapshot, cluster.client, nodes, log)
+					return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
+				}
+				log.Info("member set limits do not allow removing any instance")
+				return nil
+			}
+			if err := selectErrs.ErrorOrNil(); err != nil {
+				log.Warn("failed to select nodes in some scale sets", "error", err)
+			}
+		}
+		if len(ids) < int(num) {
+			t.logUnmatchedIdentities(snapshot, cluster.client, nodes, log)
 		}
 
+		// Member set names are distinct, see validateDistinctNames, so a
+		// node belongs to at most one set.
+		setNames := make(map[string]string, len(vmScaleSetList))
+		for _, vmScaleSet := range vmScaleSetList {
+			setNames[strings.ToLower(vmScaleSet)] = vmScaleSet
+		}
 		instanceIDs := make(map[string][]string)
+		nodeIDs := make(map[string][]scaleutils.NodeResourceID)
 		for _, node := range ids {
 			if idx := strings.LastIndex(node.RemoteResourceID, "_"); idx != -1 {
-				for _, vmScaleSet := range vmScaleSetList {
-					if strings.EqualFold(node.RemoteResourceID[0:idx], vmScaleSet) {
-						instanceIDs[vmScaleSet] = append(instanceIDs[vmScaleSet], node.RemoteResourceID[idx+1:])
-					}
+				if vmScaleSet, ok := setNames[strings.ToLower(node.RemoteResourceID[0:idx])]; ok {
+					instanceIDs[vmScaleSet] = append(instanceIDs[vmScaleSet], node.RemoteResourceID[idx+1:])
+					nodeIDs[vmScaleSet] = append(nodeIDs[vmScaleSet], node)
 				}
 			} else {
 				return errors.New("failed to get instance-id from remoteId")
 			}
 		}
+		if scaleInStarting && !drainOnly && len(ids) < int(num) {
+			t.addStartingInstances(ctx, members, snapshot, capacities, outsideZones, int(num)-len(ids), instanceIDs, log)
+		}
+
+		for _, node := range ids {
+			event.Nodes = append(event.Nodes, node.NomadNodeID)
+		}
+		if drainOnly {
+			// The drained nodes stay registered, ineligible, with their
+			// instances running until they are dealt with by hand.
+			log.Info("drained nodes, leaving their Azure instances in place", "instances", instanceIDs)
+			return nil
+		}
+		t.deregisterConsulNodes(cluster.client, ids, log)
+
+		// From here on the drained nodes are only cleaned up by this
+		// operation, so it is checkpointed for a restarted plugin to finish.
+		checkpoint := &operationCheckpoint{
+			OperationID: event.OperationID,
+			Target:      event.Target,
+			Direction:   direction,
+			Started:     event.Time,
+			Config:      config,
+		}
+		var deleting int
+		for idx, vmScaleSet := range vmScaleSetList {
+			if len(instanceIDs[vmScaleSet]) > 0 {
+				checkpoint.Sets = append(checkpoint.Sets, checkpointScaleSet{
+					ResourceGroup: resourceGroupList[idx],
+					VMScaleSet:    vmScaleSet,
+					InstanceIDs:   instanceIDs[vmScaleSet],
+					Nodes:         nodeIDs[vmScaleSet],
+				})
+				deleting++
+			}
+		}
+		t.checkpoint(checkpoint, log)
+		cleanupPending := false
+		defer func() {
+			if !cleanupPending {
+				t.completeCheckpoint(event.OperationID, log)
+			}
+		}()
+
+		// The nodes are drained by now, so a failing hook no longer stops
+		// the deletion.
+		if err := hooks.run(ctx, event.hookPayload(hookPreDelete, instanceIDs), log); err != nil {
+			log.Warn("scale hook failed", "error", err)
+		}
+		submissionFrom(ctx).expect(deleting)
 
+		var deletedLock sync.Mutex
+		var deletedIDs []scaleutils.NodeResourceID
+		var failedSets []checkpointScaleSet
 		for idx, vmScaleSet := range vmScaleSetList {
-			ctx := context.Background()
 			if len(instanceIDs[vmScaleSet]) > 0 {
+				event.setDelta(vmScaleSet, -int64(len(instanceIDs[vmScaleSet])))
+				t.scaleEventCounts.increment(resourceGroupList[idx], vmScaleSet)
 				log.Debug("deleting Azure ScaleSet instances", "instances", instanceIDs[vmScaleSet], "vmss_name", vmScaleSet)
-				go t.AzureController.scaleIn(ctx, resourceGroupList[idx], vmScaleSet, instanceIDs[vmScaleSet], &wg, log)
+				go func(resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet, capacity int64) {
+					defer wg.Done()
+					defer pool.acquire()()
+					err := t.scaleInSpotAware(ctx, resourceGroup, vmScaleSet, vmss, instanceIDs[vmScaleSet], log)
+					event.setResult(vmScaleSet, err)
+					if err != nil {
+						errs <- fmt.Errorf("%s/%s: %w", resourceGroup, vmScaleSet, err)
+						deletedLock.Lock()
+						failedSets = append(failedSets, checkpointScaleSet{
+							ResourceGroup: resourceGroup,
+							VMScaleSet:    vmScaleSet,
+							InstanceIDs:   instanceIDs[vmScaleSet],
+							Nodes:         nodeIDs[vmScaleSet],
+						})
+						deletedLock.Unlock()
+						return
+					}
+					t.desired.set(resourceGroup, vmScaleSet, capacity-int64(len(instanceIDs[vmScaleSet])))
+					t.cooldowns.record(resourceGroup, vmScaleSet, "in")
+					t.statusCache.invalidate(resourceGroup, vmScaleSet)
+					t.applyScaleEventTags(ctx, resourceGroup, vmScaleSet, tags, capacity, capacity-int64(len(instanceIDs[vmScaleSet])), nil, log)
+					deletedLock.Lock()
+					deletedIDs = append(deletedIDs, nodeIDs[vmScaleSet]...)
+					deletedLock.Unlock()
+				}(resourceGroupList[idx], vmScaleSet, snapshot.sets[idx].vmss, snapshot.sets[idx].capacity)
 			} else {
 				wg.Done()
 				log.Debug("no deletion Azure ScaleSet instance needed", "vmss_name", vmScaleSet)
@@ -150,21 +1305,97 @@ func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string)
 		}
 
 		wg.Wait()
-		log.Debug("running post scale tasks", "IDs", remoteIDs)
-		if err = t.clusterUtils.RunPostScaleInTasks(context.Background(), config, ids); err != nil {
-			return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+
+		// Only nodes whose backing instance is confirmed deleted are handed to
+		// the post scale tasks, so a purge never removes a node that is still
+		// alive in Azure. The instances which failed to delete stay in the
+		// checkpoint for the next evaluation to retry.
+		log.Debug("running post scale tasks", "IDs", deletedIDs)
+		result := collectScaleErrors(errs)
+		pending := failedSets
+		if err = utils.RunPostScaleInTasks(ctx, scaleInConfig, deletedIDs); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err))
+			pending = append(pending, cleanupNodes(deletedIDs)...)
+		}
+		if len(pending) > 0 {
+			cleanupPending = true
+			t.deferCleanup(checkpoint, pending, log)
+		}
+		if err := result.ErrorOrNil(); err != nil {
+			return fmt.Errorf("failed to scale in: %w", err)
+		}
+		if err := hooks.run(ctx, event.hookPayload(hookPostScaleIn, instanceIDs), log); err != nil {
+			log.Warn("scale hook failed", "error", err)
 		}
 		log.Info("successfully deleted Azure ScaleSet instances")
+		if canaryRemaining > 0 {
+			t.scheduleCanaryRemainder(action, config, canary, canaryRemaining, log)
+		}
 	default:
-		t.logger.Info("scaling not required", "current_count", num, "strategy_count", action.Count)
-		return nil
+		logger.Info("scaling not required", "current_count", num, "strategy_count", action.Count)
+		return clamped
 	}
 
-	return nil
+	return clamped
+}
+
+// collectScaleErrors drains the per scale set errors of a fan-out into a
+// single error listing every failing set, so the autoscaler treats a partial
+// failure as failed.
+func collectScaleErrors(errs chan error) *multierror.Error {
+	close(errs)
+	var result *multierror.Error
+	for err := range errs {
+		result = multierror.Append(result, err)
+	}
+	return result
+}
+
+// misconfiguredStatus reports a target whose scale sets cannot be worked out
+// from its config as not ready, so the autoscaler leaves it alone while the
+// meta tells why.
+func (t *TargetPlugin) misconfiguredStatus(config map[string]string, err error) *sdk.TargetStatus {
+	t.logger.Warn("target is misconfigured", "target", targetKey(config), "error", err)
+	meta := map[string]string{metaKeyMisconfigured: err.Error()}
+	annotateVersion(meta)
+	return &sdk.TargetStatus{Ready: false, Meta: meta}
 }
 
 func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, error) {
-	ready, err := t.clusterUtils.IsPoolReady(config)
+	resolved, err := t.resolveTargetGroup(config)
+	if err != nil {
+		return t.misconfiguredStatus(config, err), nil
+	}
+	config = resolved
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		// Discovery fails on Azure errors too, which are not the config's
+		// fault.
+		if isDiscoveryConfig(config) {
+			return nil, err
+		}
+		return t.misconfiguredStatus(config, err), nil
+	}
+	resourceGroupList, vmScaleSetList := splitScaleSetTargets(members)
+	filters, err := parseNodeFilters(config, vmScaleSetList)
+	if err != nil {
+		return t.misconfiguredStatus(config, err), nil
+	}
+	if t.scaleState != nil {
+		t.scaleState.restore(targetKey(config), members, t.desired, t.logger)
+	}
+	readiness, err := parseReadinessConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	readiness.ages = t.instanceAges
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ready, err := cluster.utils.IsPoolReady(poolConfig(config, filters))
 	if err != nil {
 		return nil, fmt.Errorf("failed to run Nomad node readiness check: %v", err)
 	}
@@ -172,41 +1403,228 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 		return &sdk.TargetStatus{Ready: ready}, nil
 	}
 
-	resourceGroupListStr, ok := config[configKeyResourceGroupList]
-	if !ok {
-		return nil, fmt.Errorf("required config param %s not found", configKeyResourceGroupList)
+	var nodes map[string]*api.Node
+	if filters != nil {
+		if nodes, err = t.registeredNodes(cluster.client); err != nil {
+			return nil, err
+		}
 	}
-	resourceGroupList := strings.Split(resourceGroupListStr, ",")
+	t.targets.observe(config)
 
-	vmScaleSetListStr, ok := config[configKeyVMSSList]
-	if !ok {
-		return nil, fmt.Errorf("required config param %s not found", configKeyVMSSList)
+	meta := make(map[string]string)
+	if overlaps := t.targets.overlapping(config); len(overlaps) > 0 {
+		meta[metaKeyOverlappingTargets] = strings.Join(overlaps, "; ")
+	}
+	// Post scale in tasks which failed after their instances were deleted
+	// are finished on the evaluations that follow.
+	if pending := t.operations.pendingCleanups(targetKey(config)); len(pending) > 0 {
+		meta[metaKeyPendingCleanups] = strconv.Itoa(len(pending))
+		t.resumeCleanups(targetKey(config))
 	}
-	vmScaleSetList := strings.Split(vmScaleSetListStr, ",")
-
 	ready = true
 	var totalCapacity int64
 	latestTime := int64(math.MinInt64)
-	for idx, vmScaleSet := range vmScaleSetList {
-		ctx := context.Background()
-		vmss, err := t.AzureController.vmss.Get(ctx, resourceGroupList[idx], vmScaleSet)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get Azure ScaleSet: %v", err)
+	capacityMode, err := parseCapacityMode(config)
+	if err != nil {
+		return nil, err
+	}
+	countStarting, err := parseCountStarting(config)
+	if err != nil {
+		return nil, err
+	}
+	liveExclude, err := parseLiveExclude(config)
+	if err != nil {
+		return nil, err
+	}
+	capacityUnit, err := parseCapacityUnit(config)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := parseZones(config)
+	if err != nil {
+		return nil, err
+	}
+	partial := false
+	if value, ok := config[configKeyStatusPartial]; ok {
+		if partial, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyStatusPartial, value, err)
 		}
+	}
+	reportErrors := false
+	if value, ok := config[configKeyStatusErrors]; ok {
+		if reportErrors, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyStatusErrors, value, err)
+		}
+	}
+	conflictAction, err := parseAutoscaleConflictAction(config)
+	if err != nil {
+		return nil, err
+	}
+	aksAction, err := parseAKSManagedAction(config)
+	if err != nil {
+		return nil, err
+	}
+	async, err := parseScaleAsync(config)
+	if err != nil {
+		return nil, err
+	}
+	applicationHealth, err := parseApplicationHealth(config)
+	if err != nil {
+		return nil, err
+	}
 
-		instanceView, err := t.AzureController.vmss.GetInstanceView(ctx, resourceGroupList[idx], vmScaleSet)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get Azure ScaleSet Instance View: %v", err)
+	statuses := t.fetchVMSSStatuses(context.Background(), resourceGroupList, vmScaleSetList, capacityMode != capacityModeSku || readiness.warmup > 0 || reportErrors)
+	var failed int
+	var failedErr error
+	var missing []string
+	var spotEvictions, spotSets int
+	var spotCapacity int64
+	instanceStates := make(map[string]int64)
+	for idx, vmScaleSet := range vmScaleSetList {
+		resourceGroup := resourceGroupList[idx]
+		if isAzureNotFound(statuses[idx].err) {
+			// A set that does not exist is a config mistake no retry
+			// fixes, it is reported rather than failing the whole
+			// status.
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "error")] = fmt.Sprintf("scale set not found in resource group %s", resourceGroup)
+			missing = append(missing, resourceGroup+"/"+vmScaleSet)
+			if !members[idx].skipMissing {
+				ready = false
+			}
+			continue
+		}
+		if statuses[idx].err != nil {
+			if !partial {
+				return nil, statuses[idx].err
+			}
+			// Report the remaining sets but keep the target not-ready so
+			// the autoscaler does not act on an incomplete count.
+			t.logger.Warn("failed to query scale set, reporting partial status", "vmss_name", vmScaleSet, "error", statuses[idx].err)
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "error")] = statuses[idx].err.Error()
+			ready = false
+			failed++
+			if failedErr == nil {
+				failedErr = statuses[idx].err
+			}
+			continue
+		}
+		if disabledByTag(statuses[idx].vmss.Tags) {
+			t.logger.Debug("leaving scale set disabled by tag out of status", "vmss_name", vmScaleSet, "tag", tagDisabled)
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "disabled")] = "true"
+			continue
+		}
+		pinning := zonePinning(statuses[idx].vmss, zones)
+		if pinning == zonePinningExcluded {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "zones_excluded")] = "true"
+			continue
 		}
 
 		resp := sdk.TargetStatus{
 			Ready: true,
-			Count: ptr.PtrToInt64(vmss.Sku.Capacity),
+			Count: ptr.PtrToInt64(statuses[idx].vmss.Sku.Capacity),
 			Meta:  make(map[string]string),
 		}
+		switch capacityMode {
+		case capacityModeRunning:
+			resp.Count = statuses[idx].runningCount(countStarting)
+		case capacityModeLive:
+			resp.Count = statuses[idx].liveCount(liveExclude)
+		}
+		if pinning == zonePinningPartial {
+			outside, running, err := t.outsideZones(context.Background(), resourceGroup, vmScaleSet, zones)
+			if err != nil {
+				return nil, err
+			}
+			if capacityMode == capacityModeRunning {
+				resp.Count = max(resp.Count-running, 0)
+			} else {
+				resp.Count = max(resp.Count-int64(len(outside)), 0)
+			}
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "zones")] = pinnedZones(statuses[idx].vmss, zones)
+		}
 
-		processInstanceView(instanceView, &resp)
+		var instances []vmssInstance
+		if readiness.warmup > 0 {
+			instances = statuses[idx].instances
+			t.instanceAges.observe(vmssKey(resourceGroup, vmScaleSet), instances)
+		}
+		if automaticRepairsActive(statuses[idx].vmss, &statuses[idx].instanceView) {
+			if settled := t.accountRepairs(context.Background(), resourceGroup, vmScaleSet, statuses[idx], capacityMode, countStarting, &resp, meta); settled != nil {
+				instances = settled
+			}
+		}
+		processInstanceView(statuses[idx].instanceView, instances, readiness, &resp)
+		if !resp.Ready && readiness.tolerateUpgrades &&
+			t.azureFor(resourceGroup, vmScaleSet).upgradeInProgress(context.Background(), resourceGroup, vmScaleSet) {
+			t.logger.Debug("treating scale set as ready during rolling upgrade", "vmss_name", vmScaleSet)
+			resp.Ready = true
+			processInstanceView(statuses[idx].instanceView, instances, readiness.duringUpgrade(), &resp)
+		}
+		if applicationHealth && usesApplicationHealth(statuses[idx].vmss) {
+			t.annotateApplicationHealth(context.Background(), resourceGroup, vmScaleSet, readiness, &resp, meta)
+		}
+		annotatePowerStates(resourceGroup, vmScaleSet, statuses[idx].instanceView, meta)
+		countInstanceStates(statuses[idx].instanceView, instanceStates)
+		annotateScaleSetTags(resourceGroup, vmScaleSet, statuses[idx].vmss.Tags, meta)
+		t.followSpotDeletions(resourceGroup, vmScaleSet, statuses[idx].vmss)
+		t.resumeStaleOSUpgrades(context.Background(), resourceGroup, vmScaleSet, statuses[idx].vmss)
+		t.annotateDrift(resourceGroup, vmScaleSet, ptr.PtrToInt64(statuses[idx].vmss.Sku.Capacity), meta)
+		if isSpotScaleSet(statuses[idx].vmss) {
+			capacity := ptr.PtrToInt64(statuses[idx].vmss.Sku.Capacity)
+			if evictions, ok := t.annotateSpotEvictions(context.Background(), resourceGroup, vmScaleSet, statuses[idx], capacity, meta); ok {
+				spotEvictions += evictions
+				spotCapacity += capacity
+				spotSets++
+			}
+		}
+		if age := time.Since(statuses[idx].fetchedAt); t.statusWatch > 0 && age > t.statusWatch {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "status_age")] = age.Round(time.Second).String()
+		}
+		if members[idx].paused || pausedByTag(statuses[idx].vmss.Tags) {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "paused")] = "true"
+		}
+		if members[idx].retiring {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "retiring")] = "true"
+		}
+		if singlePlacementGroup(statuses[idx].vmss) {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "placement_group_limit")] = strconv.Itoa(singlePlacementGroupLimit)
+		}
+		if count := prewarmedCount(statuses[idx].vmss.Tags); count > 0 {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "prewarmed_instances")] = strconv.FormatInt(count, 10)
+		}
+		if state := vmssProvisioningState(statuses[idx].vmss); state != "" && !strings.EqualFold(state, "Succeeded") {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "provisioning_state")] = state
+		}
+		if orphaned, ok := t.azureFor(resourceGroup, vmScaleSet).orphanedOps.get(resourceGroup, vmScaleSet); ok {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "orphaned_operation")] = orphaned.id
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "orphaned_operation_at")] = orphaned.at.UTC().Format(time.RFC3339)
+		}
+		if conflictAction != autoscaleConflictIgnore && statuses[idx].vmss.ID != nil {
+			setting, err := t.autoscaleConflict(context.Background(), resourceGroup, vmScaleSet, *statuses[idx].vmss.ID, t.logger)
+			if err != nil {
+				t.logger.Warn("failed to check for Azure autoscale settings", "vmss_name", vmScaleSet, "error", err)
+			} else if setting != "" {
+				meta[vmssMetaKey(resourceGroup, vmScaleSet, "azure_autoscale_setting")] = setting
+			}
+		}
+		t.annotateAKSManaged(context.Background(), resourceGroup, vmScaleSet, statuses[idx].vmss, aksAction, meta)
+		if reportErrors {
+			annotateProvisioningErrors(resourceGroup, vmScaleSet, statuses[idx], meta)
+		}
+		if capacityUnit == capacityUnitVCPU {
+			vcpus, instances, _, err := t.azureFor(resourceGroup, vmScaleSet).setVCPUs(context.Background(), resourceGroup, vmScaleSet, statuses[idx].vmss)
+			if err != nil {
+				return nil, err
+			}
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "instances")] = strconv.FormatInt(instances, 10)
+			resp.Count = vcpus
+		}
+		metrics.SetGaugeWithLabels([]string{"vmss", "capacity"}, float32(resp.Count), vmssLabels(resourceGroup, vmScaleSet))
 		totalCapacity = totalCapacity + resp.Count
+		if filters != nil {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "capacity")] = strconv.FormatInt(resp.Count, 10)
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "nodes")] = strconv.Itoa(countSetNodes(vmScaleSet, filters[idx], nodes))
+		}
 		if ready && !resp.Ready {
 			ready = false
 		}
@@ -216,10 +1634,59 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 				latestTime = currentTime
 			}
 		}
+		// The instance view only moves on once Azure has finished, a scale
+		// of the plugin counts from when it was made.
+		if lastScale := t.cooldowns.annotate(resourceGroup, vmScaleSet, meta); lastScale > latestTime {
+			latestTime = lastScale
+		}
+	}
+
+	if failed > 0 && failed+len(missing) == len(vmScaleSetList) {
+		return nil, fmt.Errorf("failed to query all %d scale sets: %v", failed, failedErr)
+	}
+	if failed > 0 {
+		meta[metaKeyDegraded] = strconv.Itoa(failed)
+	}
+	if len(missing) > 0 {
+		t.logger.Warn("target lists scale sets that do not exist", "target", targetKey(config), "vmss", missing)
+		meta[metaKeyMisconfigured] = "scale sets not found: " + strings.Join(missing, ", ")
+		if len(missing) == len(vmScaleSetList) {
+			// Skipping every set leaves nothing to scale.
+			ready = false
+		}
 	}
 
-	meta := make(map[string]string)
 	meta[sdk.TargetStatusMetaKeyLastEvent] = strconv.FormatInt(latestTime, 10)
+	annotateInstanceStates(instanceStates, meta)
+	if spotSets > 0 {
+		meta[metaKeySpotEvictionRate] = formatEvictionRate(spotEvictions, spotCapacity)
+	}
+	if keys, err := t.targetVMSSKeys(config); err == nil {
+		if holder := t.scaleLocks.holder(keys); holder != "" {
+			meta[metaKeyOperationInProgress] = holder
+			if async {
+				ready = false
+			}
+		}
+	}
+	t.orphans.annotate(targetKey(config), meta)
+	t.history.annotate(targetKey(config), meta)
+	t.deferrals.annotate(targetKey(config), meta)
+	t.canaries.annotate(targetKey(config), meta)
+	t.annotateStandbyPools(context.Background(), members, meta, t.logger)
+	if budget, err := parseCapacityBudget(config); err == nil && budget != nil {
+		// A partial count would understate the instance hours used.
+		if failed == 0 {
+			t.budgets.observe(targetKey(config), totalCapacity, time.Now())
+		}
+		t.budgets.annotate(targetKey(config), budget, meta)
+	}
+	if freeze, err := parseScaleInFreeze(config); err == nil {
+		if window, frozen := freeze.active(time.Now()); frozen {
+			meta[metaKeyScaleInFrozen] = window
+		}
+	}
+	annotateVersion(meta)
 	resp := sdk.TargetStatus{
 		Ready: ready,
 		Count: totalCapacity,
@@ -228,6 +1695,52 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 	return &resp, nil
 }
 
+// azureFor returns the Azure controller for the subscription a scale set was
+// listed under.
+func (t *TargetPlugin) azureFor(resourceGroup, vmScaleSet string) *AzureController {
+	return t.AzureController.forSubscription(t.targets.subscription(resourceGroup, vmScaleSet))
+}
+
+// parseVMSSList returns the resource groups and names of the member scale
+// sets of a target as parallel lists.
+func (t *TargetPlugin) parseVMSSList(config map[string]string) ([]string, []string, error) {
+	targets, err := t.scaleSetTargets(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	resourceGroupList, vmScaleSetList := splitScaleSetTargets(targets)
+	return resourceGroupList, vmScaleSetList, nil
+}
+
+func splitScaleSetTargets(targets []scaleSetTarget) ([]string, []string) {
+	resourceGroupList := make([]string, len(targets))
+	vmScaleSetList := make([]string, len(targets))
+	for idx, target := range targets {
+		resourceGroupList[idx] = target.resourceGroup
+		vmScaleSetList[idx] = target.vmScaleSet
+	}
+	return resourceGroupList, vmScaleSetList
+}
+
+// targetVMSSKeys returns the scale set keys of every member of a target.
+func (t *TargetPlugin) targetVMSSKeys(config map[string]string) ([]string, error) {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(vmScaleSetList))
+	for idx, vmScaleSet := range vmScaleSetList {
+		keys[idx] = vmssKey(resourceGroupList[idx], vmScaleSet)
+	}
+	return keys, nil
+}
+
+// vmssMetaKey returns the Status meta key of a scale set, under its alias if
+// it has one.
+func vmssMetaKey(resourceGroup, vmScaleSet, name string) string {
+	return metaKeyPrefix + setAliases.display(resourceGroup, vmScaleSet) + "." + name
+}
+
 func argsOrEnv(args map[string]string, key, env string) string {
 	if value, ok := args[key]; ok {
 		return value
@@ -259,17 +1772,30 @@ func calculateScaleDirection(vmssDesired, strategyDesired int64) (int64, string)
 	return 0, ""
 }
 
-func processInstanceView(instanceView compute.VirtualMachineScaleSetInstanceView, status *sdk.TargetStatus) {
+// processInstanceView derives readiness and the last event time of a scale
+// set. When the instance listing is supplied readiness is evaluated per
+// instance, which allows young instances to be granted a warm-up window;
+// otherwise the instance view status summary is used.
+func processInstanceView(instanceView compute.VirtualMachineScaleSetInstanceView, instances []vmssInstance, readiness *readinessConfig, status *sdk.TargetStatus) {
 
-	for _, instanceStatus := range *instanceView.VirtualMachine.StatusesSummary {
-		if *instanceStatus.Code != "ProvisioningState/succeeded" {
+	if instances != nil {
+		if !readiness.instanceListReady(instances) {
+			status.Ready = false
+		}
+	} else if instanceView.VirtualMachine != nil && instanceView.VirtualMachine.StatusesSummary != nil {
+		if !readiness.instancesReady(*instanceView.VirtualMachine.StatusesSummary) {
 			status.Ready = false
 		}
 	}
 
+	// Azure leaves the statuses out of the instance view of a set it has
+	// nothing to report for.
+	if instanceView.Statuses == nil {
+		return
+	}
 	latestTime := int64(math.MinInt64)
 	for _, instanceStatus := range *instanceView.Statuses {
-		if *instanceStatus.Code != "ProvisioningState/succeeded" {
+		if instanceStatus.Code != nil && readiness.scaleSetBlocks(*instanceStatus.Code) {
 			status.Ready = false
 		}
 
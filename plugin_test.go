@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+// newFakePlugin returns a plugin whose scale sets are the fake ones and
+// whose Nomad cluster is the fake one.
+func newFakePlugin(t *testing.T, nomad *fakeNomad) *TargetPlugin {
+	return newFakePluginWithConfig(t, nomad, nil)
+}
+
+// newFakePluginWithConfig is newFakePlugin with extra plugin config.
+func newFakePluginWithConfig(t *testing.T, nomad *fakeNomad, extra map[string]string) *TargetPlugin {
+	server := httptest.NewServer(nomad)
+	t.Cleanup(server.Close)
+
+	config := map[string]string{
+		configKeySimulate:                    "true",
+		configKeySimulateProvisioningLatency: "0s",
+		"nomad_address":                      server.URL,
+	}
+	for key, value := range extra {
+		config[key] = value
+	}
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	if err := plugin.SetConfig(config); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	t.Cleanup(plugin.shutdown)
+	return plugin
+}
+
+func checkCapacities(t *testing.T, client scaleSetClient, resourceGroup string, want map[string]int64) {
+	t.Helper()
+	for vmScaleSet, capacity := range want {
+		got, err := client.getCapacity(context.Background(), resourceGroup, vmScaleSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != capacity {
+			t.Errorf("%s has capacity %d, want %d", vmScaleSet, got, capacity)
+		}
+	}
+}
+
+func TestScaleWithFakeScaleSets(t *testing.T) {
+	cases := []struct {
+		name        string
+		initial     map[string]int64
+		action      sdk.ScalingAction
+		targets     string
+		want        map[string]int64
+		wantDrained []string
+	}{
+		{
+			name:    "scale out evenly",
+			initial: map[string]int64{"a": 1, "b": 1},
+			action:  sdk.ScalingAction{Count: 6, Direction: sdk.ScaleDirectionUp},
+			want:    map[string]int64{"a": 3, "b": 3},
+		},
+		{
+			name:    "scale out by weight",
+			initial: map[string]int64{"a": 1, "b": 1},
+			action:  sdk.ScalingAction{Count: 8, Direction: sdk.ScaleDirectionUp},
+			targets: `[{"resource_group":"rg","vmss":"a","weight":3},{"resource_group":"rg","vmss":"b"}]`,
+			want:    map[string]int64{"a": 6, "b": 2},
+		},
+		{
+			name:        "scale in selects across sets",
+			initial:     map[string]int64{"a": 3, "b": 1},
+			action:      sdk.ScalingAction{Count: 2, Direction: sdk.ScaleDirectionDown},
+			want:        map[string]int64{"a": 2, "b": 0},
+			wantDrained: []string{"node-a-2", "node-b-0"},
+		},
+		{
+			name:        "scale in by placement",
+			initial:     map[string]int64{"a": 3, "b": 1},
+			action:      sdk.ScalingAction{Count: 2, Direction: sdk.ScaleDirectionDown},
+			targets:     `[{"resource_group":"rg","vmss":"a"},{"resource_group":"rg","vmss":"b","min":1}]`,
+			want:        map[string]int64{"a": 1, "b": 1},
+			wantDrained: []string{"node-a-1", "node-a-2"},
+		},
+		{
+			name:        "scale in keeps min",
+			initial:     map[string]int64{"a": 2, "b": 2},
+			action:      sdk.ScalingAction{Count: 1, Direction: sdk.ScaleDirectionDown},
+			targets:     `[{"resource_group":"rg","vmss":"a","min":1},{"resource_group":"rg","vmss":"b"}]`,
+			want:        map[string]int64{"a": 1, "b": 0},
+			wantDrained: []string{"node-a-1", "node-b-0", "node-b-1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := newFakeScaleSets(t)
+			for vmScaleSet, capacity := range c.initial {
+				fake.add("rg", vmScaleSet, capacity)
+			}
+			nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a", "b"))
+			plugin := newFakePlugin(t, nomad)
+
+			target := map[string]string{
+				configKeyTargets:         "rg/a,rg/b",
+				"node_class":             "fake",
+				"node_selector_strategy": "newest_create_index",
+			}
+			if c.targets != "" {
+				target[configKeyTargets] = c.targets
+			}
+			if err := plugin.Scale(c.action, target); err != nil {
+				t.Fatalf("Scale failed: %v", err)
+			}
+			checkCapacities(t, fake, "rg", c.want)
+			status, err := plugin.Status(target)
+			if err != nil {
+				t.Fatalf("Status failed: %v", err)
+			}
+			if want := c.want["a"] + c.want["b"]; status.Count != want {
+				t.Errorf("Status counted %d instances, want %d", status.Count, want)
+			}
+			if got := nomad.drainedNodes(); !equalStrings(got, c.wantDrained) {
+				t.Errorf("drained %v, want %v", got, c.wantDrained)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScaleRejectsSameNameInTwoResourceGroups(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 1)
+	fake.add("other", "a", 1)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	plugin := newFakePlugin(t, nomad)
+
+	for _, targets := range []string{
+		"rg/a,other/a",
+		`[{"resource_group":"rg","vmss":"a"},{"resource_group":"other","vmss":"A"}]`,
+	} {
+		target := map[string]string{configKeyTargets: targets, "node_class": "fake"}
+		err := plugin.Scale(sdk.ScalingAction{Count: 4, Direction: sdk.ScaleDirectionUp}, target)
+		if err == nil || !strings.Contains(err.Error(), "distinct names") {
+			t.Errorf("%s: got %v, want the duplicate name rejected", targets, err)
+		}
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 1})
+	checkCapacities(t, fake, "other", map[string]int64{"a": 1})
+}
+
+func TestScaleInKeepsFailedDeletesCheckpointed(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 2)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	failing := newFakePluginWithConfig(t, nomad, map[string]string{configKeyAzureFaultInjection: faultDeleteError + "=1"})
+	failing.AzureController.vmss.RetryDuration = time.Millisecond
+
+	target := map[string]string{
+		configKeyTargets:         "rg/a",
+		"node_class":             "fake",
+		"node_selector_strategy": "newest_create_index",
+	}
+	if err := failing.Scale(sdk.ScalingAction{Count: 1, Direction: sdk.ScaleDirectionDown}, target); err == nil {
+		t.Fatal("got no error with every delete failing")
+	}
+	pending := failing.operations.pendingCleanups(targetKey(target))
+	if len(pending) != 1 || len(pending[0].Sets) != 1 || !equalStrings(pending[0].Sets[0].InstanceIDs, []string{"1"}) {
+		t.Fatalf("got pending cleanups %+v, want the failed delete of instance 1", pending)
+	}
+
+	// The next evaluation, here of a plugin whose deletes succeed, deletes
+	// the drained instance and drops the checkpoint.
+	plugin := newFakePlugin(t, nomad)
+	plugin.checkpoint(pending[0], plugin.logger)
+	plugin.resumeCleanups(targetKey(target))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(plugin.operations.pendingCleanups(targetKey(target))) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending cleanup was not completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkCapacities(t, fake, "rg", map[string]int64{"a": 1})
+}
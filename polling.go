@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errPollingBudgetExhausted is returned by pollFuture once the operation
+// has been polled as often as the polling budget allows.
+var errPollingBudgetExhausted = errors.New("polling budget exhausted")
+
+func parsePollingBudget(config map[string]string) (int, error) {
+	value, ok := config[configKeyPollingBudget]
+	if !ok {
+		return 0, nil
+	}
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 1 {
+		return 0, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyPollingBudget, value)
+	}
+	return budget, nil
+}
+
+// retryAfter returns the delay the Retry-After header of resp asks for, in
+// seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get(autorest.HeaderRetryAfter))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// pollFuture waits for a long running operation like WaitForCompletionRef,
+// but a status poll Azure throttles waits for as long as its Retry-After asks
+// and does not count as a failed poll, rather than being retried on the
+// client backoff until the retries run out. With a polling budget set, it
+// gives up once the operation was polled that often.
+func (ac *AzureController) pollFuture(ctx context.Context, future azure.FutureAPI, client autorest.Client) error {
+	if _, ok := ctx.Deadline(); !ok && client.PollingDuration != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.PollingDuration)
+		defer cancel()
+	}
+	if delay, ok := retryAfter(future.Response()); ok {
+		if !autorest.DelayForBackoff(delay, 0, ctx.Done()) {
+			return ctx.Err()
+		}
+	}
+
+	var failures, throttles int
+	for polls := 1; ; polls++ {
+		done, err := future.DoneWithContext(ctx, client)
+		if done {
+			return err
+		}
+		if ac.pollingBudget > 0 && polls >= ac.pollingBudget {
+			return errPollingBudgetExhausted
+		}
+
+		var delay time.Duration
+		var attempt int
+		resp := future.Response()
+		switch {
+		case err != nil && resp != nil && resp.StatusCode == http.StatusTooManyRequests:
+			var ok bool
+			if delay, ok = retryAfter(resp); !ok {
+				delay, attempt = client.RetryDuration, throttles
+			}
+			throttles++
+		case err != nil:
+			if failures >= client.RetryAttempts {
+				return autorest.NewErrorWithError(err, "Future", "WaitForCompletion", resp, "the number of retries has been exceeded")
+			}
+			delay, attempt = client.RetryDuration, failures
+			failures++
+		default:
+			var ok bool
+			if delay, ok = retryAfter(resp); !ok {
+				delay = client.PollingDelay
+			}
+		}
+		if !autorest.DelayForBackoff(delay, attempt, ctx.Done()) {
+			return autorest.NewErrorWithError(ctx.Err(), "Future", "WaitForCompletion", resp, "context has been cancelled")
+		}
+	}
+}
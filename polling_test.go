@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const testPollingURL = "http://fake/subscriptions/s/providers/Microsoft.Compute/locations/westeurope/operations/abc-123"
+
+// fakePoll is one response of the fake operation status endpoint.
+type fakePoll struct {
+	status     int
+	state      string
+	retryAfter string
+}
+
+// fakePoller serves the status polls of a long running operation from a
+// script, recording when each poll was made.
+type fakePoller struct {
+	lock  sync.Mutex
+	polls []fakePoll
+	at    []time.Time
+}
+
+func (p *fakePoller) Do(r *http.Request) (*http.Response, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.at = append(p.at, time.Now())
+
+	poll := fakePoll{status: http.StatusOK, state: "InProgress"}
+	if n := len(p.at) - 1; n < len(p.polls) {
+		poll = p.polls[n]
+	}
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if poll.retryAfter != "" {
+		header.Set(autorest.HeaderRetryAfter, poll.retryAfter)
+	}
+	body := `{"status":"` + poll.state + `"}`
+	if poll.status == http.StatusTooManyRequests {
+		body = `{"error":{"code":"TooManyRequests","message":"throttled"}}`
+	}
+	if r.URL.String() != testPollingURL {
+		// the final GET of the resource once the operation succeeded
+		body = `{}`
+	}
+	return &http.Response{
+		StatusCode:    poll.status,
+		Status:        http.StatusText(poll.status),
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
+
+func (p *fakePoller) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.at)
+}
+
+// newFakeFuture returns the future of a PATCH Azure accepted, and a client
+// polling it against poller.
+func newFakeFuture(t *testing.T, poller *fakePoller, retryAfter string) (azure.FutureAPI, autorest.Client) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, "http://fake/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Azure-Asyncoperation": []string{testPollingURL}}
+	if retryAfter != "" {
+		header.Set(autorest.HeaderRetryAfter, retryAfter)
+	}
+	future, err := azure.NewFutureFromResponse(&http.Response{
+		StatusCode: http.StatusAccepted,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := autorest.NewClientWithUserAgent("test")
+	client.Sender = poller
+	client.PollingDelay = 10 * time.Millisecond
+	client.RetryDuration = 10 * time.Millisecond
+	client.RetryAttempts = 2
+	return &future, client
+}
+
+func TestPollFutureHonorsRetryAfter(t *testing.T) {
+	poller := &fakePoller{polls: []fakePoll{
+		{status: http.StatusTooManyRequests, retryAfter: "1"},
+		{status: http.StatusOK, state: "Succeeded"},
+		{status: http.StatusOK},
+	}}
+	future, client := newFakeFuture(t, poller, "")
+
+	ac := &AzureController{}
+	if err := ac.pollFuture(context.Background(), future, client); err != nil {
+		t.Fatalf("pollFuture: %v", err)
+	}
+	if len(poller.at) < 2 {
+		t.Fatalf("got %d polls, want at least 2", len(poller.at))
+	}
+	if waited := poller.at[1].Sub(poller.at[0]); waited < time.Second {
+		t.Errorf("polled again after %s, want the 1s Retry-After honored", waited)
+	}
+}
+
+func TestPollFutureThrottlesAreNotFailures(t *testing.T) {
+	// More throttled polls than the client retries, none of which may
+	// count against them.
+	var polls []fakePoll
+	for i := 0; i < 5; i++ {
+		polls = append(polls, fakePoll{status: http.StatusTooManyRequests, retryAfter: "0"})
+	}
+	poller := &fakePoller{polls: append(polls, fakePoll{status: http.StatusOK, state: "Succeeded"})}
+	future, client := newFakeFuture(t, poller, "0")
+
+	ac := &AzureController{}
+	if err := ac.pollFuture(context.Background(), future, client); err != nil {
+		t.Fatalf("pollFuture: %v", err)
+	}
+}
+
+func TestPollFutureBudget(t *testing.T) {
+	poller := &fakePoller{polls: []fakePoll{
+		{status: http.StatusTooManyRequests, retryAfter: "0"},
+		{status: http.StatusOK},
+		{status: http.StatusOK},
+		{status: http.StatusOK, state: "Succeeded"},
+	}}
+	future, client := newFakeFuture(t, poller, "")
+
+	ac := &AzureController{pollingBudget: 3}
+	err := ac.pollFuture(context.Background(), future, client)
+	if !errors.Is(err, errPollingBudgetExhausted) {
+		t.Fatalf("got %v, want the polling budget exhausted", err)
+	}
+	if n := poller.count(); n != 3 {
+		t.Errorf("got %d polls, want the budget of 3", n)
+	}
+}
+
+func TestWaitForCompletionOrphansOnBudget(t *testing.T) {
+	poller := &fakePoller{}
+	future, client := newFakeFuture(t, poller, "")
+
+	ac := &AzureController{pollingBudget: 2, orphanedOps: newOrphanedOperations()}
+	err := ac.waitForCompletion(context.Background(), "rg", "vmss", future, client, "cannot scale")
+	var azErr *azureError
+	if !errors.As(err, &azErr) || azErr.kind != azureErrorTransient {
+		t.Fatalf("got %v, want a transient azure error", err)
+	}
+	op, ok := ac.orphanedOps.get("rg", "vmss")
+	if !ok || op.id != "abc-123" {
+		t.Errorf("got orphaned operation %+v, want abc-123", op)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"7", 7 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, c := range cases {
+		resp := &http.Response{Header: http.Header{}}
+		if c.value != "" {
+			resp.Header.Set(autorest.HeaderRetryAfter, c.value)
+		}
+		got, ok := retryAfter(resp)
+		if got != c.want || ok != c.ok {
+			t.Errorf("retryAfter(%q) = %s, %t, want %s, %t", c.value, got, ok, c.want, c.ok)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagPrewarmed marks instances created ahead of predicted demand, with the
+// time they were protected from scale in. On the scale set it holds how
+// many instances are pre-warmed, so sets without any are not listed.
+const tagPrewarmed = "nomad-autoscaler:prewarmed"
+
+const (
+	actionMetaPrewarm = "prewarm"
+
+	defaultPrewarmMaxAge   = time.Hour
+	prewarmReleaseInterval = time.Minute
+)
+
+// parsePrewarmHint returns how many of the instances a scale out adds are
+// pre-warmed: the action meta hint is either a count or a boolean, true
+// pre-warming all of them. A negative count stands for all.
+func parsePrewarmHint(action sdk.ScalingAction) (int64, error) {
+	raw, ok := action.Meta[actionMetaPrewarm]
+	if !ok {
+		return 0, nil
+	}
+	value := strings.TrimSpace(fmt.Sprint(raw))
+	if count, err := strconv.ParseInt(value, 10, 64); err == nil && count >= 0 {
+		return count, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s action meta %q, must be a boolean or a count", actionMetaPrewarm, value)
+	}
+	if enabled {
+		return -1, nil
+	}
+	return 0, nil
+}
+
+func parsePrewarmMaxAge(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyPrewarmMaxAge]
+	if !ok {
+		return defaultPrewarmMaxAge, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyPrewarmMaxAge, value)
+	}
+	return age, nil
+}
+
+// prewarmedCount returns the pre-warmed instances the scale set tags count.
+func prewarmedCount(tags map[string]*string) int64 {
+	for key, value := range tags {
+		if !strings.EqualFold(key, tagPrewarmed) || value == nil {
+			continue
+		}
+		count, _ := strconv.ParseInt(strings.TrimSpace(*value), 10, 64)
+		return count
+	}
+	return 0
+}
+
+// listPrewarmedInstances returns the pre-warmed instances of the scale set and
+// when each was protected.
+func (ac *AzureController) listPrewarmedInstances(ctx context.Context, resourceGroup string, vmScaleSet string) (map[string]time.Time, error) {
+	tags, err := ac.listInstanceTags(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return nil, err
+	}
+	prewarmed := make(map[string]time.Time)
+	for instanceID, instanceTags := range tags {
+		for key, value := range instanceTags {
+			if strings.EqualFold(key, tagPrewarmed) {
+				since, _ := time.Parse(time.RFC3339, value)
+				prewarmed[instanceID] = since
+			}
+		}
+	}
+	return prewarmed, nil
+}
+
+// prewarmRemoteIDs returns the remote IDs of the pre-warmed instances of a
+// set, which scale in leaves alone. Sets whose tags count none are not
+// listed.
+func (t *TargetPlugin) prewarmRemoteIDs(ctx context.Context, set *setSnapshot) (map[string]bool, error) {
+	if prewarmedCount(set.vmss.Tags) == 0 {
+		return nil, nil
+	}
+	prewarmed, err := t.azureFor(set.resourceGroup, set.vmScaleSet).listPrewarmedInstances(ctx, set.resourceGroup, set.vmScaleSet)
+	if err != nil {
+		return nil, err
+	}
+	remoteIDs := make(map[string]bool, len(prewarmed))
+	for instanceID := range prewarmed {
+		remoteIDs[fmt.Sprintf("%s_%s", set.vmScaleSet, instanceID)] = true
+	}
+	return remoteIDs, nil
+}
+
+// withoutRemoteIDs returns the remote IDs not in excluded.
+func withoutRemoteIDs(remoteIDs []string, excluded map[string]bool) []string {
+	if len(excluded) == 0 {
+		return remoteIDs
+	}
+	kept := make([]string, 0, len(remoteIDs))
+	for _, remoteID := range remoteIDs {
+		if !excluded[remoteID] {
+			kept = append(kept, remoteID)
+		}
+	}
+	return kept
+}
+
+// prewarmInstances protects up to count of the instances created since
+// before from scale in, a negative count protecting all of them. It returns
+// how many were protected.
+func (t *TargetPlugin) prewarmInstances(ctx context.Context, resourceGroup, vmScaleSet string, before map[string]map[string]string, count int64, log hclog.Logger) int64 {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	after, err := azure.listInstanceTags(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to list instances to pre-warm", "vmss_name", vmScaleSet, "error", err)
+		return 0
+	}
+	var created []string
+	for instanceID := range after {
+		if _, ok := before[instanceID]; !ok {
+			created = append(created, instanceID)
+		}
+	}
+	sort.Strings(created)
+
+	var protected int64
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, instanceID := range created {
+		if count >= 0 && protected >= count {
+			break
+		}
+		if err := azure.setScaleInProtection(ctx, resourceGroup, vmScaleSet, instanceID, true, map[string]string{tagPrewarmed: now}); err != nil {
+			log.Warn("failed to protect pre-warmed instance", "vmss_name", vmScaleSet, "instance_id", instanceID, "error", err)
+			continue
+		}
+		protected++
+	}
+	if protected > 0 {
+		log.Info("pre-warmed instances ahead of demand", "vmss_name", vmScaleSet, "count", protected)
+		t.updatePrewarmedCount(ctx, resourceGroup, vmScaleSet, log)
+	}
+	return protected
+}
+
+// releasePrewarmed lifts the scale in protection of the pre-warmed instances,
+// all of them when instanceIDs is nil.
+func (t *TargetPlugin) releasePrewarmed(ctx context.Context, resourceGroup, vmScaleSet string, instanceIDs []string, reason string, log hclog.Logger) {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	if instanceIDs == nil {
+		prewarmed, err := azure.listPrewarmedInstances(ctx, resourceGroup, vmScaleSet)
+		if err != nil {
+			log.Warn("failed to list pre-warmed instances", "vmss_name", vmScaleSet, "error", err)
+			return
+		}
+		for instanceID := range prewarmed {
+			instanceIDs = append(instanceIDs, instanceID)
+		}
+	}
+	for _, instanceID := range instanceIDs {
+		if err := azure.setScaleInProtection(ctx, resourceGroup, vmScaleSet, instanceID, false, map[string]string{tagPrewarmed: ""}); err != nil {
+			log.Warn("failed to release pre-warmed instance", "vmss_name", vmScaleSet, "instance_id", instanceID, "error", err)
+		}
+	}
+	log.Info("released pre-warmed instances", "vmss_name", vmScaleSet, "count", len(instanceIDs), "reason", reason)
+	t.updatePrewarmedCount(ctx, resourceGroup, vmScaleSet, log)
+}
+
+func (t *TargetPlugin) updatePrewarmedCount(ctx context.Context, resourceGroup, vmScaleSet string, log hclog.Logger) {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	prewarmed, err := azure.listPrewarmedInstances(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to count pre-warmed instances", "vmss_name", vmScaleSet, "error", err)
+		return
+	}
+	if err := azure.tagScaleSet(ctx, resourceGroup, vmScaleSet, map[string]string{tagPrewarmed: strconv.Itoa(len(prewarmed))}); err != nil {
+		log.Warn("failed to tag pre-warmed count", "vmss_name", vmScaleSet, "error", err)
+	}
+}
+
+// runPrewarmReleaser periodically releases the pre-warmed instances real
+// demand has arrived on, or that outlived the maximum age.
+func (t *TargetPlugin) runPrewarmReleaser(ctx context.Context) {
+	log := t.logger.With("task", "prewarm")
+	ticker := time.NewTicker(prewarmReleaseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.releaseDemandedPrewarm(ctx, config, log); err != nil {
+					log.Warn("failed to release pre-warmed instances", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+// releaseDemandedPrewarm releases the pre-warmed instances of a target whose
+// Nomad node runs allocations other than system jobs, or which were protected
+// longer than the maximum age ago.
+func (t *TargetPlugin) releaseDemandedPrewarm(ctx context.Context, config map[string]string, log hclog.Logger) error {
+	maxAge, err := parsePrewarmMaxAge(config)
+	if err != nil {
+		return err
+	}
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+	snapshot, err := t.takeScaleSnapshot(ctx, members)
+	if err != nil {
+		return err
+	}
+
+	var nodes map[string]*api.Node
+	var client *api.Client
+	for _, set := range snapshot.sets {
+		if prewarmedCount(set.vmss.Tags) == 0 {
+			continue
+		}
+		prewarmed, err := t.azureFor(set.resourceGroup, set.vmScaleSet).listPrewarmedInstances(ctx, set.resourceGroup, set.vmScaleSet)
+		if err != nil {
+			return err
+		}
+		if nodes == nil {
+			cluster, err := t.clusterFor(config)
+			if err != nil {
+				return err
+			}
+			client = cluster.client
+			if nodes, err = t.registeredNodes(client); err != nil {
+				return err
+			}
+		}
+
+		var demanded, expired []string
+		for instanceID, since := range prewarmed {
+			if time.Since(since) > maxAge {
+				expired = append(expired, instanceID)
+				continue
+			}
+			node := nodes[strings.ToLower(fmt.Sprintf("%s_%s", set.vmScaleSet, instanceID))]
+			if node != nil && runsWorkload(client, node.ID) {
+				demanded = append(demanded, instanceID)
+			}
+		}
+		if len(demanded) > 0 {
+			t.releasePrewarmed(ctx, set.resourceGroup, set.vmScaleSet, demanded, "demand arrived", log)
+		}
+		if len(expired) > 0 {
+			t.releasePrewarmed(ctx, set.resourceGroup, set.vmScaleSet, expired, "maximum age reached", log)
+		}
+	}
+	return nil
+}
+
+// runsWorkload reports whether the node runs an allocation of a job other than
+// a system job, which every node runs regardless of demand.
+func runsWorkload(client *api.Client, nodeID string) bool {
+	allocs, _, err := client.Nodes().Allocations(nodeID, nil)
+	if err != nil {
+		return false
+	}
+	for _, alloc := range allocs {
+		if alloc.ClientStatus != api.AllocClientStatusRunning || alloc.Job == nil || alloc.Job.Type == nil {
+			continue
+		}
+		if *alloc.Job.Type != api.JobTypeSystem && *alloc.Job.Type != "sysbatch" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+)
+
+// protectedJob is a job, or with job "*" every job of a namespace, whose
+// allocations keep their node from being selected for scale in. An empty
+// namespace matches the job in any namespace.
+type protectedJob struct {
+	namespace string
+	job       string
+}
+
+func (j protectedJob) String() string {
+	if j.namespace == "" {
+		return j.job
+	}
+	return j.namespace + "/" + j.job
+}
+
+// parseProtectedJobs reads the comma separated [namespace/]job entries of
+// the jobs whose nodes are not scaled in.
+func parseProtectedJobs(config map[string]string) ([]protectedJob, error) {
+	value, ok := config[configKeyScaleInProtectedJobs]
+	if !ok {
+		return nil, nil
+	}
+	entries, err := splitList(config, configKeyScaleInProtectedJobs, value)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []protectedJob
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var job protectedJob
+		if namespace, id, ok := strings.Cut(entry, "/"); ok {
+			job = protectedJob{namespace: strings.TrimSpace(namespace), job: strings.TrimSpace(id)}
+			if job.namespace == "" {
+				return nil, fmt.Errorf("invalid %s entry %q, the namespace is empty", configKeyScaleInProtectedJobs, entry)
+			}
+		} else {
+			job = protectedJob{job: entry}
+		}
+		if job.job == "" || (job.job == "*" && job.namespace == "") {
+			return nil, fmt.Errorf("invalid %s entry %q, must be [namespace/]job or namespace/*", configKeyScaleInProtectedJobs, entry)
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("invalid %s %q, lists no job", configKeyScaleInProtectedJobs, value)
+	}
+	return jobs, nil
+}
+
+// queries returns the allocation list queries of the job. A job without a
+// namespace is looked up in namespaces, or in all of them if none are given.
+func (j protectedJob) queries(namespaces []string) []*api.QueryOptions {
+	if j.namespace != "" {
+		namespaces = []string{j.namespace}
+	} else if len(namespaces) == 0 {
+		namespaces = []string{allNamespaces}
+	}
+	queries := make([]*api.QueryOptions, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		q := &api.QueryOptions{Namespace: namespace}
+		if j.job != "*" {
+			q.Filter = "JobID == " + strconv.Quote(j.job)
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// protectedNodes returns the IDs of the nodes running, or about to run, an
+// allocation of a protected job, each with the first such job found.
+func protectedNodes(client *api.Client, jobs []protectedJob, namespaces []string) (map[string]string, error) {
+	nodes := make(map[string]string)
+	for _, job := range jobs {
+		for _, q := range job.queries(namespaces) {
+			allocs, _, err := client.Allocations().List(q)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list the allocations of protected job %s: %v", job, err)
+			}
+			for _, alloc := range allocs {
+				if !activeAlloc(alloc) {
+					continue
+				}
+				if _, ok := nodes[alloc.NodeID]; !ok {
+					nodes[alloc.NodeID] = alloc.Namespace + "/" + alloc.JobID
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// withoutProtectedNodes drops the remote IDs whose node runs a protected job.
+// It returns the remote IDs kept and those dropped.
+func withoutProtectedNodes(remoteIDs []string, protected map[string]string, nodes map[string]*api.Node) ([]string, []string) {
+	if len(protected) == 0 {
+		return remoteIDs, nil
+	}
+	kept := make([]string, 0, len(remoteIDs))
+	var dropped []string
+	for _, remoteID := range remoteIDs {
+		if node := nodes[strings.ToLower(remoteID)]; node != nil {
+			if _, ok := protected[node.ID]; ok {
+				dropped = append(dropped, remoteID)
+				continue
+			}
+		}
+		kept = append(kept, remoteID)
+	}
+	return kept, dropped
+}
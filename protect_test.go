@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestParseProtectedJobs(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    []protectedJob
+		wantErr bool
+	}{
+		{value: "db", want: []protectedJob{{job: "db"}}},
+		{value: "data/db, infra/*", want: []protectedJob{{namespace: "data", job: "db"}, {namespace: "infra", job: "*"}}},
+		{value: "*", wantErr: true},
+		{value: "/db", wantErr: true},
+		{value: "data/", wantErr: true},
+		{value: ",", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseProtectedJobs(map[string]string{configKeyScaleInProtectedJobs: c.value})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v, want error %t", c.value, err, c.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestProtectedJobQueries(t *testing.T) {
+	cases := []struct {
+		job        protectedJob
+		namespaces []string
+		want       []string
+		filter     string
+	}{
+		{protectedJob{job: "db"}, nil, []string{"*"}, `JobID == "db"`},
+		{protectedJob{job: "db"}, []string{"a", "b"}, []string{"a", "b"}, `JobID == "db"`},
+		{protectedJob{namespace: "data", job: "db"}, []string{"a"}, []string{"data"}, `JobID == "db"`},
+		{protectedJob{namespace: "infra", job: "*"}, nil, []string{"infra"}, ""},
+	}
+	for _, c := range cases {
+		queries := c.job.queries(c.namespaces)
+		var namespaces []string
+		for _, q := range queries {
+			namespaces = append(namespaces, q.Namespace)
+			if q.Filter != c.filter {
+				t.Errorf("%s: got filter %q, want %q", c.job, q.Filter, c.filter)
+			}
+		}
+		if !reflect.DeepEqual(namespaces, c.want) {
+			t.Errorf("%s: got namespaces %v, want %v", c.job, namespaces, c.want)
+		}
+	}
+}
+
+func TestProtectedNodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/allocations" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*api.AllocationListStub{
+			{NodeID: "n1", Namespace: "data", JobID: "db", ClientStatus: api.AllocClientStatusRunning},
+			{NodeID: "n2", Namespace: "data", JobID: "db", ClientStatus: api.AllocClientStatusComplete},
+			{NodeID: "n3", Namespace: "data", JobID: "db", ClientStatus: api.AllocClientStatusPending},
+		})
+	}))
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protected, err := protectedNodes(client, []protectedJob{{namespace: "data", job: "db"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"n1": "data/db", "n3": "data/db"}; !reflect.DeepEqual(protected, want) {
+		t.Errorf("got %v, want %v", protected, want)
+	}
+
+	nodes := map[string]*api.Node{"vmss_1": {ID: "n1"}, "vmss_2": {ID: "n2"}}
+	kept, dropped := withoutProtectedNodes([]string{"vmss_1", "vmss_2", "vmss_3"}, protected, nodes)
+	if !reflect.DeepEqual(kept, []string{"vmss_2", "vmss_3"}) || !reflect.DeepEqual(dropped, []string{"vmss_1"}) {
+		t.Errorf("kept %v dropped %v", kept, dropped)
+	}
+}
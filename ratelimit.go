@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	metrics "github.com/armon/go-metrics"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// azureRateLimits throttles the plugin's own ARM requests so that many
+// policies evaluated at once stay below the subscription limits instead of
+// getting every caller throttled by ARM. Reads and writes are limited
+// separately, as ARM counts them separately. A nil limit lets every request
+// through.
+type azureRateLimits struct {
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+func parseAzureRateLimits(config map[string]string) (*azureRateLimits, error) {
+	burst := 0.0
+	if value, ok := config[configKeyAzureRateLimitBurst]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyAzureRateLimitBurst, value)
+		}
+		burst = float64(n)
+	}
+	reads, err := parseTokenBucket(config, configKeyAzureReadRateLimit, burst)
+	if err != nil {
+		return nil, err
+	}
+	writes, err := parseTokenBucket(config, configKeyAzureWriteRateLimit, burst)
+	if err != nil {
+		return nil, err
+	}
+	if reads == nil && writes == nil {
+		return nil, nil
+	}
+	return &azureRateLimits{reads: reads, writes: writes}, nil
+}
+
+// parseTokenBucket reads a limit in requests per second. Without an explicit
+// burst, one second worth of requests may be sent at once.
+func parseTokenBucket(config map[string]string, key string, burst float64) (*tokenBucket, error) {
+	value, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return nil, fmt.Errorf("invalid %s %q, must be a positive number of requests per second", key, value)
+	}
+	if burst == 0 {
+		burst = math.Max(1, math.Floor(rate))
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}, nil
+}
+
+func (l *azureRateLimits) wait(r *http.Request) error {
+	if l == nil {
+		return nil
+	}
+	bucket := l.writes
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		bucket = l.reads
+	}
+	return bucket.wait(r.Context())
+}
+
+// rateLimitSender holds each request until the limit allows it.
+func rateLimitSender(sender autorest.Sender, limits *azureRateLimits) autorest.Sender {
+	if limits == nil {
+		return sender
+	}
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if err := limits.wait(r); err != nil {
+			return nil, err
+		}
+		return sender.Do(r)
+	})
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token, blocking until one is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.lock.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.lock.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.lock.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// scaleWriteLimit caps the capacity updates and instance deletions of every
+// plugin instance of the process, which all share one subscription limit no
+// matter how many policies fire at once. Writes over the limit queue until
+// it allows them.
+type scaleWriteLimit struct {
+	lock   sync.Mutex
+	bucket *tokenBucket
+	queued int
+}
+
+var scaleWrites = &scaleWriteLimit{}
+
+// configure applies the limit of a plugin config. Configs without the key
+// leave the limit another instance set in place, the last one set applies.
+func (l *scaleWriteLimit) configure(config map[string]string) error {
+	value, ok := config[configKeyScaleWriteLimit]
+	if !ok {
+		return nil
+	}
+	perMinute, err := strconv.ParseFloat(value, 64)
+	if err != nil || perMinute < 0 || math.IsInf(perMinute, 0) {
+		return fmt.Errorf("invalid %s %q, must be a number of writes per minute", configKeyScaleWriteLimit, value)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if perMinute == 0 {
+		l.bucket = nil
+		return nil
+	}
+	rate := perMinute / 60
+	l.bucket = &tokenBucket{rate: rate, burst: 1, tokens: 1, last: time.Now()}
+	return nil
+}
+
+// wait holds a capacity update or instance deletion until the limit allows
+// it, or ctx is done.
+func (l *scaleWriteLimit) wait(ctx context.Context, op string) error {
+	l.lock.Lock()
+	bucket := l.bucket
+	if bucket == nil {
+		l.lock.Unlock()
+		return nil
+	}
+	l.queued++
+	metrics.SetGauge([]string{"azure", "scale_writes_queued"}, float32(l.queued))
+	l.lock.Unlock()
+
+	start := time.Now()
+	err := bucket.wait(ctx)
+	metrics.MeasureSinceWithLabels([]string{"azure", "scale_write_wait"}, start, []metrics.Label{{Name: "operation", Value: op}})
+
+	l.lock.Lock()
+	l.queued--
+	metrics.SetGauge([]string{"azure", "scale_writes_queued"}, float32(l.queued))
+	l.lock.Unlock()
+	return err
+}
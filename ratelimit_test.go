@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScaleWriteLimit(t *testing.T) {
+	limit := &scaleWriteLimit{}
+	if err := limit.configure(map[string]string{configKeyScaleWriteLimit: "600"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limit.wait(context.Background(), "set_capacity"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first write passes at once, the others queue 100ms apart.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("three writes at 600 per minute took %s, want at least 200ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limit.wait(ctx, "delete_instances"); err == nil {
+		t.Error("queued write went through with its context cancelled")
+	}
+
+	// A config without the key leaves the limit in place.
+	if err := limit.configure(map[string]string{}); err != nil || limit.bucket == nil {
+		t.Fatalf("limit cleared by a config without it: %v", err)
+	}
+	if err := limit.configure(map[string]string{configKeyScaleWriteLimit: "0"}); err != nil || limit.bucket != nil {
+		t.Fatalf("limit not disabled by zero: %v", err)
+	}
+	if err := limit.configure(map[string]string{configKeyScaleWriteLimit: "-1"}); err == nil {
+		t.Error("negative limit accepted")
+	}
+}
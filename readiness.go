@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const provisioningStateSucceeded = "ProvisioningState/succeeded"
+
+const (
+	// capacityModeSku reports the scale set Sku.Capacity, which includes
+	// deallocated and failed instances.
+	capacityModeSku = "sku"
+
+	// capacityModeRunning reports only the instances in the running power
+	// state, the capacity actually usable by Nomad.
+	capacityModeRunning = "running"
+
+	// capacityModeLive reports, and plans scales from, the instances Azure
+	// lists for the set, rather than the Sku.Capacity an operation in
+	// flight already raised to its target. The Sku.Capacity is only what
+	// the scale writes.
+	capacityModeLive = "live"
+)
+
+func parseCapacityMode(config map[string]string) (string, error) {
+	mode, ok := config[configKeyCapacityMode]
+	if !ok {
+		return capacityModeSku, nil
+	}
+	switch mode {
+	case capacityModeSku, capacityModeRunning, capacityModeLive:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be %q, %q or %q", configKeyCapacityMode, mode, capacityModeSku, capacityModeRunning, capacityModeLive)
+}
+
+// readinessConfig controls which instance states make a member scale set
+// report not-ready. The zero value matches the historic behaviour where any
+// instance not in the succeeded provisioning state blocks readiness.
+type readinessConfig struct {
+	blockingStates   map[string]struct{}
+	tolerance        float64
+	ignoreInstances  bool
+	tolerateUpgrades bool
+	upgrading        bool
+
+	// warmup is the window after an instance first appears during which
+	// it does not count against readiness. ages is only consulted when
+	// warmup is set.
+	warmup time.Duration
+	ages   *instanceAgeTracker
+}
+
+// upgradeStates are the transient states instances cycle through while a
+// rolling or automatic OS image upgrade replaces them.
+var upgradeStates = map[string]struct{}{
+	"provisioningstate/updating": {},
+	"provisioningstate/creating": {},
+	"provisioningstate/deleting": {},
+}
+
+func parseReadinessConfig(config map[string]string) (*readinessConfig, error) {
+	cfg := &readinessConfig{}
+
+	if value, ok := config[configKeyReadinessBlockingStates]; ok {
+		cfg.blockingStates = make(map[string]struct{})
+		for _, state := range strings.Split(value, ",") {
+			if state = strings.TrimSpace(state); state != "" {
+				cfg.blockingStates[strings.ToLower(state)] = struct{}{}
+			}
+		}
+	}
+	if value, ok := config[configKeyReadinessTolerance]; ok {
+		tolerance, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || tolerance < 0 || tolerance > 100 {
+			return nil, fmt.Errorf("invalid %s %q, must be a percentage between 0 and 100", configKeyReadinessTolerance, value)
+		}
+		cfg.tolerance = tolerance
+	}
+	if value, ok := config[configKeyReadinessTolerateUpgrades]; ok {
+		tolerate, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyReadinessTolerateUpgrades, value, err)
+		}
+		cfg.tolerateUpgrades = tolerate
+	}
+	if value, ok := config[configKeyReadinessWarmup]; ok {
+		warmup, err := time.ParseDuration(value)
+		if err != nil || warmup < 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a non-negative duration", configKeyReadinessWarmup, value)
+		}
+		cfg.warmup = warmup
+	}
+	if value, ok := config[configKeyReadinessIgnoreInstances]; ok {
+		ignore, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyReadinessIgnoreInstances, value, err)
+		}
+		cfg.ignoreInstances = ignore
+	}
+	return cfg, nil
+}
+
+// duringUpgrade returns the readiness criteria to apply while an upgrade is
+// rolling forward, where the transient upgrade states no longer block.
+func (r *readinessConfig) duringUpgrade() *readinessConfig {
+	upgrade := *r
+	upgrade.upgrading = true
+	return &upgrade
+}
+
+// scaleSetBlocks reports whether a scale set level status blocks readiness.
+func (r *readinessConfig) scaleSetBlocks(code string) bool {
+	if r.upgrading && isUpgradeState(code) {
+		return false
+	}
+	return code != provisioningStateSucceeded
+}
+
+func isUpgradeState(code string) bool {
+	_, ok := upgradeStates[strings.ToLower(code)]
+	return ok
+}
+
+func (r *readinessConfig) blocks(code string) bool {
+	if r.upgrading && isUpgradeState(code) {
+		return false
+	}
+	if r.blockingStates == nil {
+		return code != provisioningStateSucceeded
+	}
+	_, ok := r.blockingStates[strings.ToLower(code)]
+	return ok
+}
+
+// instancesReady evaluates the per-instance status summary of a scale set,
+// allowing up to the configured percentage of instances to be in a blocking
+// state.
+func (r *readinessConfig) instancesReady(summary []compute.VirtualMachineStatusCodeCount) bool {
+	if r.ignoreInstances {
+		return true
+	}
+
+	var total, blocked int32
+	for _, code := range summary {
+		if code.Code == nil || code.Count == nil {
+			continue
+		}
+		total += *code.Count
+		if r.blocks(*code.Code) {
+			blocked += *code.Count
+		}
+	}
+	return r.withinTolerance(int64(blocked), int64(total))
+}
+
+// instanceListReady evaluates readiness from the individual instances of a
+// scale set, skipping blocked instances which are still within the warm-up
+// window.
+func (r *readinessConfig) instanceListReady(instances []vmssInstance) bool {
+	if r.ignoreInstances {
+		return true
+	}
+
+	now := time.Now()
+	var blocked int64
+	for _, instance := range instances {
+		if !r.blocks(instance.provisioningState) {
+			continue
+		}
+		if r.warmup > 0 && now.Sub(r.ages.since(instance)) < r.warmup {
+			continue
+		}
+		blocked++
+	}
+	return r.withinTolerance(blocked, int64(len(instances)))
+}
+
+func (r *readinessConfig) withinTolerance(blocked, total int64) bool {
+	if blocked == 0 {
+		return true
+	}
+	return float64(blocked)*100/float64(total) <= r.tolerance && r.tolerance > 0
+}
+
+// instanceAgeTracker remembers when the plugin first saw each instance. Azure
+// only timestamps the provisioning state once it settles, so instances still
+// in Creating are aged from the first Status call that listed them.
+type instanceAgeTracker struct {
+	lock      sync.Mutex
+	firstSeen map[string]map[string]time.Time
+}
+
+func newInstanceAgeTracker() *instanceAgeTracker {
+	return &instanceAgeTracker{firstSeen: make(map[string]map[string]time.Time)}
+}
+
+// observe records the instances currently in a scale set, forgetting those
+// which have since been removed.
+func (a *instanceAgeTracker) observe(key string, instances []vmssInstance) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	previous := a.firstSeen[key]
+	current := make(map[string]time.Time, len(instances))
+	now := time.Now()
+	for _, instance := range instances {
+		if seen, ok := previous[instance.remoteID]; ok {
+			current[instance.remoteID] = seen
+		} else {
+			current[instance.remoteID] = now
+		}
+	}
+	a.firstSeen[key] = current
+}
+
+// since returns the time an instance came into being, preferring the
+// provisioning timestamp reported by Azure while the instance is not in a
+// transient state.
+func (a *instanceAgeTracker) since(instance vmssInstance) time.Time {
+	if !instance.provisionedAt.IsZero() && !isUpgradeState(instance.provisioningState) {
+		return instance.provisionedAt
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, instances := range a.firstSeen {
+		if seen, ok := instances[instance.remoteID]; ok {
+			return seen
+		}
+	}
+	return time.Now()
+}
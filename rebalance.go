@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultRebalanceInterval = 5 * time.Minute
+
+// rebalanceConfig enables rebalancing of a target once a member set is at
+// least threshold instances away from the capacity the distribution plans
+// for it.
+type rebalanceConfig struct {
+	threshold int64
+}
+
+func parseRebalanceConfig(config map[string]string) (*rebalanceConfig, error) {
+	cfg := &rebalanceConfig{}
+	if value, ok := config[configKeyRebalance]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyRebalance, value, err)
+		}
+		if enabled {
+			cfg.threshold = 1
+		}
+	}
+	if value, ok := config[configKeyRebalanceSkewThreshold]; ok {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyRebalanceSkewThreshold, value)
+		}
+		cfg.threshold = threshold
+	}
+	if cfg.threshold == 0 {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+func parseRebalanceInterval(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyRebalanceInterval]
+	if !ok {
+		return defaultRebalanceInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyRebalanceInterval, value)
+	}
+	return interval, nil
+}
+
+// planRebalance returns how many instances each member set gains, when
+// positive, or gives up to bring the target back to its configured
+// distribution at the same total. Paused and retiring sets are left out, and
+// direction limited sets only move the way they scale.
+func planRebalance(capacities []int64, sets []scaleSetTarget) []int64 {
+	var total int64
+	var members []int
+	var open []scaleSetTarget
+	for idx, set := range sets {
+		if set.paused || set.retiring {
+			continue
+		}
+		total += capacities[idx]
+		members = append(members, idx)
+		open = append(open, set)
+	}
+
+	moves := make([]int64, len(sets))
+	var give, take int64
+	for i, planned := range planCapacities(total, open) {
+		idx := members[i]
+		switch delta := planned - capacities[idx]; {
+		case delta > 0 && sets[idx].scalesOut():
+			moves[idx] = delta
+			take += delta
+		case delta < 0 && sets[idx].scalesIn():
+			moves[idx] = delta
+			give -= delta
+		}
+	}
+
+	// Only as much as both sides allow is moved, so the total holds.
+	limit := min(give, take)
+	grown, shrunk := limit, limit
+	for idx, move := range moves {
+		switch {
+		case move > 0:
+			moves[idx] = min(move, grown)
+			grown -= moves[idx]
+		case move < 0:
+			moves[idx] = -min(-move, shrunk)
+			shrunk += moves[idx]
+		}
+	}
+	return moves
+}
+
+// runRebalancer periodically rebalances the targets that enable it.
+func (t *TargetPlugin) runRebalancer(ctx context.Context, interval time.Duration) {
+	log := t.logger.With("task", "rebalance")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				cfg, err := parseRebalanceConfig(config)
+				if err != nil || cfg == nil {
+					continue
+				}
+				err = t.rebalance(ctx, config, cfg, log)
+				var inProgress *scaleInProgressError
+				if errors.As(err, &inProgress) {
+					log.Debug("skipping rebalance", "target", targetKey(config), "error", err)
+					continue
+				}
+				if err != nil {
+					log.Warn("failed to rebalance target", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+// rebalance moves capacity between the member sets of a target when one has
+// drifted threshold instances or more from its planned capacity, growing the
+// sets short of their share while draining nodes from those over it.
+func (t *TargetPlugin) rebalance(ctx context.Context, config map[string]string, cfg *rebalanceConfig, log hclog.Logger) error {
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+	resourceGroupList, vmScaleSetList := splitScaleSetTargets(members)
+	keys, err := t.targetVMSSKeys(config)
+	if err != nil {
+		return err
+	}
+	id := newOperationID()
+	release, err := t.scaleLocks.tryAcquire(keys, id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if t.haLock != nil {
+		releaseHA, err := t.haLock.acquire(targetKey(config))
+		if err != nil {
+			return err
+		}
+		defer releaseHA()
+	}
+	ctx = withOperationID(ctx, id)
+	log = log.With("operation_id", id, "target", targetKey(config))
+
+	snapshot, err := t.takeScaleSnapshot(ctx, members)
+	if err != nil {
+		return err
+	}
+	for idx, set := range snapshot.sets {
+		if members[idx].missing {
+			continue
+		}
+		if pausedByTag(set.vmss.Tags) || disabledByTag(set.vmss.Tags) {
+			members[idx].paused = true
+		}
+		if operation := platformOperation(ctx, set, t.azureFor(set.resourceGroup, set.vmScaleSet)); operation != "" {
+			log.Debug("skipping rebalance during platform operation", "vmss_name", set.vmScaleSet, "operation", operation)
+			return nil
+		}
+	}
+	capPlacementGroups(members, snapshot, log)
+	capacities := snapshot.capacities()
+	moves := planRebalance(capacities, members)
+	var skew int64
+	for _, move := range moves {
+		skew = max(skew, move, -move)
+	}
+	if skew < cfg.threshold {
+		log.Debug("target is balanced", "skew", skew)
+		return nil
+	}
+	log.Info("rebalancing member sets", "skew", skew, "capacities", capacities, "moves", moves)
+
+	// The sets short of their share grow first, so the target is never
+	// below its total while the others drain.
+	for idx, move := range moves {
+		if move <= 0 {
+			continue
+		}
+		resourceGroup, vmScaleSet := resourceGroupList[idx], vmScaleSetList[idx]
+		if err := t.azureFor(resourceGroup, vmScaleSet).setCapacity(ctx, resourceGroup, vmScaleSet, capacities[idx]+move); err != nil {
+			return fmt.Errorf("failed to grow %s/%s: %w", resourceGroup, vmScaleSet, err)
+		}
+		t.desired.set(resourceGroup, vmScaleSet, capacities[idx]+move)
+		t.cooldowns.record(resourceGroup, vmScaleSet, "out")
+		t.statusCache.invalidate(resourceGroup, vmScaleSet)
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+	filters, err := parseNodeFilters(config, vmScaleSetList)
+	if err != nil {
+		return err
+	}
+	nodes, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return err
+	}
+	scaleInConfig, err := t.scaleInConfig(poolConfig(config, filters))
+	if err != nil {
+		return fmt.Errorf("failed to build node drain config: %v", err)
+	}
+	utils, err := cluster.operationUtils(id, log)
+	if err != nil {
+		return err
+	}
+
+	for idx, move := range moves {
+		if move >= 0 {
+			continue
+		}
+		resourceGroup, vmScaleSet := resourceGroupList[idx], vmScaleSetList[idx]
+		remoteIDs, err := snapshot.sets[idx].runningRemoteIDs(ctx, t.azureFor(resourceGroup, vmScaleSet))
+		if err != nil {
+			return err
+		}
+		var filter nodeFilter
+		if filters != nil {
+			filter = filters[idx]
+		}
+		ids, err := utils.RunPreScaleInTasksWithRemoteCheck(ctx, scaleInConfig, filterRemoteIDs(remoteIDs, filter, nodes), int(-move))
+		if err != nil {
+			return fmt.Errorf("failed to drain nodes of %s/%s: %v", resourceGroup, vmScaleSet, err)
+		}
+		instanceIDs := make([]string, len(ids))
+		for i, node := range ids {
+			instanceIDs[i] = node.RemoteResourceID[strings.LastIndex(node.RemoteResourceID, "_")+1:]
+		}
+		t.deregisterConsulNodes(cluster.client, ids, log)
+		if err := t.azureFor(resourceGroup, vmScaleSet).deleteInstances(ctx, resourceGroup, vmScaleSet, instanceIDs); err != nil {
+			if failErr := utils.RunPostScaleInTasksOnFailure(ids); failErr != nil {
+				log.Error("failed to restore eligibility of nodes after failed delete", "error", failErr)
+			}
+			return fmt.Errorf("failed to shrink %s/%s: %w", resourceGroup, vmScaleSet, err)
+		}
+		t.desired.set(resourceGroup, vmScaleSet, capacities[idx]-int64(len(ids)))
+		t.cooldowns.record(resourceGroup, vmScaleSet, "in")
+		t.statusCache.invalidate(resourceGroup, vmScaleSet)
+		if err := utils.RunPostScaleInTasks(ctx, scaleInConfig, ids); err != nil {
+			log.Warn("failed to perform post-scale Nomad scale in tasks", "vmss_name", vmScaleSet, "error", err)
+		}
+	}
+	log.Info("rebalanced member sets")
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type reconcileConfig struct {
+	interval time.Duration
+	selfHeal bool
+}
+
+func parseReconcileConfig(config map[string]string) (*reconcileConfig, error) {
+	intervalStr, ok := config[configKeyReconcileInterval]
+	if !ok {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyReconcileInterval, intervalStr)
+	}
+
+	cfg := &reconcileConfig{interval: interval}
+	if value, ok := config[configKeyReconcileSelfHeal]; ok {
+		if cfg.selfHeal, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyReconcileSelfHeal, value, err)
+		}
+	}
+	return cfg, nil
+}
+
+func vmssKey(resourceGroup, vmScaleSet string) string {
+	return strings.ToLower(resourceGroup + "/" + vmScaleSet)
+}
+
+// capacityTracker remembers the capacity the plugin last applied to each
+// scale set, which is the reference point for detecting external changes.
+type capacityTracker struct {
+	lock       sync.RWMutex
+	capacities map[string]int64
+	drifts     map[string]int64
+}
+
+func newCapacityTracker() *capacityTracker {
+	return &capacityTracker{capacities: make(map[string]int64), drifts: make(map[string]int64)}
+}
+
+func (c *capacityTracker) set(resourceGroup, vmScaleSet string, capacity int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.capacities[vmssKey(resourceGroup, vmScaleSet)] = capacity
+	metrics.SetGaugeWithLabels([]string{"vmss", "desired_capacity"}, float32(capacity), vmssLabels(resourceGroup, vmScaleSet))
+}
+
+func (c *capacityTracker) snapshot() map[string]int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	capacities := make(map[string]int64, len(c.capacities))
+	for key, capacity := range c.capacities {
+		capacities[key] = capacity
+	}
+	return capacities
+}
+
+func (c *capacityTracker) get(resourceGroup, vmScaleSet string) (int64, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	capacity, ok := c.capacities[vmssKey(resourceGroup, vmScaleSet)]
+	return capacity, ok
+}
+
+// drift returns how far the live capacity of the set is from the capacity
+// the plugin last applied, whether one was applied, and whether the drift
+// differs from the one last seen, so each change is reported once.
+func (c *capacityTracker) drift(resourceGroup, vmScaleSet string, live int64) (int64, bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	desired, ok := c.capacities[key]
+	if !ok {
+		return 0, false, false
+	}
+	drift := live - desired
+	changed := drift != c.drifts[key]
+	c.drifts[key] = drift
+	return drift, true, changed
+}
+
+// annotateDrift reports a capacity change made to the set outside of the
+// plugin in Status meta, logging it when it first shows. Sets an operation
+// of the plugin holds are moving toward their capacity and are left alone.
+func (t *TargetPlugin) annotateDrift(resourceGroup, vmScaleSet string, live int64, meta map[string]string) {
+	if t.scaleLocks.holder([]string{vmssKey(resourceGroup, vmScaleSet)}) != "" {
+		return
+	}
+	drift, ok, changed := t.desired.drift(resourceGroup, vmScaleSet, live)
+	if !ok {
+		return
+	}
+	if changed {
+		if drift != 0 {
+			t.logger.Warn("scale set capacity changed outside of the autoscaler", "resource_group", resourceGroup,
+				"vmss_name", vmScaleSet, "capacity", live, "desired", live-drift)
+		} else {
+			t.logger.Info("scale set capacity back in line with the autoscaler", "resource_group", resourceGroup,
+				"vmss_name", vmScaleSet, "capacity", live)
+		}
+	}
+	if drift != 0 {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "desired_capacity")] = strconv.FormatInt(live-drift, 10)
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "capacity_drift")] = strconv.FormatInt(drift, 10)
+	}
+}
+
+// runReconciler periodically compares the Azure capacity, the running
+// instances and the registered Nomad nodes of every observed scale set.
+func (t *TargetPlugin) runReconciler(ctx context.Context, cfg *reconcileConfig) {
+	log := t.logger.With("task", "reconciler")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.reconcile(ctx, config, cfg.selfHeal, log); err != nil {
+					log.Warn("failed to reconcile target", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) reconcile(ctx context.Context, config map[string]string, selfHeal bool, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+
+	registered, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return err
+	}
+
+	for idx, vmScaleSet := range vmScaleSetList {
+		resourceGroup := resourceGroupList[idx]
+		var azure scaleSetClient = t.azureFor(resourceGroup, vmScaleSet)
+
+		capacity, err := azure.getCapacity(ctx, resourceGroup, vmScaleSet)
+		if err != nil {
+			return err
+		}
+
+		instances, err := azure.listRunningInstances(ctx, resourceGroup, vmScaleSet)
+		if err != nil {
+			return err
+		}
+		nodes := 0
+		for _, instance := range instances {
+			if _, ok := registered[strings.ToLower(instance.remoteID)]; ok {
+				nodes++
+			}
+		}
+
+		vmssLog := log.With("resource_group", resourceGroup, "vmss_name", vmScaleSet,
+			"capacity", capacity, "running", len(instances), "nodes", nodes)
+		if int64(len(instances)) != capacity || len(instances) != nodes {
+			vmssLog.Warn("scale set capacity drift detected")
+		} else {
+			vmssLog.Debug("scale set in sync")
+		}
+
+		desired, ok := t.desired.get(resourceGroup, vmScaleSet)
+		if !ok || desired == capacity {
+			continue
+		}
+		vmssLog.Warn("scale set capacity changed outside of the autoscaler", "desired", desired)
+		if !selfHeal {
+			continue
+		}
+		if err := t.selfHeal(ctx, azure, resourceGroup, vmScaleSet, vmssLog); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selfHeal sets the capacity of the set back to the one the plugin last
+// applied. The scale lock is taken first so a Scale or other operation on the
+// set is never undone; a held set is left for the next round. Both capacities
+// are read again under the lock, since an operation may have moved them since
+// the reconciler looked.
+func (t *TargetPlugin) selfHeal(ctx context.Context, azure scaleSetClient, resourceGroup, vmScaleSet string, log hclog.Logger) error {
+	id := newOperationID()
+	release, err := t.scaleLocks.tryAcquire([]string{vmssKey(resourceGroup, vmScaleSet)}, id)
+	if err != nil {
+		log.Debug("skipping self heal of busy scale set", "error", err)
+		return nil
+	}
+	defer release()
+	ctx = withOperationID(ctx, id)
+
+	desired, ok := t.desired.get(resourceGroup, vmScaleSet)
+	if !ok {
+		return nil
+	}
+	capacity, err := azure.getCapacity(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return err
+	}
+	if capacity == desired {
+		return nil
+	}
+	if err := azure.setCapacity(ctx, resourceGroup, vmScaleSet, desired); err != nil {
+		return err
+	}
+	log.Info("re-asserted desired scale set capacity", "desired", desired, "operation_id", id)
+	return nil
+}
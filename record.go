@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sanitizedSubscriptionID replaces the real subscription ID in recorded
+// exchanges, so fixtures can be shared and replayed under any subscription.
+const sanitizedSubscriptionID = "00000000-0000-0000-0000-000000000000"
+
+// recordedHeaders are the response headers kept in fixtures; the rest carry
+// request IDs and timings which only add noise.
+var recordedHeaders = []string{"Content-Type", "ETag", "Location", "Azure-AsyncOperation", "Retry-After"}
+
+// armExchange is one recorded request and its response.
+type armExchange struct {
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	RequestBody  string            `json:"request_body,omitempty"`
+	StatusCode   int               `json:"status_code"`
+	Header       map[string]string `json:"header,omitempty"`
+	ResponseBody string            `json:"response_body,omitempty"`
+}
+
+// wrapRecording records ARM traffic into, or replays it from, a fixture
+// directory when configured. Replay never reaches Azure.
+func wrapRecording(config map[string]string, sender autorest.Sender, subscriptionID string) (autorest.Sender, error) {
+	recordDir, replayDir := config[configKeyAzureRecordDir], config[configKeyAzureReplayDir]
+	switch {
+	case recordDir != "" && replayDir != "":
+		return nil, fmt.Errorf("%s cannot be combined with %s", configKeyAzureRecordDir, configKeyAzureReplayDir)
+	case replayDir != "":
+		return newReplaySender(replayDir, subscriptionID)
+	case recordDir != "":
+		if err := os.MkdirAll(recordDir, 0o755); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyAzureRecordDir, recordDir, err)
+		}
+		return &recordingSender{sender: sender, dir: recordDir, subscriptionID: subscriptionID}, nil
+	}
+	return sender, nil
+}
+
+type recordingSender struct {
+	sender         autorest.Sender
+	dir            string
+	subscriptionID string
+
+	lock sync.Mutex
+	seq  int
+}
+
+func (s *recordingSender) Do(r *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if r.Body != nil {
+		requestBody, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+	resp, err := s.sender.Do(r)
+	if err != nil {
+		return resp, err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	exchange := armExchange{
+		Method:       r.Method,
+		URL:          s.sanitize(r.URL.String()),
+		RequestBody:  s.sanitize(string(requestBody)),
+		StatusCode:   resp.StatusCode,
+		Header:       make(map[string]string),
+		ResponseBody: s.sanitize(string(responseBody)),
+	}
+	for _, key := range recordedHeaders {
+		if value := resp.Header.Get(key); value != "" {
+			exchange.Header[key] = s.sanitize(value)
+		}
+	}
+
+	s.lock.Lock()
+	s.seq++
+	name := fmt.Sprintf("%04d-%s-%s.json", s.seq, r.Method, strings.ReplaceAll(azureOperation(r.URL.Path), "/", "_"))
+	s.lock.Unlock()
+	// A fixture that cannot be written must not fail the request itself.
+	if data, err := json.MarshalIndent(exchange, "", "  "); err == nil {
+		_ = os.WriteFile(filepath.Join(s.dir, name), data, 0o644)
+	}
+	return resp, nil
+}
+
+// sanitize drops the subscription ID. Credentials never reach the fixture,
+// since request headers are not recorded.
+func (s *recordingSender) sanitize(value string) string {
+	if s.subscriptionID == "" {
+		return value
+	}
+	return strings.ReplaceAll(value, s.subscriptionID, sanitizedSubscriptionID)
+}
+
+// replaySender answers requests from recorded exchanges. Exchanges with the
+// same method and URL are replayed in recording order, the last one repeating
+// once the others are used up, which covers polling a long running operation.
+type replaySender struct {
+	subscriptionID string
+
+	lock      sync.Mutex
+	exchanges map[string][]armExchange
+}
+
+func newReplaySender(dir, subscriptionID string) (*replaySender, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	s := &replaySender{subscriptionID: subscriptionID, exchanges: make(map[string][]armExchange)}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixture %s: %v", file, err)
+		}
+		var exchange armExchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			return nil, fmt.Errorf("failed to decode fixture %s: %v", file, err)
+		}
+		key := exchange.Method + " " + exchange.URL
+		s.exchanges[key] = append(s.exchanges[key], exchange)
+	}
+	return s, nil
+}
+
+func (s *replaySender) Do(r *http.Request) (*http.Response, error) {
+	url := r.URL.String()
+	if s.subscriptionID != "" {
+		url = strings.ReplaceAll(url, s.subscriptionID, sanitizedSubscriptionID)
+	}
+	key := r.Method + " " + url
+
+	s.lock.Lock()
+	exchanges := s.exchanges[key]
+	if len(exchanges) == 0 {
+		s.lock.Unlock()
+		// An error would be retried on the client backoff; a status the
+		// clients do not retry fails the request at once.
+		return simulatedError(r, http.StatusNotImplemented, "NoRecordedExchange", "no recorded exchange for "+key), nil
+	}
+	exchange := exchanges[0]
+	if len(exchanges) > 1 {
+		s.exchanges[key] = exchanges[1:]
+	}
+	s.lock.Unlock()
+
+	resp := &http.Response{
+		StatusCode: exchange.StatusCode,
+		Status:     fmt.Sprintf("%d %s", exchange.StatusCode, http.StatusText(exchange.StatusCode)),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(exchange.ResponseBody)),
+		Request:    r,
+	}
+	for key, value := range exchange.Header {
+		resp.Header.Set(key, value)
+	}
+	return resp, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRecycleInterval    = 10 * time.Minute
+	defaultRecycleConcurrency = 1
+)
+
+// recycleConfig selects the instances the recycler replaces: those older
+// than maxAge, when set, and with outdated those not running the latest
+// scale set model.
+type recycleConfig struct {
+	maxAge      time.Duration
+	outdated    bool
+	interval    time.Duration
+	concurrency int
+}
+
+func parseRecycleConfig(config map[string]string) (*recycleConfig, error) {
+	cfg := &recycleConfig{interval: defaultRecycleInterval, concurrency: defaultRecycleConcurrency}
+	var err error
+	if value, ok := config[configKeyRecycleMaxAge]; ok {
+		if cfg.maxAge, err = time.ParseDuration(value); err != nil || cfg.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyRecycleMaxAge, value)
+		}
+	}
+	if value, ok := config[configKeyRecycleOutdated]; ok {
+		if cfg.outdated, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyRecycleOutdated, value, err)
+		}
+	}
+	if cfg.maxAge == 0 && !cfg.outdated {
+		return nil, nil
+	}
+
+	if value, ok := config[configKeyRecycleInterval]; ok {
+		if cfg.interval, err = time.ParseDuration(value); err != nil || cfg.interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyRecycleInterval, value)
+		}
+	}
+	if value, ok := config[configKeyRecycleConcurrency]; ok {
+		if cfg.concurrency, err = strconv.Atoi(value); err != nil || cfg.concurrency <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a positive integer", configKeyRecycleConcurrency, value)
+		}
+	}
+	return cfg, nil
+}
+
+// runRecycler gradually replaces instances older than the maximum age or not
+// on the latest model. Each round drains and deletes up to the concurrency
+// limit of such instances and restores the capacity, so Azure creates fresh instances from the
+// current model in their place.
+func (t *TargetPlugin) runRecycler(ctx context.Context, cfg *recycleConfig) {
+	log := t.logger.With("task", "recycle")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			budget := cfg.concurrency
+			for _, config := range t.targets.list() {
+				recycled, err := t.recycleInstances(ctx, config, cfg, budget, log)
+				if err != nil {
+					log.Warn("failed to recycle instances", "target", targetKey(config), "error", err)
+				}
+				if budget -= recycled; budget <= 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+// recycleInstances replaces up to budget expired or outdated instances of a target and
+// returns how many it replaced. A scale set with instances which are not yet
+// running, such as the replacements of an earlier round, is left alone until
+// they are, so the set is never short of more than budget instances.
+func (t *TargetPlugin) recycleInstances(ctx context.Context, config map[string]string, cfg *recycleConfig, budget int, log hclog.Logger) (int, error) {
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return 0, err
+	}
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return 0, err
+	}
+	nodes, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return 0, err
+	}
+	scaleInConfig, err := t.scaleInConfig(config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build node drain config: %v", err)
+	}
+
+	var recycled int
+	now := time.Now()
+	for _, member := range members {
+		if member.paused || recycled >= budget {
+			continue
+		}
+		azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+		instances, err := azure.listInstances(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			return recycled, err
+		}
+
+		var outdated map[string]bool
+		if cfg.outdated {
+			if outdated, err = azure.listOutdatedInstances(ctx, member.resourceGroup, member.vmScaleSet); err != nil {
+				return recycled, err
+			}
+			metrics.SetGaugeWithLabels([]string{"vmss", "outdated_instances"}, float32(len(outdated)),
+				vmssLabels(member.resourceGroup, member.vmScaleSet))
+		}
+
+		var expired []vmssInstance
+		settled := true
+		for _, instance := range instances {
+			if !instance.running() || instance.provisioningState != provisioningStateSucceeded {
+				settled = false
+				break
+			}
+			old := cfg.maxAge > 0 && now.Sub(instance.provisionedAt) > cfg.maxAge
+			if (old || outdated[instance.instanceID]) && nodes[strings.ToLower(instance.remoteID)] != nil {
+				expired = append(expired, instance)
+			}
+		}
+		if !settled || len(expired) == 0 {
+			continue
+		}
+		// Outdated instances go first, then the oldest.
+		sort.Slice(expired, func(i, j int) bool {
+			if outdated[expired[i].instanceID] != outdated[expired[j].instanceID] {
+				return outdated[expired[i].instanceID]
+			}
+			return expired[i].provisionedAt.Before(expired[j].provisionedAt)
+		})
+		if len(expired) > budget-recycled {
+			expired = expired[:budget-recycled]
+		}
+
+		ids := make([]scaleutils.NodeResourceID, len(expired))
+		for idx, instance := range expired {
+			ids[idx] = scaleutils.NodeResourceID{
+				NomadNodeID:      nodes[strings.ToLower(instance.remoteID)].ID,
+				RemoteResourceID: instance.remoteID,
+			}
+		}
+		err = t.recycleSet(ctx, config, cluster, member, expired, ids, scaleInConfig, log)
+		var inProgress *scaleInProgressError
+		if errors.As(err, &inProgress) {
+			log.Debug("skipping recycle", "vmss_name", member.vmScaleSet, "error", err)
+			continue
+		}
+		if err != nil {
+			return recycled, fmt.Errorf("%s/%s: %w", member.resourceGroup, member.vmScaleSet, err)
+		}
+		recycled += len(expired)
+	}
+	return recycled, nil
+}
+
+// recycleSet drains and deletes the given instances of one scale set, then
+// sets the capacity back to what it was. Fresh instances are created from the
+// latest model, so this replaces outdated instances at the pace of Nomad
+// drains rather than a rolling upgrade. The scale set is locked against
+// Scale for the duration, which also keeps Status not ready.
+func (t *TargetPlugin) recycleSet(ctx context.Context, config map[string]string, cluster *nomadCluster, member scaleSetTarget,
+	instances []vmssInstance, ids []scaleutils.NodeResourceID, scaleInConfig map[string]string, log hclog.Logger) error {
+
+	id := newOperationID()
+	log = log.With("operation_id", id, "vmss_name", member.vmScaleSet)
+	release, err := t.scaleLocks.tryAcquire([]string{vmssKey(member.resourceGroup, member.vmScaleSet)}, id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if t.haLock != nil {
+		releaseHA, err := t.haLock.acquire(targetKey(config))
+		if err != nil {
+			return err
+		}
+		defer releaseHA()
+	}
+	ctx = withOperationID(ctx, id)
+
+	azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+	capacity, err := azure.getCapacity(ctx, member.resourceGroup, member.vmScaleSet)
+	if err != nil {
+		return err
+	}
+	utils, err := cluster.operationUtils(id, log)
+	if err != nil {
+		return err
+	}
+
+	instanceIDs := make([]string, len(instances))
+	for idx, instance := range instances {
+		instanceIDs[idx] = instance.instanceID
+	}
+	log.Info("recycling instances", "instances", instanceIDs)
+	if err := utils.DrainNodes(ctx, scaleInConfig, ids); err != nil {
+		if failErr := utils.RunPostScaleInTasksOnFailure(ids); failErr != nil {
+			log.Error("failed to restore eligibility of nodes after failed drain", "error", failErr)
+		}
+		return fmt.Errorf("failed to drain nodes: %v", err)
+	}
+	t.deregisterConsulNodes(cluster.client, ids, log)
+
+	if err := azure.deleteInstances(ctx, member.resourceGroup, member.vmScaleSet, instanceIDs); err != nil {
+		return err
+	}
+	t.statusCache.invalidate(member.resourceGroup, member.vmScaleSet)
+	if err := utils.RunPostScaleInTasks(ctx, scaleInConfig, ids); err != nil {
+		log.Warn("failed to perform post-scale Nomad scale in tasks", "error", err)
+	}
+
+	if err := azure.setCapacity(ctx, member.resourceGroup, member.vmScaleSet, capacity); err != nil {
+		return fmt.Errorf("failed to restore capacity %d after recycling: %w", capacity, err)
+	}
+	t.desired.set(member.resourceGroup, member.vmScaleSet, capacity)
+	log.Info("recycled instances", "capacity", capacity)
+	return nil
+}
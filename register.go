@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegisterRetries = 1
+
+	registerRetrySame     = "same"
+	registerRetryOverflow = "overflow"
+)
+
+// registerConfig is how long the instances of a scale out have to register
+// as Nomad nodes, and what happens to those that do not: they are deleted
+// and the shortfall is created again, up to retries times, in the same set
+// or in its overflow set. With nodeMeta, the nodes that do register have the
+// scale event written to their meta.
+type registerConfig struct {
+	timeout  time.Duration
+	retries  int
+	retryOn  string
+	nodeMeta bool
+}
+
+func parseRegisterConfig(config map[string]string) (*registerConfig, error) {
+	timeoutStr, ok := config[configKeyRegisterTimeout]
+	if !ok {
+		if _, ok := config[configKeyScaleNodeMeta]; ok {
+			return nil, fmt.Errorf("%s needs %s, the nodes are written once they registered", configKeyScaleNodeMeta, configKeyRegisterTimeout)
+		}
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyRegisterTimeout, timeoutStr)
+	}
+
+	cfg := &registerConfig{timeout: timeout, retries: defaultRegisterRetries, retryOn: registerRetrySame}
+	if value, ok := config[configKeyRegisterRetries]; ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", configKeyRegisterRetries, value)
+		}
+		cfg.retries = retries
+	}
+	if value, ok := config[configKeyRegisterRetryOn]; ok {
+		if value != registerRetrySame && value != registerRetryOverflow {
+			return nil, fmt.Errorf("invalid %s %q, must be %q or %q", configKeyRegisterRetryOn, value, registerRetrySame, registerRetryOverflow)
+		}
+		cfg.retryOn = value
+	}
+	if value, ok := config[configKeyScaleNodeMeta]; ok {
+		if cfg.nodeMeta, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyScaleNodeMeta, value, err)
+		}
+	}
+	return cfg, nil
+}
+
+// registerPollInterval is how often the registration of new instances is
+// checked while waiting on it.
+func (c *registerConfig) pollInterval() time.Duration {
+	return min(max(c.timeout/10, time.Second), 15*time.Second)
+}
+
+// checkRegistration returns the nodes of the instances of a set not in
+// before that have registered, keyed by remote ID, and the instance IDs of
+// those that have not, in ID order.
+func (t *TargetPlugin) checkRegistration(ctx context.Context, cluster *nomadCluster, member scaleSetTarget, before map[string]struct{}) (map[string]*api.Node, []string, error) {
+	names, err := t.azureFor(member.resourceGroup, member.vmScaleSet).listInstanceNames(ctx, member.resourceGroup, member.vmScaleSet)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	registered := make(map[string]*api.Node)
+	var instanceIDs []string
+	for name := range names {
+		if _, ok := before[name]; ok {
+			continue
+		}
+		if node, ok := nodes[name]; ok {
+			registered[name] = node
+			continue
+		}
+		instanceIDs = append(instanceIDs, name[strings.LastIndex(name, "_")+1:])
+	}
+	sort.Strings(instanceIDs)
+	return registered, instanceIDs, nil
+}
+
+// verifyRegistration waits for the instances a scale out created in
+// members[idx], those not listed in before, to register as Nomad nodes. The
+// instances still unregistered when the timeout passes are deleted rather
+// than left running as zombies, and as many are created again. The scale
+// set locks of the operation must be held, overflow sets included.
+func (t *TargetPlugin) verifyRegistration(ctx context.Context, cluster *nomadCluster, cfg *registerConfig, members []scaleSetTarget, idx int, before map[string]struct{}, log hclog.Logger) error {
+	member := members[idx]
+	written := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		deadline := time.Now().Add(cfg.timeout)
+		var unregistered []string
+		for {
+			registered, missing, err := t.checkRegistration(ctx, cluster, member, before)
+			if err != nil {
+				return err
+			}
+			if cfg.nodeMeta {
+				for remoteID, node := range registered {
+					if !written[remoteID] {
+						written[remoteID] = true
+						t.writeScaleNodeMeta(ctx, cluster, member, remoteID, node, log)
+					}
+				}
+			}
+			if unregistered = missing; len(unregistered) == 0 {
+				return nil
+			}
+			if !time.Now().Before(deadline) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(min(cfg.pollInterval(), time.Until(deadline))):
+			}
+		}
+
+		azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+		log.Warn("Azure instances did not register as Nomad nodes in time, deleting them", "vmss_name", member.vmScaleSet,
+			"instances", unregistered, "timeout", cfg.timeout, "attempt", attempt+1)
+		if err := azure.deleteInstances(ctx, member.resourceGroup, member.vmScaleSet, unregistered); err != nil {
+			return fmt.Errorf("failed to delete %d instances that did not register: %w", len(unregistered), err)
+		}
+		t.statusCache.invalidate(member.resourceGroup, member.vmScaleSet)
+		if attempt >= cfg.retries {
+			capacity, err := azure.getCapacity(ctx, member.resourceGroup, member.vmScaleSet)
+			if err == nil {
+				t.desired.set(member.resourceGroup, member.vmScaleSet, capacity)
+			}
+			return fmt.Errorf("%d instances of %s/%s did not register as Nomad nodes within %s and were deleted",
+				len(unregistered), member.resourceGroup, member.vmScaleSet, cfg.timeout)
+		}
+
+		if cfg.retryOn == registerRetryOverflow {
+			if to := overflowIndex(members, idx); to != -1 {
+				member = members[to]
+				azure = t.azureFor(member.resourceGroup, member.vmScaleSet)
+			}
+		}
+		names, err := azure.listInstanceNames(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			return err
+		}
+		before = names
+		capacity, err := azure.getCapacity(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			return err
+		}
+		capacity += int64(len(unregistered))
+		if member.max > 0 && capacity > member.max {
+			return fmt.Errorf("cannot create %d instances again in %s/%s beyond its max %d",
+				len(unregistered), member.resourceGroup, member.vmScaleSet, member.max)
+		}
+		log.Info("creating the instances that did not register again", "vmss_name", member.vmScaleSet,
+			"count", len(unregistered), "desired_count", capacity)
+		if err := azure.setCapacity(ctx, member.resourceGroup, member.vmScaleSet, capacity); err != nil {
+			return fmt.Errorf("failed to create the %d instances that did not register again: %w", len(unregistered), err)
+		}
+		t.desired.set(member.resourceGroup, member.vmScaleSet, capacity)
+		t.statusCache.invalidate(member.resourceGroup, member.vmScaleSet)
+	}
+}
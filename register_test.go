@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRegisterConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  map[string]string
+		want    *registerConfig
+		wantErr bool
+	}{
+		{name: "disabled", config: map[string]string{}},
+		{
+			name:   "defaults",
+			config: map[string]string{configKeyRegisterTimeout: "5m"},
+			want:   &registerConfig{timeout: 5 * time.Minute, retries: 1, retryOn: registerRetrySame},
+		},
+		{
+			name: "overflow",
+			config: map[string]string{
+				configKeyRegisterTimeout: "10m",
+				configKeyRegisterRetries: "0",
+				configKeyRegisterRetryOn: registerRetryOverflow,
+			},
+			want: &registerConfig{timeout: 10 * time.Minute, retries: 0, retryOn: registerRetryOverflow},
+		},
+		{name: "invalid timeout", config: map[string]string{configKeyRegisterTimeout: "0s"}, wantErr: true},
+		{name: "invalid retries", config: map[string]string{configKeyRegisterTimeout: "1m", configKeyRegisterRetries: "-1"}, wantErr: true},
+		{name: "node meta without timeout", config: map[string]string{configKeyScaleNodeMeta: "true"}, wantErr: true},
+		{name: "invalid retry on", config: map[string]string{configKeyRegisterTimeout: "1m", configKeyRegisterRetryOn: "other"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseRegisterConfig(c.config)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %t", err, c.wantErr)
+			}
+			if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
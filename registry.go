@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// targetRegistry remembers the target configs the autoscaler has handed to
+// Scale and Status, so background tasks started at SetConfig know which sets
+// they are responsible for.
+type targetRegistry struct {
+	lock    sync.RWMutex
+	configs map[string]map[string]string
+
+	// members holds the member sets of each target, by target key, as
+	// last registered. subscriptions indexes them by vmssKey onto the
+	// subscriptions they are listed under, keyed by subscriptionKey; the
+	// plugin subscription is the empty ID. Each target only replaces its
+	// own members, so one target cannot drop the subscription another one
+	// names.
+	members       map[string][]scaleSetTarget
+	subscriptions map[string]map[string]string
+}
+
+func newTargetRegistry() *targetRegistry {
+	return &targetRegistry{
+		configs:       make(map[string]map[string]string),
+		members:       make(map[string][]scaleSetTarget),
+		subscriptions: make(map[string]map[string]string),
+	}
+}
+
+// subscriptionKey identifies a scale set across subscriptions.
+func subscriptionKey(subscription, resourceGroup, vmScaleSet string) string {
+	return strings.ToLower(subscription) + ":" + vmssKey(resourceGroup, vmScaleSet)
+}
+
+func targetKey(config map[string]string) string {
+	if path, ok := config[configKeyTargetsFile]; ok {
+		return path
+	}
+	if targets, ok := config[configKeyTargets]; ok {
+		return targets
+	}
+	resourceGroups, ok := config[configKeyResourceGroupList]
+	if !ok {
+		resourceGroups = config[configKeyResourceGroup]
+	}
+	return resourceGroups + "/" + config[configKeyVMSSList]
+}
+
+func (r *targetRegistry) observe(config map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := targetKey(config)
+	r.configs[key] = config
+	if members, err := parseScaleSetTargets(config); err == nil {
+		r.registerLocked(key, members)
+	}
+}
+
+// register records the subscriptions and aliases of member sets of a target
+// found other than by parsing the target config, such as the matches of a
+// pattern.
+func (r *targetRegistry) register(config map[string]string, members []scaleSetTarget) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.registerLocked(targetKey(config), members)
+}
+
+func (r *targetRegistry) registerLocked(key string, members []scaleSetTarget) {
+	r.members[key] = members
+	r.subscriptions = make(map[string]map[string]string, len(r.subscriptions))
+	for _, members := range r.members {
+		for _, member := range members {
+			set := vmssKey(member.resourceGroup, member.vmScaleSet)
+			if r.subscriptions[set] == nil {
+				r.subscriptions[set] = make(map[string]string, 1)
+			}
+			r.subscriptions[set][subscriptionKey(member.subscription, member.resourceGroup, member.vmScaleSet)] = member.subscription
+		}
+	}
+	setAliases.register(key, members)
+}
+
+// overlapping returns the other targets listing any of the scale sets of the
+// target, whose capacity is then counted and scaled by both.
+func (r *targetRegistry) overlapping(config map[string]string) []string {
+	members, err := parseScaleSetTargets(config)
+	if err != nil {
+		return nil
+	}
+	sets := make(map[string]bool, len(members))
+	for _, member := range members {
+		sets[vmssKey(member.resourceGroup, member.vmScaleSet)] = true
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	self := targetKey(config)
+	var overlaps []string
+	for key, other := range r.configs {
+		if key == self {
+			continue
+		}
+		others, err := parseScaleSetTargets(other)
+		if err != nil {
+			continue
+		}
+		for _, member := range others {
+			if sets[vmssKey(member.resourceGroup, member.vmScaleSet)] {
+				overlaps = append(overlaps, key)
+				break
+			}
+		}
+	}
+	sort.Strings(overlaps)
+	return overlaps
+}
+
+// subscription returns the subscription a scale set was listed under, or an
+// empty string for the plugin subscription. A set listed under several
+// subscriptions, which validateSubscriptions rejects, also resolves to the
+// plugin subscription.
+func (r *targetRegistry) subscription(resourceGroup, vmScaleSet string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	subscriptions := r.subscriptions[vmssKey(resourceGroup, vmScaleSet)]
+	if len(subscriptions) != 1 {
+		return ""
+	}
+	for _, subscription := range subscriptions {
+		return subscription
+	}
+	return ""
+}
+
+// listedSubscriptions returns the subscriptions every target lists a scale
+// set under, sorted.
+func (r *targetRegistry) listedSubscriptions(resourceGroup, vmScaleSet string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	subscriptions := make([]string, 0, len(r.subscriptions[vmssKey(resourceGroup, vmScaleSet)]))
+	for _, subscription := range r.subscriptions[vmssKey(resourceGroup, vmScaleSet)] {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Strings(subscriptions)
+	return subscriptions
+}
+
+func (r *targetRegistry) list() []map[string]string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	configs := make([]map[string]string, 0, len(r.configs))
+	for _, config := range r.configs {
+		configs = append(configs, config)
+	}
+	return configs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestRegistrySubscriptions(t *testing.T) {
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	burst := map[string]string{configKeyTargets: "burst:rg/a,rg/b"}
+	plain := map[string]string{configKeyTargets: "rg/a"}
+
+	plugin.targets.observe(burst)
+	if got := plugin.targets.subscription("rg", "a"); got != "burst" {
+		t.Fatalf("rg/a resolves to %q, want burst", got)
+	}
+	if _, err := plugin.scaleSetTargets(burst); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another target listing the same names under the plugin subscription
+	// neither erases the subscription nor goes unnoticed.
+	plugin.targets.observe(plain)
+	if got := plugin.targets.listedSubscriptions("rg", "a"); !equalStrings(got, []string{"", "burst"}) {
+		t.Errorf("rg/a listed under %q, want the plugin subscription and burst", got)
+	}
+	for _, config := range []map[string]string{burst, plain} {
+		if _, err := plugin.scaleSetTargets(config); err == nil || !strings.Contains(err.Error(), "one subscription") {
+			t.Errorf("%s: got %v, want rg/a rejected", config[configKeyTargets], err)
+		}
+	}
+	if got := plugin.targets.subscription("rg", "b"); got != "" {
+		t.Errorf("rg/b resolves to %q, want the plugin subscription", got)
+	}
+}
+
+func TestValidateTargetSpecsSubscriptions(t *testing.T) {
+	if _, err := validateTargetSpecs([]targetSpec{
+		{Subscription: "prod", ResourceGroup: "rg", VMScaleSet: "a"},
+		{Subscription: "prod", ResourceGroup: "rg", VMScaleSet: "a"},
+	}); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("got %v, want the duplicate entry rejected", err)
+	}
+	targets, err := validateTargetSpecs([]targetSpec{
+		{Subscription: "prod", ResourceGroup: "rg", VMScaleSet: "a"},
+		{Subscription: "burst", ResourceGroup: "rg", VMScaleSet: "a"},
+	})
+	if err != nil {
+		t.Fatalf("got %v, want the same names in two subscriptions to be distinct entries", err)
+	}
+	if err := validateDistinctNames(targets); err == nil || !strings.Contains(err.Error(), "prod:rg/a and burst:rg/a") {
+		t.Errorf("got %v, want the shared name rejected", err)
+	}
+}
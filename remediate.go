@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strings"
+	"time"
+)
+
+const defaultFailedInstanceCheckInterval = 5 * time.Minute
+
+type failedInstanceConfig struct {
+	threshold time.Duration
+	interval  time.Duration
+}
+
+func parseFailedInstanceConfig(config map[string]string) (*failedInstanceConfig, error) {
+	thresholdStr, ok := config[configKeyFailedInstanceThreshold]
+	if !ok {
+		return nil, nil
+	}
+	threshold, err := time.ParseDuration(thresholdStr)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyFailedInstanceThreshold, thresholdStr)
+	}
+
+	cfg := &failedInstanceConfig{threshold: threshold, interval: defaultFailedInstanceCheckInterval}
+	if value, ok := config[configKeyFailedInstanceCheckInterval]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyFailedInstanceCheckInterval, value)
+		}
+		cfg.interval = interval
+	}
+	return cfg, nil
+}
+
+// stuckProvisioning reports whether an instance is in a provisioning state
+// it does not leave on its own: failed, or creating for longer than expected.
+func stuckProvisioning(instance vmssInstance) bool {
+	state := strings.ToLower(instance.provisioningState)
+	return strings.HasPrefix(state, "provisioningstate/failed") || state == "provisioningstate/creating"
+}
+
+// runFailedInstanceRemediation periodically deletes instances stuck in
+// provisioning beyond the threshold. They count toward the capacity and
+// block readiness until removed.
+func (t *TargetPlugin) runFailedInstanceRemediation(ctx context.Context, cfg *failedInstanceConfig) {
+	log := t.logger.With("task", "failed_instance_remediation")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.remediateFailedInstances(ctx, config, cfg, log); err != nil {
+					log.Warn("failed to remediate failed instances", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) remediateFailedInstances(ctx context.Context, config map[string]string, cfg *failedInstanceConfig, log hclog.Logger) error {
+	members, err := t.scaleSetTargets(config)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if member.paused {
+			continue
+		}
+		azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+		instances, err := azure.listInstances(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			return err
+		}
+		// Instances still creating carry no provisioning timestamp, so
+		// they are aged from when they were first listed.
+		t.instanceAges.observe(vmssKey(member.resourceGroup, member.vmScaleSet), instances)
+
+		var stuckIDs []string
+		for _, instance := range instances {
+			if !stuckProvisioning(instance) || time.Since(t.instanceAges.since(instance)) < cfg.threshold {
+				continue
+			}
+			log.Warn("Azure instance stuck in provisioning", "vmss_name", member.vmScaleSet,
+				"remote_id", instance.remoteID, "provisioning_state", instance.provisioningState)
+			stuckIDs = append(stuckIDs, instance.instanceID)
+		}
+		if len(stuckIDs) == 0 {
+			continue
+		}
+
+		err = t.replaceStuckInstances(ctx, member, stuckIDs, log)
+		var inProgress *scaleInProgressError
+		if errors.As(err, &inProgress) {
+			log.Debug("skipping failed instance remediation", "vmss_name", member.vmScaleSet, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", member.resourceGroup, member.vmScaleSet, err)
+		}
+	}
+	return nil
+}
+
+// replaceStuckInstances deletes the instances and restores the capacity the
+// scale set had, so Azure provisions replacements.
+func (t *TargetPlugin) replaceStuckInstances(ctx context.Context, member scaleSetTarget, instanceIDs []string, log hclog.Logger) error {
+	id := newOperationID()
+	release, err := t.scaleLocks.tryAcquire([]string{vmssKey(member.resourceGroup, member.vmScaleSet)}, id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx = withOperationID(ctx, id)
+
+	azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+	capacity, err := azure.getCapacity(ctx, member.resourceGroup, member.vmScaleSet)
+	if err != nil {
+		return err
+	}
+	if err := azure.deleteInstances(ctx, member.resourceGroup, member.vmScaleSet, instanceIDs); err != nil {
+		return err
+	}
+	if err := azure.setCapacity(ctx, member.resourceGroup, member.vmScaleSet, capacity); err != nil {
+		return fmt.Errorf("failed to restore capacity %d after remediation: %w", capacity, err)
+	}
+	t.desired.set(member.resourceGroup, member.vmScaleSet, capacity)
+	t.statusCache.invalidate(member.resourceGroup, member.vmScaleSet)
+	log.Info("replaced failed Azure instances", "operation_id", id, "vmss_name", member.vmScaleSet,
+		"instances", instanceIDs, "capacity", capacity)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"strconv"
+)
+
+// automaticRepairsActive reports whether Azure automatic instance repairs are
+// enabled on the scale set and not suspended. The instance view is optional,
+// without it the policy alone decides.
+func automaticRepairsActive(vmss compute.VirtualMachineScaleSet, view *compute.VirtualMachineScaleSetInstanceView) bool {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.AutomaticRepairsPolicy == nil ||
+		vmss.AutomaticRepairsPolicy.Enabled == nil || !*vmss.AutomaticRepairsPolicy.Enabled {
+		return false
+	}
+	if view == nil || view.OrchestrationServices == nil {
+		return true
+	}
+	for _, service := range *view.OrchestrationServices {
+		if service.ServiceName == compute.AutomaticRepairs {
+			return service.ServiceState == compute.Running
+		}
+	}
+	return true
+}
+
+// underRepair reports whether Azure is repairing the instance: it is being
+// reimaged, deleted or recreated while no operation of the plugin holds its
+// scale set, so the transient state is not of the plugin's making.
+func (t *TargetPlugin) underRepair(resourceGroup, vmScaleSet string, instance vmssInstance) bool {
+	return isUpgradeState(instance.provisioningState) && t.scaleLocks.holder([]string{vmssKey(resourceGroup, vmScaleSet)}) == ""
+}
+
+// accountRepairs keeps instances under automatic repair out of the readiness
+// of a set, and in running capacity mode counts those not running toward the
+// capacity, as Azure brings them back on its own. It returns the instances
+// readiness is evaluated on, or nil when they could not be listed.
+func (t *TargetPlugin) accountRepairs(ctx context.Context, resourceGroup, vmScaleSet string, status vmssStatus, capacityMode string, countStarting bool, resp *sdk.TargetStatus, meta map[string]string) []vmssInstance {
+	instances := status.instances
+	if !status.hasInstances {
+		var err error
+		if instances, err = t.azureFor(resourceGroup, vmScaleSet).listInstances(ctx, resourceGroup, vmScaleSet); err != nil {
+			t.logger.Warn("failed to list instances for automatic repairs", "vmss_name", vmScaleSet, "error", err)
+			return nil
+		}
+	}
+
+	settled := make([]vmssInstance, 0, len(instances))
+	var repairing int
+	for _, instance := range instances {
+		if !t.underRepair(resourceGroup, vmScaleSet, instance) {
+			settled = append(settled, instance)
+			continue
+		}
+		repairing++
+		if capacityMode == capacityModeRunning && !instance.countsToward(countStarting) {
+			resp.Count++
+		}
+	}
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "repairing_instances")] = strconv.Itoa(repairing)
+	return settled
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// TestReplayRegressions replays the ARM exchanges of testdata/replay, each
+// directory an Azure response the plugin once got wrong, through Status.
+func TestReplayRegressions(t *testing.T) {
+	cases := []struct {
+		name      string
+		target    map[string]string
+		wantCount int64
+	}{
+		{
+			// The second page holds an instance the first does not, and a
+			// deallocated one the live capacity leaves out.
+			name:      "paging",
+			target:    map[string]string{configKeyCapacityMode: capacityModeLive},
+			wantCount: 3,
+		},
+		{
+			// An instance without an instance view and one in another
+			// casing count; the deleting and deallocated ones do not.
+			name:      "instance_view_quirks",
+			target:    map[string]string{configKeyCapacityMode: capacityModeLive},
+			wantCount: 3,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			nomad := httptest.NewServer(newFakeNomad(t, "fake", func(context.Context) ([]string, error) { return nil, nil }))
+			t.Cleanup(nomad.Close)
+
+			plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+			if err := plugin.SetConfig(map[string]string{
+				configKeySubscriptionID: "replayed",
+				configKeyAzureReplayDir: filepath.Join("testdata", "replay", c.name),
+				"nomad_address":         nomad.URL,
+			}); err != nil {
+				t.Fatalf("SetConfig failed: %v", err)
+			}
+			t.Cleanup(plugin.shutdown)
+
+			target := map[string]string{configKeyTargets: "rg/a", "node_class": "fake"}
+			for key, value := range c.target {
+				target[key] = value
+			}
+			status, err := plugin.Status(target)
+			if err != nil {
+				t.Fatalf("Status failed: %v", err)
+			}
+			if status.Count != c.wantCount {
+				t.Errorf("got count %d, want %d", status.Count, c.wantCount)
+			}
+		})
+	}
+}
+
+// TestRecordReplayRoundTrip records the exchanges of a Status against the
+// simulation, then replays them through Status under another subscription.
+func TestRecordReplayRoundTrip(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 2)
+	nomad := httptest.NewServer(newFakeNomad(t, "fake", fake.remoteIDs("rg", "a")))
+	t.Cleanup(nomad.Close)
+	dir := t.TempDir()
+	target := map[string]string{configKeyTargets: "rg/a", "node_class": "fake", configKeyCapacityMode: capacityModeLive}
+
+	recorder := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	if err := recorder.SetConfig(map[string]string{
+		configKeySimulate:                    "true",
+		configKeySimulateProvisioningLatency: "0s",
+		configKeyAzureRecordDir:              dir,
+		"nomad_address":                      nomad.URL,
+	}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	t.Cleanup(recorder.shutdown)
+	recorded, err := recorder.Status(target)
+	if err != nil {
+		t.Fatalf("recorded Status failed: %v", err)
+	}
+
+	replayer := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	if err := replayer.SetConfig(map[string]string{
+		configKeySubscriptionID: "another",
+		configKeyAzureReplayDir: dir,
+		"nomad_address":         nomad.URL,
+	}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	t.Cleanup(replayer.shutdown)
+	replayed, err := replayer.Status(target)
+	if err != nil {
+		t.Fatalf("replayed Status failed: %v", err)
+	}
+	if replayed.Count != recorded.Count || replayed.Ready != recorded.Ready {
+		t.Errorf("replayed count %d, ready %t, recorded count %d, ready %t",
+			replayed.Count, replayed.Ready, recorded.Count, recorded.Ready)
+	}
+}
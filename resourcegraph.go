@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// resourceGraphAPIVersion is the Microsoft.ResourceGraph API version the
+// plugin speaks. A single Resource Graph query covers any number of resource
+// groups and subscriptions, where ARM needs a call per group or scale set.
+const resourceGraphAPIVersion = "2021-03-01"
+
+const resourceGraphPath = "/providers/Microsoft.ResourceGraph/resources"
+
+type resourceGraphRequest struct {
+	Subscriptions []string             `json:"subscriptions"`
+	Query         string               `json:"query"`
+	Options       resourceGraphOptions `json:"options"`
+}
+
+type resourceGraphOptions struct {
+	ResultFormat string `json:"resultFormat"`
+	SkipToken    string `json:"$skipToken,omitempty"`
+}
+
+type resourceGraphResponse struct {
+	Data      []json.RawMessage `json:"data"`
+	SkipToken string            `json:"$skipToken"`
+}
+
+// queryResourceGraph runs a Resource Graph query over the subscriptions and
+// returns the rows of every page.
+func (ac *AzureController) queryResourceGraph(ctx context.Context, subscriptions []string, query string) ([]json.RawMessage, error) {
+	ctx, done := ac.timeCall(ctx, "resource_graph_query", "", "")
+	defer done()
+
+	request := resourceGraphRequest{
+		Subscriptions: subscriptions,
+		Query:         query,
+		Options:       resourceGraphOptions{ResultFormat: "objectArray"},
+	}
+	var rows []json.RawMessage
+	for {
+		req, err := autorest.CreatePreparer(
+			autorest.AsContentType("application/json; charset=utf-8"),
+			autorest.AsPost(),
+			autorest.WithBaseURL(ac.baseURI),
+			autorest.WithPath(resourceGraphPath),
+			autorest.WithQueryParameters(map[string]interface{}{"api-version": resourceGraphAPIVersion}),
+			autorest.WithJSON(request),
+		).Prepare((&http.Request{}).WithContext(ctx))
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to prepare the resource graph query", err)
+		}
+
+		resp, err := ac.graph.Send(req, azure.DoRetryWithRegistration(ac.graph))
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to send the resource graph query",
+				autorest.NewErrorWithError(err, "resourcegraph", "Resources", resp, "Failure sending request"))
+		}
+		var page resourceGraphResponse
+		err = autorest.Respond(resp,
+			azure.WithErrorUnlessStatusCode(http.StatusOK),
+			autorest.ByUnmarshallingJSON(&page),
+			autorest.ByClosing())
+		if err != nil {
+			return nil, wrapAzureError(ctx, "failed to read the resource graph response",
+				autorest.NewErrorWithError(err, "resourcegraph", "Resources", resp, "Failure responding to request"))
+		}
+		rows = append(rows, page.Data...)
+		if page.SkipToken == "" {
+			return rows, nil
+		}
+		request.Options.SkipToken = page.SkipToken
+	}
+}
+
+// graphList formats values as a KQL list of string literals.
+func graphList(values []string) string {
+	quoted := make([]string, len(values))
+	for idx, value := range values {
+		quoted[idx] = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+	}
+	return "(" + strings.Join(quoted, ", ") + ")"
+}
+
+// graphScaleSetNames returns the names of the scale sets in each of the
+// resource groups of the subscription, keyed by the lower cased group. Groups
+// without scale sets map to an empty list.
+func (ac *AzureController) graphScaleSetNames(ctx context.Context, resourceGroups []string) (map[string][]string, error) {
+	query := "resources" +
+		" | where type =~ 'microsoft.compute/virtualmachinescalesets'" +
+		" | where resourceGroup in~ " + graphList(resourceGroups) +
+		" | project name, resourceGroup"
+	rows, err := ac.queryResourceGraph(ctx, []string{ac.subscriptionID}, query)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string][]string, len(resourceGroups))
+	for _, resourceGroup := range resourceGroups {
+		names[strings.ToLower(resourceGroup)] = []string{}
+	}
+	for _, raw := range rows {
+		var row struct {
+			Name          string `json:"name"`
+			ResourceGroup string `json:"resourceGroup"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return nil, fmt.Errorf("failed to decode resource graph row: %v", err)
+		}
+		key := strings.ToLower(row.ResourceGroup)
+		names[key] = append(names[key], row.Name)
+	}
+	for _, list := range names {
+		sort.Strings(list)
+	}
+	return names, nil
+}
+
+// graphInstances lists the instances of the scale sets of the subscription
+// in one query, keyed by vmssKey. Every set asked for has an entry, empty
+// when it has no instances. Resource Graph carries the power and provisioning
+// states of the instances but neither the time of the provisioning state nor
+// the instance errors and health, so instances listed this way age from when
+// the plugin first saw them. Resource Graph also trails ARM by a few
+// seconds, which Status tolerates but scale operations do not, so those keep
+// listing instances through ARM.
+func (ac *AzureController) graphInstances(ctx context.Context, resourceGroupList, vmScaleSetList []string) (map[string][]vmssInstance, error) {
+	names := make(map[string]string, len(vmScaleSetList))
+	for idx, vmScaleSet := range vmScaleSetList {
+		names[vmssKey(resourceGroupList[idx], vmScaleSet)] = vmScaleSet
+	}
+	query := "computeresources" +
+		" | where type =~ 'microsoft.compute/virtualmachinescalesets/virtualmachines'" +
+		" | where resourceGroup in~ " + graphList(resourceGroupList) +
+		" | extend vmss = tostring(split(id, '/')[8])" +
+		" | where vmss in~ " + graphList(vmScaleSetList) +
+		" | project vmss, resourceGroup, instanceId = tostring(split(id, '/')[10])," +
+		" provisioningState = tostring(properties.provisioningState)," +
+		" powerState = tostring(properties.extended.instanceView.powerState.code)"
+	rows, err := ac.queryResourceGraph(ctx, []string{ac.subscriptionID}, query)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string][]vmssInstance, len(names))
+	for key := range names {
+		instances[key] = []vmssInstance{}
+	}
+	for _, raw := range rows {
+		var row struct {
+			VMSS              string `json:"vmss"`
+			ResourceGroup     string `json:"resourceGroup"`
+			InstanceID        string `json:"instanceId"`
+			ProvisioningState string `json:"provisioningState"`
+			PowerState        string `json:"powerState"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return nil, fmt.Errorf("failed to decode resource graph row: %v", err)
+		}
+		// The lists match groups and sets independently, so pairs of a
+		// group and a set of another group are dropped here.
+		key := vmssKey(row.ResourceGroup, row.VMSS)
+		vmScaleSet, ok := names[key]
+		if !ok {
+			continue
+		}
+		instance := vmssInstance{
+			remoteID:   fmt.Sprintf("%s_%s", vmScaleSet, row.InstanceID),
+			instanceID: row.InstanceID,
+			powerState: row.PowerState,
+		}
+		if row.ProvisioningState != "" {
+			instance.provisioningState = "ProvisioningState/" + strings.ToLower(row.ProvisioningState)
+		}
+		instances[key] = append(instances[key], instance)
+	}
+	return instances, nil
+}
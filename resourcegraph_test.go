@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+// fakeResourceGraph answers Resource Graph queries with pages of rows,
+// handing out the next page for the skip token of the previous one.
+type fakeResourceGraph struct {
+	lock    sync.Mutex
+	pages   []string
+	queries []resourceGraphRequest
+}
+
+func (f *fakeResourceGraph) Do(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var request resourceGraphRequest
+	raw, _ := io.ReadAll(r.Body)
+	_ = json.Unmarshal(raw, &request)
+	f.queries = append(f.queries, request)
+
+	page := 0
+	if request.Options.SkipToken != "" {
+		page = int(request.Options.SkipToken[0] - '0')
+	}
+	body := `{"data":[` + f.pages[page] + `]`
+	if page+1 < len(f.pages) {
+		body += `,"$skipToken":"` + string(rune('0'+page+1)) + `"`
+	}
+	body += `}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func newGraphTestPlugin(graph *fakeResourceGraph) *TargetPlugin {
+	client := autorest.NewClientWithUserAgent(pluginName)
+	client.Sender = graph
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{
+		graph:          client,
+		resourceGraph:  true,
+		baseURI:        "http://fake",
+		subscriptionID: "s",
+		logger:         hclog.NewNullLogger(),
+	}
+	return plugin
+}
+
+func TestGraphList(t *testing.T) {
+	if got := graphList([]string{"rg-1", `it's`}); got != `('rg-1', 'it\'s')` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestPrefetchScaleSets(t *testing.T) {
+	graph := &fakeResourceGraph{pages: []string{
+		`{"name":"web","resourceGroup":"RG-A"},{"name":"api","resourceGroup":"rg-a"}`,
+		`{"name":"batch","resourceGroup":"rg-b"}`,
+	}}
+	plugin := newGraphTestPlugin(graph)
+
+	targets, err := plugin.memberScaleSets(map[string]string{configKeyResourceGroupList: "rg-a,rg-b,rg-c"})
+	if err != nil {
+		t.Fatalf("memberScaleSets: %v", err)
+	}
+	var got []string
+	for _, target := range targets {
+		got = append(got, target.resourceGroup+"/"+target.vmScaleSet)
+	}
+	if strings.Join(got, ",") != "rg-a/api,rg-a/web,rg-b/batch" {
+		t.Errorf("got sets %v", got)
+	}
+	if len(graph.queries) != 2 || graph.queries[1].Options.SkipToken != "1" {
+		t.Fatalf("got queries %+v, want one query over two pages", graph.queries)
+	}
+	if !strings.Contains(graph.queries[0].Query, "('rg-a', 'rg-b', 'rg-c')") || graph.queries[0].Subscriptions[0] != "s" {
+		t.Errorf("got query %+v", graph.queries[0])
+	}
+
+	// The empty group was cached too, so nothing is queried again.
+	if _, err := plugin.memberScaleSets(map[string]string{configKeyResourceGroupList: "rg-a,rg-b,rg-c"}); err != nil {
+		t.Fatalf("memberScaleSets: %v", err)
+	}
+	if len(graph.queries) != 2 {
+		t.Errorf("got %d queries, want the discovery cached", len(graph.queries))
+	}
+}
+
+func TestGraphInstances(t *testing.T) {
+	graph := &fakeResourceGraph{pages: []string{
+		`{"vmss":"WEB","resourceGroup":"rg-a","instanceId":"3","provisioningState":"Succeeded","powerState":"PowerState/running"},` +
+			`{"vmss":"web","resourceGroup":"rg-b","instanceId":"7","provisioningState":"Succeeded","powerState":"PowerState/running"},` +
+			`{"vmss":"api","resourceGroup":"rg-b","instanceId":"1","provisioningState":"Creating","powerState":""}`,
+	}}
+	plugin := newGraphTestPlugin(graph)
+
+	instances, err := plugin.AzureController.graphInstances(context.Background(),
+		[]string{"rg-a", "rg-b", "rg-c"}, []string{"web", "api", "empty"})
+	if err != nil {
+		t.Fatalf("graphInstances: %v", err)
+	}
+	if web := instances[vmssKey("rg-a", "web")]; len(web) != 1 || web[0].remoteID != "web_3" ||
+		web[0].provisioningState != provisioningStateSucceeded || !web[0].running() {
+		t.Errorf("got %+v", web)
+	}
+	if _, ok := instances[vmssKey("rg-b", "web")]; ok {
+		t.Error("kept a set of a group it is not listed in")
+	}
+	if api := instances[vmssKey("rg-b", "api")]; len(api) != 1 || api[0].provisioningState != "ProvisioningState/creating" {
+		t.Errorf("got %+v", api)
+	}
+	if empty, ok := instances[vmssKey("rg-c", "empty")]; !ok || empty == nil || len(empty) != 0 {
+		t.Errorf("got %v for a set without instances, want an empty listing", empty)
+	}
+}
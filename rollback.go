@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// scaleOutFailureNone leaves the sets that grew as they are.
+	scaleOutFailureNone = "none"
+
+	// scaleOutFailureRollback restores the previous capacity of the sets
+	// that grew, so the target is left as it was before the Scale call.
+	scaleOutFailureRollback = "rollback"
+
+	// scaleOutFailureReplan moves the capacity that could not be added to
+	// the failed sets onto the sets that grew successfully.
+	scaleOutFailureReplan = "replan"
+)
+
+func parseScaleOutFailurePolicy(config map[string]string) (string, error) {
+	policy, ok := config[configKeyScaleOutFailurePolicy]
+	if !ok {
+		return scaleOutFailureNone, nil
+	}
+	switch policy {
+	case scaleOutFailureNone, scaleOutFailureRollback, scaleOutFailureReplan:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be one of %q, %q or %q", configKeyScaleOutFailurePolicy, policy,
+		scaleOutFailureNone, scaleOutFailureRollback, scaleOutFailureReplan)
+}
+
+// scaleOutPlan is the outcome of a scale out fan-out. Sets with a zero target
+// were not changed.
+type scaleOutPlan struct {
+	resourceGroups []string
+	vmScaleSets    []string
+	previous       []int64
+	targets        []int64
+	failed         []bool
+}
+
+// recoverScaleOut applies the failure policy after part of a scale out fan-out
+// failed. Failures are returned, the original errors are reported by the
+// caller.
+func (t *TargetPlugin) recoverScaleOut(ctx context.Context, policy string, plan scaleOutPlan, log hclog.Logger) error {
+	var succeeded []int
+	var missing int64
+	for idx := range plan.vmScaleSets {
+		switch {
+		case plan.targets[idx] == 0:
+		case plan.failed[idx]:
+			if delta := plan.targets[idx] - plan.previous[idx]; delta > 0 {
+				missing += delta
+			}
+		default:
+			succeeded = append(succeeded, idx)
+		}
+	}
+	if len(succeeded) == 0 {
+		return nil
+	}
+
+	capacities := make(map[int]int64, len(succeeded))
+	switch policy {
+	case scaleOutFailureRollback:
+		for _, idx := range succeeded {
+			capacities[idx] = plan.previous[idx]
+		}
+	case scaleOutFailureReplan:
+		if missing == 0 {
+			return nil
+		}
+		share := missing / int64(len(succeeded))
+		remainder := missing % int64(len(succeeded))
+		for _, idx := range succeeded {
+			capacities[idx] = plan.targets[idx] + share
+			if remainder > 0 {
+				capacities[idx]++
+				remainder--
+			}
+		}
+	}
+
+	var result *multierror.Error
+	for _, idx := range succeeded {
+		resourceGroup, vmScaleSet := plan.resourceGroups[idx], plan.vmScaleSets[idx]
+		log.Warn("recovering from partial scale out", "policy", policy, "vmss_name", vmScaleSet,
+			"from", plan.targets[idx], "to", capacities[idx])
+		if err := t.azureFor(resourceGroup, vmScaleSet).setCapacity(ctx, resourceGroup, vmScaleSet, capacities[idx]); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to %s %s/%s: %w", policy, resourceGroup, vmScaleSet, err))
+			continue
+		}
+		t.desired.set(resourceGroup, vmScaleSet, capacities[idx])
+		t.statusCache.invalidate(resourceGroup, vmScaleSet)
+	}
+	return result.ErrorOrNil()
+}
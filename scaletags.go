@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tagAutoscalerPolicy    = "nomad-autoscaler-policy"
+	tagAutoscalerInstance  = "nomad-autoscaler-instance"
+	tagAutoscalerLastScale = "nomad-autoscaler-last-scale"
+	// tagAutoscalerOperation ties the set and the instances a scale created
+	// to the operation ID of the scale event, as logged and published.
+	tagAutoscalerOperation = "nomad-autoscaler-operation"
+	// tagAutoscalerLastChange records the last capacity change on the scale
+	// set itself, for auditors without access to Nomad.
+	tagAutoscalerLastChange = "nomad-autoscaler-last-change"
+
+	// maxTagValueLength is the longest tag value Azure accepts.
+	maxTagValueLength = 256
+)
+
+// scaleEventTags holds the tags written whenever the plugin changes the
+// capacity of a member scale set.
+type scaleEventTags struct {
+	tags      map[string]string
+	instances bool
+}
+
+// parseScaleEventTags returns the tagging settings of a target, or nil when
+// tagging is disabled. Static tags are given as "key=value" pairs and are
+// complemented by the policy name, the autoscaler instance and a timestamp.
+func (t *TargetPlugin) parseScaleEventTags(config map[string]string) (*scaleEventTags, error) {
+	_, hasTags := config[configKeyScaleEventTags]
+	enabled := hasTags
+	if value, ok := config[configKeyScaleEventTagging]; ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyScaleEventTagging, value, err)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	tags, err := parseKeyValueList(config[configKeyScaleEventTags])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", configKeyScaleEventTags, err)
+	}
+	if policy, ok := config[configKeyPolicyName]; ok {
+		tags[tagAutoscalerPolicy] = policy
+	}
+	if t.instanceName != "" {
+		tags[tagAutoscalerInstance] = t.instanceName
+	}
+
+	cfg := &scaleEventTags{tags: tags}
+	if value, ok := config[configKeyScaleEventTagInstances]; ok {
+		if cfg.instances, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyScaleEventTagInstances, value, err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseKeyValueList(list string) (map[string]string, error) {
+	values := make(map[string]string)
+	if strings.TrimSpace(list) == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("entry %q must be in the key=value form", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+// snapshotInstancesForTagging records the instances present before a scale out
+// so the ones created by it can be told apart afterwards.
+func (t *TargetPlugin) snapshotInstancesForTagging(ctx context.Context, resourceGroup, vmScaleSet string, tags *scaleEventTags, log hclog.Logger) map[string]map[string]string {
+	if tags == nil || !tags.instances {
+		return nil
+	}
+	instances, err := t.azureFor(resourceGroup, vmScaleSet).listInstanceTags(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to list instances before scaling", "vmss_name", vmScaleSet, "error", err)
+		return nil
+	}
+	return instances
+}
+
+// lastChangeAnnotation describes a capacity change of a scale set, such as
+// "2->5 at 2024-01-02T15:04:05Z by policy web", cut to the tag value limit.
+func lastChangeAnnotation(from, to int64, at time.Time, policy string) string {
+	annotation := fmt.Sprintf("%d->%d at %s", from, to, at.UTC().Format(time.RFC3339))
+	if policy != "" {
+		annotation += " by policy " + policy
+	}
+	if len(annotation) > maxTagValueLength {
+		annotation = annotation[:maxTagValueLength]
+	}
+	return annotation
+}
+
+// withActionPolicy falls back to the ID of the policy behind the action for
+// the policy tag when the target config names no policy.
+func (s *scaleEventTags) withActionPolicy(action sdk.ScalingAction) {
+	if s == nil || s.tags[tagAutoscalerPolicy] != "" {
+		return
+	}
+	if policyID := actionPolicyID(action); policyID != "" {
+		s.tags[tagAutoscalerPolicy] = policyID
+	}
+}
+
+// applyScaleEventTags tags the scale set after a capacity change from one
+// count to another and, when before is provided, every instance that did not
+// exist prior to the change. Both carry the operation ID of the scale, so
+// individual instances can be traced to the decision that created them.
+// Tagging is best-effort and never fails the scaling action.
+func (t *TargetPlugin) applyScaleEventTags(ctx context.Context, resourceGroup, vmScaleSet string, tags *scaleEventTags, from, to int64, before map[string]map[string]string, log hclog.Logger) {
+	if tags == nil {
+		return
+	}
+
+	now := time.Now()
+	values := make(map[string]string, len(tags.tags)+1)
+	for key, value := range tags.tags {
+		values[key] = value
+	}
+	values[tagAutoscalerLastScale] = now.UTC().Format(time.RFC3339)
+	if id := operationID(ctx); id != "" {
+		values[tagAutoscalerOperation] = id
+	}
+
+	// The change is only recorded on the scale set, instances keep the tags
+	// of the change that created them.
+	setValues := make(map[string]string, len(values)+1)
+	for key, value := range values {
+		setValues[key] = value
+	}
+	setValues[tagAutoscalerLastChange] = lastChangeAnnotation(from, to, now, tags.tags[tagAutoscalerPolicy])
+
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	if err := azure.tagScaleSet(ctx, resourceGroup, vmScaleSet, setValues); err != nil {
+		log.Warn("failed to tag Azure ScaleSet", "vmss_name", vmScaleSet, "error", err)
+	}
+
+	if before == nil {
+		return
+	}
+	after, err := azure.listInstanceTags(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to list instances after scaling", "vmss_name", vmScaleSet, "error", err)
+		return
+	}
+	for instanceID := range after {
+		if _, ok := before[instanceID]; ok {
+			continue
+		}
+		if err := azure.tagInstance(ctx, resourceGroup, vmScaleSet, instanceID, values); err != nil {
+			log.Warn("failed to tag new instance", "vmss_name", vmScaleSet, "instance_id", instanceID, "error", err)
+		}
+	}
+}
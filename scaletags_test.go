@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+// fakeTaggingARM lists the instances of a scale set and records the bodies
+// of the instance updates, keyed by instance ID.
+type fakeTaggingARM struct {
+	lock      sync.Mutex
+	instances []string
+	updates   map[string]string
+}
+
+func (f *fakeTaggingARM) Do(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body := `{}`
+	path := strings.ToLower(r.URL.Path)
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/virtualmachines"):
+		var values []string
+		for _, id := range f.instances {
+			values = append(values, `{"instanceId":"`+id+`"}`)
+		}
+		body = `{"value":[` + strings.Join(values, ",") + `]}`
+	case r.Method == http.MethodPut && strings.Contains(path, "/virtualmachines/"):
+		raw, _ := io.ReadAll(r.Body)
+		f.updates[path[strings.LastIndex(path, "/")+1:]] = string(raw)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestScaleEventTagsWithActionPolicy(t *testing.T) {
+	action := sdk.ScalingAction{Meta: map[string]interface{}{actionMetaKeyPolicyID: "policy-1"}}
+
+	tags := &scaleEventTags{tags: map[string]string{}}
+	tags.withActionPolicy(action)
+	if tags.tags[tagAutoscalerPolicy] != "policy-1" {
+		t.Errorf("got policy tag %q, want the action policy", tags.tags[tagAutoscalerPolicy])
+	}
+
+	named := &scaleEventTags{tags: map[string]string{tagAutoscalerPolicy: "web"}}
+	named.withActionPolicy(action)
+	if named.tags[tagAutoscalerPolicy] != "web" {
+		t.Errorf("got policy tag %q, want the configured policy name kept", named.tags[tagAutoscalerPolicy])
+	}
+
+	var disabled *scaleEventTags
+	disabled.withActionPolicy(action)
+}
+
+func TestApplyScaleEventTagsTracesNewInstances(t *testing.T) {
+	arm := &fakeTaggingARM{instances: []string{"1", "2"}, updates: make(map[string]string)}
+	vmss := compute.NewVirtualMachineScaleSetsClientWithBaseURI("http://fake", "s")
+	vmss.Sender = arm
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = arm
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmss: vmss, vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+
+	tags := &scaleEventTags{tags: map[string]string{tagAutoscalerPolicy: "policy-1"}, instances: true}
+	before := map[string]map[string]string{"1": {}}
+	ctx := withOperationID(context.Background(), "op-1")
+	plugin.applyScaleEventTags(ctx, "rg", "vmss", tags, 1, 2, before, hclog.NewNullLogger())
+
+	if _, ok := arm.updates["1"]; ok {
+		t.Error("tagged an instance that existed before the scale out")
+	}
+	update, ok := arm.updates["2"]
+	if !ok {
+		t.Fatal("did not tag the new instance")
+	}
+	for _, want := range []string{`"nomad-autoscaler-operation":"op-1"`, `"nomad-autoscaler-policy":"policy-1"`} {
+		if !strings.Contains(update, want) {
+			t.Errorf("new instance update %s lacks %s", update, want)
+		}
+	}
+}
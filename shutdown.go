@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownDrainPeriod = 30 * time.Second
+
+func parseShutdownDrainPeriod(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyShutdownDrainPeriod]
+	if !ok {
+		return defaultShutdownDrainPeriod, nil
+	}
+	period, err := time.ParseDuration(value)
+	if err != nil || period < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyShutdownDrainPeriod, value)
+	}
+	return period, nil
+}
+
+// errShuttingDown is returned by Scale once a shutdown has begun.
+var errShuttingDown = errors.New("plugin is shutting down, not starting new scale operations")
+
+// shutdownState is shared by the plugin and its signal handler.
+type shutdownState struct {
+	stopping    atomic.Bool
+	drainPeriod atomic.Int64
+}
+
+// handleShutdownSignals shuts the plugin down gracefully on SIGTERM and exits
+// the process. It is only installed when running as an external plugin; the
+// internal plugin leaves signal handling to the autoscaler.
+func (t *TargetPlugin) handleShutdownSignals() {
+	t.shutdownState.drainPeriod.Store(int64(defaultShutdownDrainPeriod))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		t.shutdown()
+		os.Exit(0)
+	}()
+}
+
+// shutdown stops accepting scale operations, waits up to the drain period for
+// the running ones and logs how each of them ended.
+func (t *TargetPlugin) shutdown() {
+	t.shutdownState.stopping.Store(true)
+	period := time.Duration(t.shutdownState.drainPeriod.Load())
+
+	running := t.inFlight.list()
+	t.logger.Info("shutting down", "in_flight_operations", len(running), "drain_period", period)
+
+	deadline := time.Now().Add(period)
+	for len(t.inFlight.list()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	remaining := t.inFlight.list()
+	for id, op := range running {
+		if _, ok := remaining[id]; ok {
+			t.logger.Warn("abandoning in-flight scale operation", "operation_id", id, "target", op.Target,
+				"desired_count", op.Desired, "started", op.Started, "checkpointed", t.operations.persistent())
+			continue
+		}
+		t.logger.Info("scale operation completed during shutdown", "operation_id", id, "target", op.Target,
+			"desired_count", op.Desired)
+	}
+
+	t.canaries.cancelAll()
+	if t.stopBackground != nil {
+		t.stopBackground()
+	}
+	stopDebugServer(t.debugServer)
+	t.telemetry.stop()
+	t.auditLog.close()
+	t.authorizers.clear()
+	t.logger.Info("shutdown complete")
+}
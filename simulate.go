@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSimulateProvisioningLatency = time.Minute
+	defaultSimulateInitialCapacity     = 1
+
+	// simulatedSubscriptionID is used when simulating without a
+	// subscription configured.
+	simulatedSubscriptionID = "simulated"
+)
+
+// simulation configures the simulate mode, where the ARM clients are served
+// by an in-memory fleet and no request reaches Azure.
+type simulation struct {
+	// latency is how long a new instance spends being created before it
+	// reports the succeeded provisioning state and the running power state.
+	latency         time.Duration
+	initialCapacity int64
+}
+
+func parseSimulation(config map[string]string) (*simulation, error) {
+	value, ok := config[configKeySimulate]
+	if !ok {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", configKeySimulate, value, err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if config[configKeyAzureReplayDir] != "" {
+		return nil, fmt.Errorf("%s cannot be combined with %s", configKeySimulate, configKeyAzureReplayDir)
+	}
+
+	sim := &simulation{latency: defaultSimulateProvisioningLatency, initialCapacity: defaultSimulateInitialCapacity}
+	if value, ok := config[configKeySimulateProvisioningLatency]; ok {
+		if sim.latency, err = time.ParseDuration(value); err != nil || sim.latency < 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a non-negative duration", configKeySimulateProvisioningLatency, value)
+		}
+	}
+	if value, ok := config[configKeySimulateInitialCapacity]; ok {
+		if sim.initialCapacity, err = strconv.ParseInt(value, 10, 64); err != nil || sim.initialCapacity < 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", configKeySimulateInitialCapacity, value)
+		}
+	}
+	return sim, nil
+}
+
+// simulatedFleet holds the simulated scale sets. It outlives a single
+// SetConfig, so a reloaded plugin finds the fleet as it left it.
+var simulatedFleet = &simFleet{sets: make(map[string]*simScaleSet)}
+
+type simFleet struct {
+	lock sync.Mutex
+	sets map[string]*simScaleSet
+}
+
+// simScaleSet is a simulated scale set. Scale sets are created on first use
+// with the initial capacity, so any name in the target config is valid.
+type simScaleSet struct {
+	id         string
+	name       string
+	tags       map[string]string
+	instances  []*simInstance
+	nextID     int
+	generation int
+	changedAt  time.Time
+}
+
+type simInstance struct {
+	id        string
+	createdAt time.Time
+	tags      map[string]string
+	protected bool
+}
+
+func (s *simScaleSet) etag() string {
+	return fmt.Sprintf("W/\"%d\"", s.generation)
+}
+
+// resize adds instances, created now, or removes the newest ones until the
+// scale set has capacity instances.
+func (s *simScaleSet) resize(capacity int64, now time.Time) {
+	for int64(len(s.instances)) < capacity {
+		s.instances = append(s.instances, &simInstance{id: strconv.Itoa(s.nextID), createdAt: now, tags: make(map[string]string)})
+		s.nextID++
+	}
+	// Like Azure, a capacity decrease leaves instances protected from
+	// scale in alone, removing the newest of the others.
+	for idx := len(s.instances) - 1; idx >= 0 && int64(len(s.instances)) > capacity; idx-- {
+		if !s.instances[idx].protected {
+			s.instances = append(s.instances[:idx], s.instances[idx+1:]...)
+		}
+	}
+	s.generation++
+	s.changedAt = now
+}
+
+func (s *simScaleSet) instance(id string) *simInstance {
+	for _, instance := range s.instances {
+		if instance.id == id {
+			return instance
+		}
+	}
+	return nil
+}
+
+// simulateSender answers the ARM requests the plugin makes from the
+// simulated fleet.
+type simulateSender struct {
+	sim   *simulation
+	fleet *simFleet
+}
+
+func newSimulateSender(sim *simulation) autorest.Sender {
+	return &simulateSender{sim: sim, fleet: simulatedFleet}
+}
+
+func (s *simulateSender) Do(r *http.Request) (*http.Response, error) {
+	// subscriptions/{s}/resourceGroups/{rg}/providers/{namespace}/{type}/...
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	lower := strings.Split(strings.ToLower(strings.Trim(r.URL.Path, "/")), "/")
+	if len(lower) < 7 || lower[0] != "subscriptions" || lower[2] != "resourcegroups" || lower[4] != "providers" {
+		return simulatedError(r, http.StatusNotFound, "NotFound", "not simulated"), nil
+	}
+	switch lower[5] + "/" + lower[6] {
+	case "microsoft.insights/autoscalesettings":
+		return simulatedJSON(r, http.StatusOK, map[string]interface{}{"value": []interface{}{}}, ""), nil
+	case "microsoft.compute/virtualmachinescalesets":
+	default:
+		return simulatedError(r, http.StatusNotFound, "NotFound", "not simulated"), nil
+	}
+
+	s.fleet.lock.Lock()
+	defer s.fleet.lock.Unlock()
+	now := time.Now()
+
+	prefix := strings.Join(lower[:4], "/") + "/"
+	if len(segments) == 7 {
+		values := []interface{}{}
+		for key, set := range s.fleet.sets {
+			if strings.HasPrefix(key, prefix) {
+				values = append(values, s.renderScaleSet(set))
+			}
+		}
+		return simulatedJSON(r, http.StatusOK, map[string]interface{}{"value": values}, ""), nil
+	}
+
+	key := prefix + lower[7]
+	set, ok := s.fleet.sets[key]
+	if !ok {
+		set = &simScaleSet{id: "/" + strings.Join(segments[:8], "/"), name: segments[7], tags: make(map[string]string)}
+		set.resize(s.sim.initialCapacity, now.Add(-s.sim.latency))
+		s.fleet.sets[key] = set
+	}
+
+	switch rest := strings.Join(lower[8:], "/"); {
+	case rest == "" && r.Method == http.MethodGet:
+		return simulatedJSON(r, http.StatusOK, s.renderScaleSet(set), set.etag()), nil
+	case rest == "" && r.Method == http.MethodPatch:
+		if match := r.Header.Get("If-Match"); match != "" && match != set.etag() {
+			return simulatedError(r, http.StatusPreconditionFailed, "PreconditionFailed", "the scale set has changed"), nil
+		}
+		var update struct {
+			Sku *struct {
+				Capacity *int64 `json:"capacity"`
+			} `json:"sku"`
+			Tags map[string]string `json:"tags"`
+		}
+		if err := decodeSimulatedBody(r, &update); err != nil {
+			return simulatedError(r, http.StatusBadRequest, "InvalidRequestContent", err.Error()), nil
+		}
+		if update.Sku != nil && update.Sku.Capacity != nil {
+			set.resize(*update.Sku.Capacity, now)
+		}
+		if update.Tags != nil {
+			set.tags = update.Tags
+			set.generation++
+		}
+		return simulatedJSON(r, http.StatusOK, s.renderScaleSet(set), set.etag()), nil
+	case rest == "instanceview" && r.Method == http.MethodGet:
+		return simulatedJSON(r, http.StatusOK, s.renderInstanceView(set, now), ""), nil
+	case strings.HasPrefix(rest, "providers/microsoft.authorization/locks"),
+		strings.HasPrefix(rest, "providers/microsoft.policyinsights/policystates"):
+		// Simulated sets are never locked nor denied by a policy.
+		return simulatedJSON(r, http.StatusOK, map[string]interface{}{"value": []interface{}{}}, ""), nil
+	case rest == "delete" && r.Method == http.MethodPost:
+		var request struct {
+			InstanceIDs []string `json:"instanceIds"`
+		}
+		if err := decodeSimulatedBody(r, &request); err != nil {
+			return simulatedError(r, http.StatusBadRequest, "InvalidRequestContent", err.Error()), nil
+		}
+		deleted := make(map[string]bool, len(request.InstanceIDs))
+		for _, id := range request.InstanceIDs {
+			deleted[id] = true
+		}
+		kept := set.instances[:0]
+		for _, instance := range set.instances {
+			if !deleted[instance.id] {
+				kept = append(kept, instance)
+			}
+		}
+		set.instances = kept
+		set.generation++
+		set.changedAt = now
+		return simulatedJSON(r, http.StatusOK, nil, ""), nil
+	case rest == "rollingupgrades/latest":
+		return simulatedError(r, http.StatusNotFound, "NotFound", "the scale set has not been upgraded"), nil
+	case rest == "virtualmachines" && r.Method == http.MethodGet:
+		// The only filter the plugin sends selects instances reporting a
+		// power state, which those still being created do not.
+		filtered := r.URL.Query().Get("$filter") != ""
+		values := []interface{}{}
+		for _, instance := range set.instances {
+			if filtered && s.provisioning(instance, now) {
+				continue
+			}
+			values = append(values, s.renderInstance(set, instance, now))
+		}
+		return simulatedJSON(r, http.StatusOK, map[string]interface{}{"value": values}, ""), nil
+	case len(lower) == 10 && lower[8] == "virtualmachines":
+		instance := set.instance(lower[9])
+		if instance == nil {
+			return simulatedError(r, http.StatusNotFound, "NotFound", fmt.Sprintf("instance %s not found", lower[9])), nil
+		}
+		if r.Method == http.MethodPut {
+			var update struct {
+				Tags       map[string]string `json:"tags"`
+				Properties *struct {
+					ProtectionPolicy *struct {
+						ProtectFromScaleIn *bool `json:"protectFromScaleIn"`
+					} `json:"protectionPolicy"`
+				} `json:"properties"`
+			}
+			if err := decodeSimulatedBody(r, &update); err != nil {
+				return simulatedError(r, http.StatusBadRequest, "InvalidRequestContent", err.Error()), nil
+			}
+			if update.Tags != nil {
+				instance.tags = update.Tags
+			}
+			if p := update.Properties; p != nil && p.ProtectionPolicy != nil && p.ProtectionPolicy.ProtectFromScaleIn != nil {
+				instance.protected = *p.ProtectionPolicy.ProtectFromScaleIn
+			}
+		}
+		return simulatedJSON(r, http.StatusOK, s.renderInstance(set, instance, now), ""), nil
+	}
+	return simulatedError(r, http.StatusNotFound, "NotFound", "not simulated"), nil
+}
+
+// provisioning reports whether the instance is still being created.
+func (s *simulateSender) provisioning(instance *simInstance, now time.Time) bool {
+	return now.Sub(instance.createdAt) < s.sim.latency
+}
+
+// renderScaleSet reports the scale set as updating while any instance is
+// being created, as Azure does during a capacity change.
+func (s *simulateSender) renderScaleSet(set *simScaleSet) map[string]interface{} {
+	state := "Succeeded"
+	now := time.Now()
+	for _, instance := range set.instances {
+		if s.provisioning(instance, now) {
+			state = "Updating"
+			break
+		}
+	}
+	return map[string]interface{}{
+		"id":       set.id,
+		"name":     set.name,
+		"location": "simulated",
+		"tags":     set.tags,
+		"sku":      map[string]interface{}{"name": "Simulated", "tier": "Standard", "capacity": len(set.instances)},
+		"properties": map[string]interface{}{
+			"provisioningState": state,
+		},
+	}
+}
+
+// renderInstanceView reports the scale set as updating while any instance
+// is being created, which is what keeps Status from reporting ready.
+func (s *simulateSender) renderInstanceView(set *simScaleSet, now time.Time) map[string]interface{} {
+	counts := make(map[string]int)
+	for _, instance := range set.instances {
+		counts[s.provisioningState(instance, now)]++
+	}
+	state := provisioningStateSucceeded
+	summary := make([]interface{}, 0, len(counts))
+	for code, count := range counts {
+		if code != provisioningStateSucceeded {
+			state = "ProvisioningState/updating"
+		}
+		summary = append(summary, map[string]interface{}{"code": code, "count": count})
+	}
+	return map[string]interface{}{
+		"statuses": []interface{}{
+			map[string]interface{}{"code": state, "level": "Info", "time": set.changedAt.UTC().Format(time.RFC3339)},
+		},
+		"virtualMachine": map[string]interface{}{"statusesSummary": summary},
+	}
+}
+
+func (s *simulateSender) provisioningState(instance *simInstance, now time.Time) string {
+	if s.provisioning(instance, now) {
+		return "ProvisioningState/creating"
+	}
+	return provisioningStateSucceeded
+}
+
+func (s *simulateSender) renderInstance(set *simScaleSet, instance *simInstance, now time.Time) map[string]interface{} {
+	statuses := []interface{}{
+		map[string]interface{}{
+			"code":  s.provisioningState(instance, now),
+			"level": "Info",
+			"time":  instance.createdAt.Add(s.sim.latency).UTC().Format(time.RFC3339),
+		},
+	}
+	if !s.provisioning(instance, now) {
+		statuses = append(statuses, map[string]interface{}{"code": "PowerState/running", "level": "Info"})
+	}
+	return map[string]interface{}{
+		"id":         set.id + "/virtualMachines/" + instance.id,
+		"name":       set.name + "_" + instance.id,
+		"instanceId": instance.id,
+		"tags":       instance.tags,
+		"properties": map[string]interface{}{
+			"provisioningState": "Succeeded",
+			"instanceView":      map[string]interface{}{"statuses": statuses},
+			"protectionPolicy":  map[string]interface{}{"protectFromScaleIn": instance.protected},
+		},
+	}
+}
+
+func decodeSimulatedBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func simulatedJSON(r *http.Request, status int, body interface{}, etag string) *http.Response {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(string(data))),
+		Request:    r,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	return resp
+}
+
+func simulatedError(r *http.Request, status int, code, message string) *http.Response {
+	return faultResponse(r, status, code, "simulated: "+message)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+	"sync"
+)
+
+// scaleSnapshot holds what one Scale call read of its member scale sets, so
+// every step of the operation works from the same reads rather than going
+// back to ARM.
+type scaleSnapshot struct {
+	sets []*setSnapshot
+}
+
+type setSnapshot struct {
+	resourceGroup string
+	vmScaleSet    string
+	vmss          compute.VirtualMachineScaleSet
+	capacity      int64
+	etag          string
+
+	// running is listed on first use only, as a scale out does not need
+	// it. withHealth lists it with the application health of each
+	// instance, and withMaintenance with its pending maintenance.
+	// excludeRepairs leaves out instances in a transient state, which on
+	// a set with automatic repairs are being repaired.
+	lock            sync.Mutex
+	running         []vmssInstance
+	hasRunning      bool
+	withHealth      bool
+	withMaintenance bool
+	excludeRepairs  bool
+}
+
+// takeScaleSnapshot reads every member scale set of a target. Members which
+// do not exist and may be skipped are marked missing and paused, with a zero
+// capacity.
+func (t *TargetPlugin) takeScaleSnapshot(ctx context.Context, members []scaleSetTarget) (*scaleSnapshot, error) {
+	snapshot := &scaleSnapshot{sets: make([]*setSnapshot, len(members))}
+	for idx, member := range members {
+		vmss, err := t.azureFor(member.resourceGroup, member.vmScaleSet).vmss.Get(ctx, member.resourceGroup, member.vmScaleSet)
+		if err != nil {
+			err = wrapAzureError(ctx, "failed to get Azure vmss", err)
+			if !member.skipMissing || !isAzureNotFound(err) {
+				return nil, err
+			}
+			members[idx].missing, members[idx].paused = true, true
+			snapshot.sets[idx] = &setSnapshot{resourceGroup: member.resourceGroup, vmScaleSet: member.vmScaleSet}
+			continue
+		}
+		snapshot.sets[idx] = &setSnapshot{
+			resourceGroup: member.resourceGroup,
+			vmScaleSet:    member.vmScaleSet,
+			vmss:          vmss,
+			capacity:      ptr.PtrToInt64(vmss.Sku.Capacity),
+			etag:          etag(vmss),
+		}
+	}
+	return snapshot, nil
+}
+
+// capacities returns the capacity of every set, in member order.
+func (s *scaleSnapshot) capacities() []int64 {
+	capacities := make([]int64, len(s.sets))
+	for idx, set := range s.sets {
+		capacities[idx] = set.capacity
+	}
+	return capacities
+}
+
+// runningRemoteIDs returns the remote IDs of the running instances of the
+// set, the scale in candidates. The instances are listed once per Scale.
+func (s *setSnapshot) runningRemoteIDs(ctx context.Context, azure *AzureController) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.hasRunning {
+		list := azure.listRunningInstances
+		if s.withHealth || s.withMaintenance {
+			list = azure.listRunningInstancesWithHealth
+		}
+		running, err := list(ctx, s.resourceGroup, s.vmScaleSet)
+		if err != nil {
+			return nil, err
+		}
+		s.running, s.hasRunning = running, true
+	}
+	remoteIDs := make([]string, 0, len(s.running))
+	for _, instance := range s.running {
+		if s.excludeRepairs && isUpgradeState(instance.provisioningState) {
+			continue
+		}
+		remoteIDs = append(remoteIDs, instance.remoteID)
+	}
+	return remoteIDs, nil
+}
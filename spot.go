@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpotEvictionNodeMeta      = "azure.spot.eviction_scheduled"
+	defaultSpotEvictionDrainDeadline = 25 * time.Second
+)
+
+type spotEvictionConfig struct {
+	interval      time.Duration
+	nodeMeta      string
+	drainDeadline time.Duration
+	compensate    bool
+}
+
+func parseSpotEvictionConfig(config map[string]string) (*spotEvictionConfig, error) {
+	intervalStr, ok := config[configKeySpotEvictionInterval]
+	if !ok {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeySpotEvictionInterval, intervalStr)
+	}
+
+	cfg := &spotEvictionConfig{
+		interval:      interval,
+		nodeMeta:      defaultSpotEvictionNodeMeta,
+		drainDeadline: defaultSpotEvictionDrainDeadline,
+		compensate:    true,
+	}
+	if value, ok := config[configKeySpotEvictionNodeMeta]; ok {
+		cfg.nodeMeta = value
+	}
+	if value, ok := config[configKeySpotEvictionDrainDeadline]; ok {
+		if cfg.drainDeadline, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeySpotEvictionDrainDeadline, value, err)
+		}
+	}
+	if value, ok := config[configKeySpotEvictionCompensate]; ok {
+		if cfg.compensate, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeySpotEvictionCompensate, value, err)
+		}
+	}
+	return cfg, nil
+}
+
+// spotEvictionWatcher remembers which instances have already been handled so
+// a lingering signal does not drain or compensate twice.
+type spotEvictionWatcher struct {
+	lock    sync.Mutex
+	handled map[string]time.Time
+}
+
+func newSpotEvictionWatcher() *spotEvictionWatcher {
+	return &spotEvictionWatcher{handled: make(map[string]time.Time)}
+}
+
+// claim marks remoteID as handled, returning false if it already was.
+func (w *spotEvictionWatcher) claim(remoteID string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.handled[remoteID]; ok {
+		return false
+	}
+	w.handled[remoteID] = time.Now()
+	return true
+}
+
+// forget drops handled instances that are no longer present so the map does
+// not grow forever.
+func (w *spotEvictionWatcher) forget(present map[string]struct{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for remoteID := range w.handled {
+		if _, ok := present[remoteID]; !ok {
+			delete(w.handled, remoteID)
+		}
+	}
+}
+
+// runSpotEvictionWatcher periodically looks for spot instances about to be, or
+// already, evicted. Nodes flagged through their Nomad meta by an agent watching
+// Azure Scheduled Events are drained straight away, and the lost capacity is
+// added to the remaining member sets so the pool recovers before the eviction
+// lands.
+func (t *TargetPlugin) runSpotEvictionWatcher(ctx context.Context, cfg *spotEvictionConfig) {
+	log := t.logger.With("task", "spot_eviction")
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.handleSpotEvictions(ctx, config, cfg, log); err != nil {
+					log.Warn("failed to handle spot evictions", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) handleSpotEvictions(ctx context.Context, config map[string]string, cfg *spotEvictionConfig, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]struct{})
+	evicted := make([]int64, len(vmScaleSetList))
+	var total int64
+	for idx, vmScaleSet := range vmScaleSetList {
+		azure := t.azureFor(resourceGroupList[idx], vmScaleSet)
+		vmss, err := azure.vmss.Get(ctx, resourceGroupList[idx], vmScaleSet)
+		if err != nil {
+			return wrapAzureError(ctx, "failed to get Azure vmss", err)
+		}
+		if !isSpotScaleSet(vmss) {
+			continue
+		}
+
+		instances, err := azure.listInstances(ctx, resourceGroupList[idx], vmScaleSet)
+		if err != nil {
+			return err
+		}
+		for _, instance := range instances {
+			remoteID := strings.ToLower(instance.remoteID)
+			present[remoteID] = struct{}{}
+
+			node := nodes[remoteID]
+			signalled := node != nil && isTruthy(node.Meta[cfg.nodeMeta])
+			// Spot sets using the Deallocate eviction policy keep evicted
+			// instances around in a deallocated state.
+			deallocated := instance.powerState == "PowerState/deallocated"
+			if !signalled && !deallocated {
+				continue
+			}
+			if !t.spotEvictions.claim(remoteID) {
+				continue
+			}
+
+			log.Info("spot eviction detected", "vmss_name", vmScaleSet, "remote_id", instance.remoteID,
+				"signalled", signalled, "deallocated", deallocated)
+			evicted[idx]++
+			total++
+
+			if node != nil && node.Status == api.NodeStatusReady {
+				spec := &api.DrainSpec{Deadline: cfg.drainDeadline, IgnoreSystemJobs: true}
+				if _, err := cluster.client.Nodes().UpdateDrain(node.ID, spec, false, nil); err != nil {
+					log.Error("failed to drain node ahead of spot eviction", "node_id", node.ID, "error", err)
+				}
+			}
+		}
+	}
+	t.spotEvictions.forget(present)
+
+	if !cfg.compensate || total == 0 {
+		return nil
+	}
+	return t.compensateEvictions(ctx, resourceGroupList, vmScaleSetList, evicted, total, log)
+}
+
+// compensateEvictions spreads the evicted capacity evenly over the member sets
+// that did not lose instances in this round. Sets another operation holds the
+// scale lock of are left out, and the capacity of the others is read again
+// once their locks are taken.
+func (t *TargetPlugin) compensateEvictions(ctx context.Context, resourceGroupList, vmScaleSetList []string,
+	evicted []int64, total int64, log hclog.Logger) error {
+
+	id := newOperationID()
+	ctx = withOperationID(ctx, id)
+	var healthy []int
+	for idx := range vmScaleSetList {
+		if evicted[idx] != 0 {
+			continue
+		}
+		release, err := t.scaleLocks.tryAcquire([]string{vmssKey(resourceGroupList[idx], vmScaleSetList[idx])}, id)
+		if err != nil {
+			log.Debug("skipping busy scale set for spot eviction compensation", "vmss_name", vmScaleSetList[idx], "error", err)
+			continue
+		}
+		defer release()
+		healthy = append(healthy, idx)
+	}
+	if len(healthy) == 0 {
+		log.Warn("no member scale set left to compensate spot evictions", "evicted", total)
+		return nil
+	}
+
+	modulo := total / int64(len(healthy))
+	reminder := total % int64(len(healthy))
+	for _, idx := range healthy {
+		count := modulo
+		if reminder > 0 {
+			count++
+			reminder--
+		}
+		if count == 0 {
+			continue
+		}
+
+		azure := t.azureFor(resourceGroupList[idx], vmScaleSetList[idx])
+		current, err := azure.getCapacity(ctx, resourceGroupList[idx], vmScaleSetList[idx])
+		if err != nil {
+			return err
+		}
+		capacity := current + count
+		if err := azure.setCapacity(ctx, resourceGroupList[idx], vmScaleSetList[idx], capacity); err != nil {
+			return err
+		}
+		t.desired.set(resourceGroupList[idx], vmScaleSetList[idx], capacity)
+		log.Info("compensated spot eviction capacity", "vmss_name", vmScaleSetList[idx], "added", count, "capacity", capacity)
+	}
+	return nil
+}
+
+func isSpotScaleSet(vmss compute.VirtualMachineScaleSet) bool {
+	return vmss.VirtualMachineScaleSetProperties != nil &&
+		vmss.VirtualMachineProfile != nil &&
+		vmss.VirtualMachineProfile.Priority == compute.Spot
+}
+
+func isTruthy(value string) bool {
+	b, err := strconv.ParseBool(value)
+	return err == nil && b
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+)
+
+// spotEvictionPolicy returns what Azure does with the evicted instances of a
+// spot scale set, empty for other sets. Azure deallocates them unless the set
+// says otherwise. The compute API the plugin is built against predates the
+// spot restore policy, so only the eviction policy is read.
+func spotEvictionPolicy(vmss compute.VirtualMachineScaleSet) compute.VirtualMachineEvictionPolicyTypes {
+	if !isSpotScaleSet(vmss) {
+		return ""
+	}
+	if policy := vmss.VirtualMachineProfile.EvictionPolicy; policy != "" {
+		return policy
+	}
+	return compute.Deallocate
+}
+
+// startInstances starts stopped or deallocated instances of the set.
+func (ac *AzureController) startInstances(ctx context.Context, resourceGroup string, vmScaleSet string, instanceIDs []string) error {
+	ctx, done := ac.timeCall(ctx, "start_instances", resourceGroup, vmScaleSet)
+	defer done()
+
+	if err := scaleWrites.wait(ctx, "start_instances"); err != nil {
+		return wrapAzureError(ctx, "failed to wait for the scale write limit", err)
+	}
+	future, err := ac.vmss.Start(ctx, resourceGroup, vmScaleSet, &compute.VirtualMachineScaleSetVMInstanceIDs{
+		InstanceIds: ptr.StringArrToPtr(instanceIDs),
+	})
+	if err != nil {
+		return wrapAzureError(ctx, "failed to get the vmss start instances response", err)
+	}
+	return ac.waitForCompletion(ctx, resourceGroup, vmScaleSet, future.FutureAPI, ac.vmss.Client, "cannot get the vmss start instances future response")
+}
+
+// restartEvictedInstances starts up to want instances a spot set with the
+// Deallocate eviction policy kept deallocated after their eviction. They
+// still count in the capacity of the set, so a scale out starting them needs
+// to add that many fewer instances. It returns how many were started; when
+// they cannot be, the scale out adds new instances instead.
+func (t *TargetPlugin) restartEvictedInstances(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet, want int64, log hclog.Logger) int64 {
+	if want <= 0 || spotEvictionPolicy(vmss) != compute.Deallocate {
+		return 0
+	}
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	instances, err := azure.listInstances(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		log.Warn("failed to list spot instances, not restarting evicted ones", "vmss_name", vmScaleSet, "error", err)
+		return 0
+	}
+	var evicted []string
+	for _, instance := range instances {
+		if int64(len(evicted)) < want && instance.powerState == "PowerState/deallocated" {
+			evicted = append(evicted, instance.instanceID)
+		}
+	}
+	if len(evicted) == 0 {
+		return 0
+	}
+	if err := azure.startInstances(ctx, resourceGroup, vmScaleSet, evicted); err != nil {
+		log.Warn("failed to restart evicted spot instances, adding new ones instead", "vmss_name", vmScaleSet,
+			"instances", evicted, "error", err)
+		return 0
+	}
+	log.Info("restarted evicted spot instances", "vmss_name", vmScaleSet, "instances", evicted)
+	return int64(len(evicted))
+}
+
+// scaleInSpotAware deletes the instances of a scale in. Spot sets with the
+// Delete eviction policy lose instances without notice, so a failing delete
+// is retried with the instances still present, and succeeds when evictions
+// already removed all of them.
+func (t *TargetPlugin) scaleInSpotAware(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet, instanceIDs []string, log hclog.Logger) error {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+	err := azure.scaleIn(ctx, resourceGroup, vmScaleSet, instanceIDs, log)
+	if err == nil || spotEvictionPolicy(vmss) != compute.Delete {
+		return err
+	}
+
+	instances, listErr := azure.listInstances(ctx, resourceGroup, vmScaleSet)
+	if listErr != nil {
+		return err
+	}
+	present := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		present[instance.instanceID] = true
+	}
+	var remaining []string
+	for _, instanceID := range instanceIDs {
+		if present[instanceID] {
+			remaining = append(remaining, instanceID)
+		}
+	}
+	if len(remaining) == len(instanceIDs) {
+		return err
+	}
+	log.Info("spot evictions already deleted instances of the scale in", "vmss_name", vmScaleSet,
+		"evicted", len(instanceIDs)-len(remaining))
+	if len(remaining) == 0 {
+		return nil
+	}
+	return azure.scaleIn(ctx, resourceGroup, vmScaleSet, remaining, log)
+}
+
+// followSpotDeletions lowers the capacity the plugin applied to a spot set
+// with the Delete eviction policy when evictions shrank the set below it.
+// Azure deletes evicted instances and lowers the capacity with them, which
+// is expected and not reported as drift.
+func (t *TargetPlugin) followSpotDeletions(resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet) {
+	if spotEvictionPolicy(vmss) != compute.Delete || vmss.Sku == nil {
+		return
+	}
+	if t.scaleLocks.holder([]string{vmssKey(resourceGroup, vmScaleSet)}) != "" {
+		return
+	}
+	live := ptr.PtrToInt64(vmss.Sku.Capacity)
+	if desired, ok := t.desired.get(resourceGroup, vmScaleSet); ok && live < desired {
+		t.logger.Info("spot evictions deleted instances, following the lowered capacity", "resource_group", resourceGroup,
+			"vmss_name", vmScaleSet, "capacity", live, "desired", desired)
+		t.desired.set(resourceGroup, vmScaleSet, live)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+)
+
+func spotScaleSet(policy compute.VirtualMachineEvictionPolicyTypes, capacity int64) compute.VirtualMachineScaleSet {
+	return compute.VirtualMachineScaleSet{
+		Sku: &compute.Sku{Capacity: ptr.Int64ToPtr(capacity)},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{Priority: compute.Spot, EvictionPolicy: policy},
+		},
+	}
+}
+
+// fakeSpotARM serves the instance list of a scale set and records the
+// instance IDs of start and delete requests. Deleting an instance that is
+// not listed fails, as it does in Azure.
+type fakeSpotARM struct {
+	lock      sync.Mutex
+	instances map[string]string
+	started   []string
+	deletes   []string
+}
+
+func (f *fakeSpotARM) Do(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status, body := http.StatusOK, `{}`
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/virtualMachines"):
+		var values []string
+		for id, power := range f.instances {
+			values = append(values, `{"instanceId":"`+id+`","properties":{"instanceView":{"statuses":[{"code":"`+power+`"}]}}}`)
+		}
+		body = `{"value":[` + strings.Join(values, ",") + `]}`
+	case strings.HasSuffix(r.URL.Path, "/start"):
+		raw, _ := io.ReadAll(r.Body)
+		f.started = append(f.started, string(raw))
+	case strings.HasSuffix(r.URL.Path, "/delete"):
+		raw, _ := io.ReadAll(r.Body)
+		f.deletes = append(f.deletes, string(raw))
+		for _, id := range []string{"1", "2", "3"} {
+			if _, ok := f.instances[id]; !ok && strings.Contains(string(raw), `"`+id+`"`) {
+				status, body = http.StatusBadRequest, `{"error":{"code":"InvalidParameter","message":"instance `+id+` not found"}}`
+			}
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func newSpotTestPlugin(arm *fakeSpotARM) *TargetPlugin {
+	vmss := compute.NewVirtualMachineScaleSetsClientWithBaseURI("http://fake", "s")
+	vmss.Sender = arm
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = autorest.SenderFunc(arm.Do)
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmss: vmss, vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+	return plugin
+}
+
+func TestSpotEvictionPolicy(t *testing.T) {
+	if got := spotEvictionPolicy(spotScaleSet("", 1)); got != compute.Deallocate {
+		t.Errorf("got %q for a spot set without a policy, want Deallocate", got)
+	}
+	if got := spotEvictionPolicy(spotScaleSet(compute.Delete, 1)); got != compute.Delete {
+		t.Errorf("got %q, want Delete", got)
+	}
+	regular := compute.VirtualMachineScaleSet{VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+		VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{Priority: compute.Regular},
+	}}
+	if got := spotEvictionPolicy(regular); got != "" {
+		t.Errorf("got %q for a regular set, want none", got)
+	}
+}
+
+func TestRestartEvictedInstances(t *testing.T) {
+	arm := &fakeSpotARM{instances: map[string]string{
+		"1": "PowerState/deallocated",
+		"2": "PowerState/running",
+		"3": "PowerState/deallocated",
+	}}
+	plugin := newSpotTestPlugin(arm)
+	log := hclog.NewNullLogger()
+
+	if n := plugin.restartEvictedInstances(context.Background(), "rg", "vmss", spotScaleSet(compute.Delete, 3), 2, log); n != 0 {
+		t.Errorf("restarted %d instances of a Delete set, want none", n)
+	}
+	if n := plugin.restartEvictedInstances(context.Background(), "rg", "vmss", spotScaleSet(compute.Deallocate, 3), 1, log); n != 1 {
+		t.Errorf("restarted %d instances, want 1", n)
+	}
+	if n := plugin.restartEvictedInstances(context.Background(), "rg", "vmss", spotScaleSet(compute.Deallocate, 3), 5, log); n != 2 {
+		t.Errorf("restarted %d instances, want the 2 deallocated ones", n)
+	}
+	if len(arm.started) != 2 {
+		t.Errorf("got %d start requests, want 2", len(arm.started))
+	}
+}
+
+func TestScaleInSpotAware(t *testing.T) {
+	// Instance 2 was evicted and deleted by Azure already.
+	arm := &fakeSpotARM{instances: map[string]string{"1": "PowerState/running", "3": "PowerState/running"}}
+	plugin := newSpotTestPlugin(arm)
+	log := hclog.NewNullLogger()
+
+	if err := plugin.scaleInSpotAware(context.Background(), "rg", "vmss", spotScaleSet(compute.Deallocate, 2), []string{"1", "2"}, log); err == nil {
+		t.Error("got no error deleting a missing instance of a Deallocate set")
+	}
+	arm.deletes = nil
+	if err := plugin.scaleInSpotAware(context.Background(), "rg", "vmss", spotScaleSet(compute.Delete, 2), []string{"1", "2"}, log); err != nil {
+		t.Fatalf("scaleInSpotAware: %v", err)
+	}
+	if len(arm.deletes) != 2 || strings.Contains(arm.deletes[1], `"2"`) {
+		t.Errorf("got delete requests %v, want a retry without the evicted instance", arm.deletes)
+	}
+}
+
+func TestFollowSpotDeletions(t *testing.T) {
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.desired.set("rg", "vmss", 5)
+
+	plugin.followSpotDeletions("rg", "vmss", spotScaleSet(compute.Deallocate, 3))
+	if desired, _ := plugin.desired.get("rg", "vmss"); desired != 5 {
+		t.Errorf("got desired %d for a Deallocate set, want 5 kept", desired)
+	}
+	plugin.followSpotDeletions("rg", "vmss", spotScaleSet(compute.Delete, 3))
+	if desired, _ := plugin.desired.get("rg", "vmss"); desired != 3 {
+		t.Errorf("got desired %d, want the evicted capacity of 3 followed", desired)
+	}
+	plugin.followSpotDeletions("rg", "vmss", spotScaleSet(compute.Delete, 4))
+	if desired, _ := plugin.desired.get("rg", "vmss"); desired != 3 {
+		t.Errorf("got desired %d, want growth still reported as drift", desired)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// spotEvictionWindow is how far back evictions count toward the eviction
+// rate, which is per hour.
+const spotEvictionWindow = time.Hour
+
+// removalLog remembers the instances the plugin deleted, so instances that
+// disappear from a set can be told apart from evictions. It is shared by the
+// controllers of every subscription. Instances are recorded once Azure
+// deleted them; pending holds those of deletes still in flight, whose
+// disappearance is no eviction either.
+type removalLog struct {
+	lock    sync.Mutex
+	removed map[string]map[string]time.Time
+	pending map[string]map[string]struct{}
+}
+
+func newRemovalLog() *removalLog {
+	return &removalLog{
+		removed: make(map[string]map[string]time.Time),
+		pending: make(map[string]map[string]struct{}),
+	}
+}
+
+// begin marks the instances of a delete as pending until end is called.
+func (r *removalLog) begin(resourceGroup, vmScaleSet string, instanceIDs []string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	if r.pending[key] == nil {
+		r.pending[key] = make(map[string]struct{})
+	}
+	for _, instanceID := range instanceIDs {
+		r.pending[key][instanceID] = struct{}{}
+	}
+}
+
+func (r *removalLog) end(resourceGroup, vmScaleSet string, instanceIDs []string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	for _, instanceID := range instanceIDs {
+		delete(r.pending[key], instanceID)
+	}
+	if len(r.pending[key]) == 0 {
+		delete(r.pending, key)
+	}
+}
+
+func (r *removalLog) record(resourceGroup, vmScaleSet string, instanceIDs []string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := vmssKey(resourceGroup, vmScaleSet)
+	if r.removed[key] == nil {
+		r.removed[key] = make(map[string]time.Time)
+	}
+	for _, instanceID := range instanceIDs {
+		r.removed[key][instanceID] = time.Now()
+	}
+}
+
+// removedByPlugin reports whether the plugin deleted the instance, or is
+// deleting it. Entries older than the eviction window are dropped as they
+// are looked at.
+func (r *removalLog) removedByPlugin(resourceGroup, vmScaleSet, instanceID string) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed := r.removed[vmssKey(resourceGroup, vmScaleSet)]
+	for id, at := range removed {
+		if time.Since(at) > spotEvictionWindow {
+			delete(removed, id)
+		}
+	}
+	if _, ok := removed[instanceID]; ok {
+		return true
+	}
+	_, ok := r.pending[vmssKey(resourceGroup, vmScaleSet)][instanceID]
+	return ok
+}
+
+// spotSetObservation is what the last Status saw of a spot set.
+type spotSetObservation struct {
+	present     map[string]bool
+	deallocated map[string]bool
+	evictions   []time.Time
+}
+
+// spotEvictionStats counts the evictions of spot sets seen between Status
+// calls: instances that disappeared without the plugin deleting them, and
+// instances newly deallocated, as spot sets with the Deallocate eviction
+// policy keep them around.
+type spotEvictionStats struct {
+	lock sync.Mutex
+	sets map[string]*spotSetObservation
+}
+
+func newSpotEvictionStats() *spotEvictionStats {
+	return &spotEvictionStats{sets: make(map[string]*spotSetObservation)}
+}
+
+// observe compares the instances of the set to the previous observation and
+// returns the evictions within the window. The first observation of a set
+// only sets the baseline.
+func (s *spotEvictionStats) observe(resourceGroup, vmScaleSet string, instances []vmssInstance, removals *removalLog, now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current := &spotSetObservation{present: make(map[string]bool, len(instances)), deallocated: make(map[string]bool)}
+	for _, instance := range instances {
+		current.present[instance.instanceID] = true
+		if instance.powerState == "PowerState/deallocated" {
+			current.deallocated[instance.instanceID] = true
+		}
+	}
+
+	key := vmssKey(resourceGroup, vmScaleSet)
+	previous, ok := s.sets[key]
+	s.sets[key] = current
+	if !ok {
+		return 0
+	}
+	for _, at := range previous.evictions {
+		if now.Sub(at) <= spotEvictionWindow {
+			current.evictions = append(current.evictions, at)
+		}
+	}
+	for instanceID := range previous.present {
+		if !current.present[instanceID] && !previous.deallocated[instanceID] && !removals.removedByPlugin(resourceGroup, vmScaleSet, instanceID) {
+			current.evictions = append(current.evictions, now)
+		}
+	}
+	for instanceID := range current.deallocated {
+		if previous.present[instanceID] && !previous.deallocated[instanceID] {
+			current.evictions = append(current.evictions, now)
+		}
+	}
+	return len(current.evictions)
+}
+
+// recent returns the evictions of the set within the window and when the
+// last of them was seen, zero without any.
+func (s *spotEvictionStats) recent(resourceGroup, vmScaleSet string, now time.Time) (int, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	observation, ok := s.sets[vmssKey(resourceGroup, vmScaleSet)]
+	if !ok {
+		return 0, time.Time{}
+	}
+	var count int
+	var last time.Time
+	for _, at := range observation.evictions {
+		if now.Sub(at) > spotEvictionWindow {
+			continue
+		}
+		count++
+		if at.After(last) {
+			last = at
+		}
+	}
+	return count, last
+}
+
+// spotMaxPrice returns the most a spot set pays per hour for an instance,
+// -1 when it pays up to the on-demand price, and false when the set has no
+// price ceiling configured.
+func spotMaxPrice(vmss compute.VirtualMachineScaleSet) (float64, bool) {
+	if !isSpotScaleSet(vmss) || vmss.VirtualMachineProfile.BillingProfile == nil || vmss.VirtualMachineProfile.BillingProfile.MaxPrice == nil {
+		return 0, false
+	}
+	return *vmss.VirtualMachineProfile.BillingProfile.MaxPrice, true
+}
+
+// annotateSpotEvictions writes the evictions of a spot set over the last hour
+// to Status meta, along with the eviction rate: the share of its capacity
+// evicted per hour, which a strategy can over-provision by. It returns the
+// evictions, and false when the instances could not be listed.
+func (t *TargetPlugin) annotateSpotEvictions(ctx context.Context, resourceGroup, vmScaleSet string, status vmssStatus, capacity int64, meta map[string]string) (int, bool) {
+	instances := status.instances
+	if !status.hasInstances {
+		var err error
+		if instances, err = t.azureFor(resourceGroup, vmScaleSet).listInstances(ctx, resourceGroup, vmScaleSet); err != nil {
+			t.logger.Warn("failed to list spot instances for eviction statistics", "vmss_name", vmScaleSet, "error", err)
+			return 0, false
+		}
+	}
+	evictions := t.spotStats.observe(resourceGroup, vmScaleSet, instances, t.AzureController.removals, time.Now())
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "spot_evictions")] = strconv.Itoa(evictions)
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "spot_eviction_rate")] = formatEvictionRate(evictions, capacity)
+	if _, last := t.spotStats.recent(resourceGroup, vmScaleSet, time.Now()); !last.IsZero() {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "spot_last_eviction")] = last.UTC().Format(time.RFC3339)
+	}
+	if price, ok := spotMaxPrice(status.vmss); ok {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "spot_max_price")] = strconv.FormatFloat(price, 'f', -1, 64)
+	}
+	if policy := spotEvictionPolicy(status.vmss); policy != "" {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "spot_eviction_policy")] = string(policy)
+	}
+	return evictions, true
+}
+
+func formatEvictionRate(evictions int, capacity int64) string {
+	if capacity <= 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(evictions)/float64(capacity), 'f', 3, 64)
+}
+
+func parseSpotEvictionAvoidRate(config map[string]string) (float64, error) {
+	value, ok := config[configKeySpotEvictionAvoidRate]
+	if !ok {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a positive eviction rate", configKeySpotEvictionAvoidRate, value)
+	}
+	return rate, nil
+}
+
+// spotEvictionAvoidWeight scales the weights of member sets up so that the
+// weight of spot sets can be lowered in fine steps.
+const spotEvictionAvoidWeight = 100
+
+// avoidSpotEvictions returns the members with the weights a scale out plans
+// with, shifting new capacity away from spot sets in proportion to their
+// recent eviction rate. Sets usually differ by VM size or zone, so this moves
+// capacity away from the sizes and zones Azure evicts most. A set evicted at
+// avoidRate or above gets no weight, and only takes capacity the other sets
+// cannot.
+func (t *TargetPlugin) avoidSpotEvictions(members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, avoidRate float64, log hclog.Logger) []scaleSetTarget {
+	weighted := make([]scaleSetTarget, len(members))
+	copy(weighted, members)
+	now := time.Now()
+	for idx, set := range snapshot.sets {
+		weighted[idx].weight *= spotEvictionAvoidWeight
+		if !isSpotScaleSet(set.vmss) || capacities[idx] <= 0 {
+			continue
+		}
+		evictions, _ := t.spotStats.recent(set.resourceGroup, set.vmScaleSet, now)
+		if evictions == 0 {
+			continue
+		}
+		rate := float64(evictions) / float64(capacities[idx])
+		share := 1 - min(rate/avoidRate, 1)
+		weighted[idx].weight = int64(float64(weighted[idx].weight) * share)
+		log.Debug("shifting scale out away from evicted spot set", "vmss_name", set.vmScaleSet,
+			"eviction_rate", formatEvictionRate(evictions, capacities[idx]), "weight", weighted[idx].weight)
+	}
+	return weighted
+}
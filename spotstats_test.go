@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSpotMaxPrice(t *testing.T) {
+	vmss := spotScaleSet(compute.Deallocate, 2)
+	if _, ok := spotMaxPrice(vmss); ok {
+		t.Error("got a max price for a set without a billing profile")
+	}
+	price := 0.125
+	vmss.VirtualMachineProfile.BillingProfile = &compute.BillingProfile{MaxPrice: &price}
+	if got, ok := spotMaxPrice(vmss); !ok || got != price {
+		t.Errorf("got %v, %v, want %v", got, ok, price)
+	}
+}
+
+func TestAvoidSpotEvictions(t *testing.T) {
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	now := time.Now()
+	plugin.spotStats.sets[vmssKey("rg", "spot-a")] = &spotSetObservation{evictions: []time.Time{now, now.Add(-2 * spotEvictionWindow)}}
+	plugin.spotStats.sets[vmssKey("rg", "spot-b")] = &spotSetObservation{evictions: []time.Time{now, now, now, now}}
+
+	members := []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "regular", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "spot-a", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "spot-b", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "spot-c", weight: 1},
+	}
+	snapshot := &scaleSnapshot{sets: []*setSnapshot{
+		{resourceGroup: "rg", vmScaleSet: "regular", vmss: compute.VirtualMachineScaleSet{}},
+		{resourceGroup: "rg", vmScaleSet: "spot-a", vmss: spotScaleSet(compute.Delete, 4)},
+		{resourceGroup: "rg", vmScaleSet: "spot-b", vmss: spotScaleSet(compute.Delete, 4)},
+		{resourceGroup: "rg", vmScaleSet: "spot-c", vmss: spotScaleSet(compute.Delete, 4)},
+	}}
+
+	// spot-a lost one of four instances in the window, half the avoided
+	// rate; spot-b lost all of them.
+	weighted := plugin.avoidSpotEvictions(members, snapshot, []int64{4, 4, 4, 4}, 0.5, hclog.NewNullLogger())
+	want := []int64{100, 50, 0, 100}
+	for idx, set := range weighted {
+		if set.weight != want[idx] {
+			t.Errorf("%s: got weight %d, want %d", set.vmScaleSet, set.weight, want[idx])
+		}
+	}
+	if members[1].weight != 1 {
+		t.Error("changed the weights of the members")
+	}
+}
+
+func TestDeleteInstancesRecordsRemovalsOnceDeleted(t *testing.T) {
+	fake := newFakeScaleSets(t)
+	fake.add("rg", "a", 2)
+	nomad := newFakeNomad(t, "fake", fake.remoteIDs("rg", "a"))
+	failing := newFakePluginWithConfig(t, nomad, map[string]string{configKeyAzureFaultInjection: faultDeleteError + "=1"})
+	failing.AzureController.vmss.RetryDuration = time.Millisecond
+
+	azure := failing.AzureController
+	if err := azure.deleteInstances(context.Background(), "rg", "a", []string{"1"}); err == nil {
+		t.Fatal("got no error with the delete failing")
+	}
+	if azure.removals.removedByPlugin("rg", "a", "1") {
+		t.Error("instance of a failed delete recorded as removed")
+	}
+
+	azure = newFakePlugin(t, nomad).AzureController
+	if err := azure.deleteInstances(context.Background(), "rg", "a", []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !azure.removals.removedByPlugin("rg", "a", "1") {
+		t.Error("deleted instance not recorded as removed")
+	}
+}
+
+func TestRemovalLogPending(t *testing.T) {
+	removals := newRemovalLog()
+	removals.begin("rg", "a", []string{"1"})
+	if !removals.removedByPlugin("RG", "A", "1") {
+		t.Error("instance of a delete in flight taken for an eviction")
+	}
+	removals.end("rg", "a", []string{"1"})
+	if removals.removedByPlugin("rg", "a", "1") {
+		t.Error("instance of a delete that never completed recorded as removed")
+	}
+}
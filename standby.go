@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// standbyPoolAPIVersion is the Microsoft.StandbyPool API version the plugin
+// speaks. A standby pool attached to a scale set holds pre-provisioned
+// instances which Azure hands to the set on scale out before creating new
+// ones, so the plugin only reports and sizes the pool.
+const standbyPoolAPIVersion = "2024-03-01"
+
+const standbyPoolPath = "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.StandbyPool/standbyVirtualMachinePools/{standbyVirtualMachinePoolName}"
+
+type standbyPool struct {
+	Properties struct {
+		ElasticityProfile struct {
+			MaxReadyCapacity int64 `json:"maxReadyCapacity"`
+		} `json:"elasticityProfile"`
+		VirtualMachineState string `json:"virtualMachineState"`
+	} `json:"properties"`
+}
+
+type standbyPoolRuntimeView struct {
+	Properties struct {
+		InstanceCountSummary []struct {
+			InstanceCountsByState []struct {
+				State string `json:"state"`
+				Count int64  `json:"count"`
+			} `json:"instanceCountsByState"`
+		} `json:"instanceCountSummary"`
+	} `json:"properties"`
+}
+
+// standbyPoolRequest sends a request for the standby pool resource, or the
+// child resource at suffix, decoding the response into result.
+func (ac *AzureController) standbyPoolRequest(ctx context.Context, method, resourceGroup, name, suffix string, body, result interface{}) error {
+	ctx, done := ac.timeCall(ctx, "standby_pool_request", resourceGroup, name)
+	defer done()
+
+	pathParameters := map[string]interface{}{
+		"resourceGroupName":             autorest.Encode("path", resourceGroup),
+		"standbyVirtualMachinePoolName": autorest.Encode("path", name),
+		"subscriptionId":                autorest.Encode("path", ac.subscriptionID),
+	}
+	decorators := []autorest.PrepareDecorator{
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(ac.baseURI),
+		autorest.WithPathParameters(standbyPoolPath+suffix, pathParameters),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": standbyPoolAPIVersion}),
+	}
+	if body != nil {
+		decorators = append(decorators, autorest.AsContentType("application/json; charset=utf-8"), autorest.WithJSON(body))
+	}
+	req, err := autorest.CreatePreparer(decorators...).Prepare((&http.Request{}).WithContext(ctx))
+	if err != nil {
+		return wrapAzureError(ctx, "failed to prepare the standby pool request", err)
+	}
+
+	resp, err := ac.standby.Send(req, azure.DoRetryWithRegistration(ac.standby))
+	if err != nil {
+		return wrapAzureError(ctx, "failed to send the standby pool request",
+			autorest.NewErrorWithError(err, "standbypool", method, resp, "Failure sending request"))
+	}
+	err = autorest.Respond(resp,
+		azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusAccepted),
+		autorest.ByUnmarshallingJSON(result),
+		autorest.ByClosing())
+	if err != nil {
+		return wrapAzureError(ctx, "failed to read the standby pool response",
+			autorest.NewErrorWithError(err, "standbypool", method, resp, "Failure responding to request"))
+	}
+	return nil
+}
+
+func (ac *AzureController) getStandbyPool(ctx context.Context, resourceGroup, name string) (standbyPool, error) {
+	var pool standbyPool
+	err := ac.standbyPoolRequest(ctx, http.MethodGet, resourceGroup, name, "", nil, &pool)
+	return pool, err
+}
+
+// standbyReadyCount returns how many instances of the pool are ready to be
+// handed to the scale set, those in the state the pool keeps them in.
+func (ac *AzureController) standbyReadyCount(ctx context.Context, resourceGroup, name string, pool standbyPool) (int64, error) {
+	var view standbyPoolRuntimeView
+	if err := ac.standbyPoolRequest(ctx, http.MethodGet, resourceGroup, name, "/runtimeViews/latest", nil, &view); err != nil {
+		return 0, err
+	}
+	var ready int64
+	for _, summary := range view.Properties.InstanceCountSummary {
+		for _, state := range summary.InstanceCountsByState {
+			if strings.EqualFold(state.State, pool.Properties.VirtualMachineState) {
+				ready += state.Count
+			}
+		}
+	}
+	return ready, nil
+}
+
+func (ac *AzureController) setStandbyMaxReady(ctx context.Context, resourceGroup, name string, max int64) error {
+	body := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"elasticityProfile": map[string]interface{}{"maxReadyCapacity": max},
+		},
+	}
+	var pool standbyPool
+	return ac.standbyPoolRequest(ctx, http.MethodPatch, resourceGroup, name, "", body, &pool)
+}
+
+// annotateStandbyPools reports the warm capacity of the member sets with a
+// standby pool, per set and in total. Warm instances are not part of the
+// scale set capacity until Azure hands them over.
+func (t *TargetPlugin) annotateStandbyPools(ctx context.Context, members []scaleSetTarget, meta map[string]string, log hclog.Logger) {
+	var total int64
+	var pooled bool
+	for _, member := range members {
+		if member.standbyPool == "" {
+			continue
+		}
+		azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+		pool, err := azure.getStandbyPool(ctx, member.resourceGroup, member.standbyPool)
+		if err != nil {
+			log.Warn("failed to read standby pool", "vmss_name", member.vmScaleSet, "standby_pool", member.standbyPool, "error", err)
+			continue
+		}
+		ready, err := azure.standbyReadyCount(ctx, member.resourceGroup, member.standbyPool, pool)
+		if err != nil {
+			log.Warn("failed to read standby pool instances", "vmss_name", member.vmScaleSet, "standby_pool", member.standbyPool, "error", err)
+			continue
+		}
+		meta[vmssMetaKey(member.resourceGroup, member.vmScaleSet, "standby_ready")] = strconv.FormatInt(ready, 10)
+		meta[vmssMetaKey(member.resourceGroup, member.vmScaleSet, "standby_max_ready")] = strconv.FormatInt(pool.Properties.ElasticityProfile.MaxReadyCapacity, 10)
+		total += ready
+		pooled = true
+	}
+	if pooled {
+		meta[metaKeyStandbyReady] = strconv.FormatInt(total, 10)
+	}
+}
+
+// sizeStandbyPools keeps the maximum ready capacity of each standby pool at
+// the configured headroom, so the warm capacity follows the pool rather than
+// a one-off setting made when the pool was created.
+func (t *TargetPlugin) sizeStandbyPools(ctx context.Context, members []scaleSetTarget, log hclog.Logger) {
+	for _, member := range members {
+		if member.standbyPool == "" || member.standbyHeadroom < 0 {
+			continue
+		}
+		azure := t.azureFor(member.resourceGroup, member.vmScaleSet)
+		pool, err := azure.getStandbyPool(ctx, member.resourceGroup, member.standbyPool)
+		if err != nil {
+			log.Warn("failed to read standby pool", "vmss_name", member.vmScaleSet, "standby_pool", member.standbyPool, "error", err)
+			continue
+		}
+		if pool.Properties.ElasticityProfile.MaxReadyCapacity == member.standbyHeadroom {
+			continue
+		}
+		if err := azure.setStandbyMaxReady(ctx, member.resourceGroup, member.standbyPool, member.standbyHeadroom); err != nil {
+			log.Warn("failed to size standby pool", "vmss_name", member.vmScaleSet, "standby_pool", member.standbyPool, "error", err)
+			continue
+		}
+		log.Info("sized standby pool", "vmss_name", member.vmScaleSet, "standby_pool", member.standbyPool,
+			"max_ready_capacity", member.standbyHeadroom)
+	}
+}
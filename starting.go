@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"strconv"
+)
+
+func parseCountStarting(config map[string]string) (bool, error) {
+	value, ok := config[configKeyCountStarting]
+	if !ok {
+		return false, nil
+	}
+	count, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", configKeyCountStarting, value)
+	}
+	return count, nil
+}
+
+func parseScaleInStarting(config map[string]string) (bool, error) {
+	value, ok := config[configKeyScaleInStarting]
+	if !ok {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", configKeyScaleInStarting, value)
+	}
+	return include, nil
+}
+
+// starting reports whether the instance is on its way to running: it is
+// starting, or still being created and has no power state yet.
+func (i vmssInstance) starting() bool {
+	return i.powerState == "PowerState/starting" ||
+		i.powerState == "" && i.provisioningState == "ProvisioningState/creating"
+}
+
+// countsToward reports whether the instance counts toward the capacity the
+// running capacity mode reports, which includes the starting instances when
+// countStarting is set.
+func (i vmssInstance) countsToward(countStarting bool) bool {
+	return i.running() || countStarting && i.starting()
+}
+
+// startingInstances returns the instances of the set which are still
+// starting. They have no Nomad node to drain yet, so they are listed apart
+// from the scale in candidates.
+func (s *setSnapshot) startingInstances(ctx context.Context, azure *AzureController) ([]vmssInstance, error) {
+	instances, err := azure.listInstances(ctx, s.resourceGroup, s.vmScaleSet)
+	if err != nil {
+		return nil, err
+	}
+	starting := instances[:0]
+	for _, instance := range instances {
+		if instance.starting() {
+			starting = append(starting, instance)
+		}
+	}
+	return starting, nil
+}
+
+// addStartingInstances makes up for the nodes a scale in could not select by
+// deleting up to num starting instances, the last resort candidates, which
+// are added to instanceIDs. Sets are taken in member order and never below
+// their min, and instances outside the zones of the target are left alone.
+func (t *TargetPlugin) addStartingInstances(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, outsideZones []map[string]bool, num int, instanceIDs map[string][]string, log hclog.Logger) {
+	for idx, set := range snapshot.sets {
+		if num <= 0 {
+			return
+		}
+		member := members[idx]
+		if member.missing || !member.scalesIn() {
+			continue
+		}
+		room := int(capacities[idx]-member.min) - len(instanceIDs[set.vmScaleSet])
+		if room <= 0 {
+			continue
+		}
+		starting, err := set.startingInstances(ctx, t.azureFor(set.resourceGroup, set.vmScaleSet))
+		if err != nil {
+			log.Warn("failed to list the starting instances of the scale set", "vmss_name", set.vmScaleSet, "error", err)
+			continue
+		}
+		var take int
+		for _, instance := range starting {
+			if take == min(num, room) {
+				break
+			}
+			if outsideZones[idx][instance.remoteID] {
+				continue
+			}
+			instanceIDs[set.vmScaleSet] = append(instanceIDs[set.vmScaleSet], instance.instanceID)
+			take++
+		}
+		if take > 0 {
+			log.Info("removing starting instances, fewer nodes were selected than asked for", "vmss_name", set.vmScaleSet, "count", take)
+		}
+		num -= take
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestRunningCountStarting(t *testing.T) {
+	status := vmssStatus{instances: []vmssInstance{
+		{powerState: "PowerState/running"},
+		{powerState: "PowerState/starting"},
+		{provisioningState: "ProvisioningState/creating"},
+		{powerState: "PowerState/deallocated", provisioningState: "ProvisioningState/succeeded"},
+	}}
+	if got := status.runningCount(false); got != 1 {
+		t.Errorf("got %d running instances, want 1", got)
+	}
+	if got := status.runningCount(true); got != 3 {
+		t.Errorf("got %d running and starting instances, want 3", got)
+	}
+}
+
+func TestAddStartingInstances(t *testing.T) {
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"value":[` +
+			`{"instanceId":"0","properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}]}}},` +
+			`{"instanceId":"1","properties":{"instanceView":{"statuses":[{"code":"ProvisioningState/creating"}]}}},` +
+			`{"instanceId":"2","properties":{"instanceView":{"statuses":[{"code":"PowerState/starting"}]}}},` +
+			`{"instanceId":"3","properties":{"instanceView":{"statuses":[{"code":"PowerState/starting"}]}}}]}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+
+	members := []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "out-only", weight: 1, direction: "out"},
+		{resourceGroup: "rg", vmScaleSet: "zoned", weight: 1, min: 2},
+	}
+	snapshot := &scaleSnapshot{sets: []*setSnapshot{
+		{resourceGroup: "rg", vmScaleSet: "out-only"},
+		{resourceGroup: "rg", vmScaleSet: "zoned"},
+	}}
+	instanceIDs := map[string][]string{"zoned": {"0"}}
+	outside := []map[string]bool{nil, {"zoned_1": true}}
+
+	// The zoned set has room for two more removals above its min, one of
+	// its starting instances is outside the zones of the target.
+	plugin.addStartingInstances(context.Background(), members, snapshot, []int64{4, 5}, outside, 3, instanceIDs, hclog.NewNullLogger())
+	if want := map[string][]string{"zoned": {"0", "2", "3"}}; !reflect.DeepEqual(instanceIDs, want) {
+		t.Errorf("got instances %v, want %v", instanceIDs, want)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// actionMetaKeyPolicyID is the action meta the autoscaler sets to the ID of
+// the policy that produced the action.
+const actionMetaKeyPolicyID = "nomad_policy_id"
+
+// actionPolicyID returns the ID of the policy behind the action, empty when
+// the autoscaler did not pass it.
+func actionPolicyID(action sdk.ScalingAction) string {
+	raw, ok := action.Meta[actionMetaKeyPolicyID]
+	if !ok || raw == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(raw))
+}
+
+func parseScaleStateVariable(config map[string]string) (string, error) {
+	path, ok := config[configKeyScaleStateVariable]
+	if !ok {
+		return "", nil
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", fmt.Errorf("invalid %s, path must not be empty", configKeyScaleStateVariable)
+	}
+	return path, nil
+}
+
+// scaleStateCheckpoints keeps the outcome of the last successful scale of
+// every target in a Nomad variable below path. After a restart the applied
+// capacities are read back, so capacity drift is reported against what the
+// plugin applied before it restarted rather than only after its next scale.
+type scaleStateCheckpoints struct {
+	lock     sync.Mutex
+	client   *api.Client
+	path     string
+	restored map[string]bool
+}
+
+func newScaleStateCheckpoints(client *api.Client, path string) *scaleStateCheckpoints {
+	return &scaleStateCheckpoints{client: client, path: path, restored: make(map[string]bool)}
+}
+
+// variablePath maps a target onto a variable path. Target keys contain
+// characters Nomad does not allow in variable paths, so they are hashed.
+func (c *scaleStateCheckpoints) variablePath(target string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(target)))
+	return c.path + "/" + hex.EncodeToString(sum[:8])
+}
+
+// record writes the checkpoint of a successful scale of the target whose
+// members are listed, with the capacity the plugin last applied to each.
+func (c *scaleStateCheckpoints) record(action sdk.ScalingAction, event *scaleEvent, members []scaleSetTarget,
+	desired *capacityTracker, log hclog.Logger) {
+	capacities := make(map[string]int64, len(members))
+	for _, member := range members {
+		if capacity, ok := desired.get(member.resourceGroup, member.vmScaleSet); ok {
+			capacities[vmssKey(member.resourceGroup, member.vmScaleSet)] = capacity
+		}
+	}
+	encoded, err := json.Marshal(capacities)
+	if err != nil {
+		log.Warn("failed to encode scale state checkpoint", "error", err)
+		return
+	}
+
+	variable := &nomadVariable{
+		Path: c.variablePath(event.Target),
+		Items: map[string]string{
+			"target":       event.Target,
+			"count":        strconv.FormatInt(action.Count, 10),
+			"operation_id": event.OperationID,
+			"updated_at":   time.Now().UTC().Format(time.RFC3339),
+			"capacities":   string(encoded),
+		},
+	}
+	if event.Pool != "" {
+		variable.Items["pool"] = event.Pool
+	}
+	if policyID := actionPolicyID(action); policyID != "" {
+		variable.Items["policy_id"] = policyID
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// The plugin applied these capacities itself, so there is nothing
+	// earlier left to restore for the target.
+	c.restored[event.Target] = true
+	if err := writeNomadVariable(c.client, variable); err != nil {
+		log.Warn("failed to write scale state checkpoint", "path", variable.Path, "error", err)
+	}
+}
+
+// restore seeds desired with the checkpointed capacities of the target's
+// members the plugin has not applied a capacity to since it started. Each
+// target is read once; a failed read is retried on the next call.
+func (c *scaleStateCheckpoints) restore(target string, members []scaleSetTarget, desired *capacityTracker, log hclog.Logger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.restored[target] {
+		return
+	}
+
+	path := c.variablePath(target)
+	variable, err := readNomadVariable(c.client, path)
+	if err != nil {
+		log.Warn("failed to read scale state checkpoint", "path", path, "error", err)
+		return
+	}
+	c.restored[target] = true
+	if variable.Items["capacities"] == "" {
+		return
+	}
+	var capacities map[string]int64
+	if err := json.Unmarshal([]byte(variable.Items["capacities"]), &capacities); err != nil {
+		log.Warn("discarding unreadable scale state checkpoint", "path", path, "error", err)
+		return
+	}
+
+	for _, member := range members {
+		capacity, ok := capacities[vmssKey(member.resourceGroup, member.vmScaleSet)]
+		if !ok {
+			continue
+		}
+		if _, known := desired.get(member.resourceGroup, member.vmScaleSet); known {
+			continue
+		}
+		desired.set(member.resourceGroup, member.vmScaleSet, capacity)
+	}
+	log.Info("restored scale state checkpoint", "target", target, "operation_id", variable.Items["operation_id"],
+		"count", variable.Items["count"], "updated_at", variable.Items["updated_at"])
+}
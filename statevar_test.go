@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeVariables serves the Nomad Variables API from memory.
+type fakeVariables struct {
+	lock      sync.Mutex
+	variables map[string]nomadVariable
+	reads     int
+}
+
+func (f *fakeVariables) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/var/")
+	switch r.Method {
+	case http.MethodGet:
+		f.reads++
+		variable, ok := f.variables[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(variable)
+	case http.MethodPut:
+		var variable nomadVariable
+		if err := json.NewDecoder(r.Body).Decode(&variable); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.variables[path] = variable
+		_ = json.NewEncoder(w).Encode(variable)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestParseScaleStateVariable(t *testing.T) {
+	if path, err := parseScaleStateVariable(map[string]string{}); err != nil || path != "" {
+		t.Errorf("unset: got %q, %v, want disabled", path, err)
+	}
+	if path, err := parseScaleStateVariable(map[string]string{configKeyScaleStateVariable: "/autoscaler/state/"}); err != nil || path != "autoscaler/state" {
+		t.Errorf("got %q, %v, want autoscaler/state", path, err)
+	}
+	if _, err := parseScaleStateVariable(map[string]string{configKeyScaleStateVariable: "/"}); err == nil {
+		t.Error("got no error for an empty path")
+	}
+}
+
+func TestScaleStateCheckpointRestore(t *testing.T) {
+	store := &fakeVariables{variables: make(map[string]nomadVariable)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "a"},
+		{resourceGroup: "rg", vmScaleSet: "b"},
+	}
+	applied := newCapacityTracker()
+	applied.set("rg", "a", 3)
+	applied.set("rg", "b", 5)
+	event := &scaleEvent{Target: "rg/a,rg/b", OperationID: "op-1"}
+	action := sdk.ScalingAction{Count: 8, Meta: map[string]interface{}{actionMetaKeyPolicyID: "policy-1"}}
+	newScaleStateCheckpoints(client, "autoscaler/state").record(action, event, members, applied, hclog.NewNullLogger())
+
+	checkpoints := newScaleStateCheckpoints(client, "autoscaler/state")
+	variable := store.variables[checkpoints.variablePath(event.Target)]
+	if variable.Items["policy_id"] != "policy-1" || variable.Items["count"] != "8" || variable.Items["operation_id"] != "op-1" {
+		t.Fatalf("got checkpoint items %v", variable.Items)
+	}
+
+	// A restarted plugin knows only the capacity it applied to b since.
+	desired := newCapacityTracker()
+	desired.set("rg", "b", 6)
+	checkpoints.restore(event.Target, members, desired, hclog.NewNullLogger())
+	if capacity, ok := desired.get("rg", "a"); !ok || capacity != 3 {
+		t.Errorf("got restored capacity %d, %t for a, want 3", capacity, ok)
+	}
+	if capacity, _ := desired.get("rg", "b"); capacity != 6 {
+		t.Errorf("got capacity %d for b, want the applied 6 kept", capacity)
+	}
+	if drift, ok, _ := desired.drift("rg", "a", 4); !ok || drift != 1 {
+		t.Errorf("got drift %d, %t, want 1 against the checkpoint", drift, ok)
+	}
+
+	reads := store.reads
+	checkpoints.restore(event.Target, members, desired, hclog.NewNullLogger())
+	if store.reads != reads {
+		t.Error("restored a target twice")
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultStatusParallelism bounds how many member scale sets are queried at
+// once during Status, keeping large target lists fast without bursting ARM.
+// max_parallel overrides it.
+const defaultStatusParallelism = 8
+
+type vmssStatus struct {
+	vmss         compute.VirtualMachineScaleSet
+	instanceView compute.VirtualMachineScaleSetInstanceView
+	err          error
+
+	// instances is only populated when the caller asked for the per-instance
+	// listing, as it costs an extra paged ARM call.
+	instances    []vmssInstance
+	hasInstances bool
+
+	fetchedAt time.Time
+}
+
+// runningCount returns the number of instances in the running power state,
+// and those still starting when countStarting is set.
+func (s vmssStatus) runningCount(countStarting bool) int64 {
+	var count int64
+	for _, instance := range s.instances {
+		if instance.countsToward(countStarting) {
+			count++
+		}
+	}
+	return count
+}
+
+// fetchVMSSStatuses reads every member scale set and its instance view
+// concurrently, optionally listing the instances too. Results are returned in
+// the order of vmScaleSetList.
+func (t *TargetPlugin) fetchVMSSStatuses(ctx context.Context, resourceGroupList, vmScaleSetList []string, withInstances bool) []vmssStatus {
+	statuses := make([]vmssStatus, len(vmScaleSetList))
+	pool := newWorkerPool(t.readParallelism())
+	var listed []map[string][]vmssInstance
+	if withInstances {
+		listed = t.graphStatusInstances(ctx, resourceGroupList, vmScaleSetList)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(vmScaleSetList))
+	for idx, vmScaleSet := range vmScaleSetList {
+		go func(idx int, resourceGroup, vmScaleSet string) {
+			defer wg.Done()
+			defer pool.acquire()()
+
+			if status, ok := t.statusCache.get(resourceGroup, vmScaleSet); ok && (status.hasInstances || !withInstances) {
+				statuses[idx] = status
+				return
+			}
+			var instances []vmssInstance
+			if listed != nil && listed[idx] != nil {
+				instances = listed[idx][vmssKey(resourceGroup, vmScaleSet)]
+			}
+			statuses[idx] = t.fetchListedVMSSStatus(ctx, resourceGroup, vmScaleSet, withInstances, instances)
+		}(idx, resourceGroupList[idx], vmScaleSet)
+	}
+	wg.Wait()
+
+	return statuses
+}
+
+// graphStatusInstances lists the instances of the sets missing from the
+// status cache with one Resource Graph query per subscription, when the plugin
+// queries Resource Graph. It returns for each set the listing holding its
+// instances, nil for the sets left to list through ARM.
+func (t *TargetPlugin) graphStatusInstances(ctx context.Context, resourceGroupList, vmScaleSetList []string) []map[string][]vmssInstance {
+	if !t.AzureController.resourceGraph {
+		return nil
+	}
+	bySubscription := make(map[string][]int)
+	for idx, vmScaleSet := range vmScaleSetList {
+		if status, ok := t.statusCache.get(resourceGroupList[idx], vmScaleSet); ok && status.hasInstances {
+			continue
+		}
+		subscription := strings.ToLower(t.targets.subscription(resourceGroupList[idx], vmScaleSet))
+		bySubscription[subscription] = append(bySubscription[subscription], idx)
+	}
+
+	listed := make([]map[string][]vmssInstance, len(vmScaleSetList))
+	for subscription, indexes := range bySubscription {
+		if len(indexes) < 2 {
+			continue
+		}
+		resourceGroups := make([]string, len(indexes))
+		vmScaleSets := make([]string, len(indexes))
+		for i, idx := range indexes {
+			resourceGroups[i], vmScaleSets[i] = resourceGroupList[idx], vmScaleSetList[idx]
+		}
+		instances, err := t.AzureController.forSubscription(subscription).graphInstances(ctx, resourceGroups, vmScaleSets)
+		if err != nil {
+			t.logger.Warn("failed to list instances through resource graph, listing scale sets instead",
+				"vmss", vmScaleSets, "error", err)
+			continue
+		}
+		for _, idx := range indexes {
+			listed[idx] = instances
+		}
+	}
+	return listed
+}
+
+func (t *TargetPlugin) fetchVMSSStatus(ctx context.Context, resourceGroup, vmScaleSet string, withInstances bool) vmssStatus {
+	return t.fetchListedVMSSStatus(ctx, resourceGroup, vmScaleSet, withInstances, nil)
+}
+
+// fetchListedVMSSStatus reads the status of a set whose instances, when
+// withInstances is set, were already listed unless instances is nil.
+func (t *TargetPlugin) fetchListedVMSSStatus(ctx context.Context, resourceGroup, vmScaleSet string, withInstances bool, instances []vmssInstance) vmssStatus {
+	azure := t.azureFor(resourceGroup, vmScaleSet)
+
+	// The scale set Get has no expansion for the instance view in any
+	// compute API version, so the two reads are issued together instead.
+	var instanceView compute.VirtualMachineScaleSetInstanceView
+	var viewErr error
+	viewDone := make(chan struct{})
+	go func() {
+		defer close(viewDone)
+		instanceView, viewErr = azure.vmss.GetInstanceView(ctx, resourceGroup, vmScaleSet)
+	}()
+	vmss, err := azure.vmss.Get(ctx, resourceGroup, vmScaleSet)
+	<-viewDone
+	if err != nil {
+		return vmssStatus{err: wrapAzureError(ctx, "failed to get Azure ScaleSet", err)}
+	}
+	if viewErr != nil {
+		return vmssStatus{err: wrapAzureError(ctx, "failed to get Azure ScaleSet Instance View", viewErr)}
+	}
+
+	status := vmssStatus{vmss: vmss, instanceView: instanceView, fetchedAt: time.Now()}
+	if withInstances {
+		status.instances = instances
+		if instances == nil {
+			if status.instances, err = azure.listInstances(ctx, resourceGroup, vmScaleSet); err != nil {
+				return vmssStatus{err: err}
+			}
+		}
+		status.hasInstances = true
+	}
+	t.statusCache.put(resourceGroup, vmScaleSet, status)
+	return status
+}
+
+type statusCacheConfig struct {
+	ttl     time.Duration
+	refresh bool
+}
+
+func parseStatusCacheConfig(config map[string]string) (*statusCacheConfig, error) {
+	ttlStr, ok := config[configKeyStatusCacheTTL]
+	if !ok {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid %s %q", configKeyStatusCacheTTL, ttlStr)
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+
+	cfg := &statusCacheConfig{ttl: ttl}
+	if value, ok := config[configKeyStatusCacheRefresh]; ok {
+		if cfg.refresh, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyStatusCacheRefresh, value, err)
+		}
+	}
+	return cfg, nil
+}
+
+type cachedStatus struct {
+	resourceGroup string
+	vmScaleSet    string
+	status        vmssStatus
+	fetchedAt     time.Time
+}
+
+// statusCache keeps recent per scale set Status reads so that the many Status
+// calls made by the agent within the TTL do not each hit ARM. A nil cache is
+// valid and caches nothing.
+type statusCache struct {
+	lock    sync.RWMutex
+	ttl     time.Duration
+	entries map[string]cachedStatus
+}
+
+func newStatusCache(ttl time.Duration) *statusCache {
+	return &statusCache{ttl: ttl, entries: make(map[string]cachedStatus)}
+}
+
+func (c *statusCache) get(resourceGroup, vmScaleSet string) (vmssStatus, bool) {
+	if c == nil {
+		return vmssStatus{}, false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.entries[vmssKey(resourceGroup, vmScaleSet)]
+	if !ok || time.Since(entry.fetchedAt) > c.ttl {
+		return vmssStatus{}, false
+	}
+	return entry.status, true
+}
+
+func (c *statusCache) put(resourceGroup, vmScaleSet string, status vmssStatus) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[vmssKey(resourceGroup, vmScaleSet)] = cachedStatus{
+		resourceGroup: resourceGroup,
+		vmScaleSet:    vmScaleSet,
+		status:        status,
+		fetchedAt:     time.Now(),
+	}
+}
+
+// invalidate drops a scale set from the cache, used once the plugin changed its
+// capacity so the next Status reflects the change.
+func (c *statusCache) invalidate(resourceGroup, vmScaleSet string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, vmssKey(resourceGroup, vmScaleSet))
+}
+
+func (c *statusCache) list() []cachedStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entries := make([]cachedStatus, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// runStatusRefresher re-reads every cached scale set ahead of its expiry so
+// Status calls are always served from memory.
+func (t *TargetPlugin) runStatusRefresher(ctx context.Context, ttl time.Duration) {
+	log := t.logger.With("task", "status_refresher")
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.refreshStatusCache(ctx, log)
+		}
+	}
+}
+
+func (t *TargetPlugin) refreshStatusCache(ctx context.Context, log hclog.Logger) {
+	for _, entry := range t.statusCache.list() {
+		status := t.fetchVMSSStatus(ctx, entry.resourceGroup, entry.vmScaleSet, entry.status.hasInstances)
+		if status.err != nil {
+			log.Warn("failed to refresh cached status", "resource_group", entry.resourceGroup,
+				"vmss_name", entry.vmScaleSet, "error", status.err)
+		}
+	}
+}
+
+func parseStatusWatchInterval(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyStatusWatchInterval]
+	if !ok {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyStatusWatchInterval, value)
+	}
+	return interval, nil
+}
+
+// statusWatchStaleness is how old a watched status may get before Status
+// reports it as stale, leaving room for a slow round of the watcher.
+func statusWatchStaleness(interval time.Duration) time.Duration {
+	return 2 * interval
+}
+
+// statusNeedsInstances reports whether Status of a target needs the per
+// instance listing, mirroring the checks Status makes.
+func statusNeedsInstances(config map[string]string) bool {
+	if mode, err := parseCapacityMode(config); err != nil || mode != capacityModeSku {
+		return true
+	}
+	if readiness, err := parseReadinessConfig(config); err != nil || readiness.warmup > 0 {
+		return true
+	}
+	reportErrors, _ := strconv.ParseBool(config[configKeyStatusErrors])
+	return reportErrors
+}
+
+// runStatusWatcher keeps the status of every scale set of every observed target
+// in the cache, so Status is answered from memory. Unlike the refresher it
+// also picks up scale sets which were never cached or have expired.
+func (t *TargetPlugin) runStatusWatcher(ctx context.Context, interval time.Duration) {
+	log := t.logger.With("task", "status_watcher")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, config := range t.targets.list() {
+				if err := t.watchTargetStatus(ctx, config, log); err != nil {
+					log.Warn("failed to read target status", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) watchTargetStatus(ctx context.Context, config map[string]string, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+	withInstances := statusNeedsInstances(config)
+	pool := newWorkerPool(t.readParallelism())
+
+	var wg sync.WaitGroup
+	wg.Add(len(vmScaleSetList))
+	for idx, vmScaleSet := range vmScaleSetList {
+		go func(resourceGroup, vmScaleSet string) {
+			defer wg.Done()
+			defer pool.acquire()()
+			if status := t.fetchVMSSStatus(ctx, resourceGroup, vmScaleSet, withInstances); status.err != nil {
+				log.Warn("failed to read scale set status", "resource_group", resourceGroup,
+					"vmss_name", vmScaleSet, "error", status.err)
+			}
+		}(resourceGroupList[idx], vmScaleSet)
+	}
+	wg.Wait()
+	return nil
+}
+
+// summaryPowerStates are always reported, even when no instance is in them, so
+// dashboards see an explicit zero rather than a missing series.
+var summaryPowerStates = []string{"running", "deallocated", "stopping", "failed"}
+
+// annotatePowerStates writes per power state instance counts of a scale set to
+// Status meta, taken from the instance view status summary. Instances that
+// failed provisioning are counted under "failed" alongside any other power
+// state reported.
+func annotatePowerStates(resourceGroup, vmScaleSet string, instanceView compute.VirtualMachineScaleSetInstanceView, meta map[string]string) {
+	counts := make(map[string]int32, len(summaryPowerStates))
+	for _, state := range summaryPowerStates {
+		counts[state] = 0
+	}
+	if instanceView.VirtualMachine != nil && instanceView.VirtualMachine.StatusesSummary != nil {
+		for _, code := range *instanceView.VirtualMachine.StatusesSummary {
+			if code.Code == nil || code.Count == nil {
+				continue
+			}
+			lower := strings.ToLower(*code.Code)
+			switch {
+			case strings.HasPrefix(lower, "powerstate/"):
+				counts[strings.TrimPrefix(lower, "powerstate/")] += *code.Count
+			case strings.HasPrefix(lower, "provisioningstate/failed"):
+				counts["failed"] += *code.Count
+			}
+		}
+	}
+	for state, count := range counts {
+		meta[vmssMetaKey(resourceGroup, vmScaleSet, "power_state."+state)] = strconv.FormatInt(int64(count), 10)
+	}
+}
+
+// targetInstanceStates are always reported for the target, so a pool stuck in
+// creating shows against explicit zeros.
+var targetInstanceStates = []string{"creating", "running", "deallocating", "failed"}
+
+// countInstanceStates adds the instances of a scale set per provisioning and
+// power state to states, from the instance view status summary. Provisioning
+// succeeded is left out as it only says the instance exists, and every failed
+// provisioning state counts as failed.
+func countInstanceStates(instanceView compute.VirtualMachineScaleSetInstanceView, states map[string]int64) {
+	if instanceView.VirtualMachine == nil || instanceView.VirtualMachine.StatusesSummary == nil {
+		return
+	}
+	for _, code := range *instanceView.VirtualMachine.StatusesSummary {
+		if code.Code == nil || code.Count == nil {
+			continue
+		}
+		lower := strings.ToLower(*code.Code)
+		switch {
+		case strings.HasPrefix(lower, "provisioningstate/failed"):
+			states["failed"] += int64(*code.Count)
+		case lower == "provisioningstate/succeeded":
+		case strings.HasPrefix(lower, "provisioningstate/"):
+			states[strings.TrimPrefix(lower, "provisioningstate/")] += int64(*code.Count)
+		case strings.HasPrefix(lower, "powerstate/"):
+			states[strings.TrimPrefix(lower, "powerstate/")] += int64(*code.Count)
+		}
+	}
+}
+
+// annotateInstanceStates writes the instance state counts of the whole target
+// to Status meta.
+func annotateInstanceStates(states map[string]int64, meta map[string]string) {
+	for _, state := range targetInstanceStates {
+		meta[metaKeyInstanceStatePrefix+state] = "0"
+	}
+	for state, count := range states {
+		meta[metaKeyInstanceStatePrefix+state] = strconv.FormatInt(count, 10)
+	}
+}
+
+// annotateScaleSetTags writes the Azure tags of a scale set to Status meta as
+// tag.<key>, so strategies can act on them without calling Azure.
+func annotateScaleSetTags(resourceGroup, vmScaleSet string, tags map[string]*string, meta map[string]string) {
+	for key, value := range tags {
+		if value != nil {
+			meta[vmssMetaKey(resourceGroup, vmScaleSet, "tag."+key)] = *value
+		}
+	}
+}
+
+// maxErrorMessageLength bounds the sample message copied into Status meta, as
+// extension failures can carry the full script output.
+const maxErrorMessageLength = 512
+
+// annotateProvisioningErrors summarises the error level statuses of the
+// instances and the scale set itself into Status meta. The error key holds the
+// per code instance counts, sorted by code, and the message key the first
+// message seen so operators can tell why the pool is not becoming ready.
+func annotateProvisioningErrors(resourceGroup, vmScaleSet string, status vmssStatus, meta map[string]string) {
+	counts := make(map[string]int)
+	var message string
+	record := func(code, msg string) {
+		counts[code]++
+		if message == "" && msg != "" {
+			message = msg
+		}
+	}
+
+	if status.instanceView.Statuses != nil {
+		for _, s := range *status.instanceView.Statuses {
+			if s.Level == compute.Error && s.Code != nil {
+				var msg string
+				if s.Message != nil {
+					msg = *s.Message
+				}
+				record(*s.Code, msg)
+			}
+		}
+	}
+	for _, instance := range status.instances {
+		for _, e := range instance.errors {
+			record(e.code, e.message)
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	summary := make([]string, len(codes))
+	for i, code := range codes {
+		summary[i] = fmt.Sprintf("%s=%d", code, counts[code])
+	}
+
+	if len(message) > maxErrorMessageLength {
+		message = message[:maxErrorMessageLength]
+	}
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "provisioning_errors")] = strings.Join(summary, ",")
+	meta[vmssMetaKey(resourceGroup, vmScaleSet, "provisioning_error_message")] = message
+}
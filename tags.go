@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tagNomadNodeID = "nomad-node-id"
+	tagNomadPool   = "nomad-pool"
+)
+
+func parseInstanceTaggingInterval(config map[string]string) (time.Duration, error) {
+	intervalStr, ok := config[configKeyInstanceTaggingInterval]
+	if !ok {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyInstanceTaggingInterval, intervalStr)
+	}
+	return interval, nil
+}
+
+// nodeTagIndex maps Nomad node IDs onto the remote IDs of the instances tagged
+// with them, giving a fallback when a node lacks the Azure fingerprint.
+type nodeTagIndex struct {
+	lock      sync.RWMutex
+	remoteIDs map[string]string
+}
+
+func newNodeTagIndex() *nodeTagIndex {
+	return &nodeTagIndex{remoteIDs: make(map[string]string)}
+}
+
+func (n *nodeTagIndex) set(nodeID, remoteID string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.remoteIDs[nodeID] = remoteID
+}
+
+func (n *nodeTagIndex) lookup(nodeID string) (string, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	remoteID, ok := n.remoteIDs[nodeID]
+	return remoteID, ok
+}
+
+// nodeIDMap resolves the remote ID of a node from its Azure fingerprint,
+// falling back to the instance tags written by the tagging task. The remote
+// ID is normalized as those of the instances are.
+func (t *TargetPlugin) nodeIDMap(n *api.Node) (string, error) {
+	remoteID, err := azureNodeIDMap(n)
+	if err == nil {
+		return t.nodeIdentity.normalize(remoteID), nil
+	}
+	if remoteID, ok := t.nodeTags.lookup(n.ID); ok {
+		return t.nodeIdentity.normalize(remoteID), nil
+	}
+	return "", err
+}
+
+// runInstanceTagger periodically writes the Nomad node ID and pool of every
+// registered node onto its Azure instance.
+func (t *TargetPlugin) runInstanceTagger(ctx context.Context, interval time.Duration) {
+	log := t.logger.With("task", "instance_tagger")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.leader.isLeader() {
+				continue
+			}
+			for _, config := range t.targets.list() {
+				if err := t.tagInstances(ctx, config, log); err != nil {
+					log.Warn("failed to tag instances", "target", targetKey(config), "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *TargetPlugin) tagInstances(ctx context.Context, config map[string]string, log hclog.Logger) error {
+	resourceGroupList, vmScaleSetList, err := t.parseVMSSList(config)
+	if err != nil {
+		return err
+	}
+
+	cluster, err := t.clusterFor(config)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := t.registeredNodes(cluster.client)
+	if err != nil {
+		return err
+	}
+
+	for idx, vmScaleSet := range vmScaleSetList {
+		azure := t.azureFor(resourceGroupList[idx], vmScaleSet)
+		instanceTags, err := azure.listInstanceTags(ctx, resourceGroupList[idx], vmScaleSet)
+		if err != nil {
+			return err
+		}
+
+		for instanceID, tags := range instanceTags {
+			remoteID := fmt.Sprintf("%s_%s", vmScaleSet, instanceID)
+			if nodeID, ok := tags[tagNomadNodeID]; ok {
+				t.nodeTags.set(nodeID, remoteID)
+			}
+
+			node, ok := nodes[strings.ToLower(remoteID)]
+			if !ok {
+				continue
+			}
+
+			pool := config[configKeyPoolName]
+			if pool == "" {
+				pool = node.NodeClass
+			}
+			if tags[tagNomadNodeID] == node.ID && tags[tagNomadPool] == pool {
+				continue
+			}
+
+			err := azure.tagInstance(ctx, resourceGroupList[idx], vmScaleSet, instanceID, map[string]string{
+				tagNomadNodeID: node.ID,
+				tagNomadPool:   pool,
+			})
+			if err != nil {
+				log.Warn("failed to tag instance", "remote_id", remoteID, "node_id", node.ID, "error", err)
+				continue
+			}
+			t.nodeTags.set(node.ID, remoteID)
+			log.Debug("tagged instance with Nomad node", "remote_id", remoteID, "node_id", node.ID, "pool", pool)
+		}
+	}
+	return nil
+}
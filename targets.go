@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// scaleSetTarget is one member scale set of a target together with its
+// placement options. The zero max means unbounded.
+type scaleSetTarget struct {
+	resourceGroup string
+	vmScaleSet    string
+	subscription  string
+	weight        int64
+	min           int64
+	max           int64
+	priority      int
+
+	// direction limits the set to scaling "in" or "out" only; empty
+	// means both.
+	direction string
+
+	// paused sets keep their capacity and take no part in scaling.
+	paused bool
+
+	// retiring sets are being rotated out: they never scale out and give
+	// up their instances first on scale in, down to zero.
+	retiring bool
+
+	// standbyPool names the standby pool attached to the set, in the same
+	// resource group. standbyHeadroom is the maximum ready capacity the
+	// pool is kept at, negative when the plugin leaves it alone.
+	standbyPool     string
+	standbyHeadroom int64
+
+	// overflow is the vmssKey of the member set a scale out spills to
+	// when Azure cannot allocate capacity in this one.
+	overflow string
+
+	// alias is the short name logs, metric labels and Status meta keys
+	// use for the set, empty for its name.
+	alias string
+
+	// skipMissing leaves the set out, rather than failing, when it does
+	// not exist in Azure. missing is set once a snapshot found it so, which
+	// pauses the set.
+	skipMissing bool
+	missing     bool
+}
+
+// hasPlacement reports whether the entry deviates from an even spread.
+func (s scaleSetTarget) hasPlacement() bool {
+	return s.weight != 1 || s.min != 0 || s.max != 0 || s.priority != 0
+}
+
+// scalesOut reports whether the set may receive new capacity.
+func (s scaleSetTarget) scalesOut() bool {
+	return !s.paused && !s.retiring && s.direction != "in"
+}
+
+// scalesIn reports whether instances of the set may be removed.
+func (s scaleSetTarget) scalesIn() bool {
+	return !s.paused && s.direction != "out"
+}
+
+// targetSpec is a structured target list entry, as given in JSON or HCL.
+type targetSpec struct {
+	ResourceGroup string `json:"resource_group" hcl:"resource_group"`
+	VMScaleSet    string `json:"vmss" hcl:"vmss"`
+	Subscription  string `json:"subscription,omitempty" hcl:"subscription,optional"`
+	Alias         string `json:"alias,omitempty" hcl:"alias,optional"`
+	Weight        *int64 `json:"weight,omitempty" hcl:"weight,optional"`
+	Min           int64  `json:"min,omitempty" hcl:"min,optional"`
+	Max           int64  `json:"max,omitempty" hcl:"max,optional"`
+	Priority      int    `json:"priority,omitempty" hcl:"priority,optional"`
+	Direction     string `json:"direction,omitempty" hcl:"direction,optional"`
+	Paused        bool   `json:"paused,omitempty" hcl:"paused,optional"`
+	Retiring      bool   `json:"retiring,omitempty" hcl:"retiring,optional"`
+
+	StandbyPool     string `json:"standby_pool,omitempty" hcl:"standby_pool,optional"`
+	StandbyHeadroom *int64 `json:"standby_headroom,omitempty" hcl:"standby_headroom,optional"`
+
+	// Overflow names another entry, by vmss or resource_group/vmss.
+	Overflow string `json:"overflow,omitempty" hcl:"overflow,optional"`
+}
+
+// targetsFileHCL is the layout of an HCL targets file, one target block per
+// member scale set.
+type targetsFileHCL struct {
+	Targets []targetSpec `hcl:"target,block"`
+}
+
+// parseScaleSetTargets reads the member scale sets of a target from, in order
+// of precedence, a targets file, the targets key or the parallel resource
+// group and scale set lists. The targets key holds either a JSON list of
+// entries or "resource_group/vmss" pairs, optionally prefixed by an alias and
+// a subscription as "alias=sub-id:resource_group/vmss".
+func parseScaleSetTargets(config map[string]string) ([]scaleSetTarget, error) {
+	path, fileOK := config[configKeyTargetsFile]
+	value, targetsOK := config[configKeyTargets]
+	if !fileOK && !targetsOK {
+		return parseScaleSetLists(config)
+	}
+	for _, key := range []string{configKeyResourceGroupList, configKeyVMSSList} {
+		if _, ok := config[key]; ok {
+			return nil, fmt.Errorf("%s and %s cannot be combined with %s", configKeyTargets, configKeyTargetsFile, key)
+		}
+	}
+
+	var specs []targetSpec
+	var err error
+	switch {
+	case fileOK && targetsOK:
+		return nil, fmt.Errorf("%s cannot be combined with %s", configKeyTargets, configKeyTargetsFile)
+	case fileOK:
+		specs, err = targetsFiles.load(path)
+	case strings.HasPrefix(strings.TrimSpace(value), "["):
+		if err = json.Unmarshal([]byte(value), &specs); err != nil {
+			err = fmt.Errorf("invalid %s: %v", configKeyTargets, err)
+		}
+	default:
+		specs, err = parseTargetPairs(config, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resourceGroup := strings.TrimSpace(config[configKeyResourceGroup]); resourceGroup != "" {
+		specs = withDefaultResourceGroup(specs, resourceGroup)
+	}
+	return validateTargetSpecs(specs)
+}
+
+// withDefaultResourceGroup returns the specs with the entries that name no
+// resource group placed in the default one. The specs are copied, as those
+// of a targets file are cached.
+func withDefaultResourceGroup(specs []targetSpec, resourceGroup string) []targetSpec {
+	defaulted := make([]targetSpec, len(specs))
+	copy(defaulted, specs)
+	for idx := range defaulted {
+		if strings.TrimSpace(defaulted[idx].ResourceGroup) == "" {
+			defaulted[idx].ResourceGroup = resourceGroup
+		}
+	}
+	return defaulted
+}
+
+// splitList splits the value of a list key on the list separator, a comma
+// unless the config sets another. A list holding a double quote is read as
+// CSV instead, so a quoted entry may hold the separator, as in
+// `"rg,with,commas/vmss",rg/other`.
+func splitList(config map[string]string, key, value string) ([]string, error) {
+	separator := ','
+	if sep, ok := config[configKeyListSeparator]; ok {
+		runes := []rune(sep)
+		if len(runes) != 1 || strings.ContainsRune("\"\r\n/@=:", runes[0]) || runes[0] == utf8.RuneError {
+			return nil, fmt.Errorf("invalid %s %q, must be a single character other than a quote, line break, '/', '@', '=' or ':'", configKeyListSeparator, sep)
+		}
+		separator = runes[0]
+	}
+	if !strings.Contains(value, "\"") {
+		return strings.Split(value, string(separator)), nil
+	}
+	reader := csv.NewReader(strings.NewReader(value))
+	reader.Comma = separator
+	reader.TrimLeadingSpace = true
+	entries, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		return nil, fmt.Errorf("invalid %s: must be a single line", key)
+	}
+	return entries, nil
+}
+
+// parseTargetPairs reads "resource_group/vmss" or "vmss@resource_group"
+// pairs, each optionally prefixed by the subscription the set lives in, as in
+// "sub-id:resource_group/vmss", and by an alias, as in
+// "alias=resource_group/vmss".
+func parseTargetPairs(config map[string]string, value string) ([]targetSpec, error) {
+	entries, err := splitList(config, configKeyTargets, value)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]targetSpec, len(entries))
+	for idx, entry := range entries {
+		spec, err := parseTargetPair(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %d %q: %v", configKeyTargets, idx+1, strings.TrimSpace(entry), err)
+		}
+		specs[idx] = spec
+	}
+	return specs, nil
+}
+
+func parseTargetPair(entry string) (targetSpec, error) {
+	var spec targetSpec
+	pair := strings.TrimSpace(entry)
+	if pair == "" {
+		return spec, fmt.Errorf("the entry is empty")
+	}
+	if name, rest, ok := strings.Cut(pair, "="); ok {
+		if spec.Alias = strings.TrimSpace(name); spec.Alias == "" {
+			return spec, fmt.Errorf("the alias before '=' is empty")
+		}
+		pair = strings.TrimSpace(rest)
+	}
+	if sub, rest, ok := strings.Cut(pair, ":"); ok {
+		if spec.Subscription = strings.TrimSpace(sub); spec.Subscription == "" {
+			return spec, fmt.Errorf("the subscription before ':' is empty")
+		}
+		pair = strings.TrimSpace(rest)
+	}
+
+	if strings.Contains(pair, "@") {
+		if strings.Contains(pair, "/") {
+			return spec, fmt.Errorf("%q mixes the vmss@resource_group and resource_group/vmss forms", pair)
+		}
+		parts := strings.Split(pair, "@")
+		if len(parts) != 2 {
+			return spec, fmt.Errorf("%q has %d '@', want vmss@resource_group", pair, len(parts)-1)
+		}
+		spec.VMScaleSet, spec.ResourceGroup = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case spec.VMScaleSet == "":
+			return spec, fmt.Errorf("the scale set before '@' is empty")
+		case spec.ResourceGroup == "":
+			return spec, fmt.Errorf("the resource group after '@' is empty")
+		}
+		return spec, nil
+	}
+
+	parts := strings.Split(pair, "/")
+	switch len(parts) {
+	case 1:
+		// The resource group key supplies the group.
+		spec.VMScaleSet = parts[0]
+	case 2:
+		spec.ResourceGroup, spec.VMScaleSet = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case spec.ResourceGroup == "":
+			return spec, fmt.Errorf("the resource group before '/' is empty")
+		case spec.VMScaleSet == "":
+			return spec, fmt.Errorf("the scale set after '/' is empty")
+		}
+	default:
+		return spec, fmt.Errorf("%q has %d '/', want [alias=][subscription:]resource_group/vmss or vmss@resource_group", pair, len(parts)-1)
+	}
+	return spec, nil
+}
+
+// targetsFiles caches the parsed targets files. A file is read again once its
+// modification time or size changes, so edits apply to the next Status or
+// Scale without reloading the plugin.
+var targetsFiles = &targetsFileCache{files: make(map[string]cachedTargetsFile)}
+
+type targetsFileCache struct {
+	lock  sync.Mutex
+	files map[string]cachedTargetsFile
+}
+
+type cachedTargetsFile struct {
+	modTime time.Time
+	size    int64
+	specs   []targetSpec
+}
+
+func (c *targetsFileCache) load(path string) ([]targetSpec, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", configKeyTargetsFile, err)
+	}
+
+	c.lock.Lock()
+	cached, ok := c.files[path]
+	c.lock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.specs, nil
+	}
+
+	// A file that fails to parse, for example while it is being written,
+	// is reported rather than falling back to the previous contents.
+	specs, err := readTargetsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.files[path] = cachedTargetsFile{modTime: info.ModTime(), size: info.Size(), specs: specs}
+	c.lock.Unlock()
+	return specs, nil
+}
+
+// readTargetsFile loads a targets file, as HCL when it has the .hcl extension
+// and as a JSON list otherwise.
+func readTargetsFile(path string) ([]targetSpec, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", configKeyTargetsFile, err)
+	}
+	if filepath.Ext(path) == ".hcl" {
+		var file targetsFileHCL
+		if err := hclsimple.Decode(path, src, nil, &file); err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %v", configKeyTargetsFile, path, err)
+		}
+		return file.Targets, nil
+	}
+	var specs []targetSpec
+	if err := json.Unmarshal(src, &specs); err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", configKeyTargetsFile, path, err)
+	}
+	return specs, nil
+}
+
+func validateTargetSpecs(specs []targetSpec) ([]scaleSetTarget, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%s must list at least one scale set", configKeyTargets)
+	}
+	targets := make([]scaleSetTarget, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for idx, spec := range specs {
+		target := scaleSetTarget{
+			resourceGroup: strings.TrimSpace(spec.ResourceGroup),
+			vmScaleSet:    strings.TrimSpace(spec.VMScaleSet),
+			subscription:  strings.TrimSpace(spec.Subscription),
+			alias:         strings.TrimSpace(spec.Alias),
+			weight:        1,
+			min:           spec.Min,
+			max:           spec.Max,
+			priority:      spec.Priority,
+			direction:     strings.ToLower(strings.TrimSpace(spec.Direction)),
+			paused:        spec.Paused,
+			retiring:      spec.Retiring,
+
+			standbyPool:     strings.TrimSpace(spec.StandbyPool),
+			standbyHeadroom: -1,
+		}
+		if spec.Weight != nil {
+			target.weight = *spec.Weight
+		}
+		if spec.StandbyHeadroom != nil {
+			target.standbyHeadroom = *spec.StandbyHeadroom
+		}
+		name := target.resourceGroup + "/" + target.vmScaleSet
+		switch {
+		case target.resourceGroup == "" || target.vmScaleSet == "":
+			return nil, fmt.Errorf("%s entry %d must set both resource_group and vmss", configKeyTargets, idx+1)
+		case target.weight < 0:
+			return nil, fmt.Errorf("%s entry %s has a negative weight", configKeyTargets, name)
+		case target.min < 0 || target.max < 0:
+			return nil, fmt.Errorf("%s entry %s has a negative min or max", configKeyTargets, name)
+		case target.max > 0 && target.min > target.max:
+			return nil, fmt.Errorf("%s entry %s has min %d above max %d", configKeyTargets, name, target.min, target.max)
+		case target.direction != "" && target.direction != "in" && target.direction != "out":
+			return nil, fmt.Errorf("%s entry %s has invalid direction %q, must be in or out", configKeyTargets, name, spec.Direction)
+		case target.retiring && target.direction == "out":
+			return nil, fmt.Errorf("%s entry %s is retiring and cannot only scale out", configKeyTargets, name)
+		case spec.StandbyHeadroom != nil && (target.standbyPool == "" || *spec.StandbyHeadroom < 0):
+			return nil, fmt.Errorf("%s entry %s needs a standby_pool and a non-negative standby_headroom", configKeyTargets, name)
+		}
+
+		if err := validatePatternEntry(target); err != nil {
+			return nil, err
+		}
+
+		key := subscriptionKey(target.subscription, target.resourceGroup, target.vmScaleSet)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate %s entry %s", configKeyTargets, memberName(target))
+		}
+		seen[key] = true
+		targets[idx] = target
+	}
+	for idx, spec := range specs {
+		if overflow := strings.TrimSpace(spec.Overflow); overflow != "" {
+			key, err := resolveOverflow(targets, idx, overflow)
+			if err != nil {
+				return nil, err
+			}
+			targets[idx].overflow = key
+		}
+	}
+	if err := validateAliases(targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// validateDistinctNames rejects a target whose member sets share a name in
+// different resource groups or subscriptions. Nomad nodes only carry the
+// scale set name in their remote ID, so the instances of such sets could not
+// be told apart on scale in.
+func validateDistinctNames(targets []scaleSetTarget) error {
+	seen := make(map[string]scaleSetTarget, len(targets))
+	for _, target := range targets {
+		name := strings.ToLower(target.vmScaleSet)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("scale sets %s and %s share a name, member scale sets must have distinct names",
+				memberName(other), memberName(target))
+		}
+		seen[name] = target
+	}
+	return nil
+}
+
+// memberName returns the resource group and name of a member set, prefixed
+// by its subscription when the entry names one.
+func memberName(target scaleSetTarget) string {
+	name := target.resourceGroup + "/" + target.vmScaleSet
+	if target.subscription != "" {
+		name = target.subscription + ":" + name
+	}
+	return name
+}
+
+// resolveOverflow finds the entry the overflow of targets[idx] names.
+func resolveOverflow(targets []scaleSetTarget, idx int, overflow string) (string, error) {
+	name := targets[idx].resourceGroup + "/" + targets[idx].vmScaleSet
+	var found []string
+	for other, target := range targets {
+		if strings.EqualFold(overflow, target.vmScaleSet) || strings.EqualFold(overflow, target.resourceGroup+"/"+target.vmScaleSet) {
+			if other == idx {
+				return "", fmt.Errorf("%s entry %s cannot overflow to itself", configKeyTargets, name)
+			}
+			found = append(found, vmssKey(target.resourceGroup, target.vmScaleSet))
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%s entry %s overflows to %q, which is not in the list", configKeyTargets, name, overflow)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%s entry %s overflow %q is ambiguous, use resource_group/vmss", configKeyTargets, name, overflow)
+}
+
+// parseScaleSetLists reads the parallel resource group and scale set lists.
+// A scale set entry may name its own group as "vmss@resource_group", which
+// makes the resource group list optional. Empty resource group entries, or
+// all of them when the list is left out, fall back to the resource group key.
+func parseScaleSetLists(config map[string]string) ([]scaleSetTarget, error) {
+	defaultResourceGroup := strings.TrimSpace(config[configKeyResourceGroup])
+	resourceGroupListStr, hasResourceGroupList := config[configKeyResourceGroupList]
+
+	vmScaleSetListStr, ok := config[configKeyVMSSList]
+	if !ok {
+		if !hasResourceGroupList {
+			return nil, fmt.Errorf("required config param %s or %s not found", configKeyTargets, configKeyVMSSList)
+		}
+		return nil, fmt.Errorf("required config param %s not found", configKeyVMSSList)
+	}
+	vmScaleSetList, err := splitList(config, configKeyVMSSList, vmScaleSetListStr)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceGroupList := make([]string, len(vmScaleSetList))
+	if hasResourceGroupList {
+		if resourceGroupList, err = splitList(config, configKeyResourceGroupList, resourceGroupListStr); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(resourceGroupList) != len(vmScaleSetList) {
+		return nil, fmt.Errorf("%s has %d entries but %s has %d, they must match",
+			configKeyResourceGroupList, len(resourceGroupList), configKeyVMSSList, len(vmScaleSetList))
+	}
+	targets := make([]scaleSetTarget, len(vmScaleSetList))
+	seen := make(map[string]bool, len(vmScaleSetList))
+	for idx := range vmScaleSetList {
+		targets[idx] = scaleSetTarget{
+			resourceGroup: strings.TrimSpace(resourceGroupList[idx]),
+			vmScaleSet:    strings.TrimSpace(vmScaleSetList[idx]),
+			weight:        1,
+		}
+		if strings.Contains(targets[idx].vmScaleSet, "@") {
+			spec, err := parseTargetPair(targets[idx].vmScaleSet)
+			if err == nil && spec.ResourceGroup == "" {
+				err = fmt.Errorf("want vmss@resource_group")
+			}
+			if err == nil && (spec.Alias != "" || spec.Subscription != "") {
+				err = fmt.Errorf("aliases and subscriptions are only supported by %s", configKeyTargets)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %d %q: %v", configKeyVMSSList, idx+1, targets[idx].vmScaleSet, err)
+			}
+			if targets[idx].resourceGroup != "" && !strings.EqualFold(targets[idx].resourceGroup, spec.ResourceGroup) {
+				return nil, fmt.Errorf("%s entry %d %q names resource group %s but %s entry %d is %s",
+					configKeyVMSSList, idx+1, targets[idx].vmScaleSet, spec.ResourceGroup, configKeyResourceGroupList, idx+1, targets[idx].resourceGroup)
+			}
+			targets[idx].resourceGroup, targets[idx].vmScaleSet = spec.ResourceGroup, spec.VMScaleSet
+		}
+		if targets[idx].resourceGroup == "" {
+			targets[idx].resourceGroup = defaultResourceGroup
+		}
+		switch {
+		case targets[idx].vmScaleSet == "":
+			return nil, fmt.Errorf("%s entry %d is empty", configKeyVMSSList, idx+1)
+		case targets[idx].resourceGroup == "":
+			return nil, fmt.Errorf("%s entry %d %q has no resource group, set %s or %s, or write it as vmss@resource_group",
+				configKeyVMSSList, idx+1, targets[idx].vmScaleSet, configKeyResourceGroupList, configKeyResourceGroup)
+		}
+		if err := validatePatternEntry(targets[idx]); err != nil {
+			return nil, err
+		}
+		// A set listed twice would be counted twice by Status and
+		// scaled twice.
+		key := vmssKey(targets[idx].resourceGroup, targets[idx].vmScaleSet)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate entry %s/%s in %s", targets[idx].resourceGroup, targets[idx].vmScaleSet, configKeyVMSSList)
+		}
+		seen[key] = true
+	}
+	return targets, nil
+}
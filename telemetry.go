@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	metrics "github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/datadog"
+	prometheussink "github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPrometheusRetention is how long a series is kept after it was last
+// updated, so scale sets removed from every target eventually disappear.
+const defaultPrometheusRetention = 24 * time.Hour
+
+// telemetryConfig mirrors the telemetry block of the Nomad Autoscaler agent,
+// so plugin metrics can be shipped to the same statsd or DogStatsD pipeline.
+type telemetryConfig struct {
+	prometheusListen string
+	statsdAddress    string
+	dogStatsdAddress string
+	dogStatsdTags    []string
+}
+
+func parseTelemetryConfig(config map[string]string) (*telemetryConfig, error) {
+	cfg := &telemetryConfig{}
+	if value, ok := config[configKeyPrometheusListen]; ok {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyPrometheusListen, value, err)
+		}
+		cfg.prometheusListen = value
+	}
+	for key, address := range map[string]*string{
+		configKeyStatsdAddress:    &cfg.statsdAddress,
+		configKeyDogStatsdAddress: &cfg.dogStatsdAddress,
+	} {
+		if value, ok := config[key]; ok {
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			*address = value
+		}
+	}
+	if value, ok := config[configKeyDogStatsdTags]; ok {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				cfg.dogStatsdTags = append(cfg.dogStatsdTags, tag)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// telemetry owns the metric sinks installed as the go-metrics global and any
+// listener serving them. Metrics are emitted through the go-metrics package
+// functions so call sites do not need access to the plugin.
+type telemetry struct {
+	server *http.Server
+	sinks  metrics.FanoutSink
+}
+
+func newTelemetry(cfg *telemetryConfig, logger hclog.Logger) (*telemetry, error) {
+	t := &telemetry{}
+
+	if cfg.statsdAddress != "" {
+		sink, err := metrics.NewStatsdSink(cfg.statsdAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create statsd sink: %v", err)
+		}
+		t.sinks = append(t.sinks, sink)
+	}
+	if cfg.dogStatsdAddress != "" {
+		sink, err := datadog.NewDogStatsdSink(cfg.dogStatsdAddress, "")
+		if err != nil {
+			t.stop()
+			return nil, fmt.Errorf("failed to create dogstatsd sink: %v", err)
+		}
+		sink.SetTags(cfg.dogStatsdTags)
+		t.sinks = append(t.sinks, sink)
+	}
+	if cfg.prometheusListen != "" {
+		registry := prometheus.NewRegistry()
+		sink, err := prometheussink.NewPrometheusSinkFrom(prometheussink.PrometheusOpts{
+			Expiration: defaultPrometheusRetention,
+			Registerer: registry,
+		})
+		if err != nil {
+			t.stop()
+			return nil, fmt.Errorf("failed to create prometheus sink: %v", err)
+		}
+		t.sinks = append(t.sinks, sink)
+
+		listener, err := net.Listen("tcp", cfg.prometheusListen)
+		if err != nil {
+			t.stop()
+			return nil, fmt.Errorf("failed to listen on %s: %v", cfg.prometheusListen, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		t.server = &http.Server{Handler: mux}
+		go func() {
+			if err := t.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error("prometheus listener stopped", "error", err)
+			}
+		}()
+		logger.Info("serving prometheus metrics", "address", listener.Addr().String())
+	}
+
+	metricsConfig := metrics.DefaultConfig(pluginName)
+	metricsConfig.EnableHostname = false
+	metricsConfig.EnableRuntimeMetrics = false
+	var sink metrics.MetricSink = &metrics.BlackholeSink{}
+	if len(t.sinks) > 0 {
+		sink = t.sinks
+	}
+	if _, err := metrics.NewGlobal(metricsConfig, sink); err != nil {
+		t.stop()
+		return nil, fmt.Errorf("failed to set up metrics: %v", err)
+	}
+	return t, nil
+}
+
+// stop closes the listener of a previous configuration so SetConfig can be
+// called again with a different address.
+func (t *telemetry) stop() {
+	if t == nil {
+		return
+	}
+	for _, sink := range t.sinks {
+		if s, ok := sink.(interface{ Shutdown() }); ok {
+			s.Shutdown()
+		}
+	}
+	if t.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = t.server.Shutdown(ctx)
+	}
+}
+
+// instrumentSender wraps an Azure client sender to count and time every ARM
+// request, labelled by HTTP method, resource operation and status code.
+// Throttled requests are additionally counted on their own. Requests made on
+// behalf of a scale operation carry its ID as the client request ID.
+func instrumentSender(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if id := operationID(r.Context()); id != "" {
+			r.Header.Set(azure.HeaderClientID, id)
+			r.Header.Set(azure.HeaderReturnClientID, "true")
+		}
+
+		start := time.Now()
+		resp, err := sender.Do(r)
+		azureCalls.observe(resp, err)
+		traceRequest(r, resp)
+
+		code := "error"
+		if resp != nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		labels := []metrics.Label{
+			{Name: "method", Value: r.Method},
+			{Name: "operation", Value: azureOperation(r.URL.Path)},
+			{Name: "code", Value: code},
+		}
+		metrics.MeasureSinceWithLabels([]string{"azure", "request"}, start, labels)
+		if err != nil || resp.StatusCode >= http.StatusBadRequest {
+			metrics.IncrCounterWithLabels([]string{"azure", "request_errors"}, 1, labels)
+		}
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			metrics.IncrCounterWithLabels([]string{"azure", "throttled"}, 1, labels[:2])
+		}
+		return resp, err
+	})
+}
+
+// azureOperation reduces an ARM request path to its resource types, dropping
+// names and IDs to keep the label cardinality bounded. For example a scale set
+// instance view read becomes "virtualMachineScaleSets/instanceView".
+func azureOperation(path string) string {
+	idx := strings.Index(strings.ToLower(path), "/providers/microsoft.compute/")
+	if idx < 0 {
+		return "other"
+	}
+	segments := strings.Split(strings.Trim(path[idx+len("/providers/microsoft.compute/"):], "/"), "/")
+	types := make([]string, 0, (len(segments)+1)/2)
+	for i := 0; i < len(segments); i += 2 {
+		types = append(types, segments[i])
+	}
+	return strings.Join(types, "/")
+}
+
+// emitScaleEventMetrics records the outcome of a completed scale event.
+func emitScaleEventMetrics(event *scaleEvent) {
+	event.lock.Lock()
+	defer event.lock.Unlock()
+
+	labels := []metrics.Label{
+		{Name: "target", Value: event.Target},
+		{Name: "direction", Value: event.Direction},
+		{Name: "result", Value: event.Result},
+	}
+	metrics.MeasureSinceWithLabels([]string{"scale", "duration"}, event.start, labels)
+	metrics.IncrCounterWithLabels([]string{"scale", "events"}, 1, labels)
+	if len(event.Nodes) > 0 {
+		metrics.IncrCounterWithLabels([]string{"scale", "nodes_drained"}, float32(len(event.Nodes)), labels[:1])
+	}
+}
+
+// vmssLabels labels the metrics of a scale set, by its alias if it has one.
+func vmssLabels(resourceGroup, vmScaleSet string) []metrics.Label {
+	return []metrics.Label{
+		{Name: "resource_group", Value: resourceGroup},
+		{Name: "vmss", Value: setAliases.display(resourceGroup, vmScaleSet)},
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"time"
+)
+
+var azureTransportKeys = []string{
+	configKeyAzureMaxIdleConnsPerHost,
+	configKeyAzureMaxConnsPerHost,
+	configKeyAzureIdleConnTimeout,
+	configKeyAzureKeepAlive,
+	configKeyAzureTLSHandshakeTimeout,
+}
+
+// newAzureSender returns the sender shared by the ARM clients. Without any
+// transport setting it is the autorest default sender; otherwise it is a copy
+// of that sender's transport with the settings applied. The default keeps
+// only two idle connections to ARM, so at high request rates most requests
+// open a new connection.
+func newAzureSender(config map[string]string) (autorest.Sender, error) {
+	configured := false
+	for _, key := range azureTransportKeys {
+		if _, ok := config[key]; ok {
+			configured = true
+		}
+	}
+	if !configured {
+		return autorest.CreateSender(), nil
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion:    tls.VersionTLS12,
+			Renegotiation: tls.RenegotiateNever,
+		},
+	}
+
+	var err error
+	if transport.MaxIdleConnsPerHost, err = parseConnCount(config, configKeyAzureMaxIdleConnsPerHost); err != nil {
+		return nil, err
+	}
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	if transport.MaxConnsPerHost, err = parseConnCount(config, configKeyAzureMaxConnsPerHost); err != nil {
+		return nil, err
+	}
+	if err := parseTransportDuration(config, configKeyAzureIdleConnTimeout, &transport.IdleConnTimeout); err != nil {
+		return nil, err
+	}
+	if err := parseTransportDuration(config, configKeyAzureTLSHandshakeTimeout, &transport.TLSHandshakeTimeout); err != nil {
+		return nil, err
+	}
+	if err := parseTransportDuration(config, configKeyAzureKeepAlive, &dialer.KeepAlive); err != nil {
+		return nil, err
+	}
+	if dialer.KeepAlive == 0 {
+		// A zero keep alive turns persistent connections off altogether.
+		transport.DisableKeepAlives = true
+	}
+	transport.DialContext = dialer.DialContext
+
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar, Transport: transport}, nil
+}
+
+func parseConnCount(config map[string]string, key string) (int, error) {
+	value, ok := config[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative integer", key, value)
+	}
+	return n, nil
+}
+
+func parseTransportDuration(config map[string]string, key string, d *time.Duration) error {
+	value, ok := config[key]
+	if !ok {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid %s %q", key, value)
+	}
+	*d = parsed
+	return nil
+}
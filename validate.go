@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"sort"
+	"strings"
+)
+
+// knownConfigKeys lists every option the plugin understands, at the plugin or
+// the target level. Keys with the Nomad prefix are passed through to the
+// Nomad client and are not listed.
+var knownConfigKeys = []string{
+	configKeySubscriptionID,
+	configKeyTenantID,
+	configKeyClientID,
+	configKeySecretKey,
+	configKeySecretKeyFile,
+	configKeyResourceManagerEndpoint,
+	configKeyResourceGroupList,
+	configKeyResourceGroup,
+	configKeyVMSSList,
+	configKeyTargets,
+	configKeyTargetsFile,
+	configKeyTargetGroup,
+	configKeyListSeparator,
+	configKeyVMSSExclude,
+	configKeyNodeClassList,
+	configKeyDatacenterList,
+	configKeyZones,
+	configKeyNodeDrainForce,
+	configKeyNodeDrainConcurrency,
+	configKeyGhostNodeGCInterval,
+	configKeyGhostNodeGCAction,
+	configKeyOrphanThreshold,
+	configKeyOrphanCheckInterval,
+	configKeyOrphanAction,
+	configKeyReconcileInterval,
+	configKeyReconcileSelfHeal,
+	configKeySpotEvictionInterval,
+	configKeySpotEvictionNodeMeta,
+	configKeySpotEvictionDrainDeadline,
+	configKeySpotEvictionCompensate,
+	configKeyRecycleMaxAge,
+	configKeyRecycleInterval,
+	configKeyRecycleConcurrency,
+	configKeyRecycleOutdated,
+	configKeyFailedInstanceThreshold,
+	configKeyFailedInstanceCheckInterval,
+	configKeyFailedNodeThreshold,
+	configKeyFailedNodeCheckInterval,
+	configKeyHookPreScaleOut,
+	configKeyHookPostScaleOut,
+	configKeyHookPreDelete,
+	configKeyHookPostScaleIn,
+	configKeyHookTimeout,
+	configKeyScaleInCooldown,
+	configKeyScaleOutCooldown,
+	configKeyDuplicateActionWindow,
+	configKeyMaxTotalInstances,
+	configKeyMaxInstanceHoursPerDay,
+	configKeyScaleInFreezeWindows,
+	configKeyScaleInFreezeTimezone,
+	configKeyPlatformOperationWait,
+	configKeyPauseOSUpgrades,
+	configKeyApplicationHealth,
+	configKeyScaleInPreferMaintenance,
+	configKeyRebalance,
+	configKeyRebalanceSkewThreshold,
+	configKeyRebalanceInterval,
+	configKeyScaleInCanaryPercent,
+	configKeyScaleInCanaryDelay,
+	configKeyPrewarmMaxAge,
+	configKeyConsulDeregister,
+	configKeyConsulAddress,
+	configKeyConsulToken,
+	configKeyConsulDatacenter,
+	configKeyInstanceTaggingInterval,
+	configKeyPoolName,
+	configKeyScaleEventTagging,
+	configKeyScaleEventTags,
+	configKeyScaleEventTagInstances,
+	configKeyPolicyName,
+	configKeyAutoscalerInstance,
+	configKeyScaleEventVariable,
+	configKeyScaleEventHistory,
+	configKeyScaleStateVariable,
+	configKeyHALockPath,
+	configKeyHALockTTL,
+	configKeyLeaderLeaseBlob,
+	configKeyLeaderLeaseDuration,
+	configKeyStatusCacheTTL,
+	configKeyStatusCacheRefresh,
+	configKeyStatusWatchInterval,
+	configKeyReadinessBlockingStates,
+	configKeyReadinessTolerance,
+	configKeyReadinessIgnoreInstances,
+	configKeyReadinessTolerateUpgrades,
+	configKeyReadinessWarmup,
+	configKeyCapacityMode,
+	configKeyCountStarting,
+	configKeyScaleInStarting,
+	configKeyLiveExclude,
+	configKeyCapacityUnit,
+	configKeyScaleOutFailurePolicy,
+	configKeyVMSSIfMatch,
+	configKeyResourceGraph,
+	configKeyCapacityConflictAction,
+	configKeyCapacityConflictRetries,
+	configKeyDeadlineMargin,
+	configKeyScaleLockWait,
+	configKeyRegisterTimeout,
+	configKeyRegisterRetries,
+	configKeyRegisterRetryOn,
+	configKeyScaleNodeMeta,
+	configKeyUpgradeNewInstances,
+	configKeyUpgradeOutdated,
+	configKeyScaleInExemptMeta,
+	configKeyScaleInMode,
+	configKeyScaleInProtectedJobs,
+	configKeyScaleInNamespaces,
+	configKeyOperationDeadline,
+	configKeyPollingBudget,
+	configKeySlowCallThreshold,
+	configKeyScaleAsync,
+	configKeyOperationStatePath,
+	configKeyShutdownDrainPeriod,
+	configKeyMaxParallel,
+	configKeyNomadRetryAttempts,
+	configKeyNomadRetryBackoff,
+	configKeyNodeIdentity,
+	configKeyAzureReadRateLimit,
+	configKeyAzureWriteRateLimit,
+	configKeyAzureRateLimitBurst,
+	configKeyScaleWriteLimit,
+	configKeyAzureMaxIdleConnsPerHost,
+	configKeyAzureMaxConnsPerHost,
+	configKeyAzureIdleConnTimeout,
+	configKeyAzureKeepAlive,
+	configKeyAzureTLSHandshakeTimeout,
+	configKeyAzureRecordDir,
+	configKeyAzureReplayDir,
+	configKeyAzureFaultInjection,
+	configKeySimulate,
+	configKeySimulateProvisioningLatency,
+	configKeySimulateInitialCapacity,
+	configKeyStatusPartial,
+	configKeyMissingScaleSetAction,
+	configKeyStatusErrors,
+	configKeyPrometheusListen,
+	configKeyStatsdAddress,
+	configKeyDogStatsdAddress,
+	configKeyDogStatsdTags,
+	configKeyAuditLogPath,
+	configKeyAuditLogMaxBytes,
+	configKeyAuditLogMaxFiles,
+	configKeyWebhookURL,
+	configKeyWebhookHeaders,
+	configKeyWebhookTimeout,
+	configKeyEventGridEndpoint,
+	configKeyEventGridKey,
+	configKeySlackWebhook,
+	configKeySlackFailureWebhook,
+	configKeyTeamsWebhook,
+	configKeyTeamsFailureWebhook,
+	configKeyDebugListen,
+	configKeyScaleHistorySize,
+	configKeyAzureMonitorMetrics,
+	configKeyAzureMonitorInterval,
+	configKeyAzureMonitorNamespace,
+	configKeySpotEvictionAvoidRate,
+	configKeyLoadAwareDistribution,
+	configKeyLoadAwareWindow,
+	configKeyAzureAutoscaleConflict,
+	configKeyAzureLockCheck,
+	configKeyAKSManagedAction,
+	configKeyConfigVariable,
+	configKeyConfigVariableInterval,
+
+	sdk.TargetConfigKeyClass,
+	sdk.TargetConfigKeyDatacenter,
+	sdk.TargetConfigKeyDrainDeadline,
+	sdk.TargetConfigKeyIgnoreSystemJobs,
+	sdk.TargetConfigKeyNodePurge,
+	sdk.TargetConfigNodeSelectorStrategy,
+}
+
+// validatePluginConfig rejects plugin configs which can never work, so the
+// mistake is reported by SetConfig rather than by the first Scale.
+func validatePluginConfig(config map[string]string) error {
+	known := make(map[string]bool, len(knownConfigKeys))
+	for _, key := range knownConfigKeys {
+		known[key] = true
+	}
+	var unknown []string
+	for key := range config {
+		if !known[key] && !strings.HasPrefix(key, nomadConfigKeyPrefix) && !strings.HasPrefix(key, configKeyTargetGroupPrefix) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		messages := make([]string, len(unknown))
+		for idx, key := range unknown {
+			messages[idx] = fmt.Sprintf("%q", key)
+			if suggestion := closestConfigKey(key); suggestion != "" {
+				messages[idx] += fmt.Sprintf(" (did you mean %q?)", suggestion)
+			}
+		}
+		return fmt.Errorf("unknown config keys %s", strings.Join(messages, ", "))
+	}
+
+	sim, err := parseSimulation(config)
+	if err != nil {
+		return err
+	}
+	// A simulation needs no subscription or credentials.
+	if sim == nil && argsOrEnv(config, configKeySubscriptionID, "ARM_SUBSCRIPTION_ID") == "" {
+		return fmt.Errorf("%s must be set, or ARM_SUBSCRIPTION_ID in the environment", configKeySubscriptionID)
+	}
+	// A client secret is only used together with a tenant and client ID; a
+	// partial set would silently fall back to environment credentials.
+	secretKey, hasSecret := configKeySecretKey, argsOrEnv(config, configKeySecretKey, "ARM_CLIENT_SECRET") != ""
+	if _, ok := config[configKeySecretKeyFile]; ok {
+		if _, ok := config[configKeySecretKey]; ok {
+			return fmt.Errorf("%s cannot be combined with %s", configKeySecretKeyFile, configKeySecretKey)
+		}
+		if _, err := newSecretSource(config).read(); err != nil {
+			return err
+		}
+		secretKey, hasSecret = configKeySecretKeyFile, true
+	}
+	if hasSecret {
+		for key, env := range map[string]string{configKeyTenantID: "ARM_TENANT_ID", configKeyClientID: "ARM_CLIENT_ID"} {
+			if argsOrEnv(config, key, env) == "" {
+				return fmt.Errorf("%s is set but %s is not, or %s in the environment", secretKey, key, env)
+			}
+		}
+	}
+
+	groups, err := parseTargetGroups(config)
+	if err != nil {
+		return err
+	}
+	if name, ok := config[configKeyTargetGroup]; ok {
+		if _, ok := groups[name]; !ok {
+			return fmt.Errorf("unknown %s %q, it must be defined as %s%s", configKeyTargetGroup, name, configKeyTargetGroupPrefix, name)
+		}
+	}
+
+	_, targetsOK := config[configKeyTargets]
+	_, fileOK := config[configKeyTargetsFile]
+	_, rgOK := config[configKeyResourceGroupList]
+	_, vmssOK := config[configKeyVMSSList]
+	if isDiscoveryConfig(config) {
+		if _, err := parseDiscoveryExclude(config); err != nil {
+			return err
+		}
+	} else if targetsOK || fileOK || rgOK || vmssOK {
+		if _, err := parseScaleSetTargets(config); err != nil {
+			return err
+		}
+	}
+
+	if err := validateScaleSetOptions(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateScaleSetOptions parses the target level options which may also be
+// given as plugin level defaults.
+func validateScaleSetOptions(config map[string]string) error {
+	if _, err := parseReadinessConfig(config); err != nil {
+		return err
+	}
+	if _, err := parseCapacityMode(config); err != nil {
+		return err
+	}
+	if _, err := parseCapacityUnit(config); err != nil {
+		return err
+	}
+	if _, err := parseCountStarting(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleInStarting(config); err != nil {
+		return err
+	}
+	if _, err := parseLiveExclude(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleOutFailurePolicy(config); err != nil {
+		return err
+	}
+	if _, err := parseAutoscaleConflictAction(config); err != nil {
+		return err
+	}
+	if _, err := parseLockCheckAction(config); err != nil {
+		return err
+	}
+	if _, err := parseAKSManagedAction(config); err != nil {
+		return err
+	}
+	if _, err := parseSpotEvictionAvoidRate(config); err != nil {
+		return err
+	}
+	if _, err := parseLoadAwareWindow(config); err != nil {
+		return err
+	}
+	if _, err := parseZones(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleAsync(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleHooks(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleCooldowns(config); err != nil {
+		return err
+	}
+	if _, err := parseCapacityBudget(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleInFreeze(config); err != nil {
+		return err
+	}
+	if _, err := parsePlatformOperationWait(config); err != nil {
+		return err
+	}
+	if _, err := parsePauseOSUpgrades(config); err != nil {
+		return err
+	}
+	if _, err := parseMissingScaleSetAction(config); err != nil {
+		return err
+	}
+	if _, err := parseCapacityConflict(config); err != nil {
+		return err
+	}
+	if _, err := parseDeadlineMargin(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleLockWait(config); err != nil {
+		return err
+	}
+	if _, err := parseRegisterConfig(config); err != nil {
+		return err
+	}
+	if _, err := parseModelUpgradeConfig(config); err != nil {
+		return err
+	}
+	if _, err := parseNodeMetaExemptions(config); err != nil {
+		return err
+	}
+	if _, err := parseDrainOnly(config, sdk.ScalingAction{}); err != nil {
+		return err
+	}
+	if _, err := parseProtectedJobs(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleInNamespaces(config); err != nil {
+		return err
+	}
+	if _, err := parseApplicationHealth(config); err != nil {
+		return err
+	}
+	if _, err := parsePreferMaintenance(config); err != nil {
+		return err
+	}
+	if _, err := parseScaleInCanary(config); err != nil {
+		return err
+	}
+	if _, err := parsePrewarmMaxAge(config); err != nil {
+		return err
+	}
+	if _, err := parseRebalanceConfig(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// closestConfigKey returns the known key nearest to a misspelt one, if any is
+// within a few edits.
+func closestConfigKey(key string) string {
+	best, bestDistance := "", 4
+	for _, known := range knownConfigKeys {
+		if distance := editDistance(key, known); distance < bestDistance {
+			best, bestDistance = known, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
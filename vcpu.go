@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	capacityUnitInstances = "instances"
+	capacityUnitVCPU      = "vcpu"
+)
+
+// parseCapacityUnit returns what the target count is in: instances, or the
+// vCPUs of the instances, for sets mixing VM sizes whose instances are not
+// worth the same to the strategy.
+func parseCapacityUnit(config map[string]string) (string, error) {
+	unit, ok := config[configKeyCapacityUnit]
+	if !ok {
+		return capacityUnitInstances, nil
+	}
+	switch unit {
+	case capacityUnitInstances, capacityUnitVCPU:
+		return unit, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be %q or %q", configKeyCapacityUnit, unit, capacityUnitInstances, capacityUnitVCPU)
+}
+
+// vmSizeVCPUs caches the vCPUs of the VM sizes of each location, which do
+// not change.
+type vmSizeVCPUs struct {
+	lock      sync.Mutex
+	locations map[string]map[string]int64
+}
+
+func newVMSizeVCPUs() *vmSizeVCPUs {
+	return &vmSizeVCPUs{locations: make(map[string]map[string]int64)}
+}
+
+// sizeVCPUs returns the vCPUs of a VM size, listing the sizes of the location
+// on first use.
+func (ac *AzureController) sizeVCPUs(ctx context.Context, location, size string) (int64, error) {
+	location, size = strings.ToLower(location), strings.ToLower(size)
+	ac.vcpus.lock.Lock()
+	defer ac.vcpus.lock.Unlock()
+	sizes, ok := ac.vcpus.locations[location]
+	if !ok {
+		result, err := ac.sizes.List(ctx, location)
+		if err != nil {
+			return 0, wrapAzureError(ctx, "failed to list VM sizes", err)
+		}
+		sizes = make(map[string]int64)
+		if result.Value != nil {
+			for _, s := range *result.Value {
+				if s.Name != nil && s.NumberOfCores != nil {
+					sizes[strings.ToLower(*s.Name)] = int64(*s.NumberOfCores)
+				}
+			}
+		}
+		ac.vcpus.locations[location] = sizes
+	}
+	vcpus, ok := sizes[size]
+	if !ok {
+		return 0, fmt.Errorf("unknown VM size %q in %s", size, location)
+	}
+	return vcpus, nil
+}
+
+// setVCPUs returns the vCPUs of the instances of a set, how many instances
+// it has, and the vCPUs of an instance of its model, which is what a scale
+// out adds. Instances of another size than the model, as found in sets
+// mixing sizes, count with their own.
+func (ac *AzureController) setVCPUs(ctx context.Context, resourceGroup, vmScaleSet string, vmss compute.VirtualMachineScaleSet) (int64, int64, int64, error) {
+	var location, modelSize string
+	if vmss.Location != nil {
+		location = *vmss.Location
+	}
+	if vmss.Sku != nil && vmss.Sku.Name != nil {
+		modelSize = *vmss.Sku.Name
+	}
+	perInstance, err := ac.sizeVCPUs(ctx, location, modelSize)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	ctx, done := ac.timeCall(ctx, "list_instance_sizes", resourceGroup, vmScaleSet)
+	defer done()
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, "", "", "")
+	if err != nil {
+		return 0, 0, 0, wrapAzureError(ctx, "failed to query VMSS instances", err)
+	}
+	var total, instances int64
+	for pager.NotDone() {
+		for _, vm := range pager.Values() {
+			size := instanceSize(vm)
+			if size == "" {
+				size = modelSize
+			}
+			vcpus, err := ac.sizeVCPUs(ctx, location, size)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			total += vcpus
+			instances++
+		}
+		if err := pager.NextWithContext(ctx); err != nil {
+			return 0, 0, 0, wrapAzureError(ctx, "failed to list instances in VMSS", err)
+		}
+	}
+	return total, instances, perInstance, nil
+}
+
+func instanceSize(vm compute.VirtualMachineScaleSetVM) string {
+	if vm.Sku != nil && vm.Sku.Name != nil {
+		return *vm.Sku.Name
+	}
+	if vm.VirtualMachineScaleSetVMProperties != nil && vm.HardwareProfile != nil {
+		return string(vm.HardwareProfile.VMSize)
+	}
+	return ""
+}
+
+// instanceCountFor translates a desired vCPU count into the instance count a
+// scale plans with, given the vCPUs and instances the target has and the
+// vCPUs a new instance adds. Scale outs round up so the desired vCPUs are
+// met; scale ins remove instances of the average size, rounding down so
+// they never go below.
+func instanceCountFor(desired, vcpus, instances int64, perNew float64) int64 {
+	switch {
+	case desired == vcpus:
+		return instances
+	case desired > vcpus:
+		if perNew <= 0 {
+			return instances
+		}
+		return instances + int64(math.Ceil(float64(desired-vcpus)/perNew))
+	case instances == 0 || vcpus == 0:
+		return 0
+	}
+	average := float64(vcpus) / float64(instances)
+	return max(instances-int64(math.Floor(float64(vcpus-desired)/average)), 0)
+}
+
+// vcpuInstanceCount returns the instance count of the members that matches a
+// desired vCPU count. Members left out of the capacity are skipped, and only
+// those that scale out contribute to the size of a new instance.
+func (t *TargetPlugin) vcpuInstanceCount(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, desired int64, log hclog.Logger) (int64, error) {
+	var vcpus, instances int64
+	var perNew float64
+	var growing int
+	for idx, set := range snapshot.sets {
+		if members[idx].missing || capacities[idx] == 0 && members[idx].paused {
+			continue
+		}
+		setVCPUs, setInstances, perInstance, err := t.azureFor(set.resourceGroup, set.vmScaleSet).setVCPUs(ctx, set.resourceGroup, set.vmScaleSet, set.vmss)
+		if err != nil {
+			return 0, err
+		}
+		vcpus += setVCPUs
+		instances += setInstances
+		if !members[idx].paused && members[idx].scalesOut() {
+			perNew += float64(perInstance)
+			growing++
+		}
+	}
+	if growing > 0 {
+		perNew /= float64(growing)
+	}
+	count := instanceCountFor(desired, vcpus, instances, perNew)
+	log.Debug("translated vCPU count into instances", "desired_vcpus", desired, "vcpus", vcpus,
+		"instances", instances, "desired_count", count)
+	// The instances listed may differ from the capacity while instances
+	// are being created or deleted; the plan works on the capacity.
+	var capacity int64
+	for _, c := range capacities {
+		capacity += c
+	}
+	return max(capacity+count-instances, 0), nil
+}
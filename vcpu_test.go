@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/ptr"
+)
+
+func TestInstanceCountFor(t *testing.T) {
+	cases := []struct {
+		name                      string
+		desired, vcpus, instances int64
+		perNew                    float64
+		want                      int64
+	}{
+		{"unchanged", 16, 16, 4, 4, 4},
+		{"scale out rounds up", 18, 16, 4, 4, 5},
+		{"scale out by whole instances", 24, 16, 4, 4, 6},
+		{"scale in rounds down", 10, 16, 4, 4, 3},
+		{"scale in of mixed sizes", 8, 24, 4, 4, 2},
+		{"scale in to zero", 0, 16, 4, 4, 0},
+		{"empty target scales out", 8, 0, 0, 2, 4},
+		{"no set scales out", 32, 16, 4, 0, 4},
+	}
+	for _, c := range cases {
+		if got := instanceCountFor(c.desired, c.vcpus, c.instances, c.perNew); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSetVCPUs(t *testing.T) {
+	var sizeLists int
+	sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{}`
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/vmSizes"):
+			sizeLists++
+			body = `{"value":[{"name":"Standard_D2s_v3","numberOfCores":2},{"name":"Standard_D8s_v3","numberOfCores":8}]}`
+		case strings.HasSuffix(strings.ToLower(r.URL.Path), "/virtualmachines"):
+			body = `{"value":[{"instanceId":"0"},{"instanceId":"1","sku":{"name":"Standard_D8s_v3"}},` +
+				`{"instanceId":"2","properties":{"hardwareProfile":{"vmSize":"Standard_D2s_v3"}}}]}`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	sizes := compute.NewVirtualMachineSizesClientWithBaseURI("http://fake", "s")
+	sizes.Sender = sender
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = sender
+	ac := &AzureController{sizes: sizes, vmssVMs: vmssVMs, vcpus: newVMSizeVCPUs()}
+
+	vmss := compute.VirtualMachineScaleSet{
+		Location: ptr.StringToPtr("westeurope"),
+		Sku:      &compute.Sku{Name: ptr.StringToPtr("standard_d2s_v3"), Capacity: ptr.Int64ToPtr(3)},
+	}
+	for i := 0; i < 2; i++ {
+		vcpus, instances, perInstance, err := ac.setVCPUs(context.Background(), "rg", "vmss", vmss)
+		if err != nil {
+			t.Fatalf("setVCPUs: %v", err)
+		}
+		if vcpus != 12 || instances != 3 || perInstance != 2 {
+			t.Errorf("got %d vCPUs over %d instances of %d, want 12 over 3 of 2", vcpus, instances, perInstance)
+		}
+	}
+	if sizeLists != 1 {
+		t.Errorf("listed the location sizes %d times, want them cached", sizeLists)
+	}
+
+	vmss.Sku.Name = ptr.StringToPtr("Standard_Unknown")
+	if _, _, _, err := ac.setVCPUs(context.Background(), "rg", "vmss", vmss); err == nil {
+		t.Error("got no error for an unknown VM size")
+	}
+}
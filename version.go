@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+	"io"
+	"sort"
+	"strings"
+)
+
+// version and gitCommit are set at build time, see builder.sh.
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+)
+
+// computeAPIVersion is the compute API the plugin is compiled against, the
+// version in the compute package import path.
+const computeAPIVersion = "2020-06-01"
+
+// pluginCapabilities names the features of the plugin a scaling action can
+// ask for, reported in Status meta so agents and policies can tell what this
+// build supports before relying on it.
+var pluginCapabilities = []string{
+	"deadline",
+	"drain_only",
+	"dry_run",
+	"dry_run_plan",
+	"eval_dedupe",
+	"prewarm",
+}
+
+// actionMetaKeysRequiredCapabilities lists, comma separated, the capabilities
+// an action needs. An action asking for one this build lacks is refused
+// rather than carried out without the feature.
+var actionMetaKeysRequiredCapabilities = []string{"nomad_autoscaler.required_capabilities", "required_capabilities"}
+
+// checkRequiredCapabilities returns an error naming the capabilities the
+// action requires that the plugin does not have.
+func checkRequiredCapabilities(action sdk.ScalingAction) error {
+	supported := make(map[string]bool, len(pluginCapabilities))
+	for _, capability := range pluginCapabilities {
+		supported[capability] = true
+	}
+	var missing []string
+	for _, key := range actionMetaKeysRequiredCapabilities {
+		raw, ok := action.Meta[key]
+		if !ok || raw == nil {
+			continue
+		}
+		for _, capability := range strings.Split(fmt.Sprint(raw), ",") {
+			capability = strings.ToLower(strings.TrimSpace(capability))
+			if capability != "" && !supported[capability] {
+				missing = append(missing, capability)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("plugin %s does not support required capabilities %s", versionString(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// annotateVersion reports the build and its capabilities in Status meta.
+func annotateVersion(meta map[string]string) {
+	meta[metaKeyPluginVersion] = versionString()
+	meta[metaKeyCapabilities] = strings.Join(pluginCapabilities, ",")
+}
+
+func versionString() string {
+	return fmt.Sprintf("%s (%s)", version, gitCommit)
+}
+
+// printVersion writes the build metadata and the supported config keys.
+func printVersion(out io.Writer) {
+	fmt.Fprintf(out, "%s %s\n", pluginName, versionString())
+	fmt.Fprintf(out, "compute API %s, Azure SDK for Go %s\n", computeAPIVersion, compute.Version())
+	fmt.Fprintf(out, "capabilities: %s\n", strings.Join(pluginCapabilities, ", "))
+	fmt.Fprintln(out, "config keys:")
+	keys := append([]string(nil), knownConfigKeys...)
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "  %s\n", key)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad-autoscaler/sdk"
+)
+
+func TestCheckRequiredCapabilities(t *testing.T) {
+	cases := []struct {
+		meta    map[string]interface{}
+		wantErr string
+	}{
+		{meta: nil},
+		{meta: map[string]interface{}{"required_capabilities": "drain_only, dry_run_plan"}},
+		{meta: map[string]interface{}{"nomad_autoscaler.required_capabilities": "Deadline"}},
+		{meta: map[string]interface{}{"required_capabilities": "drain_only,teleport"}, wantErr: "teleport"},
+	}
+	for _, c := range cases {
+		err := checkRequiredCapabilities(sdk.ScalingAction{Meta: c.meta})
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: got %v, want no error", c.meta, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%v: got %v, want an error naming %s", c.meta, err, c.wantErr)
+		}
+	}
+}
+
+func TestScaleRefusesMissingCapabilities(t *testing.T) {
+	plugin := factory(nil).(*TargetPlugin)
+	action := sdk.ScalingAction{
+		Count: sdk.StrategyActionMetaValueDryRunCount,
+		Meta:  map[string]interface{}{"required_capabilities": "teleport"},
+	}
+	if err := plugin.Scale(action, map[string]string{}); err == nil {
+		t.Error("got no error for an action requiring a missing capability")
+	}
+}
+
+func TestAnnotateVersion(t *testing.T) {
+	meta := make(map[string]string)
+	annotateVersion(meta)
+	if meta[metaKeyPluginVersion] != versionString() {
+		t.Errorf("got version %q, want %q", meta[metaKeyPluginVersion], versionString())
+	}
+	if !strings.Contains(meta[metaKeyCapabilities], "dry_run_plan") {
+		t.Errorf("got capabilities %q, want dry_run_plan listed", meta[metaKeyCapabilities])
+	}
+
+	var out bytes.Buffer
+	printVersion(&out)
+	if !strings.Contains(out.String(), "capabilities: ") {
+		t.Errorf("version output lacks the capabilities:\n%s", out.String())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+func parseOperationDeadline(config map[string]string) (time.Duration, error) {
+	value, ok := config[configKeyOperationDeadline]
+	if !ok {
+		return 0, nil
+	}
+	deadline, err := time.ParseDuration(value)
+	if err != nil || deadline <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", configKeyOperationDeadline, value)
+	}
+	return deadline, nil
+}
+
+// orphanedOperation is a long running Azure operation the plugin stopped
+// waiting on. Azure may still complete it.
+type orphanedOperation struct {
+	id string
+	at time.Time
+}
+
+// orphanedOperations remembers, per scale set, the last operation the
+// watchdog gave up on, until an operation on the set completes again. It is
+// shared by the controllers of every subscription.
+type orphanedOperations struct {
+	lock sync.Mutex
+	sets map[string]orphanedOperation
+}
+
+func newOrphanedOperations() *orphanedOperations {
+	return &orphanedOperations{sets: make(map[string]orphanedOperation)}
+}
+
+func (o *orphanedOperations) record(resourceGroup, vmScaleSet string, op orphanedOperation) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.sets[vmssKey(resourceGroup, vmScaleSet)] = op
+}
+
+func (o *orphanedOperations) clear(resourceGroup, vmScaleSet string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.sets, vmssKey(resourceGroup, vmScaleSet))
+}
+
+func (o *orphanedOperations) get(resourceGroup, vmScaleSet string) (orphanedOperation, bool) {
+	if o == nil {
+		return orphanedOperation{}, false
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	op, ok := o.sets[vmssKey(resourceGroup, vmScaleSet)]
+	return op, ok
+}
+
+// asyncOperationID returns the ID Azure gave a long running operation, the
+// last segment of its polling URL, or the URL itself when it has none.
+func asyncOperationID(pollingURL string) string {
+	parsed, err := url.Parse(pollingURL)
+	if err != nil || parsed.Path == "" {
+		return pollingURL
+	}
+	return path.Base(parsed.Path)
+}
+
+// waitForCompletion waits for a long running operation on a scale set. With
+// an operation deadline or a polling budget set, a watchdog stops waiting once
+// it is spent, so an operation stuck in Azure, such as a deallocation, cannot
+// block the Scale call forever. The operation is then recorded as orphaned and
+// a retryable error returned. The op is the message prefix used for the failed
+// call.
+func (ac *AzureController) waitForCompletion(ctx context.Context, resourceGroup, vmScaleSet string, future azure.FutureAPI, client autorest.Client, op string) error {
+	waitCtx := ctx
+	if ac.operationDeadline > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, ac.operationDeadline)
+		defer cancel()
+	}
+
+	err := ac.pollFuture(waitCtx, future, client)
+	if err == nil {
+		ac.orphanedOps.clear(resourceGroup, vmScaleSet)
+		return nil
+	}
+	var spent string
+	switch {
+	case errors.Is(err, errPollingBudgetExhausted):
+		spent = fmt.Sprintf("%d status polls", ac.pollingBudget)
+	case ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded):
+		spent = ac.operationDeadline.String()
+	default:
+		return wrapAzureError(ctx, op, err)
+	}
+
+	orphaned := orphanedOperation{
+		id: asyncOperationID(future.PollingURL()),
+		at: time.Now(),
+	}
+	ac.orphanedOps.record(resourceGroup, vmScaleSet, orphaned)
+	return &azureError{
+		op:          op,
+		kind:        azureErrorTransient,
+		operationID: operationID(ctx),
+		err: fmt.Errorf("operation %s on %s/%s did not complete within %s and was left running",
+			orphaned.id, resourceGroup, vmScaleSet, spent),
+	}
+}
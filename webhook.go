@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-hclog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+
+	eventGridEventType   = "NomadAutoscaler.AzureVMSS.ScaleEvent"
+	eventGridDataVersion = "1.0"
+)
+
+type webhookConfig struct {
+	url     string
+	headers map[string]string
+
+	eventGridEndpoint string
+	eventGridKey      string
+
+	timeout time.Duration
+}
+
+func parseWebhookConfig(config map[string]string) (*webhookConfig, error) {
+	cfg := &webhookConfig{timeout: defaultWebhookTimeout}
+
+	if value, ok := config[configKeyWebhookURL]; ok && value != "" {
+		if _, err := url.ParseRequestURI(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyWebhookURL, value, err)
+		}
+		cfg.url = value
+	}
+	headers, err := parseKeyValueList(config[configKeyWebhookHeaders])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", configKeyWebhookHeaders, err)
+	}
+	cfg.headers = headers
+
+	if value, ok := config[configKeyEventGridEndpoint]; ok && value != "" {
+		if _, err := url.ParseRequestURI(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", configKeyEventGridEndpoint, value, err)
+		}
+		cfg.eventGridEndpoint = value
+		cfg.eventGridKey = argsOrEnv(config, configKeyEventGridKey, "AZURE_EVENTGRID_KEY")
+		if cfg.eventGridKey == "" {
+			return nil, fmt.Errorf("%s is required when %s is set", configKeyEventGridKey, configKeyEventGridEndpoint)
+		}
+	}
+
+	if value, ok := config[configKeyWebhookTimeout]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", configKeyWebhookTimeout, value)
+		}
+		cfg.timeout = timeout
+	}
+
+	if cfg.url == "" && cfg.eventGridEndpoint == "" {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// eventGridEvent is a single event in the Event Grid schema.
+type eventGridEvent struct {
+	ID          string          `json:"id"`
+	EventType   string          `json:"eventType"`
+	Subject     string          `json:"subject"`
+	EventTime   time.Time       `json:"eventTime"`
+	Data        json.RawMessage `json:"data"`
+	DataVersion string          `json:"dataVersion"`
+}
+
+// webhookNotifier posts every completed or failed scale event to a generic
+// HTTP webhook and/or an Event Grid topic. Deliveries are made in the
+// background so a slow receiver never delays Scale.
+type webhookNotifier struct {
+	cfg    *webhookConfig
+	client *http.Client
+}
+
+func newWebhookNotifier(cfg *webhookConfig) *webhookNotifier {
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = cfg.timeout
+	return &webhookNotifier{cfg: cfg, client: client}
+}
+
+func (w *webhookNotifier) notify(event *scaleEvent, log hclog.Logger) {
+	encoded, err := event.encode()
+	if err != nil {
+		log.Warn("failed to encode scale event", "error", err)
+		return
+	}
+
+	if w.cfg.url != "" {
+		go func() {
+			if err := postWebhook(w.client, w.cfg.url, encoded, w.cfg.headers); err != nil {
+				log.Warn("failed to deliver scale event webhook", "error", err)
+			}
+		}()
+	}
+	if w.cfg.eventGridEndpoint != "" {
+		payload, err := json.Marshal([]eventGridEvent{{
+			ID:          event.OperationID,
+			EventType:   eventGridEventType,
+			Subject:     event.Target,
+			EventTime:   event.Time,
+			Data:        encoded,
+			DataVersion: eventGridDataVersion,
+		}})
+		if err != nil {
+			log.Warn("failed to encode Event Grid event", "error", err)
+			return
+		}
+		go func() {
+			headers := map[string]string{"aeg-sas-key": w.cfg.eventGridKey}
+			if err := postWebhook(w.client, w.cfg.eventGridEndpoint, payload, headers); err != nil {
+				log.Warn("failed to publish scale event to Event Grid", "error", err)
+			}
+		}()
+	}
+}
+
+// postWebhook delivers a JSON payload, treating any non-2xx response as a
+// failure. The client timeout bounds the whole exchange.
+func postWebhook(client *http.Client, target string, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
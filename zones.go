@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/hashicorp/go-hclog"
+	"sort"
+	"strings"
+)
+
+func parseZones(config map[string]string) (map[string]bool, error) {
+	value, ok := config[configKeyZones]
+	if !ok {
+		return nil, nil
+	}
+	zones, err := splitList(config, configKeyZones, value)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		zone = strings.TrimSpace(zone)
+		if zone == "" {
+			return nil, fmt.Errorf("invalid %s %q, empty zone", configKeyZones, value)
+		}
+		allowed[zone] = true
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("invalid %s %q, no zone listed", configKeyZones, value)
+	}
+	return allowed, nil
+}
+
+func scaleSetZones(vmss compute.VirtualMachineScaleSet) []string {
+	if vmss.Zones == nil {
+		return nil
+	}
+	return *vmss.Zones
+}
+
+const (
+	// zonePinningNone leaves a set as it is: it is regional, or all its
+	// zones are allowed.
+	zonePinningNone = iota
+
+	// zonePinningExcluded leaves a set none of whose zones are allowed out
+	// of the target.
+	zonePinningExcluded
+
+	// zonePinningPartial counts only the instances of a set in the allowed
+	// zones, which are also the only ones scaled in. Azure spreads new
+	// instances over all the zones of a set, so partial sets get no new
+	// capacity.
+	zonePinningPartial
+)
+
+// zonePinning returns how a scale set is scaled when the target only scales
+// in the allowed zones.
+func zonePinning(vmss compute.VirtualMachineScaleSet, allowed map[string]bool) int {
+	zones := scaleSetZones(vmss)
+	if allowed == nil || len(zones) == 0 {
+		return zonePinningNone
+	}
+	var in int
+	for _, zone := range zones {
+		if allowed[zone] {
+			in++
+		}
+	}
+	switch in {
+	case len(zones):
+		return zonePinningNone
+	case 0:
+		return zonePinningExcluded
+	}
+	return zonePinningPartial
+}
+
+type zonedInstance struct {
+	zone    string
+	running bool
+}
+
+// listInstanceZones returns the zone of every instance of a set, keyed by
+// remote ID.
+func (ac *AzureController) listInstanceZones(ctx context.Context, resourceGroup string, vmScaleSet string) (map[string]zonedInstance, error) {
+	ctx, done := ac.timeCall(ctx, "list_instance_zones", resourceGroup, vmScaleSet)
+	defer done()
+
+	pager, err := ac.vmssVMs.List(ctx, resourceGroup, vmScaleSet, "", "", "instanceView")
+	if err != nil {
+		return nil, wrapAzureError(ctx, "failed to query VMSS instances", err)
+	}
+	instances := make(map[string]zonedInstance)
+	for pager.NotDone() {
+		for _, vm := range pager.Values() {
+			var instance zonedInstance
+			if vm.Zones != nil && len(*vm.Zones) > 0 {
+				instance.zone = (*vm.Zones)[0]
+			}
+			if vm.VirtualMachineScaleSetVMProperties != nil && vm.InstanceView != nil && vm.InstanceView.Statuses != nil {
+				for _, s := range *vm.InstanceView.Statuses {
+					if s.Code != nil && *s.Code == "PowerState/running" {
+						instance.running = true
+					}
+				}
+			}
+			instances[fmt.Sprintf("%s_%s", vmScaleSet, *vm.InstanceID)] = instance
+		}
+		if err := pager.NextWithContext(ctx); err != nil {
+			return nil, wrapAzureError(ctx, "failed to list instances in VMSS", err)
+		}
+	}
+	return instances, nil
+}
+
+// outsideZones returns the remote IDs of the instances of a set outside the
+// allowed zones, and how many of them are running.
+func (t *TargetPlugin) outsideZones(ctx context.Context, resourceGroup, vmScaleSet string, allowed map[string]bool) (map[string]bool, int64, error) {
+	instances, err := t.azureFor(resourceGroup, vmScaleSet).listInstanceZones(ctx, resourceGroup, vmScaleSet)
+	if err != nil {
+		return nil, 0, err
+	}
+	outside := make(map[string]bool)
+	var running int64
+	for remoteID, instance := range instances {
+		if allowed[instance.zone] {
+			continue
+		}
+		outside[remoteID] = true
+		if instance.running {
+			running++
+		}
+	}
+	return outside, running, nil
+}
+
+// pinnedZones returns the zones of a set the target scales in, sorted.
+func pinnedZones(vmss compute.VirtualMachineScaleSet, allowed map[string]bool) string {
+	var zones []string
+	for _, zone := range scaleSetZones(vmss) {
+		if allowed[zone] {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return strings.Join(zones, ",")
+}
+
+// applyZonePinning restricts a scale to the allowed zones. Sets outside
+// them are paused with no capacity, and partial sets only scale in. It
+// returns, for each partial set, the instances outside the allowed zones,
+// which do not count toward the capacity and are never scaled in.
+func (t *TargetPlugin) applyZonePinning(ctx context.Context, members []scaleSetTarget, snapshot *scaleSnapshot, capacities []int64, allowed map[string]bool, log hclog.Logger) ([]map[string]bool, error) {
+	outside := make([]map[string]bool, len(members))
+	for idx, set := range snapshot.sets {
+		if members[idx].missing {
+			continue
+		}
+		switch zonePinning(set.vmss, allowed) {
+		case zonePinningExcluded:
+			log.Info("leaving out scale set outside the zones of the target", "vmss_name", set.vmScaleSet,
+				"zones", scaleSetZones(set.vmss))
+			members[idx].paused = true
+			capacities[idx] = 0
+		case zonePinningPartial:
+			ids, _, err := t.outsideZones(ctx, set.resourceGroup, set.vmScaleSet, allowed)
+			if err != nil {
+				return nil, err
+			}
+			outside[idx] = ids
+			members[idx].direction = "in"
+			log.Debug("scaling only the instances of the scale set in the zones of the target", "vmss_name", set.vmScaleSet,
+				"zones", pinnedZones(set.vmss, allowed), "outside", len(ids))
+		}
+	}
+	return outside, nil
+}
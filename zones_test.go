@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-hclog"
+)
+
+func zonalScaleSet(capacity int64, zones ...string) compute.VirtualMachineScaleSet {
+	vmss := compute.VirtualMachineScaleSet{Sku: &compute.Sku{Capacity: &capacity}}
+	if len(zones) > 0 {
+		vmss.Zones = &zones
+	}
+	return vmss
+}
+
+func TestParseZones(t *testing.T) {
+	if zones, err := parseZones(map[string]string{}); zones != nil || err != nil {
+		t.Errorf("got %v, %v without zones", zones, err)
+	}
+	zones, err := parseZones(map[string]string{configKeyZones: "1, 3"})
+	if err != nil || len(zones) != 2 || !zones["1"] || !zones["3"] {
+		t.Errorf("got %v, %v", zones, err)
+	}
+	if _, err := parseZones(map[string]string{configKeyZones: "1,,3"}); err == nil {
+		t.Error("got no error for an empty zone")
+	}
+}
+
+func TestZonePinning(t *testing.T) {
+	allowed := map[string]bool{"1": true, "3": true}
+	cases := []struct {
+		name  string
+		zones []string
+		want  int
+	}{
+		{"regional", nil, zonePinningNone},
+		{"within", []string{"1", "3"}, zonePinningNone},
+		{"outside", []string{"2"}, zonePinningExcluded},
+		{"partial", []string{"1", "2", "3"}, zonePinningPartial},
+	}
+	for _, tc := range cases {
+		if got := zonePinning(zonalScaleSet(3, tc.zones...), allowed); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if got := zonePinning(zonalScaleSet(3, "2"), nil); got != zonePinningNone {
+		t.Errorf("got %d without pinned zones", got)
+	}
+}
+
+func TestApplyZonePinning(t *testing.T) {
+	vmssVMs := compute.NewVirtualMachineScaleSetVMsClientWithBaseURI("http://fake", "s")
+	vmssVMs.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"value":[` +
+			`{"instanceId":"0","zones":["1"],"properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}]}}},` +
+			`{"instanceId":"1","zones":["2"],"properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}]}}},` +
+			`{"instanceId":"2","zones":["3"],"properties":{"instanceView":{"statuses":[{"code":"PowerState/running"}]}}}]}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	plugin := factory(hclog.NewNullLogger()).(*TargetPlugin)
+	plugin.AzureController = &AzureController{vmssVMs: vmssVMs, logger: hclog.NewNullLogger()}
+
+	members := []scaleSetTarget{
+		{resourceGroup: "rg", vmScaleSet: "regional", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "outside", weight: 1},
+		{resourceGroup: "rg", vmScaleSet: "partial", weight: 1},
+	}
+	snapshot := &scaleSnapshot{sets: []*setSnapshot{
+		{resourceGroup: "rg", vmScaleSet: "regional", vmss: zonalScaleSet(2)},
+		{resourceGroup: "rg", vmScaleSet: "outside", vmss: zonalScaleSet(2, "2")},
+		{resourceGroup: "rg", vmScaleSet: "partial", vmss: zonalScaleSet(3, "1", "2", "3")},
+	}}
+	capacities := snapshot.capacities()
+	outside, err := plugin.applyZonePinning(context.Background(), members, snapshot, capacities,
+		map[string]bool{"1": true, "3": true}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("applyZonePinning: %v", err)
+	}
+
+	if !members[0].scalesOut() || outside[0] != nil {
+		t.Error("pinned a regional set")
+	}
+	if !members[1].paused || capacities[1] != 0 {
+		t.Errorf("got paused %v and capacity %d for a set outside the zones", members[1].paused, capacities[1])
+	}
+	if members[2].scalesOut() || !members[2].scalesIn() {
+		t.Error("got a partial set scaling out")
+	}
+	if len(outside[2]) != 1 || !outside[2]["partial_1"] {
+		t.Errorf("got instances %v outside the zones, want partial_1", outside[2])
+	}
+}